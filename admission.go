@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/ratelimit"
+)
+
+// dropError is returned for requests that are dropped before they are processed, reason is the label of the
+// dropped requests metric
+type dropError struct {
+	reason string
+	err    error
+}
+
+func (e *dropError) Error() string {
+	return e.err.Error()
+}
+
+type rateLimits struct {
+	mac   *ratelimit.Limiter
+	relay *ratelimit.Limiter
+}
+
+func newRateLimits(conf config.RateLimit) *rateLimits {
+	return &rateLimits{
+		mac:   ratelimit.New(conf.Mac, conf.MacBurst),
+		relay: ratelimit.New(conf.Relay, conf.RelayBurst),
+	}
+}
+
+// admit drops the requests that exceed the rate limits or are not allowed by the mac address lists of their pool. The
+// limits are checked first, so that a flood never gets to the pool lookup. The client is checked before the relay,
+// otherwise a single client could use up the requests of everyone else behind the same relay.
+func admit(conf *config.Config, limits *rateLimits, req *layers.DHCPv4, sourceNet net.IP, vlan int) error {
+	mac := req.ClientHWAddr.String()
+	return admitClient(conf, limits, mac, mac, req.RelayAgentIP, sourceNet, vlan)
+}
+
+// admit6 checks DHCPv6 requests like admit. Clients whose mac address is unknown are limited by their DUID and only
+// pass pools without an allow list.
+func admit6(conf *config.Config, limits *rateLimits, req *dhcpv6Request) error {
+	var mac string
+	if req.mac != nil {
+		mac = req.mac.String()
+	}
+	client := mac
+	if client == "" {
+		client = hex.EncodeToString(clientID6(req.msg))
+	}
+
+	var relay net.IP
+	if len(req.relays) > 0 {
+		relay = req.linkAddr
+	}
+
+	return admitClient(conf, limits, client, mac, relay, req.linkAddr, req.vlan)
+}
+
+// admitClient checks the rate limits of the client and the relay, and the mac address against the lists of the pool
+func admitClient(conf *config.Config, limits *rateLimits, client string, mac string, relay net.IP, sourceNet net.IP, vlan int) error {
+	if !limits.mac.Allow(client) {
+		return &dropError{reason: "rate_limit_mac", err: fmt.Errorf("dropped, %s exceeds the rate limit", client)}
+	}
+
+	if relay != nil && !relay.IsUnspecified() && !limits.relay.Allow(relay.String()) {
+		return &dropError{reason: "rate_limit_relay", err: fmt.Errorf("dropped, relay %s exceeds the rate limit", relay)}
+	}
+
+	// Another server hands out the addresses, there is no pool
+	if conf.DisableDhcp {
+		return nil
+	}
+
+	// Requests without a pool are ignored while they are processed
+	pool, err := findPool(sourceNet, vlan)
+	if err != nil {
+		return nil
+	}
+
+	if err := pool.MacAllowed(mac); err != nil {
+		return &dropError{reason: "mac_filter", err: fmt.Errorf("dropped, %w", err)}
+	}
+
+	return nil
+}
@@ -160,10 +160,19 @@ func CreateAddress(c *gin.Context) {
 		return
 	}
 
+	// the excluded ranges belong to devices that are not managed by us
+	if na.IsExcluded(net.ParseIP(item.IP)) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the ip address is excluded from the dhcp pool associated with the group")) // 400
+		return
+	}
+
 	// ensure the mac address is properly formated.
 	mac, _ := net.ParseMAC(item.Mac)
 	item.Mac = mac.String()
 
+	// addresses that are set up by hand are never handed out to someone else
+	item.Reserved = true
+
 	// if ip address checks pas, continue to commit.
 	if item.ID != 0 { // Save if its an existing item
 		if res := db.DB.Save(&item); res.Error != nil {
@@ -183,6 +192,8 @@ func CreateAddress(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditCreate, "address", item.ID, nil, item)
+
 	c.JSON(http.StatusOK, item) // 200
 
 	logrus.WithFields(logrus.Fields{
@@ -232,6 +243,21 @@ func UpdateAddress(c *gin.Context) {
 		return
 	}
 
+	// users without the hosts permission may only flag the host for re-imaging
+	if user := CurrentUser(c); user != nil && !user.Can(models.PermissionHosts) {
+		deploy := models.AddressForm{
+			Reimage:      form.Reimage,
+			Progress:     form.Progress,
+			Progresstext: form.Progresstext,
+		}
+		if form != deploy {
+			Error(c, http.StatusForbidden, fmt.Errorf("permission denied, %s is required to modify anything but the re-image state", models.PermissionHosts)) // 403
+			return
+		}
+	}
+
+	before := item
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.Address{AddressForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
@@ -253,6 +279,8 @@ func UpdateAddress(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditUpdate, "address", item.ID, before, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -290,5 +318,10 @@ func DeleteAddress(c *gin.Context) {
 		return
 	}
 
+	// outstanding kickstart tokens must not outlive the address
+	db.DB.Where("address_id = ?", item.ID).Delete(&models.KsToken{})
+
+	Audit(c, models.AuditDelete, "address", item.ID, item, nil)
+
 	c.JSON(http.StatusNoContent, gin.H{}) //204
 }
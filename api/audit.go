@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+)
+
+// auditIgnoredFields are left out of the diff, they either change on every write or are relations that are audited on their own
+var auditIgnoredFields = map[string]struct{}{
+	"created_at": {},
+	"updated_at": {},
+	"pool":       {},
+	"group":      {},
+	"address":    {},
+	"option":     {},
+	"user":       {},
+}
+
+// auditRedactedFields are never written to the audit log in clear text
+var auditRedactedFields = map[string]struct{}{
+	"password":      {},
+	"root_password": {},
+}
+
+// Audit records an action performed by the authenticated user. before and after are the state of the object
+// prior to and following the change, either can be nil for creates and deletes.
+func Audit(c *gin.Context, action string, targetType string, targetID int, before interface{}, after interface{}) {
+	entry := auditEntry(c, action, targetType, targetID, "")
+
+	if before != nil || after != nil {
+		diff, err := auditDiff(before, after)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("audit: failed to compute diff")
+		}
+		entry.Diff = diff
+	}
+
+	AuditEvent(entry)
+}
+
+// auditEntry returns an audit log entry for an action of the authenticated user
+func auditEntry(c *gin.Context, action string, targetType string, targetID int, message string) models.AuditLog {
+	entry := models.AuditLog{
+		Actor:      "anonymous",
+		SourceIP:   c.ClientIP(),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Message:    message,
+	}
+	if user := CurrentUser(c); user != nil {
+		entry.Actor = user.Username
+		entry.ActorID = user.ID
+	}
+	return entry
+}
+
+// AuditEvent persists an audit log entry, it is used directly for actions that are not triggered by a user
+func AuditEvent(entry models.AuditLog) {
+	if res := db.DB.Create(&entry); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Error("audit: failed to persist audit log entry")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"actor":  entry.Actor,
+		"source": entry.SourceIP,
+		"action": entry.Action,
+		"target": entry.TargetType,
+		"id":     entry.TargetID,
+	}).Debug("audit")
+}
+
+// auditDiff only keeps the fields that have changed between before and after
+func auditDiff(before interface{}, after interface{}) ([]byte, error) {
+	b, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := models.AuditDiff{}
+	if b != nil {
+		diff.Before = map[string]interface{}{}
+	}
+	if a != nil {
+		diff.After = map[string]interface{}{}
+	}
+
+	for k, v := range b {
+		if av, ok := a[k]; a == nil || !ok || !reflect.DeepEqual(v, av) {
+			diff.Before[k] = auditValue(k, v)
+		}
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; b == nil || !ok || !reflect.DeepEqual(v, bv) {
+			diff.After[k] = auditValue(k, v)
+		}
+	}
+
+	return json.Marshal(diff)
+}
+
+// auditValue replaces the value of a redacted field, the values are compared before so that a change is still
+// visible in the diff
+func auditValue(k string, v interface{}) interface{} {
+	if _, ok := auditRedactedFields[k]; ok && v != "" {
+		return "redacted"
+	}
+	return v
+}
+
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(j, &fields); err != nil {
+		return nil, err
+	}
+
+	for k := range fields {
+		if _, ok := auditIgnoredFields[k]; ok {
+			delete(fields, k)
+		}
+	}
+
+	return fields, nil
+}
+
+// ListAudit Get the audit log
+// @Summary Get the audit log
+// @Tags audit
+// @Accept  json
+// @Produce  json
+// @Produce  text/csv
+// @Param  actor query string false "Username of the actor"
+// @Param  action query string false "Action"
+// @Param  target_type query string false "Type of the object, eg. pool, address or group"
+// @Param  target_id query int false "ID of the object"
+// @Param  from query string false "Only entries at or after this time (RFC3339)"
+// @Param  to query string false "Only entries before this time (RFC3339)"
+// @Param  format query string false "json (default) or csv"
+// @Success 200 {array} models.AuditLog
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /audit [get]
+func ListAudit(c *gin.Context) {
+	query := db.DB.Order("created_at desc")
+
+	if v := c.Query("actor"); v != "" {
+		query = query.Where("actor = ?", v)
+	}
+	if v := c.Query("action"); v != "" {
+		query = query.Where("action = ?", v)
+	}
+	if v := c.Query("target_type"); v != "" {
+		query = query.Where("target_type = ?", v)
+	}
+	if v := c.Query("target_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		query = query.Where("target_id = ?", id)
+	}
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		query = query.Where("created_at < ?", t)
+	}
+
+	var items []models.AuditLog
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, items) // 200
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=audit-"+time.Now().Format("20060102-150405")+".csv")
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"time", "actor", "source_ip", "action", "target_type", "target_id", "message", "diff"})
+	for _, v := range items {
+		w.Write([]string{
+			v.CreatedAt.Format(time.RFC3339),
+			v.Actor,
+			v.SourceIP,
+			v.Action,
+			v.TargetType,
+			strconv.Itoa(v.TargetID),
+			v.Message,
+			string(v.Diff),
+		})
+	}
+	w.Flush()
+}
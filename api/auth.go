@@ -0,0 +1,148 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// contextUserKey is the gin context key the authenticated user is stored under
+const contextUserKey = "user"
+
+// Authenticate validates the session or api token of every request in the group it is attached to.
+// The token is read from the "Authorization: Bearer" header.
+func Authenticate(c *gin.Context) {
+	authenticate(c, bearerToken(c))
+}
+
+// AuthenticateWebsocket is Authenticate for the websocket routes. Browsers are unable to set headers on the
+// upgrade request, so the token is also read from the "token" query parameter of it. Query parameters end up in
+// access logs, they are not accepted anywhere else.
+func AuthenticateWebsocket(c *gin.Context) {
+	token := bearerToken(c)
+	if token == "" && c.IsWebsocket() {
+		token = c.Query("token")
+	}
+	authenticate(c, token)
+}
+
+func authenticate(c *gin.Context, token string) {
+	if token == "" {
+		Error(c, http.StatusUnauthorized, fmt.Errorf("missing authentication token")) // 401
+		c.Abort()
+		return
+	}
+
+	var user *models.User
+	var status int
+	var err error
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		user, status, err = apiTokenUser(token)
+	} else {
+		user, status, err = sessionUser(token)
+	}
+	if err != nil {
+		Error(c, status, err)
+		c.Abort()
+		return
+	}
+
+	c.Set(contextUserKey, user)
+	c.Next()
+}
+
+func sessionUser(token string) (*models.User, int, error) {
+	var session models.Session
+	if res := db.DB.Preload("User").Where("token_hash = ?", hashToken(token)).First(&session); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid authentication token") // 401
+		}
+		return nil, http.StatusInternalServerError, res.Error // 500
+	}
+
+	if session.User == nil || session.ExpiresAt.Before(time.Now()) {
+		db.DB.Delete(&session)
+		return nil, http.StatusUnauthorized, fmt.Errorf("session expired") // 401
+	}
+
+	db.DB.Model(&session).UpdateColumn("last_seen", time.Now())
+
+	return session.User, http.StatusOK, nil
+}
+
+// Require only lets the request through if the authenticated user has been granted the permission
+func Require(p models.Permission) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		user := CurrentUser(c)
+		if user == nil || !user.Can(p) {
+			Error(c, http.StatusForbidden, fmt.Errorf("permission denied, %s is required", p)) // 403
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser returns the user that has been authenticated for this request, or nil
+func CurrentUser(c *gin.Context) *models.User {
+	if v, ok := c.Get(contextUserKey); ok {
+		if user, ok := v.(*models.User); ok {
+			return user
+		}
+	}
+	return nil
+}
+
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return ""
+}
+
+// newSession creates a session for the user and returns the plaintext token, only the hash is persisted
+func newSession(user models.User, sourceIP string, lifetime time.Duration) (string, models.Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", models.Session{}, err
+	}
+	token := hex.EncodeToString(b)
+
+	session := models.Session{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		SourceIP:  sourceIP,
+		ExpiresAt: time.Now().Add(lifetime),
+		LastSeen:  time.Now(),
+	}
+	if res := db.DB.Create(&session); res.Error != nil {
+		return "", models.Session{}, res.Error
+	}
+
+	// housekeeping, remove all sessions that have expired
+	if res := db.DB.Where("expires_at < ?", time.Now()).Delete(&models.Session{}); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("auth: failed to remove expired sessions")
+	}
+
+	return token, session, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
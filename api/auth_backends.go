@@ -0,0 +1,97 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/ldap"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// Sources a user can originate from
+const (
+	sourceLocal = "local"
+	sourceLDAP  = "ldap"
+)
+
+// authBackend verifies a username and password, and returns the matching user
+type authBackend interface {
+	name() string
+	authenticate(username string, password string) (*models.User, error)
+}
+
+// authBackends returns the configured backends in the order they should be tried,
+// the local users are always last to be used as a fallback
+func authBackends(conf *config.Config) []authBackend {
+	var backends []authBackend
+	if conf.LDAP.URL != "" {
+		backends = append(backends, &ldapBackend{conf: conf.LDAP})
+	}
+	return append(backends, &localBackend{})
+}
+
+type localBackend struct{}
+
+func (b *localBackend) name() string {
+	return sourceLocal
+}
+
+func (b *localBackend) authenticate(username string, password string) (*models.User, error) {
+	var user models.User
+	if res := db.DB.Where("username = ?", username).First(&user); res.Error != nil {
+		return nil, fmt.Errorf("supplied username does not exist")
+	}
+	if user.Source != "" && user.Source != sourceLocal {
+		return nil, fmt.Errorf("user is managed by the %s backend", user.Source)
+	}
+	if !ComparePasswords(user.Password, []byte(password), username) {
+		return &user, fmt.Errorf("invalid password supplied")
+	}
+	return &user, nil
+}
+
+type ldapBackend struct {
+	conf config.LDAP
+}
+
+func (b *ldapBackend) name() string {
+	return sourceLDAP
+}
+
+// authenticate binds against the directory and keeps a local copy of the user, so that sessions,
+// api tokens and the audit log can reference it
+func (b *ldapBackend) authenticate(username string, password string) (*models.User, error) {
+	identity, err := ldap.Authenticate(b.conf, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	res := db.DB.Where("username = ?", username).First(&user)
+	if res.Error != nil && !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, res.Error
+	}
+
+	// never let a directory user take over a local account with the same name
+	if res.Error == nil && user.Source != sourceLDAP {
+		logrus.WithFields(logrus.Fields{
+			"username": username,
+		}).Warn("auth: directory user collides with a local user, ignoring the directory")
+		return nil, fmt.Errorf("a local user with the same name exists")
+	}
+
+	user.Username = identity.Username
+	user.Email = identity.Email
+	user.Role = identity.Role
+	user.Comment = identity.DN
+	user.Source = sourceLDAP
+	if res := db.DB.Save(&user); res.Error != nil {
+		return nil, res.Error
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,488 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/config"
+	ca "github.com/tribock/go-via/crypto"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// ListCertificates Get a list of all issued certificates
+// @Summary Get all certificates issued by the internal CA
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param  address_id query int false "Only certificates of this host"
+// @Param  revoked query bool false "Only revoked (true) or valid (false) certificates"
+// @Success 200 {array} models.Certificate
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/certificates [get]
+func ListCertificates(c *gin.Context) {
+	query := db.DB.Order("created_at desc")
+
+	if v := c.Query("address_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		query = query.Where("address_id = ?", id)
+	}
+	if v := c.Query("revoked"); v != "" {
+		revoked, err := strconv.ParseBool(v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if revoked {
+			query = query.Where("revoked_at IS NOT NULL")
+		} else {
+			query = query.Where("revoked_at IS NULL")
+		}
+	}
+
+	var items []models.Certificate
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetCertificate Get an existing certificate
+// @Summary Get an existing certificate
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Certificate ID"
+// @Success 200 {object} models.Certificate
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/certificates/{id} [get]
+func GetCertificate(c *gin.Context) {
+	item, ok := loadCertificate(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DownloadCertificate Download a certificate
+// @Summary Download a certificate in PEM format
+// @Tags ca
+// @Produce  application/x-pem-file
+// @Param  id path int true "Certificate ID"
+// @Success 200 {file} file
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/certificates/{id}/download [get]
+func DownloadCertificate(c *gin.Context) {
+	item, ok := loadCertificate(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+item.CommonName+".crt")
+	c.Data(http.StatusOK, "application/x-pem-file", []byte(item.PEM)) // 200
+}
+
+// RevokeCertificate Revoke a certificate
+// @Summary Revoke a certificate, it will be published on the CRL
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Certificate ID"
+// @Param  item body models.RevokeForm false "Revocation reason"
+// @Success 200 {object} models.Certificate
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/certificates/{id}/revoke [post]
+func RevokeCertificate(c *gin.Context) {
+	var form models.RevokeForm
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+	}
+
+	// reason 7 is unused, 8 (removeFromCRL) is only valid in delta CRLs
+	if form.Reason < 0 || form.Reason > 10 || form.Reason == 7 || form.Reason == 8 {
+		Error(c, http.StatusBadRequest, fmt.Errorf("invalid revocation reason %d", form.Reason)) // 400
+		return
+	}
+
+	item, ok := loadCertificate(c)
+	if !ok {
+		return
+	}
+	before := item
+
+	if item.RevokedAt != nil {
+		Error(c, http.StatusConflict, fmt.Errorf("the certificate has already been revoked")) // 409
+		return
+	}
+	if item.External {
+		Error(c, http.StatusConflict, fmt.Errorf("the certificate has been issued by %s, it has to be revoked there", item.Issuer)) // 409
+		return
+	}
+
+	if err := ca.Revoke(&item, form.Reason); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	Audit(c, models.AuditRevoke, "certificate", item.ID, before, item)
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// ReissueCertificate Re-issue a certificate
+// @Summary Issue a new certificate with the same names, the old one is revoked as superseded
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Certificate ID"
+// @Success 200 {object} models.Certificate
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/certificates/{id}/reissue [post]
+func ReissueCertificate(c *gin.Context) {
+	item, ok := loadCertificate(c)
+	if !ok {
+		return
+	}
+
+	if item.External {
+		Error(c, http.StatusConflict, fmt.Errorf("the certificate has been issued by %s, create a new certificate request instead", item.Issuer)) // 409
+		return
+	}
+
+	n, err := ca.Reissue(item)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	Audit(c, models.AuditReissue, "certificate", n.ID, item, n)
+
+	c.JSON(http.StatusOK, n) // 200
+}
+
+// DownloadCA Download the CA certificate
+// @Summary Download the CA certificate in PEM format
+// @Tags ca
+// @Produce  application/x-pem-file
+// @Success 200 {file} file
+// @Failure 500 {object} models.APIError
+// @Router /ca/ca.crt [get]
+func DownloadCA(c *gin.Context) {
+	b, err := ca.CACertificate()
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=ca.crt")
+	c.Data(http.StatusOK, "application/x-pem-file", b) // 200
+}
+
+// CRL Download the certificate revocation list
+// @Summary Download the DER encoded certificate revocation list
+// @Tags ca
+// @Produce  application/pkix-crl
+// @Success 200 {file} file
+// @Failure 500 {object} models.APIError
+// @Router /ca/crl [get]
+func CRL(c *gin.Context) {
+	b, err := ca.CRL()
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.Data(http.StatusOK, "application/pkix-crl", b) // 200
+}
+
+func loadCertificate(c *gin.Context) (models.Certificate, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return models.Certificate{}, false
+	}
+
+	var item models.Certificate
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return models.Certificate{}, false
+	}
+	return item, true
+}
+
+// ImportCA Import an intermediate CA
+// @Summary Replace the internal CA with an intermediate CA issued by an enterprise PKI
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param item body models.CAImportForm true "Certificate and key of the intermediate CA"
+// @Success 200 {object} models.Certificate
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/import [post]
+func ImportCA(c *gin.Context) {
+	var form models.CAImportForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	cert, err := ca.ImportCA([]byte(form.Certificate), []byte(form.Key))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item := models.Certificate{
+		Serial:     hex.EncodeToString(cert.SerialNumber.Bytes()),
+		CommonName: cert.Subject.CommonName,
+		Issuer:     cert.Issuer.String(),
+		External:   true,
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		Path:       filepath.Dir(ca.CACertFile),
+		Name:       "ca",
+		PEM:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	}
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	AuditEvent(auditEntry(c, models.AuditImport, "certificate", item.ID, "imported ca "+cert.Subject.String()+" issued by "+cert.Issuer.String()))
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// ListCertificateRequests Get a list of all certificate requests
+// @Summary Get all certificate requests
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.CertificateRequest
+// @Failure 500 {object} models.APIError
+// @Router /ca/requests [get]
+func ListCertificateRequests(c *gin.Context) {
+	var items []models.CertificateRequest
+	if res := db.DB.Order("created_at desc").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// CreateCertificateRequest Create a certificate request
+// @Summary Generate a key and a certificate request for a host, or the appliance itself, to be signed by an external CA
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param item body models.CertificateRequestForm true "Host to create the request for, address_id 0 for the appliance"
+// @Success 200 {object} models.CertificateRequest
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/requests [post]
+func CreateCertificateRequest(conf *config.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var form models.CertificateRequestForm
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// the appliance itself
+		path, name, req := filepath.Dir(ca.ServerCertFile), "server-csr", ca.ServerRequest(conf.Network.Interfaces)
+
+		if form.AddressID != 0 {
+			var address models.Address
+			if res := db.DB.First(&address, form.AddressID); res.Error != nil {
+				if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+					Error(c, http.StatusNotFound, fmt.Errorf("address not found")) // 404
+				} else {
+					Error(c, http.StatusInternalServerError, res.Error) // 500
+				}
+				return
+			}
+			if address.Hostname == "" || address.Domain == "" {
+				Error(c, http.StatusBadRequest, fmt.Errorf("the host needs a hostname and domain")) // 400
+				return
+			}
+
+			fqdn := address.Hostname + "." + address.Domain
+			path, name = "./cert/"+fqdn, "rui-external"
+			req = ca.Request{
+				CommonName:  fqdn,
+				DNSNames:    []string{address.Hostname},
+				IPAddresses: ca.ParseIPs(address.IP),
+				AddressID:   address.ID,
+			}
+		}
+
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		// a new request replaces the pending ones, their key is overwritten
+		if res := db.DB.Where("address_id = ? AND status = ?", form.AddressID, models.RequestPending).Delete(&models.CertificateRequest{}); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		item, err := ca.CreateCSR(path, name, req)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		Audit(c, models.AuditCreate, "certificate_request", item.ID, nil, item)
+
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// DownloadCertificateRequest Download a certificate request
+// @Summary Download a certificate request in PEM format
+// @Tags ca
+// @Produce  application/pkcs10
+// @Param  id path int true "Certificate request ID"
+// @Success 200 {file} file
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/requests/{id}/download [get]
+func DownloadCertificateRequest(c *gin.Context) {
+	item, ok := loadCertificateRequest(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+item.CommonName+".csr")
+	c.Data(http.StatusOK, "application/pkcs10", []byte(item.PEM)) // 200
+}
+
+// UploadCertificate Upload the signed certificate for a request
+// @Summary Upload the certificate an external CA has signed for a request
+// @Description Host certificates are pushed by the next postconfig, a certificate for the appliance is installed immediately.
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Certificate request ID"
+// @Param item body models.CertificateUploadForm true "Signed certificate"
+// @Success 200 {object} models.Certificate
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/requests/{id}/certificate [post]
+func UploadCertificate(c *gin.Context) {
+	var form models.CertificateUploadForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item, ok := loadCertificateRequest(c)
+	if !ok {
+		return
+	}
+
+	if item.Status != models.RequestPending {
+		Error(c, http.StatusConflict, fmt.Errorf("the request has already been signed")) // 409
+		return
+	}
+
+	cert, err := ca.AcceptCertificate(&item, []byte(form.Certificate))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if item.AddressID == 0 {
+		if err := ca.InstallServerCertificate(cert); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+	}
+
+	Audit(c, models.AuditUpload, "certificate", cert.ID, nil, cert)
+
+	c.JSON(http.StatusOK, cert) // 200
+}
+
+// DeleteCertificateRequest Remove a certificate request
+// @Summary Remove a certificate request
+// @Tags ca
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Certificate request ID"
+// @Success 204
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ca/requests/{id} [delete]
+func DeleteCertificateRequest(c *gin.Context) {
+	item, ok := loadCertificateRequest(c)
+	if !ok {
+		return
+	}
+
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	Audit(c, models.AuditDelete, "certificate_request", item.ID, item, nil)
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+func loadCertificateRequest(c *gin.Context) (models.CertificateRequest, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return models.CertificateRequest{}, false
+	}
+
+	var item models.CertificateRequest
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return models.CertificateRequest{}, false
+	}
+	return item, true
+}
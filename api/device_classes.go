@@ -126,6 +126,8 @@ func CreateDeviceClass(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditCreate, "device_class", item.ID, nil, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -166,6 +168,8 @@ func UpdateDeviceClass(c *gin.Context) {
 		return
 	}
 
+	before := item
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.DeviceClass{DeviceClassForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
@@ -177,6 +181,8 @@ func UpdateDeviceClass(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditUpdate, "device_class", item.ID, before, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -214,5 +220,7 @@ func DeleteDeviceClass(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditDelete, "device_class", item.ID, item, nil)
+
 	c.JSON(http.StatusNoContent, gin.H{}) //204
 }
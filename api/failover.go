@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/failover"
+	"github.com/tribock/go-via/models"
+)
+
+// AuthenticatePeer validates the shared secret of the requests of the failover partner
+func AuthenticatePeer(c *gin.Context) {
+	if !failover.Authorized(c.GetHeader(failover.SecretHeader)) {
+		Error(c, http.StatusUnauthorized, fmt.Errorf("invalid failover secret")) // 401
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// GetFailover Get the failover state
+// @Summary Get the failover state of this instance and its partner
+// @Tags failover
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.FailoverStatus
+// @Router /failover [get]
+func GetFailover(c *gin.Context) {
+	c.JSON(http.StatusOK, failover.Status()) // 200
+}
+
+// FailoverHeartbeat Receive the heartbeat of the failover partner
+// @Summary Receive the heartbeat of the failover partner
+// @Tags failover
+// @Accept  json
+// @Produce  json
+// @Param item body models.FailoverStatus true "State of the partner"
+// @Success 200 {object} models.FailoverStatus
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Router /failover/heartbeat [post]
+func FailoverHeartbeat(c *gin.Context) {
+	var form models.FailoverStatus
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item, err := failover.Heartbeat(form)
+	if err != nil {
+		Error(c, http.StatusConflict, err) // 409
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// ListFailoverLeases Get the leases for the failover partner
+// @Summary Get all active leases for the failover partner
+// @Tags failover
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.FailoverLease
+// @Failure 401 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /failover/leases [get]
+func ListFailoverLeases(c *gin.Context) {
+	items, err := failover.Leases()
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// ReplicateLeases Receive the leases written by the failover partner
+// @Summary Receive the leases written by the failover partner
+// @Tags failover
+// @Accept  json
+// @Produce  json
+// @Param item body []models.FailoverLease true "Leases of the partner"
+// @Success 200 {object} models.FailoverResult
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /failover/leases [post]
+func ReplicateLeases(c *gin.Context) {
+	var form []models.FailoverLease
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	applied, err := failover.Apply(form)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, models.FailoverResult{Applied: applied}) // 200
+}
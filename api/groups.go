@@ -79,7 +79,7 @@ func GetGroup(c *gin.Context) {
 // @Failure 400 {object} models.APIError
 // @Failure 500 {object} models.APIError
 // @Router /groups [post]
-func CreateGroup(key string) func(c *gin.Context) {
+func CreateGroup(keys *secrets.Keyring) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		var form models.GroupForm
 
@@ -100,7 +100,12 @@ func CreateGroup(key string) func(c *gin.Context) {
 			Error(c, http.StatusBadRequest, err) // 400
 			return
 		}
-		item.Password = secrets.Encrypt(item.Password, key)
+		encrypted, err := keys.Encrypt(item.Password)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+		item.Password = encrypted
 
 		if res := db.DB.Create(&item); res.Error != nil {
 			Error(c, http.StatusInternalServerError, res.Error) // 500
@@ -113,6 +118,8 @@ func CreateGroup(key string) func(c *gin.Context) {
 			return
 		}
 
+		Audit(c, models.AuditCreate, "group", item.ID, nil, item)
+
 		c.JSON(http.StatusOK, item) // 200
 
 		logrus.WithFields(logrus.Fields{
@@ -137,7 +144,7 @@ func CreateGroup(key string) func(c *gin.Context) {
 // @Failure 404 {object} models.APIError
 // @Failure 500 {object} models.APIError
 // @Router /groups/{id} [patch]
-func UpdateGroup(key string) func(c *gin.Context) {
+func UpdateGroup(keys *secrets.Keyring) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
@@ -163,6 +170,8 @@ func UpdateGroup(key string) func(c *gin.Context) {
 			return
 		}
 
+		before := item
+
 		// Merge the item and the form data
 		if err := mergo.Merge(&item, models.Group{GroupForm: form}, mergo.WithOverride); err != nil {
 			Error(c, http.StatusInternalServerError, err) // 500
@@ -181,7 +190,11 @@ func UpdateGroup(key string) func(c *gin.Context) {
 				return
 			}
 
-			item.Password = secrets.Encrypt(item.Password, key)
+			item.Password, err = keys.Encrypt(item.Password)
+			if err != nil {
+				Error(c, http.StatusInternalServerError, err) // 500
+				return
+			}
 		}
 
 		//mergo wont overwrite values with empty space. To enable removal of ntp, dns, syslog, vlan, always overwrite.
@@ -203,6 +216,8 @@ func UpdateGroup(key string) func(c *gin.Context) {
 			return
 		}
 
+		Audit(c, models.AuditUpdate, "group", item.ID, before, item)
+
 		c.JSON(http.StatusOK, item) // 200
 	}
 }
@@ -242,6 +257,7 @@ func DeleteGroup(c *gin.Context) {
 			Error(c, http.StatusInternalServerError, res.Error) // 500
 			return
 		}
+		Audit(c, models.AuditDelete, "group", item.ID, item, nil)
 		c.JSON(http.StatusNoContent, gin.H{}) //204
 	} else {
 		c.JSON(http.StatusConflict, "the group is not empty, please delete all hosts first.")
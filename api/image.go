@@ -203,6 +203,7 @@ func CreateImage(conf *config.Config) func(c *gin.Context) {
 				"size":        item.Size,
 				"description": item.Description,
 			}).Info("image")
+			Audit(c, models.AuditUpload, "image", item.ID, nil, item)
 			c.JSON(http.StatusOK, item) // 200
 		}
 	}
@@ -262,6 +263,8 @@ func UpdateImage(c *gin.Context) {
 		return
 	}
 
+	before := item
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.Image{ImageForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
@@ -279,6 +282,8 @@ func UpdateImage(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditUpdate, "image", item.ID, before, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -331,6 +336,8 @@ func DeleteImage(c *gin.Context) {
 			return
 		}
 
+		Audit(c, models.AuditDelete, "image", item.ID, item, nil)
+
 		c.JSON(http.StatusNoContent, gin.H{}) //204
 	}
 
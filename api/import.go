@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/importer"
+	"github.com/tribock/go-via/models"
+)
+
+// maxImportSize is the largest export that is accepted, the lease files of big installations are a few MB
+const maxImportSize = 64 << 20
+
+// ImportPools Import the pools and reservations of another dhcp server
+// @Summary Import the subnets, reservations and active leases of an ISC dhcpd, Kea or Windows DHCP export
+// @Tags pools
+// @Accept  multipart/form-data
+// @Produce  json
+// @Param  file formData file true "dhcpd.conf, dhcpd.leases, Kea configuration or Export-DhcpServer xml"
+// @Param  format formData string false "isc, isc-leases, kea or windows, it is detected if it is empty"
+// @Param  dry_run formData bool false "Only report what would be imported and the conflicts with the existing pools"
+// @Success 200 {object} models.ImportReport
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /pools/import [post]
+func ImportPools(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	if file.Size > maxImportSize {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the export is larger than %d MB", maxImportSize>>20)) // 400
+		return
+	}
+
+	var dryRun bool
+	if v := c.PostForm("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	report, err := importer.Parse(c.PostForm("format"), data)
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if err := importer.Run(report, dryRun); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	if !dryRun {
+		// the index may have been rebuilt while the import was running
+		InvalidatePools()
+
+		AuditEvent(auditEntry(c, models.AuditImport, "pool", 0, fmt.Sprintf("imported %s from %s export, %d created, %d updated, %d existing, %d conflicts",
+			file.Filename, report.Format, report.Created, report.Updated, report.Existing, report.Conflicts)))
+	}
+
+	c.JSON(http.StatusOK, report) // 200
+}
@@ -1,11 +1,16 @@
 package api
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"text/template"
+	"time"
 
 	"encoding/base64"
 
@@ -14,6 +19,7 @@ import (
 	"github.com/tribock/go-via/db"
 	"github.com/tribock/go-via/models"
 	"github.com/tribock/go-via/secrets"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
@@ -35,31 +41,115 @@ install --disk=/vmfs/devices/disks/{{.bootdisk}} --overwritevmfs --novmfsondisk
 install --overwritevmfs {{ if not .createvmfs }} --novmfsondisk {{ end }} --firstdisk="localesx,usb,ahci,vmw_ahci,VMware"
 {{ end }}
 
+{{ if .ipv6 }}
+# The network command only takes IPv4 settings, the static IPv6 address is set on first boot
+network --bootproto=dhcp --nameserver={{ .dns }} --hostname={{ .hostname }} --device={{ .mac }} {{if .vlan}} --vlanid={{.vlan}} {{end}}
+{{ else }}
 # Set the network to static on the first network adapter
 network --bootproto=static --ip={{ .ip }} --gateway={{ .gateway }} --netmask={{ .netmask }} --nameserver={{ .dns }} --hostname={{ .hostname }} --device={{ .mac }} {{if .vlan}} --vlanid={{.vlan}} {{end}}
+{{ end }}
 
 reboot
+{{ if .ipv6 }}
+%firstboot --interpreter=busybox
+esxcli network ip interface ipv6 set --interface-name=vmk0 --enable-ipv6=true --enable-dhcpv6=false --enable-router-adv=false
+esxcli network ip interface ipv6 address add --interface-name=vmk0 --ipv6={{ .ip }}/{{ .prefixlen }}
+esxcli network ip route ipv6 add --gateway={{ .gateway }} --network=::/0
+{{ end }}
 `
 
-// func Ks(c *gin.Context) {
-func Ks(key string) func(c *gin.Context) {
+// IssueKsToken creates a single use token for the address, it is embedded in the ks= url of boot.cfg. Tokens that
+// have been issued earlier and not been used yet are revoked, so only the boot.cfg that was served last is valid.
+func IssueKsToken(addressID int, lifetime time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	if res := db.DB.Where("address_id = ? AND used_at IS NULL", addressID).Delete(&models.KsToken{}); res.Error != nil {
+		return "", res.Error
+	}
+
+	item := models.KsToken{
+		AddressID: addressID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+	if res := db.DB.Create(&item); res.Error != nil {
+		return "", res.Error
+	}
+
+	return token, nil
+}
+
+// findKsToken looks up a token that has neither been used nor expired yet
+func findKsToken(token string) (models.KsToken, error) {
+	var item models.KsToken
+	if token == "" {
+		return item, fmt.Errorf("no kickstart token supplied")
+	}
+
+	if res := db.DB.Where("token_hash = ?", hashToken(token)).First(&item); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return item, fmt.Errorf("unknown kickstart token")
+		}
+		return item, res.Error
+	}
+
+	if item.UsedAt != nil {
+		return item, fmt.Errorf("kickstart token has already been used by %s at %s", item.UsedBy, item.UsedAt.Format(time.RFC3339))
+	}
+	if time.Now().After(item.ExpiresAt) {
+		return item, fmt.Errorf("kickstart token expired at %s", item.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return item, nil
+}
+
+// burnKsToken marks the token as used
+func burnKsToken(tx *gorm.DB, item models.KsToken, source string) error {
+	// only one of two concurrent requests with the same token may win
+	res := tx.Model(&item).Where("used_at IS NULL").Updates(map[string]interface{}{"used_at": time.Now(), "used_by": source})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return fmt.Errorf("kickstart token has already been used")
+	}
+	return nil
+}
+
+// Ks serves the kickstart file to the host that holds the kickstart token from its boot.cfg
+func Ks(keys *secrets.Keyring) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		var item models.Address
 		host, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
 
-		if res := db.DB.Preload(clause.Associations).Where("ip = ?", host).First(&item); res.Error != nil {
-			Error(c, http.StatusInternalServerError, res.Error) // 500
+		token, err := findKsToken(c.Query("token"))
+
+		// the token is only good for the host it has been issued to, it is checked before anything is rendered so
+		// that someone else can not use it up
+		var item models.Address
+		if err == nil {
+			if res := db.DB.Preload(clause.Associations).First(&item, token.AddressID); res.Error != nil {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+				return
+			}
+			if ip := net.ParseIP(host); ip == nil || !ip.Equal(net.ParseIP(item.IP)) {
+				err = fmt.Errorf("kickstart token of %s used from an unexpected address", item.IP)
+			} else if !item.Reimage {
+				err = fmt.Errorf("kickstart token of %s used, but the host is not marked for reimage", item.IP)
+			}
+		}
+
+		if err != nil {
+			denyKs(c, host, token.AddressID, err)
 			return
 		}
 
 		options := models.GroupOptions{}
 		json.Unmarshal(item.Group.Options, &options)
 
-		if reimage := db.DB.Model(&item).Where("ip = ?", host).Update("reimage", false); reimage.Error != nil {
-			Error(c, http.StatusInternalServerError, reimage.Error) // 500
-			return
-		}
-
 		laddrport, ok := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
 		if !ok {
 			logrus.WithFields(logrus.Fields{
@@ -67,14 +157,29 @@ func Ks(key string) func(c *gin.Context) {
 			}).Debug("ks")
 		}
 
-		logrus.Info("Disabling re-imaging for host to avoid re-install looping")
-
 		//convert netmask from bit to long format.
-		nm := net.CIDRMask(item.Pool.Netmask, 32)
-		netmask := ipv4MaskString(nm)
+		var netmask string
+		if !item.Pool.IsIPv6() {
+			nm := net.CIDRMask(item.Pool.Netmask, 32)
+			netmask = ipv4MaskString(nm)
+		}
 
 		//decrypt the password
-		decryptedPassword := secrets.Decrypt(item.Group.Password, key)
+		var decryptedPassword string
+		if options.UniqueRootPassword {
+			decryptedPassword, err = issueRootPassword(keys, &item)
+		} else {
+			// the host is installed with the group password again, a previously generated password is void
+			if item.RootPassword != "" {
+				item.RootPassword = ""
+				item.RootPasswordSetAt = nil
+			}
+			decryptedPassword, err = keys.Decrypt(item.Group.Password)
+		}
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
 
 		//cleanup data to allow easier custom templating
 		data := map[string]interface{}{
@@ -85,6 +190,8 @@ func Ks(key string) func(c *gin.Context) {
 			"dns":        item.Group.DNS,
 			"hostname":   item.Hostname,
 			"netmask":    netmask,
+			"prefixlen":  item.Pool.Netmask,
+			"ipv6":       item.Pool.IsIPv6(),
 			"via_server": laddrport,
 			"erasedisks": options.EraseDisks,
 			"bootdisk":   item.Group.BootDisk,
@@ -109,16 +216,48 @@ func Ks(key string) func(c *gin.Context) {
 			}).Debug("ks")
 		}
 
+		// the ks.cfg is rendered completely before the token is used up, the host can try again if anything fails
 		t, err := template.New("").Parse(ks)
 		if err != nil {
-			logrus.Info(err)
+			Error(c, http.StatusInternalServerError, err) // 500
 			return
 		}
-		err = t.Execute(c.Writer, data)
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		logrus.Info("Disabling re-imaging for host to avoid re-install looping")
+
+		item.Reimage = false
+		err = db.DB.Transaction(func(tx *gorm.DB) error {
+			if err := burnKsToken(tx, token, host); err != nil {
+				return err
+			}
+			return tx.Model(&item).Select("reimage", "root_password", "root_password_set_at").Updates(map[string]interface{}{
+				"reimage":              false,
+				"root_password":        item.RootPassword,
+				"root_password_set_at": item.RootPasswordSetAt,
+			}).Error
+		})
 		if err != nil {
-			logrus.Info(err)
+			denyKs(c, host, token.AddressID, err)
 			return
 		}
+		// the pool index may have reloaded the host before the commit
+		refreshAddresses(item.ID)
+
+		AuditEvent(models.AuditLog{
+			Actor:      "host",
+			SourceIP:   host,
+			Action:     models.AuditKickstart,
+			TargetType: "address",
+			TargetID:   item.ID,
+			Message:    "ks.cfg served to " + item.Hostname,
+		})
+
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", buf.Bytes()) // 200
 
 		logrus.Info("Served ks.cfg file")
 		logrus.WithFields(logrus.Fields{
@@ -136,12 +275,30 @@ func Ks(key string) func(c *gin.Context) {
 		item.Progresstext = "kickstart"
 		db.DB.Save(&item)
 
-		go ProvisioningWorker(item, key)
+		go ProvisioningWorker(item, keys)
 
 		logrus.Info("Started worker")
 	}
 }
 
+// denyKs refuses the kickstart file, the host is not told why
+func denyKs(c *gin.Context, host string, addressID int, err error) {
+	logrus.WithFields(logrus.Fields{
+		"ip":  host,
+		"id":  addressID,
+		"err": err,
+	}).Warn("ks")
+	AuditEvent(models.AuditLog{
+		Actor:      "host",
+		SourceIP:   host,
+		Action:     models.AuditKsDenied,
+		TargetType: "address",
+		TargetID:   addressID,
+		Message:    err.Error(),
+	})
+	Error(c, http.StatusUnauthorized, fmt.Errorf("invalid kickstart token")) // 401
+}
+
 func ipv4MaskString(m []byte) string {
 	if len(m) != 4 {
 		panic("ipv4Mask: len must be 4 bytes")
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+)
+
+// ListLeaseArchive Get the leases that have been swept from the address table
+// @Summary Get archived leases
+// @Tags leases
+// @Accept  json
+// @Produce  json
+// @Param  mac query string false "Only leases of this mac address"
+// @Param  ip query string false "Only leases of this ip address"
+// @Success 200 {array} models.LeaseArchive
+// @Failure 500 {object} models.APIError
+// @Router /leases/archive [get]
+func ListLeaseArchive(c *gin.Context) {
+	tx := db.DB.Order("archived_at desc")
+	if mac := c.Query("mac"); mac != "" {
+		tx = tx.Where("mac = ?", mac)
+	}
+	if ip := c.Query("ip"); ip != "" {
+		tx = tx.Where("ip = ?", ip)
+	}
+
+	var items []models.LeaseArchive
+	if res := tx.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
@@ -3,8 +3,10 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/config"
 	"github.com/tribock/go-via/db"
 	"github.com/tribock/go-via/models"
 
@@ -12,37 +14,96 @@ import (
 )
 
 // Login handles user login
-func Login(c *gin.Context) {
+// @Summary Authenticate and receive a session token
+// @Tags login
+// @Accept  json
+// @Produce  json
+// @Param item body models.UserLogin true "Credentials"
+// @Success 200 {object} models.LoginResponse
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /login [post]
+func Login(conf *config.Config) func(c *gin.Context) {
+	backends := authBackends(conf)
 
-	var user models.UserLogin
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+	return func(c *gin.Context) {
 
-	//get the user that is trying to authenticate
+		var user models.UserLogin
+		if err := c.ShouldBindJSON(&user); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
 
-	var dbUser models.User
-	if res := db.DB.Where("username = ?", user.Username).First(&dbUser); res.Error != nil {
-		logrus.WithFields(logrus.Fields{
-			"username": user.Username,
-			"status":   "supplied username does not exist",
-		}).Info("auth")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
-		Error(c, http.StatusUnauthorized, fmt.Errorf("supplied username does not exist")) // 404
-		return
-	}
-	if ComparePasswords(dbUser.Password, []byte(user.Password), user.Username) {
+		//try all backends in order until one of them accepts the credentials
+		var dbUser *models.User
+		var failedID int
+		for _, backend := range backends {
+			u, err := backend.authenticate(user.Username, user.Password)
+			if err == nil {
+				dbUser = u
+				break
+			}
+			if u != nil {
+				failedID = u.ID
+			}
+			logrus.WithFields(logrus.Fields{
+				"username": user.Username,
+				"backend":  backend.name(),
+				"status":   err.Error(),
+			}).Info("auth")
+		}
+		if dbUser == nil {
+			auditLogin(c, models.AuditLoginFail, user.Username, failedID)
+			Error(c, http.StatusUnauthorized, fmt.Errorf("invalid username or password")) // 401
+			return
+		}
+
+		token, session, err := newSession(*dbUser, c.ClientIP(), time.Duration(conf.SessionTimeout)*time.Minute)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
 
 		logrus.WithFields(logrus.Fields{
 			"username": user.Username,
 			"status":   "successfully authenticated",
 		}).Debug("auth")
-	} else {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
-		Error(c, http.StatusUnauthorized, fmt.Errorf("supplied username does not exist"))
+		auditLogin(c, models.AuditLogin, dbUser.Username, dbUser.ID)
+
+		c.JSON(http.StatusOK, models.LoginResponse{
+			Message:   "login successful",
+			Token:     token,
+			ExpiresAt: session.ExpiresAt,
+		}) // 200
+	}
+}
+
+// Logout invalidates the session token used for the request
+// @Summary Invalidate the current session token
+// @Tags login
+// @Accept  json
+// @Produce  json
+// @Success 204
+// @Failure 401 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /logout [post]
+func Logout(c *gin.Context) {
+	if res := db.DB.Where("token_hash = ?", hashToken(bearerToken(c))).Delete(&models.Session{}); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "login successful"})
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+func auditLogin(c *gin.Context, action string, username string, id int) {
+	AuditEvent(models.AuditLog{
+		Actor:      username,
+		ActorID:    id,
+		SourceIP:   c.ClientIP(),
+		Action:     action,
+		TargetType: "user",
+		TargetID:   id,
+	})
 }
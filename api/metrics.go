@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/metrics"
+)
+
+// Metrics Get the dhcp counters
+// @Summary Get the dhcp request and drop counters in the Prometheus text format
+// @Tags dhcp
+// @Produce  plain
+// @Success 200 {string} string
+// @Router /dhcp/metrics [get]
+func Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(http.StatusOK)
+	metrics.WriteTo(c.Writer)
+}
@@ -121,6 +121,12 @@ func CreateOption(c *gin.Context) {
 
 	item := models.Option{OptionForm: form}
 
+	// options that can't be encoded would only show up as errors when a client asks for them
+	if err := validateOption(item); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	if res := db.DB.Create(&item); res.Error != nil {
 		Error(c, http.StatusInternalServerError, res.Error) // 500
 		return
@@ -132,6 +138,8 @@ func CreateOption(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditCreate, "option", item.ID, nil, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -172,11 +180,18 @@ func UpdateOption(c *gin.Context) {
 		return
 	}
 
+	before := item
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.Option{OptionForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
 	}
 
+	if err := validateOption(item); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	// Save it
 	if res := db.DB.Preload("Pool").Save(&item); res.Error != nil {
 		Error(c, http.StatusInternalServerError, res.Error) // 500
@@ -189,6 +204,8 @@ func UpdateOption(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditUpdate, "option", item.ID, before, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -226,5 +243,25 @@ func DeleteOption(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditDelete, "option", item.ID, item, nil)
+
 	c.JSON(http.StatusNoContent, gin.H{}) //204
 }
+
+// validateOption encodes the option the way it is sent to the clients, options of IPv6 pools are DHCPv6 options
+func validateOption(item models.Option) error {
+	if item.PoolID > 0 {
+		var pool models.Pool
+		if res := db.DB.First(&pool, item.PoolID); res.Error == nil && pool.IsIPv6() {
+			if _, err := item.ToDHCPv6Option(); err != nil {
+				return fmt.Errorf("invalid dhcpv6 option %d: %w", item.OpCode, err)
+			}
+			return nil
+		}
+	}
+
+	if _, _, err := item.ToDHCPOption(); err != nil {
+		return fmt.Errorf("invalid dhcp option %d: %w", item.OpCode, err)
+	}
+	return nil
+}
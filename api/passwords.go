@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"github.com/tribock/go-via/secrets"
+	"gorm.io/gorm"
+)
+
+// rootPasswordLength of generated root passwords
+const rootPasswordLength = 20
+
+// rootPassword returns the root password the host has been installed with, the generated one if it has been
+// given one at kickstart, otherwise the password of its group
+func rootPassword(keys *secrets.Keyring, item models.Address) (string, error) {
+	if item.RootPassword != "" {
+		return keys.Decrypt(item.RootPassword)
+	}
+	return keys.Decrypt(item.Group.Password)
+}
+
+// RevealPassword Reveal the generated root password of a host
+// @Summary Reveal the generated root password of a host
+// @Tags addresses
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Address ID"
+// @Success 200 {object} models.AddressPassword
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /addresses/{id}/password [get]
+func RevealPassword(keys *secrets.Keyring) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Address
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		if item.RootPassword == "" {
+			Error(c, http.StatusNotFound, fmt.Errorf("the host has not been installed with a generated root password")) // 404
+			return
+		}
+
+		password, err := keys.Decrypt(item.RootPassword)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		AuditEvent(auditEntry(c, models.AuditReveal, "address", item.ID, "root password revealed for "+item.Hostname))
+
+		c.JSON(http.StatusOK, addressPassword(item, password)) // 200
+	}
+}
+
+// ExportPasswords Export all generated root passwords
+// @Summary Export the generated root passwords as csv, encrypted with a passphrase
+// @Description The export can be decrypted with: openssl enc -d -aes-256-cbc -pbkdf2 -iter 600000 -md sha256 -in root-passwords.csv.enc
+// @Tags addresses
+// @Accept  json
+// @Produce  application/octet-stream
+// @Param item body models.PasswordExportForm true "Passphrase to encrypt the export with"
+// @Success 200 {file} file
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /addresses/passwords/export [post]
+func ExportPasswords(keys *secrets.Keyring) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var form models.PasswordExportForm
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		query := db.DB.Where("root_password IS NOT NULL AND root_password <> ''")
+		if form.GroupID != 0 {
+			query = query.Where("group_id = ?", form.GroupID)
+		}
+
+		var items []models.Address
+		if res := query.Order("hostname").Find(&items); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"id", "hostname", "domain", "ip", "mac", "password", "set_at"})
+		for _, v := range items {
+			password, err := keys.Decrypt(v.RootPassword)
+			if err != nil {
+				Error(c, http.StatusInternalServerError, fmt.Errorf("host %d: %w", v.ID, err)) // 500
+				return
+			}
+
+			p := addressPassword(v, password)
+			setAt := ""
+			if p.SetAt != nil {
+				setAt = p.SetAt.Format(time.RFC3339)
+			}
+			w.Write([]string{strconv.Itoa(p.ID), p.Hostname, p.Domain, p.IP, p.Mac, p.Password, setAt})
+		}
+		w.Flush()
+
+		enc, err := secrets.EncryptExport(buf.Bytes(), form.Passphrase)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		AuditEvent(auditEntry(c, models.AuditExport, "address", 0, fmt.Sprintf("exported the root passwords of %d hosts", len(items))))
+
+		c.Header("Content-Disposition", "attachment; filename=root-passwords-"+time.Now().Format("20060102-150405")+".csv.enc")
+		c.Data(http.StatusOK, "application/octet-stream", enc) // 200
+	}
+}
+
+// issueRootPassword generates a new root password for the host, it is set encrypted on the item and stored along with
+// the rest of the host by the caller
+func issueRootPassword(keys *secrets.Keyring, item *models.Address) (string, error) {
+	password, err := secrets.GeneratePassword(rootPasswordLength)
+	if err != nil {
+		return "", err
+	}
+
+	enc, err := keys.Encrypt(password)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	item.RootPassword = enc
+	item.RootPasswordSetAt = &now
+
+	return password, nil
+}
+
+func addressPassword(item models.Address, password string) models.AddressPassword {
+	return models.AddressPassword{
+		ID:       item.ID,
+		Hostname: item.Hostname,
+		Domain:   item.Domain,
+		IP:       item.IP,
+		Mac:      item.Mac,
+		Password: password,
+		SetAt:    item.RootPasswordSetAt,
+	}
+}
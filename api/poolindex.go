@@ -0,0 +1,366 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// The dhcp servers look up the pool, the leases and the reservations for every request. Instead of loading them from
+// the database each time they are kept in an index. An address that has been written is reloaded on the next lookup,
+// the index is only rebuilt after a pool has been written or a statement may have changed several addresses.
+
+// maxChangedAddresses is the number of changed addresses above which a rebuild is cheaper than reloading them
+const maxChangedAddresses = 256
+
+type poolIndex struct {
+	sync.Mutex
+	// generation is bumped by every write that needs a rebuild, the snapshot is stale once it has been built for an
+	// older one
+	generation uint64
+	snapshot   *poolSnapshot
+
+	changedMu sync.Mutex
+	// changed are the ids of the addresses that have been written since the last lookup
+	changed map[int]bool
+}
+
+type poolSnapshot struct {
+	generation uint64
+	pools      []indexedPool
+	// reimage are the addresses flagged for re-imaging that are not assigned to a pool yet
+	reimage []models.Address
+	// reservations are the addresses that have been set up for a host of all pools by ip
+	reservations map[string][]models.Address
+}
+
+type indexedPool struct {
+	pool      models.Pool
+	net       *net.IPNet
+	addresses []models.Address
+}
+
+var pools poolIndex
+
+// WatchPools invalidates the pool index whenever a pool or an address is written
+func WatchPools(tx *gorm.DB) error {
+	invalidate := func(tx *gorm.DB) {
+		// raw statements have no table, they may write anything
+		switch tx.Statement.Table {
+		case "addresses":
+			if ids, ok := writtenAddresses(tx); ok {
+				refreshAddresses(ids...)
+				return
+			}
+			InvalidatePools()
+		case "pools", "":
+			InvalidatePools()
+		}
+	}
+
+	cb := tx.Callback()
+	if err := cb.Create().After("gorm:create").Register("api:pool_index", invalidate); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:update").Register("api:pool_index", invalidate); err != nil {
+		return err
+	}
+	if err := cb.Delete().After("gorm:delete").Register("api:pool_index", invalidate); err != nil {
+		return err
+	}
+	return cb.Raw().After("gorm:raw").Register("api:pool_index", invalidate)
+}
+
+// InvalidatePools makes the next lookup rebuild the pool index. Writes are picked up automatically, but the index may
+// be rebuilt from the old data while a transaction is running, so it has to be called again after the commit.
+func InvalidatePools() {
+	atomic.AddUint64(&pools.generation, 1)
+}
+
+// refreshAddresses makes the next lookup reload the addresses. Like InvalidatePools it has to be called again after
+// the commit if they have been written in a transaction.
+func refreshAddresses(ids ...int) {
+	pools.changedMu.Lock()
+	defer pools.changedMu.Unlock()
+
+	if pools.changed == nil {
+		pools.changed = make(map[int]bool)
+	}
+	for _, id := range ids {
+		pools.changed[id] = true
+	}
+
+	if len(pools.changed) > maxChangedAddresses {
+		pools.changed = nil
+		InvalidatePools()
+	}
+}
+
+// writtenAddresses returns the ids of the addresses that a statement has written, it fails if the statement has not
+// been limited to the primary keys of its model, eg. an update with conditions only
+func writtenAddresses(tx *gorm.DB) ([]int, bool) {
+	if tx.Statement.Schema == nil || tx.Statement.Schema.PrioritizedPrimaryField == nil {
+		return nil, false
+	}
+	field := tx.Statement.Schema.PrioritizedPrimaryField
+
+	var values []reflect.Value
+	switch rv := tx.Statement.ReflectValue; rv.Kind() {
+	case reflect.Struct:
+		values = append(values, rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			values = append(values, reflect.Indirect(rv.Index(i)))
+		}
+	}
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	ids := make([]int, 0, len(values))
+	for _, v := range values {
+		if v.Kind() != reflect.Struct {
+			return nil, false
+		}
+		id, zero := field.ValueOf(v)
+		if zero {
+			return nil, false
+		}
+		n, ok := id.(int)
+		if !ok {
+			return nil, false
+		}
+		ids = append(ids, n)
+	}
+	return ids, true
+}
+
+func (x *poolIndex) get() (*poolSnapshot, error) {
+	generation := atomic.LoadUint64(&x.generation)
+
+	x.Lock()
+	defer x.Unlock()
+
+	// taken before the database is read, addresses that are written in the meantime are reloaded again next time
+	x.changedMu.Lock()
+	changed := x.changed
+	x.changed = nil
+	x.changedMu.Unlock()
+
+	if x.snapshot == nil || x.snapshot.generation != generation {
+		s, err := buildPoolSnapshot(generation)
+		if err != nil {
+			return nil, err
+		}
+		x.snapshot = s
+		return s, nil
+	}
+
+	if len(changed) > 0 {
+		s, err := x.snapshot.update(changed)
+		if err != nil {
+			// reloaded with the next lookup
+			x.changedMu.Lock()
+			if x.changed == nil {
+				x.changed = make(map[int]bool)
+			}
+			for id := range changed {
+				x.changed[id] = true
+			}
+			x.changedMu.Unlock()
+			return nil, err
+		}
+		x.snapshot = s
+	}
+
+	return x.snapshot, nil
+}
+
+func buildPoolSnapshot(generation uint64) (*poolSnapshot, error) {
+	var items []models.Pool
+	if res := db.DB.Table("pools").Find(&items); res.Error != nil {
+		return nil, res.Error
+	}
+
+	var addresses []models.Address
+	if res := db.DB.Order("id").Find(&addresses); res.Error != nil {
+		return nil, res.Error
+	}
+
+	s := &poolSnapshot{
+		generation:   generation,
+		reservations: make(map[string][]models.Address),
+	}
+
+	byPool := make(map[int][]models.Address)
+	for _, v := range addresses {
+		if v.PoolID.Valid {
+			byPool[int(v.PoolID.Int32)] = append(byPool[int(v.PoolID.Int32)], v)
+		}
+		if v.IsReservation() {
+			s.reservations[v.IP] = append(s.reservations[v.IP], v)
+		}
+		if v.Reimage && !v.PoolID.Valid {
+			s.reimage = append(s.reimage, v)
+		}
+	}
+
+	for _, v := range items {
+		_, ipNet, err := net.ParseCIDR(v.NetAddress + "/" + strconv.Itoa(v.Netmask))
+		if err != nil {
+			continue
+		}
+		s.pools = append(s.pools, indexedPool{pool: v, net: ipNet, addresses: byPool[v.ID]})
+	}
+
+	return s, nil
+}
+
+// update returns a copy of the snapshot with the changed addresses reloaded, the lookups that are using the snapshot
+// keep their version. Addresses that are gone have been deleted.
+func (s *poolSnapshot) update(changed map[int]bool) (*poolSnapshot, error) {
+	ids := make([]int, 0, len(changed))
+	for id := range changed {
+		ids = append(ids, id)
+	}
+
+	var addresses []models.Address
+	if res := db.DB.Where("id IN ?", ids).Find(&addresses); res.Error != nil {
+		return nil, res.Error
+	}
+
+	u := &poolSnapshot{
+		generation:   s.generation,
+		pools:        append([]indexedPool(nil), s.pools...),
+		reservations: make(map[string][]models.Address, len(s.reservations)),
+	}
+
+	for i := range u.pools {
+		u.pools[i].addresses = withoutAddresses(u.pools[i].addresses, changed)
+	}
+	u.reimage = withoutAddresses(s.reimage, changed)
+	for ip, v := range s.reservations {
+		if v = withoutAddresses(v, changed); len(v) > 0 {
+			u.reservations[ip] = v
+		}
+	}
+
+	for _, v := range addresses {
+		if v.PoolID.Valid {
+			for i := range u.pools {
+				if u.pools[i].pool.ID == int(v.PoolID.Int32) {
+					u.pools[i].addresses = withAddress(u.pools[i].addresses, v)
+				}
+			}
+		}
+		if v.IsReservation() {
+			u.reservations[v.IP] = withAddress(u.reservations[v.IP], v)
+		}
+		if v.Reimage && !v.PoolID.Valid {
+			u.reimage = withAddress(u.reimage, v)
+		}
+	}
+
+	return u, nil
+}
+
+// withoutAddresses returns the addresses except for the changed ones, the slice is only copied if one is removed
+func withoutAddresses(addresses []models.Address, changed map[int]bool) []models.Address {
+	for i, v := range addresses {
+		if !changed[v.ID] {
+			continue
+		}
+
+		kept := append([]models.Address(nil), addresses[:i]...)
+		for _, v := range addresses[i+1:] {
+			if !changed[v.ID] {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	}
+	return addresses
+}
+
+// withAddress returns a copy of the addresses with the address added, they are kept in the order of their id like a
+// rebuild would
+func withAddress(addresses []models.Address, address models.Address) []models.Address {
+	i := sort.Search(len(addresses), func(i int) bool {
+		return addresses[i].ID > address.ID
+	})
+
+	result := make([]models.Address, 0, len(addresses)+1)
+	result = append(result, addresses[:i]...)
+	result = append(result, address)
+	return append(result, addresses[i:]...)
+}
+
+// FindPool returns the pool the ip belongs to along with its leases
+func FindPool(ip string) (*models.PoolWithAddresses, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("no matching pool found")
+	}
+
+	s, err := pools.get()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range s.pools {
+		// DHCPv4 and DHCPv6 only serve the pools of their own address family
+		if (parsed.To4() == nil) != v.pool.IsIPv6() {
+			continue
+		}
+
+		if v.net.Contains(parsed) {
+			return s.copyPool(v), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no matching pool found")
+}
+
+// FindPoolByVlan returns the IPv4 pool that is authorized for the vlan along with its leases
+func FindPoolByVlan(vlan int) (*models.PoolWithAddresses, error) {
+	s, err := pools.get()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range s.pools {
+		if vlan != 0 && v.pool.AuthorizedVlan == vlan && !v.pool.IsIPv6() {
+			return s.copyPool(v), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no pool found for vlan %d", vlan)
+}
+
+// FindReimageAddresses returns the addresses flagged for re-imaging that are not assigned to a pool yet
+func FindReimageAddresses() ([]models.Address, error) {
+	s, err := pools.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]models.Address(nil), s.reimage...), nil
+}
+
+// copyPool gives the caller its own copy of the leases, it may add to them
+func (s *poolSnapshot) copyPool(v indexedPool) *models.PoolWithAddresses {
+	pool := models.PoolWithAddresses{
+		Pool:      v.pool,
+		Addresses: append([]models.Address(nil), v.addresses...),
+	}
+	pool.SetReservations(s.reservations)
+	return &pool
+}
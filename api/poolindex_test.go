@@ -0,0 +1,153 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	benchPools  = 40
+	benchLeases = 300
+)
+
+// setupPools fills a database with pools of a /23 that are partly leased, like the racks of a data center
+func setupPools(b testing.TB) []models.Address {
+	b.Helper()
+
+	var err error
+	db.DB, err = gorm.Open(sqlite.Open(filepath.Join(b.TempDir(), "via.db")), &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := db.DB.AutoMigrate(&models.Pool{}, &models.Address{}); err != nil {
+		b.Fatal(err)
+	}
+
+	var addresses []models.Address
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < benchPools; i++ {
+		pool := models.Pool{
+			NetAddress: fmt.Sprintf("10.%d.%d.0", i/64, (i%64)*2),
+			PoolForm: models.PoolForm{
+				Name:         fmt.Sprintf("rack%d", i),
+				StartAddress: fmt.Sprintf("10.%d.%d.10", i/64, (i%64)*2),
+				EndAddress:   fmt.Sprintf("10.%d.%d.250", i/64, (i%64)*2+1),
+				Netmask:      23,
+				Gateway:      fmt.Sprintf("10.%d.%d.1", i/64, (i%64)*2),
+				LeaseTime:    3600,
+			},
+		}
+		if res := db.DB.Create(&pool); res.Error != nil {
+			b.Fatal(res.Error)
+		}
+
+		for j := 0; j < benchLeases; j++ {
+			item := models.Address{Expires: expires}
+			item.IP = fmt.Sprintf("10.%d.%d.%d", i/64, (i%64)*2+j/200, 10+j%200)
+			item.Mac = fmt.Sprintf("02:00:00:%02x:%02x:%02x", i, j>>8, j&0xff)
+			item.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}}
+			// every tenth address is a host that is provisioned
+			item.Reserved = j%10 == 0
+			addresses = append(addresses, item)
+		}
+	}
+	if res := db.DB.CreateInBatches(&addresses, 500); res.Error != nil {
+		b.Fatal(res.Error)
+	}
+
+	pools = poolIndex{}
+	if err := WatchPools(db.DB); err != nil {
+		b.Fatal(err)
+	}
+	return addresses
+}
+
+func TestPoolIndexReloadsWrittenAddresses(t *testing.T) {
+	addresses := setupPools(t)
+	if _, err := FindPool("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	lease := addresses[1]
+	if res := db.DB.Model(&lease).Update("hostname", "esx01"); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	reserved := addresses[10]
+	if res := db.DB.Delete(&reserved); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	created := models.Address{Expires: time.Now().Add(time.Hour)}
+	created.IP, created.Mac = "10.0.1.240", "02:00:00:ff:00:01"
+	created.PoolID = lease.PoolID
+	if res := db.DB.Create(&created); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.2.1"} {
+		got, err := FindPool(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		InvalidatePools()
+		want, err := FindPool(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got.Addresses) != len(want.Addresses) {
+			t.Fatalf("%s: %d addresses after the reload, %d after a rebuild", ip, len(got.Addresses), len(want.Addresses))
+		}
+		for i := range want.Addresses {
+			if got.Addresses[i].ID != want.Addresses[i].ID || got.Addresses[i].Hostname != want.Addresses[i].Hostname {
+				t.Fatalf("%s: address %d is %+v after the reload, %+v after a rebuild", ip, i, got.Addresses[i], want.Addresses[i])
+			}
+		}
+		if err := got.IsAvailable(net.ParseIP(reserved.IP)); ip == "10.0.0.1" && err != nil {
+			t.Errorf("the deleted reservation %s is still taken: %s", reserved.IP, err)
+		}
+	}
+}
+
+func BenchmarkFindPool(b *testing.B) {
+	setupPools(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FindPool(fmt.Sprintf("10.0.%d.1", (i%benchPools)*2)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFindPoolAfterLeaseWrite is the lookup of a DHCPREQUEST, the lease of the previous request has been written
+func BenchmarkFindPoolAfterLeaseWrite(b *testing.B) {
+	addresses := setupPools(b)
+	if _, err := FindPool("10.0.0.1"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lease := addresses[i%len(addresses)]
+		if res := db.DB.Model(&lease).Updates(map[string]interface{}{"last_seen": time.Now()}); res.Error != nil {
+			b.Fatal(res.Error)
+		}
+		if _, err := FindPool(lease.IP); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,13 +3,15 @@ package api
 import (
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/imdario/mergo"
+	"github.com/tribock/go-via/config"
 	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/failover"
+	"github.com/tribock/go-via/ipam"
 	"github.com/tribock/go-via/models"
 	"gorm.io/gorm"
 )
@@ -142,6 +144,8 @@ func CreatePool(c *gin.Context) {
 			spew.Dump(opt.ID)
 		}
 	*/
+	Audit(c, models.AuditCreate, "pool", item.ID, nil, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -174,7 +178,7 @@ func GetNextFreeIP(c *gin.Context) {
 		return
 	}
 
-	ip, err := item.Next()
+	ip, err := failover.Next(&item)
 	if err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
 		return
@@ -267,12 +271,20 @@ func UpdatePool(c *gin.Context) {
 		return
 	}
 
+	before := item
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.Pool{PoolForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
 	}
 
 	item.OnlyServeReimage = form.OnlyServeReimage
+	item.OnlyServeReserved = form.OnlyServeReserved
+	item.Exclusions = form.Exclusions
+	item.MacAllow = form.MacAllow
+	item.MacDeny = form.MacDeny
+	item.AuthorizedVlan = form.AuthorizedVlan
+	item.ManagedRef = form.ManagedRef
 
 	// Save it
 	if res := db.DB.Save(&item); res.Error != nil {
@@ -280,9 +292,68 @@ func UpdatePool(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditUpdate, "pool", item.ID, before, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
+// SyncPool Update a pool from the IPAM object it is linked to
+// @Summary Update a pool from the IPAM object it is linked to
+// @Tags pools
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Pool ID"
+// @Success 200 {object} models.Pool
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 502 {object} models.APIError
+// @Router /pools/{id}/sync [post]
+func SyncPool(conf *config.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		client, err := ipam.New(conf.IPAM)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Pool
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		if item.ManagedRef == "" {
+			Error(c, http.StatusBadRequest, fmt.Errorf("the pool is not linked to the ipam")) // 400
+			return
+		}
+
+		before := item
+
+		changed, err := client.Sync(&item)
+		if err != nil {
+			Error(c, http.StatusBadGateway, err) // 502
+			return
+		}
+
+		if changed {
+			Audit(c, models.AuditUpdate, "pool", item.ID, before, item)
+		}
+
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
 // DeletePool Remove an existing pool
 // @Summary Remove an existing pool
 // @Tags pools
@@ -324,41 +395,9 @@ func DeletePool(c *gin.Context) {
 			return
 		}
 
-		c.JSON(http.StatusNoContent, gin.H{}) //204
-	}
-
-}
-
-func FindPool(ip string) (*models.PoolWithAddresses, error) {
-	var pools []models.Pool
-	if res := db.DB.Table("pools").Find(&pools); res.Error != nil {
-		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, fmt.Errorf("no matching pool found")
-		}
-		return nil, res.Error
-	}
-	var pool models.PoolWithAddresses
-	for _, v := range pools {
-		_, ipv4Net, err := net.ParseCIDR(ip + "/" + strconv.Itoa(v.Netmask))
-		if err != nil {
-			continue
-		}
-
-		if ipv4Net.IP.String() == v.NetAddress {
-			pool.Pool = v
-			break
-		}
-	}
+		Audit(c, models.AuditDelete, "pool", item.ID, item, nil)
 
-	if pool.ID == 0 {
-		return nil, fmt.Errorf("no matching pool found")
+		c.JSON(http.StatusNoContent, gin.H{}) //204
 	}
 
-	if res := db.DB.Table("pools").Preload("Addresses").First(&pool, pool.ID); res.Error != nil {
-		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, fmt.Errorf("no matching pool found")
-		}
-		return nil, res.Error
-	}
-	return &pool, nil
 }
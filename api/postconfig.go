@@ -5,11 +5,14 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -25,10 +28,11 @@ import (
 	"github.com/vmware/govmomi/govc/host/esxcli"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/types"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
-func PostConfig(key string) func(c *gin.Context) {
+func PostConfig(keys *secrets.Keyring) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		var item models.Address
 		host, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
@@ -38,15 +42,24 @@ func PostConfig(key string) func(c *gin.Context) {
 			return
 		}
 
+		AuditEvent(models.AuditLog{
+			Actor:      "host",
+			SourceIP:   host,
+			Action:     models.AuditPostConfig,
+			TargetType: "address",
+			TargetID:   item.ID,
+			Message:    "postconfig requested by the installed host",
+		})
+
 		c.JSON(http.StatusOK, item) // 200
 
 		logrus.Info("ks config done!")
 
-		go ProvisioningWorker(item, key)
+		go ProvisioningWorker(item, keys)
 	}
 }
 
-func PostConfigID(key string) func(c *gin.Context) {
+func PostConfigID(keys *secrets.Keyring) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		var item models.Address
 
@@ -61,15 +74,17 @@ func PostConfigID(key string) func(c *gin.Context) {
 			return
 		}
 
+		Audit(c, models.AuditPostConfig, "address", item.ID, nil, nil)
+
 		c.JSON(http.StatusOK, item) // 200
 
 		logrus.Info("Manual PostConfig of host" + item.Hostname + "started!")
 
-		go ProvisioningWorker(item, key)
+		go ProvisioningWorker(item, keys)
 	}
 }
 
-func ProvisioningWorker(item models.Address, key string) {
+func ProvisioningWorker(item models.Address, keys *secrets.Keyring) {
 
 	//create empty model and load it with the json content from database
 	options := models.GroupOptions{}
@@ -79,12 +94,19 @@ func ProvisioningWorker(item models.Address, key string) {
 	}).Debug("host")
 
 	// decrypt login password
-	decryptedPassword := secrets.Decrypt(item.Group.Password, key)
+	decryptedPassword, err := rootPassword(keys, item)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"IP":  item.IP,
+			"err": err,
+		}).Error("postconfig failed to decrypt the root password")
+		return
+	}
 
 	// connection info
 	url := &url.URL{
 		Scheme: "https",
-		Host:   item.IP,
+		Host:   item.URLHost(),
 		Path:   "sdk",
 		User:   url.UserPassword("root", decryptedPassword),
 	}
@@ -100,7 +122,6 @@ func ProvisioningWorker(item models.Address, key string) {
 
 	// ensure that host has enough time to boot, and for SOAP API to respond
 	var c *govmomi.Client
-	var err error
 	ctx := context.Background()
 	i := 1
 	timeout := 360
@@ -528,32 +549,68 @@ func PostConfigVlan(e *esxcli.Executor, item models.Address) error {
 	return nil
 }
 
-func PostConfigCertificate(e *esxcli.Executor, item models.Address, decryptedPassword string, ctx context.Context, timeout int, i int, c *govmomi.Client, url *url.URL) error {
+// hostCertificate returns the certificate to push to the host. A valid certificate that an external CA has signed for
+// the host is preferred, otherwise a new one is issued by the internal CA.
+func hostCertificate(item models.Address) (models.Certificate, error) {
+	var cert models.Certificate
+	res := db.DB.Where("address_id = ? AND external = ? AND revoked_at IS NULL AND not_after > ?", item.ID, true, time.Now()).Order("id desc").First(&cert)
+	if res.Error == nil {
+		logrus.WithFields(logrus.Fields{
+			"IP":     item.IP,
+			"serial": cert.Serial,
+			"issuer": cert.Issuer,
+		}).Debug("postconfig: using externally signed certificate")
+		return cert, nil
+	}
+	if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return cert, res.Error
+	}
+
 	//create directory
-	os.MkdirAll("./cert/"+item.Hostname+"."+item.Domain, os.ModePerm)
-	//create certificate
-	ca.CreateCert("./cert/"+item.Hostname+"."+item.Domain, "rui", item.Hostname+"."+item.Domain)
+	path := "./cert/" + item.Hostname + "." + item.Domain
+	os.MkdirAll(path, os.ModePerm)
+	//create certificate, valid for the fqdn, the short hostname and the ip
+	cert, err := ca.CreateCert(path, "rui", ca.Request{
+		CommonName:  item.Hostname + "." + item.Domain,
+		DNSNames:    []string{item.Hostname},
+		IPAddresses: ca.ParseIPs(item.IP),
+		AddressID:   item.ID,
+	})
+	if err != nil {
+		return cert, err
+	}
+	// the certificates the host has been given on earlier installs are replaced
+	if err := ca.Supersede(item.ID, cert.ID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"IP":  item.IP,
+			"err": err,
+		}).Warn("postconfig")
+	}
+	return cert, nil
+}
+
+func PostConfigCertificate(e *esxcli.Executor, item models.Address, decryptedPassword string, ctx context.Context, timeout int, i int, c *govmomi.Client, url *url.URL) error {
+	cert, err := hostCertificate(item)
+	if err != nil {
+		return err
+	}
 
 	//post to esxi host https://docs.vmware.com/en/VMware-vSphere/7.0/com.vmware.vsphere.security.doc/GUID-43B7B817-C58F-4C6F-AF3D-9F1D52B116A0.html
-	crt, err := os.Open("./cert/" + item.Hostname + "." + item.Domain + "/rui.crt")
+	crt, err := os.Open(filepath.Join(cert.Path, cert.Name+".crt"))
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"postconfig": "couldn't find the .crt file",
-		}).Debug(item.IP)
+		return fmt.Errorf("couldn't open the .crt file: %w", err)
 	}
 	defer crt.Close()
 
-	key, err := os.Open("./cert/" + item.Hostname + "." + item.Domain + "/rui.key")
+	key, err := os.Open(filepath.Join(cert.Path, cert.Name+".key"))
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"postconfig": "couldn't find the .key file",
-		}).Debug(item.IP)
+		return fmt.Errorf("couldn't open the .key file: %w", err)
 	}
 	defer key.Close()
 
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	putRequest("https://"+item.IP+"/host/ssl_cert", crt, "root", decryptedPassword)
-	putRequest("https://"+item.IP+"/host/ssl_key", key, "root", decryptedPassword)
+	putRequest("https://"+item.URLHost()+"/host/ssl_cert", crt, "root", decryptedPassword)
+	putRequest("https://"+item.URLHost()+"/host/ssl_key", key, "root", decryptedPassword)
 
 	// set the host into maintenanace mode
 	cmd := strings.Fields("system maintenanceMode set -e true")
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"github.com/tribock/go-via/secrets"
+	"gorm.io/gorm"
+)
+
+// RotateSecrets Rotate the data key used to encrypt stored secrets
+// @Summary Generate a new data key and re-encrypt all stored secrets with it
+// @Tags secrets
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.SecretRotation
+// @Failure 500 {object} models.APIError
+// @Router /secrets/rotate [post]
+func RotateSecrets(keys *secrets.Keyring) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		before := keys.Version()
+
+		item, err := ReencryptSecrets(keys)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		Audit(c, models.AuditRotate, "secret", item.Version, gin.H{"version": before}, gin.H{"version": item.Version})
+
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// ReencryptSecrets rotates the data key and re-encrypts every stored secret in a single transaction
+func ReencryptSecrets(keys *secrets.Keyring) (models.SecretRotation, error) {
+	var count int
+	version, err := keys.Rotate(db.DB, func(tx *gorm.DB, rewrap func(string) (string, error)) error {
+		var err error
+		count, err = rewrapSecrets(tx, rewrap)
+		return err
+	})
+	if err != nil {
+		return models.SecretRotation{}, err
+	}
+	// the pool index holds the root passwords of the hosts
+	InvalidatePools()
+
+	return models.SecretRotation{Version: version, Reencrypted: count}, nil
+}
+
+// RotateSecretKey rewraps the data keys with a new master key, an empty master generates one. Secrets that are still
+// encrypted with the old master key are moved to the current data key within the same transaction.
+func RotateSecretKey(keys *secrets.Keyring, master string) (models.SecretRotation, error) {
+	var count int
+	err := keys.RotateMaster(db.DB, master, func(tx *gorm.DB, rewrap func(string) (string, error)) error {
+		var err error
+		count, err = rewrapSecrets(tx, rewrap)
+		return err
+	})
+	if err != nil {
+		return models.SecretRotation{}, err
+	}
+	InvalidatePools()
+
+	return models.SecretRotation{Version: keys.Version(), Reencrypted: count}, nil
+}
+
+// rewrapSecrets passes every stored secret through rewrap and returns how many of them have changed
+func rewrapSecrets(tx *gorm.DB, rewrap func(string) (string, error)) (int, error) {
+	var count int
+
+	var groups []models.Group
+	if res := tx.Find(&groups); res.Error != nil {
+		return count, res.Error
+	}
+
+	for _, v := range groups {
+		password, err := rewrap(v.Password)
+		if err != nil {
+			return count, fmt.Errorf("group %d: %w", v.ID, err)
+		}
+		if password == v.Password {
+			continue
+		}
+		if res := tx.Model(&v).UpdateColumn("password", password); res.Error != nil {
+			return count, res.Error
+		}
+		count++
+	}
+
+	var addresses []models.Address
+	if res := tx.Where("root_password IS NOT NULL AND root_password <> ''").Find(&addresses); res.Error != nil {
+		return count, res.Error
+	}
+
+	for _, v := range addresses {
+		password, err := rewrap(v.RootPassword)
+		if err != nil {
+			return count, fmt.Errorf("address %d: %w", v.ID, err)
+		}
+		if password == v.RootPassword {
+			continue
+		}
+		if res := tx.Model(&v).UpdateColumn("root_password", password); res.Error != nil {
+			return count, res.Error
+		}
+		count++
+	}
+
+	return count, nil
+}
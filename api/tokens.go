@@ -0,0 +1,223 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// apiTokenPrefix is used to tell api tokens apart from interactive session tokens
+const apiTokenPrefix = "via_"
+
+// defaultAPITokenLifetime is used when no expiry date has been supplied
+const defaultAPITokenLifetime = 90 * 24 * time.Hour
+
+// ListAPITokens Get a list of the api tokens owned by the current user
+// @Summary Get all api tokens of the current user
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.APIToken
+// @Failure 500 {object} models.APIError
+// @Router /tokens [get]
+func ListAPITokens(c *gin.Context) {
+	user := CurrentUser(c)
+
+	query := db.DB
+	// administrators are able to see the tokens of all users to be able to revoke them
+	if !user.Can(models.PermissionUsers) {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	var items []models.APIToken
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// CreateAPIToken Create a new api token for the current user
+// @Summary Create a new api token for the current user
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Param item body models.APITokenForm true "Add an api token"
+// @Success 200 {object} models.NewAPIToken
+// @Failure 400 {object} models.APIError
+// @Failure 403 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /tokens [post]
+func CreateAPIToken(c *gin.Context) {
+	user := CurrentUser(c)
+
+	// tokens should only be handed out to someone who knows the password
+	if user.Scopes != nil {
+		Error(c, http.StatusForbidden, fmt.Errorf("api tokens can not be used to create api tokens")) // 403
+		return
+	}
+
+	var form models.APITokenForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// the token can never grant more than the owner is allowed to do
+	scopes := parseScopes(form.Scopes)
+	for _, v := range scopes {
+		if !models.ValidPermission(v) {
+			Error(c, http.StatusBadRequest, fmt.Errorf("unknown scope %q", v)) // 400
+			return
+		}
+		if !user.Can(v) {
+			Error(c, http.StatusForbidden, fmt.Errorf("you are not allowed to grant the %s scope", v)) // 403
+			return
+		}
+	}
+	if len(scopes) == 0 {
+		Error(c, http.StatusBadRequest, fmt.Errorf("at least one scope is required")) // 400
+		return
+	}
+
+	if form.ExpiresAt == nil {
+		expires := time.Now().Add(defaultAPITokenLifetime)
+		form.ExpiresAt = &expires
+	}
+	if form.ExpiresAt.Before(time.Now()) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("the expiry date is in the past")) // 400
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+	token := apiTokenPrefix + hex.EncodeToString(b)
+
+	form.Scopes = joinScopes(scopes)
+	item := models.APIToken{
+		UserID:       user.ID,
+		Prefix:       token[:len(apiTokenPrefix)+6],
+		TokenHash:    hashToken(token),
+		APITokenForm: form,
+	}
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"username": user.Username,
+		"name":     item.Name,
+		"scopes":   item.Scopes,
+	}).Info("auth: api token created")
+
+	Audit(c, models.AuditCreate, "api_token", item.ID, nil, item)
+
+	c.JSON(http.StatusOK, models.NewAPIToken{APIToken: item, Token: token}) // 200
+}
+
+// DeleteAPIToken Revoke an existing api token
+// @Summary Revoke an existing api token
+// @Tags tokens
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Token ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /tokens/{id} [delete]
+func DeleteAPIToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	user := CurrentUser(c)
+
+	// Load the item
+	var item models.APIToken
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// only the owner and administrators can revoke the token
+	if item.UserID != user.ID && !user.Can(models.PermissionUsers) {
+		Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"username": user.Username,
+		"name":     item.Name,
+	}).Info("auth: api token revoked")
+
+	Audit(c, models.AuditDelete, "api_token", item.ID, item, nil)
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+func apiTokenUser(token string) (*models.User, int, error) {
+	var item models.APIToken
+	if res := db.DB.Preload("User").Where("token_hash = ?", hashToken(token)).First(&item); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid authentication token") // 401
+		}
+		return nil, http.StatusInternalServerError, res.Error // 500
+	}
+
+	if item.User == nil || (item.ExpiresAt != nil && item.ExpiresAt.Before(time.Now())) {
+		return nil, http.StatusUnauthorized, fmt.Errorf("api token expired") // 401
+	}
+
+	db.DB.Model(&item).UpdateColumn("last_used", time.Now())
+
+	user := item.User
+	user.Scopes = parseScopes(item.Scopes)
+
+	return user, http.StatusOK, nil
+}
+
+func parseScopes(s string) []models.Permission {
+	scopes := []models.Permission{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			scopes = append(scopes, models.Permission(v))
+		}
+	}
+	return scopes
+}
+
+func joinScopes(scopes []models.Permission) string {
+	s := make([]string, len(scopes))
+	for i, v := range scopes {
+		s[i] = string(v)
+	}
+	return strings.Join(s, ",")
+}
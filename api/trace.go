@@ -0,0 +1,61 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tribock/go-via/trace"
+)
+
+// ListTrace Get the last dhcp transactions
+// @Summary Get the last dhcp transactions with the decision that was made about them
+// @Tags dhcp
+// @Accept  json
+// @Produce  json
+// @Param  mac query string false "Only transactions of this mac address or mac address prefix"
+// @Param  limit query int false "Only the last n transactions"
+// @Success 200 {array} models.DHCPTransaction
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Router /dhcp/trace [get]
+func ListTrace(c *gin.Context) {
+	var limit int
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+	}
+
+	items, err := trace.List(c.Query("mac"), limit)
+	if err != nil {
+		Error(c, http.StatusNotFound, err) // 404
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// ExportTrace Download the raw frames of the last dhcp transactions
+// @Summary Download the raw frames of the last dhcp transactions as pcap
+// @Tags dhcp
+// @Produce  application/vnd.tcpdump.pcap
+// @Param  mac query string false "Only transactions of this mac address or mac address prefix"
+// @Success 200 {file} file
+// @Failure 404 {object} models.APIError
+// @Router /dhcp/trace/pcap [get]
+func ExportTrace(c *gin.Context) {
+	if !trace.PcapEnabled() {
+		Error(c, http.StatusNotFound, fmt.Errorf("the pcap export is disabled")) // 404
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=dhcp-"+time.Now().Format("20060102-150405")+".pcap")
+	c.Header("Content-Type", "application/vnd.tcpdump.pcap")
+	c.Status(http.StatusOK)
+	trace.WritePcap(c.Writer, c.Query("mac"))
+}
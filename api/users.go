@@ -121,7 +121,16 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
-	item := models.User{UserForm: form}
+	item := models.User{UserForm: form, Source: sourceLocal}
+
+	// new users are read-only unless a role has been specified
+	if item.Role == "" {
+		item.Role = models.RoleReadOnly
+	}
+	if !models.ValidRole(item.Role) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("unknown role %q", item.Role)) // 400
+		return
+	}
 
 	// hash and salt the plaintext password
 	hp := HashAndSalt([]byte(item.Password))
@@ -131,6 +140,8 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditCreate, "user", item.ID, nil, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -171,14 +182,29 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
+	if form.Role != "" && !models.ValidRole(form.Role) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("unknown role %q", form.Role)) // 400
+		return
+	}
+
+	// dont let administrators lock themselves out
+	if user := CurrentUser(c); user != nil && user.ID == item.ID && form.Role != "" && form.Role != item.Role {
+		Error(c, http.StatusConflict, fmt.Errorf("you can not change your own role")) // 409
+		return
+	}
+
+	before := item
+
 	// Merge the item and the form data
 	if err := mergo.Merge(&item, models.User{UserForm: form}, mergo.WithOverride); err != nil {
 		Error(c, http.StatusInternalServerError, err) // 500
 	}
 
-	// hash and salt the plaintext password
-	hp := HashAndSalt([]byte(item.Password))
-	item.Password = hp
+	// hash and salt the plaintext password, only if a new one has been supplied to avoid re-hashing the hash
+	if form.Password != "" {
+		hp := HashAndSalt([]byte(item.Password))
+		item.Password = hp
+	}
 
 	// Save it
 	if res := db.DB.Save(&item); res.Error != nil {
@@ -186,6 +212,8 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
+	Audit(c, models.AuditUpdate, "user", item.ID, before, item)
+
 	c.JSON(http.StatusOK, item) // 200
 }
 
@@ -217,15 +245,50 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
+	// dont let administrators lock themselves out
+	if user := CurrentUser(c); user != nil && user.ID == item.ID {
+		Error(c, http.StatusConflict, fmt.Errorf("you can not delete your own user")) // 409
+		return
+	}
+
 	// Save it
 	if res := db.DB.Delete(&item); res.Error != nil {
 		Error(c, http.StatusInternalServerError, res.Error) // 500
 		return
 	}
 
+	// revoke everything the user was able to authenticate with
+	db.DB.Where("user_id = ?", item.ID).Delete(&models.Session{})
+	db.DB.Where("user_id = ?", item.ID).Delete(&models.APIToken{})
+
+	Audit(c, models.AuditDelete, "user", item.ID, item, nil)
+
 	c.JSON(http.StatusNoContent, gin.H{}) //204
 }
 
+// GetCurrentUser Get the authenticated user and its effective permissions
+// @Summary Get the authenticated user and its effective permissions
+// @Tags users
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.UserPermissions
+// @Failure 401 {object} models.APIError
+// @Router /me [get]
+func GetCurrentUser(c *gin.Context) {
+	user := CurrentUser(c)
+	if user == nil {
+		Error(c, http.StatusUnauthorized, fmt.Errorf("not authenticated")) // 401
+		return
+	}
+
+	c.JSON(http.StatusOK, models.UserPermissions{
+		ID:          user.ID,
+		Username:    user.Username,
+		Role:        user.Role,
+		Permissions: user.Permissions(),
+	}) // 200
+}
+
 // functions to hash and compare passwords
 
 func HashAndSalt(pwd []byte) string {
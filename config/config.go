@@ -6,8 +6,148 @@ type Config struct {
 	File        string
 	Network     Network
 	DisableDhcp bool `default:"true"`
+	// TFTPPort is the port of the tftp server, it only has to be changed to run a failover pair on a single host
+	TFTPPort int `default:"69"`
+	// ImagePort serves the images read-only over plain http and points boot.cfg at it, so that mboot.efi downloads the
+	// modules over http instead of tftp. 0 disables it.
+	ImagePort int
+	// ProxyDhcp answers PXE clients that are flagged for re-imaging with the boot server and file while another dhcp
+	// server hands out the addresses, it only has an effect as long as the dhcp server is disabled
+	ProxyDhcp bool
+	// SessionTimeout is the lifetime of a login session in minutes
+	SessionTimeout int `default:"480"`
+	// KsTokenTimeout is how long in minutes a host may take from loading boot.cfg to requesting its ks.cfg
+	KsTokenTimeout int `default:"60"`
+	// SecretKey is the hex encoded master key, preferably set through the CONFIG_SECRETKEY environment variable.
+	// SecretKeyFile reads it from a file instead, eg. a mounted secret. If neither is set secret/secret.key is used.
+	SecretKey     string
+	SecretKeyFile string
+	// RotateSecrets re-encrypts all stored secrets with a new data key and exits. The server keeps the keys in memory,
+	// so it has to be stopped first, the command refuses to run next to it. A running server rotates the data key
+	// through POST /v1/secrets/rotate instead.
+	RotateSecrets bool
+	// RotateSecretKey rewraps the data keys with a new master key and exits, the server has to be stopped first as
+	// well. The new key is taken from NewSecretKey, the master key has to be replaced with it before the next start.
+	// Without it a new key is generated and written to the key file, a master key from the configuration can not be
+	// replaced that way.
+	RotateSecretKey bool
+	NewSecretKey    string
+	// LeaseSweepInterval is how often in minutes expired dynamic leases and decline blocks are cleaned up, 0 disables it
+	LeaseSweepInterval int `default:"15"`
+	// LeaseRetention is how long in hours an expired lease is kept before it is swept
+	LeaseRetention int `default:"168"`
+	// LeaseArchive moves swept leases to the lease archive instead of deleting them
+	LeaseArchive bool
+	// RateLimit drops the dhcp requests of clients and relays that send too many of them, eg. during a broadcast storm
+	RateLimit RateLimit
+	// Trace keeps the last dhcp transactions in memory for the trace endpoint, 0 disables it
+	Trace int `default:"1000"`
+	// TracePcap also keeps the raw frames of the traced transactions for the pcap export
+	TracePcap bool
+	// ConflictProbe is how long in milliseconds to wait for an answer to the ARP or ICMP probe that is sent before a
+	// dynamic address is offered, 0 disables the probe. The DHCPDISCOVER that starts the probe is not answered, the
+	// client gets the offer when it retransmits. An address that has not been in use is offered without another probe
+	// for a minute.
+	ConflictProbe int `default:"500"`
+	LDAP          LDAP
+	CA            CA
+	IPAM          IPAM
+	Failover      Failover
 }
 
 type Network struct {
+	// Interfaces to serve dhcp on, vlan sub-interfaces (eg. eth0.100) serve the pools authorized for their vlan
 	Interfaces []string
+	// Trunk also answers 802.1Q tagged requests on the interfaces, the pool is the one authorized for the vlan of the
+	// request and the answer is tagged the same way. The tag is taken from the auxiliary data of the frame, so rx-vlan
+	// offload may be enabled. The server has no address on the tagged vlans, its interface address is the server
+	// identifier and next server of the answers and has to be reachable from the vlans through their gateway. Use
+	// vlan sub-interfaces instead if the server should be part of the vlans.
+	Trunk bool
+}
+
+// RateLimit configures a token bucket per client mac address and per relay, DHCPv6 clients whose mac address is
+// unknown are limited by their DUID
+type RateLimit struct {
+	// Mac is the number of requests per second a client may send on average, MacBurst the number it may send at once.
+	// 0 disables the limit.
+	Mac      float64 `default:"1"`
+	MacBurst int     `default:"10"`
+	// Relay is the number of requests per second that may arrive through a relay on average, 0 disables the limit
+	Relay      float64 `default:"100"`
+	RelayBurst int     `default:"500"`
+}
+
+// LDAP configures the directory login backend, it is disabled as long as no URL has been set
+type LDAP struct {
+	// URL of the directory, ldap://host:389 or ldaps://host:636
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	// BindDN and BindPassword of the service account used to look up users
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter is used to find the user, {username} is replaced with the escaped login name
+	UserFilter     string `default:"(&(objectClass=user)(sAMAccountName={username}))"`
+	GroupAttribute string `default:"memberOf"`
+	EmailAttribute string `default:"mail"`
+	// group DNs mapped to roles, the most privileged match wins
+	AdminGroups    []string
+	OperatorGroups []string
+	ReadOnlyGroups []string
+	// DefaultRole is given to directory users that are not in any mapped group, empty denies the login
+	DefaultRole string
+	// Timeout in seconds for connecting and every request
+	Timeout int `default:"10"`
+}
+
+// CA configures the internal certificate authority that issues the appliance and host certificates
+type CA struct {
+	Organization string `default:"go-via"`
+	Country      string `default:"US"`
+	// KeyType of new keys, rsa or ecdsa
+	KeyType string `default:"rsa"`
+	// KeySize in bits, 2048, 3072 or 4096 for rsa and 256 or 384 for ecdsa
+	KeySize int `default:"2048"`
+	// Validity of issued certificates in days, and of the CA itself
+	Validity   int `default:"825"`
+	CAValidity int `default:"3650"`
+	// CRLValidity is the number of hours a published CRL is valid
+	CRLValidity int `default:"24"`
+	// CRLURL is embedded as CRL distribution point in issued certificates, eg. https://via.example.com:8443/ca.crl
+	CRLURL string
+}
+
+// IPAM keeps the pools that have a managed reference in sync with NetBox, it is disabled as long as no URL has been set
+type IPAM struct {
+	// URL of NetBox, eg. https://netbox.example.com
+	URL string
+	// Token of an API user that may read the ip ranges and prefixes
+	Token              string
+	InsecureSkipVerify bool
+	// Interval in minutes between syncs
+	Interval int `default:"15"`
+	// Timeout in seconds for every request
+	Timeout int `default:"10"`
+}
+
+// Failover pairs two instances that serve the same pools, it is disabled as long as no peer has been set. The leases
+// and reservations are replicated, the unique root passwords of the hosts are not. The password of a host is revealed
+// by the instance that served its kickstart file, the other one still has the previous password.
+type Failover struct {
+	// Peer is the https url of the api of the partner, eg. https://via-2.example.com:8443
+	Peer string
+	// Role of this instance, primary or secondary
+	Role string `default:"primary"`
+	// Secret is shared by both instances to authenticate each other
+	Secret             string
+	InsecureSkipVerify bool
+	// Split is the percentage of the dynamic range of every pool that is handed out by the primary, the secondary
+	// hands out the rest
+	Split int `default:"50"`
+	// Heartbeat is the interval in seconds between heartbeats
+	Heartbeat int `default:"2"`
+	// PeerTimeout is how long in seconds the partner may be silent before this instance serves the whole range
+	PeerTimeout int `default:"10"`
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+)
+
+const (
+	// maxConflictProbes limits how many addresses that have been found in use are skipped for a single DHCPDISCOVER
+	maxConflictProbes = 4
+
+	// probeCacheTTL is how long an address that has not been in use is offered without probing it again, the
+	// DHCPDISCOVERs that clients retransmit and the ones of other clients that get the same offer dont wait for the
+	// probe. Addresses that are in use are blocked instead.
+	probeCacheTTL = time.Minute
+
+	// maxProbeCache is the number of free addresses that are remembered before the expired ones are forgotten
+	maxProbeCache = 1024
+)
+
+// errProbing is returned while the address is probed, the DHCPDISCOVER is not answered and the client gets the offer
+// when it retransmits the DHCPDISCOVER
+var errProbing = errors.New("probing the address for a conflict, it is offered on retransmit")
+
+// conflictProber makes sure that an address is not in use by a statically configured device before it is offered.
+// Addresses on the network of the serving interface are probed with ARP (RFC 5227), the ones of relayed pools with an
+// ICMP echo request. The probes are sent in the background, the dhcp server keeps answering other clients while it
+// waits. The ARP probes are sent on the raw socket of the dhcp server, serveConn hands the ARP frames it receives over
+// to the prober. A nil prober never finds a conflict.
+type conflictProber struct {
+	ifi     *net.Interface
+	ip      net.IP
+	ipNet   *net.IPNet
+	conn    net.PacketConn
+	timeout time.Duration
+	seq     atomic.Uint32
+
+	mu sync.Mutex
+	// free are the addresses that have not been in use when they were probed last
+	free map[string]time.Time
+	// pending are the addresses that are probed right now
+	pending map[string]*pendingProbe
+	// conflicts are the addresses that have been found in use, they are blocked when the client retransmits
+	conflicts map[string]foundConflict
+	// icmp is opened with the first ICMP probe
+	icmp net.PacketConn
+}
+
+type pendingProbe struct {
+	// client is the hardware address of the client the address is probed for, its own answers are ignored
+	client net.HardwareAddr
+	// seq is the sequence number of the ICMP echo request
+	seq uint16
+}
+
+type foundConflict struct {
+	mac   net.HardwareAddr
+	found time.Time
+}
+
+func newConflictProber(conf *config.Config, ifi *net.Interface, ip net.IP, ipNet *net.IPNet, c net.PacketConn) *conflictProber {
+	if conf.ConflictProbe <= 0 {
+		return nil
+	}
+
+	return &conflictProber{
+		ifi:       ifi,
+		ip:        ip,
+		ipNet:     ipNet,
+		conn:      c,
+		timeout:   time.Duration(conf.ConflictProbe) * time.Millisecond,
+		free:      make(map[string]time.Time),
+		pending:   make(map[string]*pendingProbe),
+		conflicts: make(map[string]foundConflict),
+	}
+}
+
+// Probe returns true if another device answered for ip. mac is the hardware address of the device, it is only known
+// for ARP probes. Answers of the client itself are ignored. errProbing is returned until the probe of an address that
+// has not been probed recently times out or is answered.
+func (p *conflictProber) Probe(ip net.IP, client net.HardwareAddr) (conflict bool, mac net.HardwareAddr, err error) {
+	if p == nil {
+		return false, nil, nil
+	}
+
+	key := ip.String()
+	pending := &pendingProbe{client: client, seq: uint16(p.seq.Add(1))}
+
+	p.mu.Lock()
+	if found, ok := p.conflicts[key]; ok {
+		delete(p.conflicts, key)
+		p.mu.Unlock()
+		return true, found.mac, nil
+	}
+	if probed, ok := p.free[key]; ok && time.Since(probed) < probeCacheTTL {
+		p.mu.Unlock()
+		return false, nil, nil
+	}
+	if _, ok := p.pending[key]; ok {
+		p.mu.Unlock()
+		return false, nil, errProbing
+	}
+	p.pending[key] = pending
+	p.mu.Unlock()
+
+	if p.ipNet != nil && p.ipNet.Contains(ip) {
+		err = p.sendARP(ip)
+	} else {
+		err = p.sendICMP(ip, pending.seq)
+	}
+	if err != nil {
+		// An address we cant probe is offered anyway, the client declines it if it detects a conflict itself
+		logrus.WithFields(logrus.Fields{
+			"ip":  ip,
+			"err": err,
+		}).Warn("dhcp: failed to probe address")
+
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+		return false, nil, nil
+	}
+
+	time.AfterFunc(p.timeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.pending[key] != pending {
+			return
+		}
+		delete(p.pending, key)
+		p.rememberFree(key)
+	})
+
+	return false, nil, errProbing
+}
+
+// rememberFree caches an address that has not been in use, p.mu is held
+func (p *conflictProber) rememberFree(key string) {
+	now := time.Now()
+	if len(p.free) >= maxProbeCache {
+		for k, v := range p.free {
+			if now.Sub(v) >= probeCacheTTL {
+				delete(p.free, k)
+			}
+		}
+	}
+	p.free[key] = now
+}
+
+// answered records the conflict if ip is probed and mac is not the one of the client or our own. match checks that
+// the answer belongs to the probe.
+func (p *conflictProber) answered(ip net.IP, mac net.HardwareAddr, match func(*pendingProbe) bool) {
+	key := ip.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending, ok := p.pending[key]
+	if !ok || !match(pending) || (mac != nil && (bytes.Equal(mac, pending.client) || bytes.Equal(mac, p.ifi.HardwareAddr))) {
+		return
+	}
+	delete(p.pending, key)
+
+	// the conflicts of clients that never retransmitted are forgotten
+	now := time.Now()
+	for k, v := range p.conflicts {
+		if now.Sub(v.found) >= probeCacheTTL {
+			delete(p.conflicts, k)
+		}
+	}
+	p.conflicts[key] = foundConflict{mac: mac, found: now}
+}
+
+// sendARP sends an ARP probe with an unspecified sender address, so that the caches of the other hosts are left alone
+func (p *conflictProber) sendARP(ip net.IP) error {
+	eth := &layers.Ethernet{
+		SrcMAC:       p.ifi.HardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   p.ifi.HardwareAddr,
+		SourceProtAddress: net.IPv4zero.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, arp); err != nil {
+		return err
+	}
+	_, err := p.conn.WriteTo(buf.Bytes(), &raw.Addr{HardwareAddr: layers.EthernetBroadcast})
+	return err
+}
+
+// handleARP is called with the ARP frames the dhcp server received. A reply, or another host probing or announcing
+// the same address is a conflict.
+func (p *conflictProber) handleARP(arp *layers.ARP) {
+	if p == nil {
+		return
+	}
+
+	p.answered(net.IP(arp.SourceProtAddress), net.HardwareAddr(arp.SourceHwAddress), func(*pendingProbe) bool {
+		return true
+	})
+}
+
+// sendICMP pings an address of a relayed pool, the hardware address of the device cant be learned this way
+func (p *conflictProber) sendICMP(ip net.IP, seq uint16) error {
+	c, err := p.listenICMP()
+	if err != nil {
+		return err
+	}
+
+	echo := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       icmpID(),
+		Seq:      seq,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, echo, gopacket.Payload("go-via conflict probe")); err != nil {
+		return err
+	}
+	_, err = c.WriteTo(buf.Bytes(), &net.IPAddr{IP: ip})
+	return err
+}
+
+// listenICMP returns the socket for the ICMP probes, it is kept open and read in the background
+func (p *conflictProber) listenICMP() (net.PacketConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.icmp != nil {
+		return p.icmp, nil
+	}
+
+	c, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	p.icmp = c
+	go p.readICMP(c)
+
+	return c, nil
+}
+
+func (p *conflictProber) readICMP(c net.PacketConn) {
+	b := make([]byte, 1500)
+	for {
+		n, src, err := c.ReadFrom(b)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("dhcp: failed to receive icmp probe reply")
+
+			// the next probe opens a new socket
+			p.mu.Lock()
+			p.icmp = nil
+			p.mu.Unlock()
+			c.Close()
+			return
+		}
+
+		addr, ok := src.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+
+		packet := gopacket.NewPacket(b[:n], layers.LayerTypeICMPv4, gopacket.Default)
+		icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
+		if icmpLayer == nil {
+			continue
+		}
+		reply, _ := icmpLayer.(*layers.ICMPv4)
+		if reply.TypeCode.Type() != layers.ICMPv4TypeEchoReply || reply.Id != icmpID() {
+			continue
+		}
+
+		p.answered(addr.IP, nil, func(pending *pendingProbe) bool {
+			return pending.seq == reply.Seq
+		})
+	}
+}
+
+func icmpID() uint16 {
+	return uint16(os.Getpid() & 0xffff)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tribock/go-via/config"
+)
+
+// frameConn stands in for the raw socket of the dhcp server, it keeps the frames that are sent
+type frameConn struct {
+	net.PacketConn
+	sent chan []byte
+}
+
+func (c *frameConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.sent <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestConflictProbeARP(t *testing.T) {
+	self, _ := net.ParseMAC("02:00:00:00:00:01")
+	client, _ := net.ParseMAC("02:00:00:00:00:02")
+	other, _ := net.ParseMAC("02:00:00:00:00:03")
+	_, ipNet, _ := net.ParseCIDR("192.0.2.0/24")
+
+	c := &frameConn{sent: make(chan []byte, 10)}
+	p := newConflictProber(&config.Config{ConflictProbe: 50}, &net.Interface{Name: "test", HardwareAddr: self}, net.ParseIP("192.0.2.1"), ipNet, c)
+
+	reply := func(ip string, mac net.HardwareAddr) {
+		p.handleARP(&layers.ARP{Operation: layers.ARPReply, SourceHwAddress: mac, SourceProtAddress: net.ParseIP(ip).To4()})
+	}
+
+	// the probe is sent in the background, the dhcp server does not wait for it
+	used := net.ParseIP("192.0.2.10")
+	if _, _, err := p.Probe(used, client); err != errProbing {
+		t.Fatalf("got %v, expected the address to be probed", err)
+	}
+	packet := gopacket.NewPacket(<-c.sent, layers.LayerTypeEthernet, gopacket.Default)
+	arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || !net.IP(arp.DstProtAddress).Equal(used) || !net.IP(arp.SourceProtAddress).Equal(net.IPv4zero) {
+		t.Fatalf("sent %v, expected an ARP probe for %s", packet, used)
+	}
+	if _, _, err := p.Probe(used, client); err != errProbing {
+		t.Errorf("got %v, expected the retransmit to wait for the probe", err)
+	}
+	if len(c.sent) != 0 {
+		t.Errorf("probed the address twice")
+	}
+
+	// the answers of the client itself do not count
+	reply(used.String(), client)
+	reply(used.String(), other)
+	conflict, mac, err := p.Probe(used, client)
+	if err != nil || !conflict || mac.String() != other.String() {
+		t.Errorf("got %t %s %v, expected a conflict with %s", conflict, mac, err, other)
+	}
+
+	free := net.ParseIP("192.0.2.11")
+	p.Probe(free, client)
+	<-c.sent
+	time.Sleep(100 * time.Millisecond)
+	// a late answer is not a conflict anymore
+	reply(free.String(), other)
+	for i := 0; i < 2; i++ {
+		if conflict, _, err := p.Probe(free, client); err != nil || conflict {
+			t.Errorf("got %t %v, expected the address to be free", conflict, err)
+		}
+	}
+	if len(c.sent) != 0 {
+		t.Errorf("probed a free address again")
+	}
+}
@@ -0,0 +1,74 @@
+package ca
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+)
+
+// Revoke marks the certificate as revoked, it will be listed on the CRL until it expires
+func Revoke(item *models.Certificate, reason int) error {
+	if item.RevokedAt != nil {
+		return fmt.Errorf("ca: certificate %s has already been revoked", item.Serial)
+	}
+
+	now := time.Now()
+	if res := db.DB.Model(item).Updates(map[string]interface{}{"revoked_at": now, "revocation_reason": reason}); res.Error != nil {
+		return res.Error
+	}
+	item.RevokedAt = &now
+	item.RevocationReason = reason
+
+	logrus.WithFields(logrus.Fields{
+		"serial": item.Serial,
+		"cn":     item.CommonName,
+		"reason": reason,
+	}).Info("cert revoked")
+
+	return nil
+}
+
+// CRL returns a DER encoded certificate revocation list of all revoked certificates that have not expired yet
+func CRL() ([]byte, error) {
+	ca, caKey, err := LoadCA()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []models.Certificate
+	// only certificates issued by the current CA belong on its CRL
+	if res := db.DB.Where("revoked_at IS NOT NULL AND not_after > ? AND external = ? AND (issuer = ? OR issuer = '')", time.Now(), false, ca.Subject.String()).Find(&items); res.Error != nil {
+		return nil, res.Error
+	}
+
+	var revoked []x509.RevocationListEntry
+	for _, v := range items {
+		b, err := hex.DecodeString(v.Serial)
+		if err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, x509.RevocationListEntry{
+			SerialNumber:   new(big.Int).SetBytes(b),
+			RevocationTime: *v.RevokedAt,
+			ReasonCode:     v.RevocationReason,
+		})
+	}
+
+	now := time.Now()
+	tmpl := &x509.RevocationList{
+		// the CRL number has to increase with every CRL that is published
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(time.Duration(conf.CRLValidity) * time.Hour),
+		RevokedCertificateEntries: revoked,
+	}
+
+	return x509.CreateRevocationList(rand.Reader, tmpl, ca, caKey)
+}
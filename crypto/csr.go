@@ -0,0 +1,232 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+)
+
+// CreateCSR generates a key in path/name.key and a certificate signing request for it, to be signed by an external CA
+func CreateCSR(path string, name string, req Request) (models.CertificateRequest, error) {
+	priv, keyPEM, err := generateKey()
+	if err != nil {
+		return models.CertificateRequest{}, err
+	}
+
+	dnsNames := []string{req.CommonName}
+	for _, v := range req.DNSNames {
+		if v != "" && !contains(dnsNames, v) {
+			dnsNames = append(dnsNames, v)
+		}
+	}
+
+	tmpl := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			Organization: []string{conf.Organization},
+			Country:      []string{conf.Country},
+			CommonName:   req.CommonName,
+		},
+		DNSNames:    dnsNames,
+		IPAddresses: req.IPAddresses,
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, tmpl, priv)
+	if err != nil {
+		return models.CertificateRequest{}, err
+	}
+
+	if err := writePEM(filepath.Join(path, name+".key"), 0600, keyPEM); err != nil {
+		return models.CertificateRequest{}, err
+	}
+
+	var ips []string
+	for _, v := range req.IPAddresses {
+		ips = append(ips, v.String())
+	}
+
+	item := models.CertificateRequest{
+		CertificateRequestForm: models.CertificateRequestForm{AddressID: req.AddressID},
+		CommonName:             req.CommonName,
+		DNSNames:               strings.Join(dnsNames, ","),
+		IPAddresses:            strings.Join(ips, ","),
+		KeyType:                keyType(),
+		Path:                   path,
+		Name:                   name,
+		PEM:                    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+		Status:                 models.RequestPending,
+	}
+	if res := db.DB.Create(&item); res.Error != nil {
+		return models.CertificateRequest{}, res.Error
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"cn":   req.CommonName,
+		"path": path + "/" + name + ".key",
+	}).Info("cert: created certificate request")
+
+	return item, nil
+}
+
+// AcceptCertificate stores the certificate that an external CA has signed for the request in path/name.crt and
+// records it in the issuance index
+func AcceptCertificate(item *models.CertificateRequest, certPEM []byte) (models.Certificate, error) {
+	if item.Status != models.RequestPending {
+		return models.Certificate{}, fmt.Errorf("ca: the request has already been signed")
+	}
+
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return models.Certificate{}, err
+	}
+	cert := certs[0]
+
+	block, _ := pem.Decode([]byte(item.PEM))
+	if block == nil {
+		return models.Certificate{}, fmt.Errorf("ca: the stored request is corrupt")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return models.Certificate{}, err
+	}
+
+	// the certificate is only usable with the key that has been generated for the request
+	want, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return models.Certificate{}, err
+	}
+	got, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return models.Certificate{}, err
+	}
+	if !bytes.Equal(want, got) {
+		return models.Certificate{}, fmt.Errorf("ca: the certificate has not been issued for this request")
+	}
+	if time.Now().After(cert.NotAfter) {
+		return models.Certificate{}, fmt.Errorf("ca: the certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	// leaf first, followed by the chain as it has been uploaded
+	var out bytes.Buffer
+	for _, v := range certs {
+		pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: v.Raw})
+	}
+	if err := ioutil.WriteFile(filepath.Join(item.Path, item.Name+".crt"), out.Bytes(), 0644); err != nil {
+		return models.Certificate{}, err
+	}
+
+	var ips []string
+	for _, v := range cert.IPAddresses {
+		ips = append(ips, v.String())
+	}
+
+	c := models.Certificate{
+		Serial:      hex.EncodeToString(cert.SerialNumber.Bytes()),
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    strings.Join(cert.DNSNames, ","),
+		IPAddresses: strings.Join(ips, ","),
+		AddressID:   item.AddressID,
+		KeyType:     item.KeyType,
+		Issuer:      cert.Issuer.String(),
+		External:    true,
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Path:        item.Path,
+		Name:        item.Name,
+		PEM:         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	}
+	if res := db.DB.Create(&c); res.Error != nil {
+		return models.Certificate{}, res.Error
+	}
+
+	item.Status = models.RequestSigned
+	item.CertificateID = c.ID
+	if res := db.DB.Save(item); res.Error != nil {
+		return models.Certificate{}, res.Error
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"cn":     c.CommonName,
+		"serial": c.Serial,
+		"issuer": c.Issuer,
+	}).Info("cert: accepted externally signed certificate")
+
+	return c, nil
+}
+
+// InstallServerCertificate makes the certificate the one served by the appliance, the running server picks it up
+// with the next connection
+func InstallServerCertificate(item models.Certificate) error {
+	crt, err := ioutil.ReadFile(filepath.Join(item.Path, item.Name+".crt"))
+	if err != nil {
+		return err
+	}
+	key, err := ioutil.ReadFile(filepath.Join(item.Path, item.Name+".key"))
+	if err != nil {
+		return err
+	}
+
+	// write the key first, the server only reloads once the certificate changes
+	if err := ioutil.WriteFile(ServerKeyFile, key, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(ServerCertFile, crt, 0644); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"cn":     item.CommonName,
+		"serial": item.Serial,
+	}).Info("cert: installed server certificate")
+
+	return nil
+}
+
+// ServerRequest makes the appliance certificate valid for its hostname and the addresses of all interfaces it serves
+func ServerRequest(interfaces []string) Request {
+	req := Request{CommonName: "server"}
+	if hostname, err := os.Hostname(); err == nil {
+		req.CommonName = hostname
+	}
+
+	for _, v := range interfaces {
+		ifi, err := net.InterfaceByName(v)
+		if err != nil {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if v, ok := addr.(*net.IPNet); ok && v.IP.IsGlobalUnicast() {
+				req.IPAddresses = append(req.IPAddresses, v.IP)
+			}
+		}
+	}
+	return req
+}
+
+// ParseIPs converts a list of addresses, invalid ones are skipped
+func ParseIPs(s ...string) []net.IP {
+	var ips []net.IP
+	for _, v := range s {
+		if ip := net.ParseIP(v); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
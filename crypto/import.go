@@ -0,0 +1,212 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ImportCA replaces the internal CA with an intermediate issued by an external CA. certPEM starts with the
+// certificate of the intermediate and may be followed by the rest of the chain up to the root.
+func ImportCA(certPEM []byte, keyPEM []byte) (*x509.Certificate, error) {
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	ca := certs[0]
+
+	if !ca.BasicConstraintsValid || !ca.IsCA {
+		return nil, fmt.Errorf("ca: %s is not a CA certificate", ca.Subject)
+	}
+	if ca.KeyUsage != 0 && ca.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("ca: %s is not allowed to sign certificates", ca.Subject)
+	}
+	if time.Now().After(ca.NotAfter) {
+		return nil, fmt.Errorf("ca: %s expired at %s", ca.Subject, ca.NotAfter.Format(time.RFC3339))
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("ca: no key found in PEM data")
+	}
+	if _, ok := keyBlock.Headers["DEK-Info"]; ok {
+		return nil, fmt.Errorf("ca: encrypted keys are not supported")
+	}
+	if keyBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("ca: encrypted keys are not supported")
+	}
+
+	// verifies that the key belongs to the certificate
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	if _, err := tls.X509KeyPair(caPEM, pem.EncodeToMemory(keyBlock)); err != nil {
+		return nil, fmt.Errorf("ca: %w", err)
+	}
+
+	// the chain must actually belong to the intermediate
+	if len(certs) > 1 {
+		roots := x509.NewCertPool()
+		intermediates := x509.NewCertPool()
+		for _, v := range certs[1:] {
+			if isSelfSigned(v) {
+				roots.AddCert(v)
+			} else {
+				intermediates.AddCert(v)
+			}
+		}
+		if _, err := ca.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			return nil, fmt.Errorf("ca: the chain does not verify: %w", err)
+		}
+	}
+
+	files := []caFile{
+		{CACertFile, 0644, caPEM},
+		{CAKeyFile, 0600, pem.EncodeToMemory(keyBlock)},
+		// without a chain the one of the previous CA is moved away only
+		{CAChainFile, 0644, nil},
+	}
+	if len(certs) > 1 {
+		var chain bytes.Buffer
+		for _, v := range certs[1:] {
+			pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: v.Raw})
+		}
+		files[2].data = chain.Bytes()
+	}
+
+	if err := replaceCA(files, ".bak-"+time.Now().Format("20060102-150405")); err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"subject": ca.Subject.String(),
+		"issuer":  ca.Issuer.String(),
+		"expires": ca.NotAfter,
+	}).Info("cert: imported ca")
+
+	return ca, nil
+}
+
+type caFile struct {
+	name string
+	perm os.FileMode
+	data []byte
+}
+
+// replaceCA writes the files next to the current ones and renames them into place. The previous CA is kept with the
+// suffix, certificates issued by it are still in use. If anything fails the previous CA is restored.
+func replaceCA(files []caFile, suffix string) (err error) {
+	var written, backups, replaced []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, v := range written {
+			os.Remove(v)
+		}
+		for _, v := range replaced {
+			os.Remove(v)
+		}
+		for _, v := range backups {
+			if rerr := os.Rename(v+suffix, v); rerr != nil {
+				logrus.WithFields(logrus.Fields{
+					"file": v,
+					"err":  rerr,
+				}).Error("cert: failed to restore the previous ca")
+			}
+		}
+	}()
+
+	for _, v := range files {
+		if v.data == nil {
+			continue
+		}
+		os.Remove(v.name + ".new")
+		if err := ioutil.WriteFile(v.name+".new", v.data, v.perm); err != nil {
+			return err
+		}
+		written = append(written, v.name+".new")
+	}
+
+	for _, v := range files {
+		if _, err := os.Stat(v.name); err == nil {
+			if err := os.Rename(v.name, v.name+suffix); err != nil {
+				return err
+			}
+			backups = append(backups, v.name)
+		}
+	}
+
+	for _, v := range files {
+		if v.data == nil {
+			continue
+		}
+		if err := os.Rename(v.name+".new", v.name); err != nil {
+			return err
+		}
+		written = written[1:]
+		replaced = append(replaced, v.name)
+	}
+
+	return nil
+}
+
+// issuerChain returns the PEM encoded certificates that have to be sent along with a certificate issued by ca. It is
+// empty for a self-signed CA, otherwise it contains the CA and all intermediates above it, but not the root.
+func issuerChain(ca *x509.Certificate) ([]byte, error) {
+	if isSelfSigned(ca) {
+		return nil, nil
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+
+	b, err := ioutil.ReadFile(CAChainFile)
+	if os.IsNotExist(err) {
+		return chain, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range certs {
+		if !isSelfSigned(v) {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Raw})...)
+		}
+	}
+	return chain, nil
+}
+
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("ca: no certificate found in PEM data")
+	}
+	return certs, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
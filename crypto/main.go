@@ -1,129 +1,400 @@
 package ca
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
 	"encoding/pem"
-	"log"
+	"fmt"
+	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
 )
 
-func CreateCA() {
+const (
+	CACertFile = "cert/ca.crt"
+	CAKeyFile  = "cert/ca.key"
+	// CAChainFile holds the issuers of an imported intermediate CA
+	CAChainFile = "cert/ca-chain.crt"
+
+	ServerCertFile = "cert/server.crt"
+	ServerKeyFile  = "cert/server.key"
+)
+
+var conf = config.CA{
+	Organization: "go-via",
+	Country:      "US",
+	KeyType:      "rsa",
+	KeySize:      2048,
+	Validity:     825,
+	CAValidity:   3650,
+	CRLValidity:  24,
+}
+
+// Init sets the configuration used for all keys and certificates that are created afterwards
+func Init(c config.CA) error {
+	switch {
+	case c.KeyType == "rsa" && (c.KeySize == 2048 || c.KeySize == 3072 || c.KeySize == 4096):
+	case c.KeyType == "ecdsa" && (c.KeySize == 256 || c.KeySize == 384):
+	default:
+		return fmt.Errorf("ca: unsupported key type %s with size %d", c.KeyType, c.KeySize)
+	}
+	if c.Validity <= 0 || c.CAValidity <= 0 || c.CRLValidity <= 0 {
+		return fmt.Errorf("ca: validity has to be positive")
+	}
+
+	conf = c
+	return nil
+}
+
+// Request describes a certificate to be issued
+type Request struct {
+	CommonName  string
+	DNSNames    []string
+	IPAddresses []net.IP
+	// AddressID links the certificate to a host, 0 for the appliance itself
+	AddressID int
+}
+
+// CreateCA creates a new self-signed CA in cert/ca.crt and cert/ca.key
+func CreateCA() error {
+	priv, keyPEM, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	ski, err := subjectKeyID(priv.Public())
+	if err != nil {
+		return err
+	}
+
 	ca := &x509.Certificate{
-		SerialNumber: big.NewInt(1653),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization: []string{"VMware ESX Server Default Certificate"},
-			Country:      []string{"US"},
-			Province:     []string{"California"},
-			Locality:     []string{"Palo Alto"},
+			Organization: []string{conf.Organization},
+			Country:      []string{conf.Country},
+			CommonName:   conf.Organization + " CA",
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().AddDate(0, 0, conf.CAValidity),
 		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
+		SubjectKeyId:          ski,
 	}
 
-	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
-	pub := &priv.PublicKey
-	ca_b, err := x509.CreateCertificate(rand.Reader, ca, ca, pub, priv)
+	ca_b, err := x509.CreateCertificate(rand.Reader, ca, ca, priv.Public(), priv)
 	if err != nil {
-		log.Println("create ca failed", err)
-		return
+		return fmt.Errorf("ca: create ca failed: %w", err)
 	}
 
 	// Public key
-	certOut, err := os.Create("cert/ca.crt")
-	if err != nil {
-		logrus.Fatal(err)
+	if err := writePEM(CACertFile, 0644, &pem.Block{Type: "CERTIFICATE", Bytes: ca_b}); err != nil {
+		return err
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: ca_b})
-	certOut.Close()
 	logrus.WithFields(logrus.Fields{
-		"cert": "ca.pem created",
+		"cert":   "ca.crt created",
+		"serial": hex.EncodeToString(serial.Bytes()),
 	}).Info("cert")
 
 	// Private key
-	keyOut, err := os.OpenFile("cert/ca.key", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		logrus.Fatal(err)
+	if err := writePEM(CAKeyFile, 0600, keyPEM); err != nil {
+		return err
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-	keyOut.Close()
 	logrus.WithFields(logrus.Fields{
 		"cert": "ca.key created",
 	}).Info("cert")
+
+	return nil
 }
 
-func CreateCert(path string, name string, cn string) {
+// LoadCA loads the CA certificate and key
+func LoadCA() (*x509.Certificate, crypto.Signer, error) {
+	catls, err := tls.LoadX509KeyPair(CACertFile, CAKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(catls.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := catls.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("ca: unsupported ca key")
+	}
+	return ca, signer, nil
+}
+
+// CreateCert issues a certificate, writes it to path/name.crt and path/name.key and records it in the issuance index
+func CreateCert(path string, name string, req Request) (models.Certificate, error) {
 
 	// Load CA
-	catls, err := tls.LoadX509KeyPair("cert/ca.crt", "cert/ca.key")
+	ca, caKey, err := LoadCA()
 	if err != nil {
-		logrus.Fatal(err)
+		return models.Certificate{}, err
 	}
-	ca, err := x509.ParseCertificate(catls.Certificate[0])
+
+	priv, keyPEM, err := generateKey()
+	if err != nil {
+		return models.Certificate{}, err
+	}
+
+	serial, err := randomSerial()
 	if err != nil {
-		logrus.Fatal(err)
+		return models.Certificate{}, err
+	}
+
+	ski, err := subjectKeyID(priv.Public())
+	if err != nil {
+		return models.Certificate{}, err
+	}
+
+	// the common name is always part of the SAN, clients ignore the subject if a SAN is present
+	dnsNames := []string{req.CommonName}
+	for _, v := range req.DNSNames {
+		if v != "" && !contains(dnsNames, v) {
+			dnsNames = append(dnsNames, v)
+		}
 	}
 
 	// Prepare certificate
 	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(1658),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization: []string{"VMware ESX Server Default Certificate"},
-			Country:      []string{"US"},
-			Province:     []string{"California"},
-			Locality:     []string{"Palo Alto"},
-			CommonName:   cn,
+			Organization: []string{conf.Organization},
+			Country:      []string{conf.Country},
+			CommonName:   req.CommonName,
 		},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0),
-		SubjectKeyId: []byte{1, 2, 3, 4, 6},
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotBefore:      time.Now().Add(-5 * time.Minute),
+		NotAfter:       time.Now().AddDate(0, 0, conf.Validity),
+		SubjectKeyId:   ski,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		DNSNames:       dnsNames,
+		IPAddresses:    req.IPAddresses,
+		AuthorityKeyId: ca.SubjectKeyId,
+	}
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		cert.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if conf.CRLURL != "" {
+		cert.CRLDistributionPoints = []string{conf.CRLURL}
 	}
-	// add SAN
-	cert.DNSNames = []string{cn}
-	cert.EmailAddresses = []string{"ssl-certificates@vmware.com"}
-
-	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
-	pub := &priv.PublicKey
 
 	// Sign the certificate
-	cert_b, err := x509.CreateCertificate(rand.Reader, cert, ca, pub, catls.PrivateKey)
+	cert_b, err := x509.CreateCertificate(rand.Reader, cert, ca, priv.Public(), caKey)
 	if err != nil {
-		logrus.Fatal(err)
+		return models.Certificate{}, err
 	}
+	certPEM := &pem.Block{Type: "CERTIFICATE", Bytes: cert_b}
 
-	// Public key
-	certOut, err := os.Create(path + "/" + name + ".crt")
+	// Public key, followed by the issuing certificates if the CA is an intermediate
+	chain, err := issuerChain(ca)
 	if err != nil {
-		logrus.Fatal(err)
+		return models.Certificate{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, name+".crt"), append(pem.EncodeToMemory(certPEM), chain...), 0644); err != nil {
+		return models.Certificate{}, err
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert_b})
-	certOut.Close()
 	logrus.WithFields(logrus.Fields{
-		"cert": path + "/" + name + ".crt created",
+		"cert":   path + "/" + name + ".crt created",
+		"serial": hex.EncodeToString(serial.Bytes()),
 	}).Info("cert")
 
 	// Private key
-	keyOut, err := os.OpenFile(path+"/"+name+".key", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		logrus.Fatal(err)
+	if err := writePEM(filepath.Join(path, name+".key"), 0600, keyPEM); err != nil {
+		return models.Certificate{}, err
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-	keyOut.Close()
 	logrus.WithFields(logrus.Fields{
 		"cert": path + "/" + name + ".key created",
 	}).Info("cert")
 
+	var ips []string
+	for _, v := range req.IPAddresses {
+		ips = append(ips, v.String())
+	}
+
+	item := models.Certificate{
+		Serial:      hex.EncodeToString(serial.Bytes()),
+		CommonName:  req.CommonName,
+		DNSNames:    strings.Join(dnsNames, ","),
+		IPAddresses: strings.Join(ips, ","),
+		AddressID:   req.AddressID,
+		KeyType:     keyType(),
+		Issuer:      ca.Subject.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Path:        path,
+		Name:        name,
+		PEM:         string(pem.EncodeToMemory(certPEM)),
+	}
+	if res := db.DB.Create(&item); res.Error != nil {
+		return models.Certificate{}, res.Error
+	}
+
+	return item, nil
+}
+
+// RequestOf returns the request a certificate has been issued for, to issue it again
+func RequestOf(item models.Certificate) Request {
+	req := Request{
+		CommonName: item.CommonName,
+		AddressID:  item.AddressID,
+	}
+	if item.DNSNames != "" {
+		req.DNSNames = strings.Split(item.DNSNames, ",")
+	}
+	if item.IPAddresses != "" {
+		req.IPAddresses = ParseIPs(strings.Split(item.IPAddresses, ",")...)
+	}
+	return req
+}
+
+// Reissue issues a new certificate with the same names to the same location, the old certificate is revoked as superseded
+func Reissue(item models.Certificate) (models.Certificate, error) {
+	if err := os.MkdirAll(item.Path, os.ModePerm); err != nil {
+		return models.Certificate{}, err
+	}
+
+	n, err := CreateCert(item.Path, item.Name, RequestOf(item))
+	if err != nil {
+		return models.Certificate{}, err
+	}
+
+	if item.RevokedAt == nil {
+		if err := Revoke(&item, models.RevocationSuperseded); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Supersede revokes all certificates of a host, except the one that has just been issued
+func Supersede(addressID int, keep int) error {
+	var items []models.Certificate
+	if res := db.DB.Where("address_id = ? AND id <> ? AND revoked_at IS NULL", addressID, keep).Find(&items); res.Error != nil {
+		return res.Error
+	}
+	for i := range items {
+		if err := Revoke(&items[i], models.RevocationSuperseded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CACertificate returns the PEM encoded CA certificate, followed by its chain if it is an intermediate
+func CACertificate() ([]byte, error) {
+	b, err := ioutil.ReadFile(CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ioutil.ReadFile(CAChainFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(b, chain...), nil
+}
+
+func keyType() string {
+	return fmt.Sprintf("%s-%d", conf.KeyType, conf.KeySize)
+}
+
+func generateKey() (crypto.Signer, *pem.Block, error) {
+	switch conf.KeyType {
+	case "ecdsa":
+		curve := elliptic.P256()
+		if conf.KeySize == 384 {
+			curve = elliptic.P384()
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	default:
+		priv, err := rsa.GenerateKey(rand.Reader, conf.KeySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}, nil
+	}
+}
+
+// randomSerial returns a positive random 128 bit serial number
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	for {
+		serial, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, err
+		}
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
+
+// subjectKeyID is the SHA-1 hash of the public key, RFC 5280 section 4.2.1.2 method 1
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(b, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+func writePEM(filename string, perm os.FileMode, block *pem.Block) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func contains(s []string, v string) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
 }
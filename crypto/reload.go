@@ -0,0 +1,65 @@
+package ca
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reloader serves a certificate from disk and picks up a replaced certificate without restarting the server
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) reload() error {
+	fi, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && fi.ModTime().Equal(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = fi.ModTime()
+
+	logrus.WithFields(logrus.Fields{
+		"cert": r.certFile,
+	}).Info("cert: loaded server certificate")
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate, if the certificate on disk can't be loaded the previous one
+// continues to be served
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"cert": r.certFile,
+			"err":  err,
+		}).Warn("cert: failed to reload server certificate")
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package db
+
+import "errors"
+
+// ErrLocked is returned by Lock if another process uses the database
+var ErrLocked = errors.New("db: the database is in use by another process")
+
+// Lock does nothing, the database directory can only be locked on unix
+func Lock() error {
+	return nil
+}
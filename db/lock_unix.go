@@ -0,0 +1,37 @@
+//go:build unix
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked is returned by Lock if another process uses the database
+var ErrLocked = errors.New("db: the database is in use by another process")
+
+// lockFile is kept open for the lifetime of the process, closing it would release the lock
+var lockFile *os.File
+
+// Lock takes an exclusive lock on the database directory. The running server holds it, so that the command line
+// tools that change the secret keys refuse to run next to it.
+func Lock() error {
+	f, err := os.OpenFile("database/via.lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return ErrLocked
+		}
+		return fmt.Errorf("db: failed to lock the database: %w", err)
+	}
+
+	lockFile = f
+	return nil
+}
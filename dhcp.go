@@ -13,23 +13,31 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/sirupsen/logrus"
 	"github.com/tribock/go-via/api"
+	"github.com/tribock/go-via/config"
 	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/failover"
 	"github.com/tribock/go-via/models"
+	"github.com/tribock/go-via/option82"
 	"gorm.io/gorm"
 )
 
-func processPacket(t layers.DHCPMsgType, req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *layers.DHCPv4, err error) {
+func processPacket(conf *config.Config, t layers.DHCPMsgType, req *layers.DHCPv4, sourceNet net.IP, ip net.IP, vlan int, probe *conflictProber) (resp *layers.DHCPv4, err error) {
+	// Another server hands out the addresses, only answer the PXE clients
+	if conf.DisableDhcp {
+		return processProxy(t, req, ip)
+	}
+
 	switch t {
 	case layers.DHCPMsgTypeDiscover:
-		return processDiscover(req, sourceNet, ip)
+		return processDiscover(conf, req, sourceNet, ip, vlan, probe)
 	case layers.DHCPMsgTypeRequest:
-		return processRequest(req, sourceNet, ip)
+		return processRequest(conf, req, sourceNet, ip, vlan)
 	case layers.DHCPMsgTypeRelease:
-		//return "Release"
+		return processRelease(req, sourceNet, ip, vlan)
 	case layers.DHCPMsgTypeInform:
 		return nil, fmt.Errorf("ignored, inform type")
 	case layers.DHCPMsgTypeDecline:
-		return processDecline(req, sourceNet, ip)
+		return processDecline(req, sourceNet, ip, vlan)
 
 	case layers.DHCPMsgTypeUnspecified:
 		return nil, fmt.Errorf("ignored, unspecified type")
@@ -44,16 +52,14 @@ func processPacket(t layers.DHCPMsgType, req *layers.DHCPv4, sourceNet net.IP, i
 	return nil, fmt.Errorf("unknown dhcp request type")
 }
 
-func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *layers.DHCPv4, err error) {
+func processDiscover(conf *config.Config, req *layers.DHCPv4, sourceNet net.IP, ip net.IP, vlan int, probe *conflictProber) (resp *layers.DHCPv4, err error) {
 	// Find all reimage addresses that is not yet assigned a pool
-	var reimageAddresses []models.Address
-	if res := db.DB.Where("pool_id IS NULL").Where("reimage = 1").Find(&reimageAddresses); res.Error != nil {
-		if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, res.Error
-		}
+	reimageAddresses, err := api.FindReimageAddresses()
+	if err != nil {
+		return nil, err
 	}
 
-	pool, err := api.FindPool(sourceNet.String())
+	pool, err := findPool(sourceNet, vlan)
 	if err != nil {
 		return nil, err
 	}
@@ -61,7 +67,8 @@ func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *lay
 	// Make a list of all reimage and pool addresses
 	addresses := append(reimageAddresses, pool.Addresses...)
 
-	// Search in the list for our mac address
+	// Search in the list for our mac address or switch port
+	agent, _ := option82.Decode(req)
 	var leaseIP net.IP
 	var lease *models.Address
 	for _, v := range addresses {
@@ -70,9 +77,9 @@ func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *lay
 		ok, _ := pool.Contains(parsedIp)
 
 		// Check so we havent given someone else this IP
-		err := pool.IsAvailableExcept(parsedIp, req.ClientHWAddr.String())
+		err := pool.IsAvailableFor(parsedIp, v, req.ClientHWAddr.String())
 
-		if v.Mac == req.ClientHWAddr.String() && ok && err == nil {
+		if matchLease(v, req.ClientHWAddr.String(), agent) && ok && err == nil {
 			leaseIP = parsedIp
 			lease = &v
 			break
@@ -84,8 +91,13 @@ func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *lay
 		return nil, fmt.Errorf("ignored because mac address is not flagged for re-imaging")
 	}
 
+	// Pools in static mode dont hand out dynamic addresses
+	if pool.OnlyServeReserved && (lease == nil || !lease.IsReservation()) {
+		return nil, fmt.Errorf("ignored because mac address has no reservation")
+	}
+
 	if leaseIP == nil {
-		leaseIP, err = pool.Next()
+		leaseIP, err = nextUnused(pool, req, probe)
 		if err != nil {
 			return nil, err
 		}
@@ -103,28 +115,32 @@ func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *lay
 
 	resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeOffer)}))
 
-	AddOptions(req, resp, *pool, lease, ip)
+	AddOptions(conf, req, resp, *pool, lease, ip)
 
 	//req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithAddresses, lease *models.Address, ip net.IP
 
 	return resp, nil
 }
 
-func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DHCPv4, error) {
-	/*if opt82, ok := option82.Decode(req); ok {
-		spew.Dump(opt82)
-	}*/
+func processRequest(conf *config.Config, req *layers.DHCPv4, sourceNet net.IP, ip net.IP, vlan int) (*layers.DHCPv4, error) {
+	// Relay agent information, used to match reservations by switch port
+	agent, _ := option82.Decode(req)
 
 	// Find all reimage addresses that is not yet assigned a pool
-	var reimageAddresses []models.Address
-	if res := db.DB.Where("pool_id IS NULL").Where("reimage = 1").Find(&reimageAddresses); res.Error != nil {
-		if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			return nil, res.Error
+	reimageAddresses, err := api.FindReimageAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	// The client has accepted the offer of another server, eg. the failover partner
+	for _, v := range req.Options {
+		if v.Type == layers.DHCPOptServerID && !net.IP(v.Data).Equal(ip.To4()) {
+			return nil, fmt.Errorf("ignored, the client selected server %s", net.IP(v.Data))
 		}
 	}
 
 	// Figure out and get the pool
-	pool, err := api.FindPool(sourceNet.String())
+	pool, err := findPool(sourceNet, vlan)
 	if err != nil {
 		return nil, err
 	}
@@ -158,19 +174,21 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		ok, _ := pool.Contains(parsedIp)
 
 		// Check so we havent given someone else this IP
-		err := pool.IsAvailableExcept(parsedIp, req.ClientHWAddr.String())
+		err := pool.IsAvailableFor(parsedIp, v, req.ClientHWAddr.String())
 
-		if v.Mac == req.ClientHWAddr.String() && v.IP != requestedIP.String() && v.Expires.After(time.Now()) && ok && err == nil {
+		if matchLease(v, req.ClientHWAddr.String(), agent) && v.IP != requestedIP.String() && v.Expires.After(time.Now()) && ok && err == nil {
 			logrus.WithFields(logrus.Fields{
 				"pool":      pool.ID,
 				"expected":  v.IP,
 				"requested": requestedIP.String(),
 			}).Warn("dhcp: wrong ip requested")
 			resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeNak)}))
+			resp.Options = append(resp.Options, models.NewStringOption(layers.DHCPOptMessage, "wrong ip requested"))
 			return resp, nil
 		}
 
-		if v.Mac == req.ClientHWAddr.String() {
+		// A reservation for the switch port wins over earlier leases of the mac address
+		if matchLease(v, req.ClientHWAddr.String(), agent) && (lease == nil || lease.CircuitID == "") {
 			foundLease := models.Address(v)
 			lease = &foundLease
 		}
@@ -185,19 +203,21 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 				"err":       err,
 			}).Warnf("dhcp: the requested ip is not available")
 			resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeNak)}))
+			resp.Options = append(resp.Options, models.NewStringOption(layers.DHCPOptMessage, "the requested ip is not available: "+err.Error()))
 			return resp, nil
 		}
 	}
 
 	// Make sure the address isnt already used
 	if lease != nil {
-		if err := pool.IsAvailableExcept(requestedIP, req.ClientHWAddr.String()); err != nil {
+		if err := pool.IsAvailableFor(requestedIP, *lease, req.ClientHWAddr.String()); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"pool":      pool.ID,
 				"requested": requestedIP.String(),
 				"err":       err,
 			}).Warnf("dhcp: the requested ip is not available (used by someone else)")
 			resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeNak)}))
+			resp.Options = append(resp.Options, models.NewStringOption(layers.DHCPOptMessage, "the requested ip is used by someone else"))
 			return resp, nil
 		}
 	}
@@ -207,6 +227,11 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		return nil, fmt.Errorf("ignored because mac address is not flagged for reimaging")
 	}
 
+	// Pools in static mode dont hand out dynamic addresses
+	if pool.OnlyServeReserved && (lease == nil || !lease.IsReservation()) {
+		return nil, fmt.Errorf("ignored because mac address has no reservation")
+	}
+
 	// Its a new lease!
 	if lease == nil {
 		lease = &models.Address{
@@ -228,11 +253,17 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	resp.YourClientIP = requestedIP
 
 	resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeAck)}))
-	AddOptions(req, resp, *pool, lease, ip)
+	AddOptions(conf, req, resp, *pool, lease, ip)
 
+	// Reservations that are bound to a switch port learn the mac address of the connected host
+	lease.Mac = req.ClientHWAddr.String()
 	lease.IP = requestedIP.String()
 	lease.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}}
 	lease.LastSeenRelay = req.RelayAgentIP.String()
+	if agent != nil {
+		lease.LastSeenCircuitID = agent.CircuitID
+		lease.LastSeenRemoteID = agent.RemoteID
+	}
 	if (lease.FirstSeen == time.Time{}) {
 		lease.FirstSeen = time.Now()
 	}
@@ -240,17 +271,70 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	lease.Expires = time.Now().Add(3600 * time.Second)
 	lease.MissingOptions = listMissingOptions(req, resp)
 
+	// Take over the ip from an expired lease if there is any
+	if err := reclaim(db.DB, conf.LeaseArchive, lease.IP, lease.ID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"pool":      pool.ID,
+			"requested": requestedIP.String(),
+			"err":       err,
+		}).Warn("dhcp: failed to reclaim the expired lease")
+	}
+
 	if lease.ID == 0 {
 		db.DB.Create(lease)
 	} else {
-		// Remove the previous record if there is any
-		db.DB.Exec("DELETE FROM addresses WHERE ip=? AND reimage=0 AND expires <= datetime('now', 'utc')", lease.IP)
 		db.DB.Save(lease)
 	}
 
 	return resp, nil
 }
 
+// the client does not need its address anymore, expire the lease so it can be handed out again
+func processRelease(req *layers.DHCPv4, sourceNet net.IP, ip net.IP, vlan int) (*layers.DHCPv4, error) {
+	pool, err := findPool(sourceNet, vlan)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try to find the lease that is released
+	var lease *models.Address
+	for _, v := range pool.Addresses {
+		if v.Mac == req.ClientHWAddr.String() && v.IP == req.ClientIP.To4().String() {
+			foundLease := models.Address(v)
+			lease = &foundLease
+		}
+	}
+
+	if lease == nil {
+		return nil, fmt.Errorf("no lease found for %s", req.ClientIP)
+	}
+
+	now := time.Now()
+	if lease.Expires.After(now) {
+		if res := db.DB.Model(lease).Updates(map[string]interface{}{"expires": now, "last_seen": now}); res.Error != nil {
+			return nil, res.Error
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"pool":       pool.ID,
+		"ip":         lease.IP,
+		"client-mac": lease.Mac,
+	}).Info("dhcp: lease released")
+
+	return nil, nil
+}
+
+// matchLease reports if the address belongs to the client. Reservations with a circuit id are bound to the switch
+// port the host is connected to, all other addresses to the mac address of the client.
+func matchLease(v models.Address, mac string, agent *option82.Info) bool {
+	if v.CircuitID != "" {
+		return agent != nil && agent.CircuitID == v.CircuitID && (v.RemoteID == "" || agent.RemoteID == v.RemoteID)
+	}
+
+	return v.Mac == mac
+}
+
 func listMissingOptions(req *layers.DHCPv4, resp *layers.DHCPv4) string {
 	requested := map[byte]struct{}{}
 	for _, v := range req.Options {
@@ -276,9 +360,9 @@ func listMissingOptions(req *layers.DHCPv4, resp *layers.DHCPv4) string {
 }
 
 // a IP address conflict was detected, add/update the address table to block that address from being used for a while (lease time)
-func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DHCPv4, error) {
+func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP, vlan int) (*layers.DHCPv4, error) {
 
-	pool, err := api.FindPool(sourceNet.String())
+	pool, err := findPool(sourceNet, vlan)
 	if err != nil {
 		return nil, err
 	}
@@ -290,10 +374,48 @@ func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		}
 	}
 
+	blockAddress(pool, requestedIP, "", req.RelayAgentIP)
+
+	return nil, nil
+}
+
+// nextUnused returns the next free address of the pool that does not answer a conflict probe. Addresses in use by
+// another device are blocked like declined ones. errProbing is returned while the address is probed.
+func nextUnused(pool *models.PoolWithAddresses, req *layers.DHCPv4, probe *conflictProber) (net.IP, error) {
+	for i := 0; i < maxConflictProbes; i++ {
+		leaseIP, err := failover.Next(pool)
+		if err != nil {
+			return nil, err
+		}
+
+		conflict, mac, err := probe.Probe(leaseIP, req.ClientHWAddr)
+		if err != nil {
+			return nil, err
+		}
+		if !conflict {
+			return leaseIP, nil
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"ip":         leaseIP.String(),
+			"mac":        mac.String(),
+			"client-mac": req.ClientHWAddr.String(),
+			"relay":      req.RelayAgentIP,
+		}).Warn("dhcp: address conflict detected, blocking the address")
+
+		pool.Addresses = append(pool.Addresses, blockAddress(pool, leaseIP, mac.String(), req.RelayAgentIP))
+	}
+
+	return nil, fmt.Errorf("could not find a free address, %d addresses are in use by other devices", maxConflictProbes)
+}
+
+// blockAddress adds/updates the address table to block ip from being used for a while (lease time), mac is the
+// device that is using it if known
+func blockAddress(pool *models.PoolWithAddresses, ip net.IP, mac string, relay net.IP) models.Address {
 	// Try to find the lease in our address history
 	var lease *models.Address
 	for _, v := range pool.Addresses {
-		if v.IP == requestedIP.To4().String() {
+		if v.IP == ip.To4().String() {
 			lease = &v
 		}
 	}
@@ -302,7 +424,7 @@ func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	if lease == nil {
 		lease = &models.Address{
 			AddressForm: models.AddressForm{
-				IP:       requestedIP.String(),
+				IP:       ip.String(),
 				Hostname: "-",
 				Reimage:  false,
 			},
@@ -310,8 +432,9 @@ func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	}
 
 	lease.Mac = ""
+	lease.ConflictMac = mac
 	lease.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}}
-	lease.LastSeenRelay = req.RelayAgentIP.String()
+	lease.LastSeenRelay = relay.String()
 	lease.LastSeen = time.Now()
 	lease.Expires = time.Now().Add(3600 * time.Second)
 
@@ -321,11 +444,11 @@ func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		db.DB.Save(lease)
 	}
 
-	return nil, nil
+	return *lease
 }
 
 // AddOptions will try to add all requested options and the manually specified ones to the response
-func AddOptions(req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithAddresses, lease *models.Address, ip net.IP) error {
+func AddOptions(conf *config.Config, req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithAddresses, lease *models.Address, ip net.IP) error {
 	var options []models.Option
 	var leaseID interface{}
 
@@ -335,12 +458,19 @@ func AddOptions(req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithAdd
 
 	// Try to find the device class
 	var deviceClass models.DeviceClass
+	var httpBoot bool
 	for _, v := range req.Options {
 		if v.Type == 60 { // Vendor class
 			db.DB.Where("? LIKE '%' || vendor_class || '%'", string(v.Data)).First(&deviceClass)
+			httpBoot = strings.HasPrefix(string(v.Data), "HTTPClient")
 		}
 	}
 
+	// UEFI HTTP Boot clients ignore offers that do not identify the server as HTTPClient
+	if httpBoot {
+		resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptClassID, []byte("HTTPClient")))
+	}
+
 	if res := db.DB.Where("((pool_id = 0 AND device_class_id = 0 AND address_id = 0) OR pool_id = ? OR address_id = ?) AND (device_class_id = 0 OR device_class_id = ?)", pool.ID, leaseID, deviceClass.ID).Order("device_class_id desc").Order("address_id desc").Order("pool_id desc").Find(&options); res.Error != nil && !errors.Is(res.Error, gorm.ErrRecordNotFound) {
 
 		return res.Error
@@ -397,19 +527,7 @@ func AddOptions(req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithAdd
 	}
 	for opCode := range requestedOptions {
 		if options, ok := byOpCode[opCode]; ok {
-			for _, v := range options {
-				dhcpOpt, _, err := v.ToDHCPOption() // TODO: fix merge
-				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"opcode": opCode,
-						"name":   layers.DHCPOpt(opCode).String(),
-						"err":    err,
-					}).Error("dhcp: failed to encode dhcp option")
-					continue
-				}
-
-				resp.Options = append(resp.Options, dhcpOpt)
-			}
+			addOption(resp, opCode, options)
 			delete(byOpCode, opCode)
 			continue
 		}
@@ -420,6 +538,10 @@ func AddOptions(req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithAdd
 		/*case 66:
 		resp.Options = append(resp.Options, layers.NewDHCPOption(code, ip.To4())) */
 		case 67:
+			if httpBoot {
+				resp.Options = append(resp.Options, layers.NewDHCPOption(code, []byte(httpBootURL(ip, conf))))
+				continue
+			}
 			resp.Options = append(resp.Options, layers.NewDHCPOption(code, []byte("mboot.efi")))
 		case layers.DHCPOptSubnetMask:
 			resp.Options = append(resp.Options, layers.NewDHCPOption(code, net.CIDRMask(pool.Netmask, 32)))
@@ -467,20 +589,24 @@ func AddOptions(req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithAdd
 
 	// Add the remaining options (that werent requested) in the end
 	for opCode, options := range byOpCode {
-		for _, v := range options {
-			dhcpOpt, _, err := v.ToDHCPOption() // TODO: fix merge
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"opcode": opCode,
-					"name":   layers.DHCPOpt(opCode).String(),
-					"err":    err,
-				}).Error("dhcp: failed to encode dhcp option")
-				continue
-			}
-
-			resp.Options = append(resp.Options, dhcpOpt)
-		}
+		addOption(resp, opCode, options)
 	}
 
 	return nil
 }
+
+// addOption adds the options configured for an opcode as a single option, the values of lists are merged and options
+// longer than 255 bytes are split up
+func addOption(resp *layers.DHCPv4, opCode byte, options []models.Option) {
+	dhcpOpt, err := models.EncodeDHCPOptions(options)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"opcode": opCode,
+			"name":   layers.DHCPOpt(opCode).String(),
+			"err":    err,
+		}).Error("dhcp: failed to encode dhcp option")
+		return
+	}
+
+	resp.Options = append(resp.Options, models.SplitDHCPOption(dhcpOpt)...)
+}
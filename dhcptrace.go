@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/tribock/go-via/metrics"
+	"github.com/tribock/go-via/models"
+	"github.com/tribock/go-via/option82"
+	"github.com/tribock/go-via/trace"
+)
+
+// newTransaction describes the request for the trace
+func newTransaction(ifi *net.Interface, t layers.DHCPMsgType, req *layers.DHCPv4, source string, vlan int) models.DHCPTransaction {
+	tx := models.DHCPTransaction{
+		Time:           time.Now(),
+		Interface:      ifi.Name,
+		Vlan:           vlan,
+		Source:         source,
+		Xid:            req.Xid,
+		Mac:            req.ClientHWAddr.String(),
+		MessageType:    t.String(),
+		RequestOptions: trace.DecodeOptions(req.Options),
+	}
+
+	if req.RelayAgentIP != nil && !req.RelayAgentIP.Equal(net.IPv4zero) {
+		tx.Relay = req.RelayAgentIP.String()
+	}
+	if agent, _ := option82.Decode(req); agent != nil {
+		tx.CircuitID = agent.CircuitID
+		tx.RemoteID = agent.RemoteID
+	}
+
+	for _, v := range req.Options {
+		switch v.Type {
+		case layers.DHCPOptClassID:
+			tx.VendorClass = string(v.Data)
+		case layers.DHCPOptRequestIP:
+			tx.RequestedIP = net.IP(v.Data).String()
+		}
+	}
+
+	return tx
+}
+
+// newTransaction6 describes the DHCPv6 request for the trace, the relay is the innermost one
+func newTransaction6(link *dhcpv6Link, req *dhcpv6Request) models.DHCPTransaction {
+	tx := models.DHCPTransaction{
+		Time:           time.Now(),
+		Interface:      link.ifi.Name,
+		Vlan:           req.vlan,
+		Source:         "multicast",
+		MessageType:    req.msg.MsgType.String(),
+		VendorClass:    vendorClass6(req.msg),
+		RequestOptions: trace.DecodeOptions6(req.msg.Options),
+	}
+
+	var xid uint32
+	for _, v := range req.msg.TransactionID {
+		xid = xid<<8 | uint32(v)
+	}
+	tx.Xid = xid
+
+	if req.mac != nil {
+		tx.Mac = req.mac.String()
+	}
+	if ips := requestedIPv6(req.msg); len(ips) > 0 {
+		tx.RequestedIP = ips[0].String()
+	}
+
+	if len(req.relays) > 0 {
+		tx.Source = "relayed"
+		tx.Relay = req.linkAddr.String()
+		for _, v := range req.relays[len(req.relays)-1].Options {
+			switch v.Code {
+			case layers.DHCPv6OptInterfaceID:
+				tx.CircuitID = string(v.Data)
+			case layers.DHCPv6OptRemoteID:
+				// the enterprise number comes first
+				if len(v.Data) > 4 {
+					tx.RemoteID = string(v.Data[4:])
+				}
+			}
+		}
+	}
+
+	return tx
+}
+
+// recordTransaction completes the transaction with the decision that has been made and adds it to the trace, frames
+// are the raw request and reply
+func recordTransaction(tx models.DHCPTransaction, sourceNet net.IP, resp *layers.DHCPv4, err error, frames ...[]byte) {
+	if err == nil && resp != nil {
+		tx.Decision = strings.ToLower(findMsgType(resp).String())
+		tx.ReplyOptions = trace.DecodeOptions(resp.Options)
+		if resp.YourClientIP != nil && !resp.YourClientIP.Equal(net.IPv4zero) {
+			tx.Lease = resp.YourClientIP.String()
+		}
+		for _, v := range resp.Options {
+			if v.Type == layers.DHCPOptMessage {
+				tx.Reason = string(v.Data)
+			}
+		}
+	}
+
+	finishTransaction(tx, sourceNet, err, frames...)
+}
+
+// recordTransaction6 completes the DHCPv6 transaction like recordTransaction, the link address selects the pool
+func recordTransaction6(tx models.DHCPTransaction, req *dhcpv6Request, resp *layers.DHCPv6, err error) {
+	if err == nil && resp != nil {
+		tx.Decision = strings.ToLower(resp.MsgType.String())
+		if resp.MsgType == layers.DHCPv6MsgTypeAdverstise {
+			// gopacket spells it the way the constant is named
+			tx.Decision = "advertise"
+		}
+		tx.ReplyOptions = trace.DecodeOptions6(resp.Options)
+		tx.Lease = leasedIPv6(resp)
+		if opt := findOption6(resp, layers.DHCPv6OptStatusCode); opt != nil && len(opt.Data) > 2 {
+			tx.Reason = string(opt.Data[2:])
+		}
+	}
+
+	finishTransaction(tx, req.linkAddr, err)
+}
+
+// finishTransaction sets the decision of the requests that have not been answered, counts the transaction and adds
+// it to the trace
+func finishTransaction(tx models.DHCPTransaction, sourceNet net.IP, err error, frames ...[]byte) {
+	tx.Duration = float64(time.Since(tx.Time).Microseconds()) / 1000
+
+	var drop *dropError
+	switch {
+	case errors.As(err, &drop):
+		tx.Decision = "dropped"
+		tx.Reason = err.Error()
+		metrics.DHCPDropped.Inc(drop.reason)
+	case err != nil:
+		tx.Decision = "ignored"
+		tx.Reason = err.Error()
+	case tx.Decision == "":
+		// releases and declines are not answered
+		tx.Decision = "processed"
+	}
+
+	metrics.DHCPRequests.Inc(strings.ToLower(tx.MessageType), tx.Decision)
+
+	if !trace.Enabled() {
+		return
+	}
+
+	if pool, err := findPool(sourceNet, tx.Vlan); err == nil {
+		tx.PoolID = pool.ID
+		tx.PoolName = pool.Name
+	}
+
+	trace.Record(tx, frames...)
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/api"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/failover"
+	"github.com/tribock/go-via/models"
+	"golang.org/x/net/ipv6"
+)
+
+// All_DHCP_Relay_Agents_and_Servers (RFC 8415)
+var dhcpv6Group = net.ParseIP("ff02::1:2")
+
+// dhcpv6Link is an interface the DHCPv6 server listens on
+type dhcpv6Link struct {
+	ifi  *net.Interface
+	ip   net.IP
+	duid []byte
+	vlan int
+}
+
+// dhcpv6Request is a client message and what the relays it passed told us about the client
+type dhcpv6Request struct {
+	msg *layers.DHCPv6
+
+	// linkAddr identifies the link the client is on, it selects the pool
+	linkAddr net.IP
+	// peerAddr is the link-local address of the client
+	peerAddr net.IP
+	// mac is taken from the relay, the DUID or the link-local address of the client
+	mac net.HardwareAddr
+	// linkLayer is set if the mac has been reported by the relay or is part of the DUID, and not been guessed from
+	// the link-local address
+	linkLayer bool
+	// relays the message passed, the innermost relay last
+	relays []*layers.DHCPv6
+	// vlan the message arrived on
+	vlan int
+}
+
+// serve6 runs the DHCPv6 server on all interfaces that have a global IPv6 address
+func serve6(conf *config.Config) {
+	c, err := net.ListenPacket("udp6", "[::]:547")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("dhcpv6: failed to listen")
+		return
+	}
+	defer c.Close()
+
+	p := ipv6.NewPacketConn(c)
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("dhcpv6: failed to listen")
+		return
+	}
+
+	links := map[int]*dhcpv6Link{}
+	for _, v := range conf.Network.Interfaces {
+		ifi, err := net.InterfaceByName(v)
+		if err != nil {
+			continue
+		}
+
+		ip, _, err := findIPv6Addr(ifi)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"if":  v,
+				"err": err,
+			}).Debug("dhcpv6: not serving interface")
+			continue
+		}
+
+		if err := p.JoinGroup(ifi, &net.UDPAddr{IP: dhcpv6Group}); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"if":  v,
+				"err": err,
+			}).Warn("dhcpv6: failed to join multicast group")
+			continue
+		}
+
+		// DUID-LL of the interface
+		duid := &layers.DHCPv6DUID{Type: layers.DHCPv6DUIDTypeLL, HardwareType: []byte{0, 1}, LinkLayerAddress: ifi.HardwareAddr}
+		links[ifi.Index] = &dhcpv6Link{ifi: ifi, ip: ip, duid: duid.Encode(), vlan: interfaceVlan(ifi)}
+
+		logrus.WithFields(logrus.Fields{
+			"mac": ifi.HardwareAddr,
+			"ip":  ip,
+			"int": v,
+		}).Infof("Starting dhcpv6 server")
+	}
+
+	if len(links) == 0 {
+		logrus.Info("dhcpv6: no interface with a global IPv6 address, not starting")
+		return
+	}
+
+	limits := newRateLimits(conf.RateLimit)
+
+	b := make([]byte, 65536)
+	for {
+		n, cm, src, err := p.ReadFrom(b)
+		if err != nil {
+			logrus.Fatalf("dhcpv6: failed to receive message: %v", err)
+		}
+		if cm == nil {
+			continue
+		}
+
+		link, ok := links[cm.IfIndex]
+		if !ok {
+			continue
+		}
+
+		req, err := decodeDHCPv6(b[:n], src.(*net.UDPAddr).IP, link)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"source": src.String(),
+				"err":    err,
+			}).Debug("dhcpv6: failed to decode message")
+			continue
+		}
+
+		t := req.msg.MsgType
+		tx := newTransaction6(link, req)
+
+		// Floods and clients that are not allowed are dropped quietly, like the DHCPv4 ones
+		if err := admit6(conf, limits, req); err != nil {
+			recordTransaction6(tx, req, nil, err)
+			logrus.WithFields(logrus.Fields{
+				"type":       t.String(),
+				"client-mac": req.mac.String(),
+				"link":       req.linkAddr.String(),
+				"error":      err,
+			}).Debugf("dhcpv6: dropped %s", t)
+			continue
+		}
+
+		resp, err := processPacket6(conf, req, link)
+		if err != nil {
+			recordTransaction6(tx, req, nil, err)
+			logrus.WithFields(logrus.Fields{
+				"type":       t.String(),
+				"client-mac": req.mac.String(),
+				"link":       req.linkAddr.String(),
+				"error":      err,
+			}).Warnf("dhcpv6: failed to process %s", t)
+			continue
+		}
+		if resp == nil {
+			recordTransaction6(tx, req, nil, nil)
+			continue
+		}
+
+		out, err := encodeDHCPv6(resp, req.relays)
+		if err != nil {
+			recordTransaction6(tx, req, nil, fmt.Errorf("failed to serialise the response: %w", err))
+			logrus.WithFields(logrus.Fields{
+				"type":       t.String(),
+				"client-mac": req.mac.String(),
+				"err":        err,
+			}).Warnf("dhcpv6: failed to serialise response to %s", t)
+			continue
+		}
+
+		p.WriteTo(out, &ipv6.ControlMessage{IfIndex: cm.IfIndex}, src)
+		recordTransaction6(tx, req, resp, nil)
+
+		logrus.WithFields(logrus.Fields{
+			"response":   resp.MsgType.String(),
+			"client-mac": req.mac.String(),
+			"ip":         leasedIPv6(resp),
+			"relayed":    len(req.relays) > 0,
+		}).Infof("dhcpv6: answered %s with %s", t, resp.MsgType)
+	}
+}
+
+// decodeDHCPv6 unwraps relayed messages down to the message of the client
+func decodeDHCPv6(b []byte, src net.IP, link *dhcpv6Link) (*dhcpv6Request, error) {
+	req := &dhcpv6Request{linkAddr: link.ip, peerAddr: src, vlan: link.vlan}
+
+	for {
+		packet := gopacket.NewPacket(b, layers.LayerTypeDHCPv6, gopacket.Default)
+		l := packet.Layer(layers.LayerTypeDHCPv6)
+		if l == nil {
+			return nil, fmt.Errorf("not a dhcpv6 message")
+		}
+		msg := l.(*layers.DHCPv6)
+
+		if msg.MsgType != layers.DHCPv6MsgTypeRelayForward {
+			req.msg = msg
+			break
+		}
+
+		req.relays = append(req.relays, msg)
+		req.peerAddr = msg.PeerAddr
+		if !msg.LinkAddr.IsUnspecified() {
+			req.linkAddr = msg.LinkAddr
+		}
+
+		b = nil
+		for _, v := range msg.Options {
+			switch v.Code {
+			case layers.DHCPv6OptRelayMessage:
+				b = v.Data
+			case layers.DHCPv6OptClientLinkLayerAddress:
+				if len(v.Data) > 2 {
+					req.mac = net.HardwareAddr(v.Data[2:])
+					req.linkLayer = true
+				}
+			}
+		}
+		if b == nil {
+			return nil, fmt.Errorf("relay message without client message")
+		}
+	}
+
+	if req.mac == nil {
+		if duid := clientDUID(req.msg); duid != nil && (duid.Type == layers.DHCPv6DUIDTypeLLT || duid.Type == layers.DHCPv6DUIDTypeLL) && len(duid.LinkLayerAddress) == 6 {
+			req.mac = duid.LinkLayerAddress
+			req.linkLayer = true
+		} else {
+			req.mac = eui64MAC(req.peerAddr)
+		}
+	}
+
+	return req, nil
+}
+
+// encodeDHCPv6 wraps the response in a relay reply for every relay the request passed
+func encodeDHCPv6(resp *layers.DHCPv6, relays []*layers.DHCPv6) ([]byte, error) {
+	opts := gopacket.SerializeOptions{FixLengths: true}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := resp.SerializeTo(buf, opts); err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+
+	for i := len(relays) - 1; i >= 0; i-- {
+		reply := &layers.DHCPv6{
+			MsgType:  layers.DHCPv6MsgTypeRelayReply,
+			HopCount: relays[i].HopCount,
+			LinkAddr: relays[i].LinkAddr,
+			PeerAddr: relays[i].PeerAddr,
+		}
+		for _, v := range relays[i].Options {
+			if v.Code == layers.DHCPv6OptInterfaceID {
+				reply.Options = append(reply.Options, v)
+			}
+		}
+		reply.Options = append(reply.Options, layers.NewDHCPv6Option(layers.DHCPv6OptRelayMessage, out))
+
+		buf := gopacket.NewSerializeBuffer()
+		if err := reply.SerializeTo(buf, opts); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	}
+
+	return out, nil
+}
+
+func processPacket6(conf *config.Config, req *dhcpv6Request, link *dhcpv6Link) (*layers.DHCPv6, error) {
+	msg := req.msg
+
+	// Messages that are meant for another server
+	if id := findOption6(msg, layers.DHCPv6OptServerID); id != nil && string(id.Data) != string(link.duid) {
+		return nil, nil
+	}
+
+	switch msg.MsgType {
+	case layers.DHCPv6MsgTypeSolicit:
+		if findOption6(msg, layers.DHCPv6OptRapidCommit) != nil {
+			return processRequest6(conf, req, link, true)
+		}
+		return processSolicit6(conf, req, link)
+	case layers.DHCPv6MsgTypeRequest, layers.DHCPv6MsgTypeRenew, layers.DHCPv6MsgTypeRebind:
+		return processRequest6(conf, req, link, false)
+	case layers.DHCPv6MsgTypeConfirm:
+		return processConfirm6(req, link)
+	case layers.DHCPv6MsgTypeRelease:
+		return processRelease6(req, link)
+	case layers.DHCPv6MsgTypeDecline:
+		return processDecline6(req, link)
+	case layers.DHCPv6MsgTypeInformationRequest:
+		resp := newReply6(msg, layers.DHCPv6MsgTypeReply, link)
+		pool, _ := findPool(req.linkAddr, req.vlan)
+		addOptions6(conf, req, resp, pool, nil, link)
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("ignored, %s type", msg.MsgType)
+}
+
+func processSolicit6(conf *config.Config, req *dhcpv6Request, link *dhcpv6Link) (*layers.DHCPv6, error) {
+	pool, lease, leaseIP, err := findLease6(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := newReply6(req.msg, layers.DHCPv6MsgTypeAdverstise, link)
+	addIANA6(req.msg, resp, pool, leaseIP)
+	addOptions6(conf, req, resp, pool, lease, link)
+
+	return resp, nil
+}
+
+func processRequest6(conf *config.Config, req *dhcpv6Request, link *dhcpv6Link, rapidCommit bool) (*layers.DHCPv6, error) {
+	pool, lease, leaseIP, err := findLease6(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := newReply6(req.msg, layers.DHCPv6MsgTypeReply, link)
+	if rapidCommit {
+		resp.Options = append(resp.Options, layers.NewDHCPv6Option(layers.DHCPv6OptRapidCommit, nil))
+	}
+	addIANA6(req.msg, resp, pool, leaseIP)
+	addOptions6(conf, req, resp, pool, lease, link)
+
+	if leaseIP == nil {
+		return resp, nil
+	}
+
+	// Its a new lease!
+	if lease == nil {
+		lease = &models.Address{
+			AddressForm: models.AddressForm{
+				Hostname: "-",
+				Reimage:  false,
+			},
+		}
+	}
+
+	if opt := findOption6(req.msg, layers.DHCPv6OptClientFQDN); opt != nil && len(opt.Data) > 1 {
+		if name := decodeDomainName(opt.Data[1:]); name != "" {
+			lease.Hostname = strings.Split(name, ".")[0]
+		}
+	}
+
+	// New leases are bound to the DUID, reservations keep matching the way they have been created
+	if lease.ID == 0 {
+		lease.DUID = hex.EncodeToString(clientID6(req.msg))
+	}
+	if lease.Mac == "" && req.mac != nil {
+		lease.Mac = req.mac.String()
+	}
+	lease.IP = leaseIP.String()
+	lease.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}}
+	if len(req.relays) > 0 {
+		lease.LastSeenRelay = req.linkAddr.String()
+	}
+	if (lease.FirstSeen == time.Time{}) {
+		lease.FirstSeen = time.Now()
+	}
+	lease.LastSeen = time.Now()
+	lease.Expires = time.Now().Add(time.Duration(leaseTime6(pool)) * time.Second)
+
+	// Take over the ip from an expired lease if there is any
+	if err := reclaim(db.DB, conf.LeaseArchive, lease.IP, lease.ID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"pool":      pool.ID,
+			"requested": lease.IP,
+			"err":       err,
+		}).Warn("dhcpv6: failed to reclaim the expired lease")
+	}
+
+	if lease.ID == 0 {
+		db.DB.Create(lease)
+	} else {
+		db.DB.Save(lease)
+	}
+
+	return resp, nil
+}
+
+// the client moved and wants to know if its addresses are still on the link
+func processConfirm6(req *dhcpv6Request, link *dhcpv6Link) (*layers.DHCPv6, error) {
+	pool, err := findPool(req.linkAddr, req.vlan)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := newReply6(req.msg, layers.DHCPv6MsgTypeReply, link)
+	status := layers.DHCPv6StatusCodeSuccess
+	for _, ip := range requestedIPv6(req.msg) {
+		if ok, _ := pool.Contains(ip); !ok {
+			status = layers.DHCPv6StatusCodeNotOnLink
+		}
+	}
+	resp.Options = append(resp.Options, statusOption6(status, status.String()))
+
+	return resp, nil
+}
+
+// the client does not need its addresses anymore, expire the leases so they can be handed out again
+func processRelease6(req *dhcpv6Request, link *dhcpv6Link) (*layers.DHCPv6, error) {
+	duid := hex.EncodeToString(clientID6(req.msg))
+	now := time.Now()
+	for _, ip := range requestedIPv6(req.msg) {
+		res := db.DB.Model(&models.Address{}).Where("ip = ? AND duid = ? AND expires > ?", ip.String(), duid, now).Updates(map[string]interface{}{"expires": now, "last_seen": now})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"ip":   ip.String(),
+			"duid": duid,
+		}).Info("dhcpv6: lease released")
+	}
+
+	resp := newReply6(req.msg, layers.DHCPv6MsgTypeReply, link)
+	resp.Options = append(resp.Options, statusOption6(layers.DHCPv6StatusCodeSuccess, "released"))
+	return resp, nil
+}
+
+// a duplicate address was detected, block the address from being used for a while (lease time)
+func processDecline6(req *dhcpv6Request, link *dhcpv6Link) (*layers.DHCPv6, error) {
+	pool, err := findPool(req.linkAddr, req.vlan)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range requestedIPv6(req.msg) {
+		// Try to find the lease in our address history
+		var lease *models.Address
+		for _, v := range pool.Addresses {
+			if v.IP == ip.String() {
+				foundLease := models.Address(v)
+				lease = &foundLease
+			}
+		}
+
+		// Its an unknown device
+		if lease == nil {
+			lease = &models.Address{
+				AddressForm: models.AddressForm{
+					IP:       ip.String(),
+					Hostname: "-",
+					Reimage:  false,
+				},
+			}
+		}
+
+		lease.Mac = ""
+		lease.DUID = ""
+		lease.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}}
+		lease.LastSeen = time.Now()
+		lease.Expires = time.Now().Add(time.Duration(leaseTime6(pool)) * time.Second)
+
+		if lease.ID == 0 {
+			db.DB.Create(lease)
+		} else {
+			db.DB.Save(lease)
+		}
+	}
+
+	resp := newReply6(req.msg, layers.DHCPv6MsgTypeReply, link)
+	resp.Options = append(resp.Options, statusOption6(layers.DHCPv6StatusCodeSuccess, "declined"))
+	return resp, nil
+}
+
+// findLease6 returns the pool of the client and its address, either a reservation by DUID or mac address, an
+// earlier lease or the next free address of the pool. leaseIP is nil if the pool is exhausted.
+func findLease6(req *dhcpv6Request) (*models.PoolWithAddresses, *models.Address, net.IP, error) {
+	// Find all reimage addresses that is not yet assigned a pool
+	reimageAddresses, err := api.FindReimageAddresses()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pool, err := findPool(req.linkAddr, req.vlan)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Make a list of all reimage and pool addresses
+	addresses := append(reimageAddresses, pool.Addresses...)
+
+	duid := hex.EncodeToString(clientID6(req.msg))
+	var mac string
+	if req.mac != nil {
+		mac = req.mac.String()
+	}
+
+	var lease *models.Address
+	for _, v := range addresses {
+		parsedIp := net.ParseIP(v.IP)
+		ok, _ := pool.Contains(parsedIp)
+
+		// Check so we havent given someone else this IP
+		err := pool.IsAvailableFor(parsedIp, v, mac)
+
+		if matchLease6(v, duid, mac, req.linkLayer) && ok && err == nil {
+			foundLease := models.Address(v)
+			lease = &foundLease
+			break
+		}
+	}
+
+	// Dont answer pools with "only serve requested" flag set
+	if pool.OnlyServeReimage && (lease == nil || !lease.Reimage) {
+		return nil, nil, nil, fmt.Errorf("ignored because the client is not flagged for re-imaging")
+	}
+
+	// Pools in static mode dont hand out dynamic addresses
+	if pool.OnlyServeReserved && (lease == nil || !lease.IsReservation()) {
+		return nil, nil, nil, fmt.Errorf("ignored because the client has no reservation")
+	}
+
+	if lease != nil {
+		return pool, lease, net.ParseIP(lease.IP), nil
+	}
+
+	leaseIP, err := failover.Next(pool)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"pool": pool.ID,
+			"err":  err,
+		}).Warn("dhcpv6: no address available")
+		return pool, nil, nil, nil
+	}
+
+	return pool, nil, leaseIP, nil
+}
+
+// matchLease6 reports if the address belongs to the client, addresses with a DUID only match that DUID. Reservations
+// also match the link-layer address of the client that the relay or the DUID reported, the ESXi installer sends
+// another DUID than the firmware of the host.
+func matchLease6(v models.Address, duid string, mac string, linkLayer bool) bool {
+	if v.DUID != "" {
+		if strings.EqualFold(v.DUID, duid) {
+			return true
+		}
+		return linkLayer && mac != "" && v.Mac == mac && v.IsReservation()
+	}
+
+	return mac != "" && v.Mac == mac
+}
+
+func newReply6(req *layers.DHCPv6, t layers.DHCPv6MsgType, link *dhcpv6Link) *layers.DHCPv6 {
+	resp := &layers.DHCPv6{
+		MsgType:       t,
+		TransactionID: req.TransactionID,
+	}
+
+	if id := findOption6(req, layers.DHCPv6OptClientID); id != nil {
+		resp.Options = append(resp.Options, *id)
+	}
+	resp.Options = append(resp.Options, layers.NewDHCPv6Option(layers.DHCPv6OptServerID, link.duid))
+
+	return resp
+}
+
+// addIANA6 answers every IA_NA of the request with the address of the client
+func addIANA6(req *layers.DHCPv6, resp *layers.DHCPv6, pool *models.PoolWithAddresses, ip net.IP) {
+	lt := leaseTime6(pool)
+
+	for _, v := range req.Options {
+		if v.Code != layers.DHCPv6OptIANA || len(v.Data) < 12 {
+			continue
+		}
+
+		ia := make([]byte, 12)
+		copy(ia, v.Data[:4]) // IAID
+		if ip == nil {
+			ia = append(ia, encodeOption6(statusOption6(layers.DHCPv6StatusCodeNoAddrsAvail, "no addresses available"))...)
+			resp.Options = append(resp.Options, layers.NewDHCPv6Option(layers.DHCPv6OptIANA, ia))
+			continue
+		}
+
+		binary.BigEndian.PutUint32(ia[4:8], uint32(float64(lt)*0.5))  // T1
+		binary.BigEndian.PutUint32(ia[8:12], uint32(float64(lt)*0.8)) // T2
+
+		addr := make([]byte, 24)
+		copy(addr, ip.To16())
+		binary.BigEndian.PutUint32(addr[16:20], uint32(lt)) // preferred lifetime
+		binary.BigEndian.PutUint32(addr[20:24], uint32(lt)) // valid lifetime
+		ia = append(ia, encodeOption6(layers.NewDHCPv6Option(layers.DHCPv6OptIAAddr, addr))...)
+
+		resp.Options = append(resp.Options, layers.NewDHCPv6Option(layers.DHCPv6OptIANA, ia))
+	}
+}
+
+// addOptions6 adds the options of the pool and the address, and the boot file url and parameters for PXE and HTTP boot
+// clients
+func addOptions6(conf *config.Config, req *dhcpv6Request, resp *layers.DHCPv6, pool *models.PoolWithAddresses, lease *models.Address, link *dhcpv6Link) {
+	requested := map[layers.DHCPv6Opt]struct{}{}
+	if oro := findOption6(req.msg, layers.DHCPv6OptOro); oro != nil {
+		for i := 0; i+1 < len(oro.Data); i += 2 {
+			requested[layers.DHCPv6Opt(binary.BigEndian.Uint16(oro.Data[i:]))] = struct{}{}
+		}
+	}
+
+	vendorClass := vendorClass6(req.msg)
+	httpBoot := strings.HasPrefix(vendorClass, "HTTPClient")
+	if strings.HasPrefix(vendorClass, "PXEClient") || httpBoot {
+		requested[layers.DHCPv6OptBootFileURL] = struct{}{}
+		requested[layers.DHCPv6OptBootFileParam] = struct{}{}
+	}
+
+	// The options of IPv6 pools and their addresses are DHCPv6 options, the address specific ones win
+	byOpCode := map[layers.DHCPv6Opt]models.Option{}
+	if pool != nil {
+		var leaseID interface{}
+		if lease != nil {
+			leaseID = lease.ID
+		}
+
+		var options []models.Option
+		db.DB.Where("pool_id = ? OR (address_id = ? AND address_id <> 0)", pool.ID, leaseID).Order("address_id").Find(&options)
+		for _, v := range options {
+			byOpCode[layers.DHCPv6Opt(v.OpCode)] = v
+		}
+	}
+
+	for code, v := range byOpCode {
+		opt, err := v.ToDHCPv6Option()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"opcode": code,
+				"name":   code.String(),
+				"err":    err,
+			}).Error("dhcpv6: failed to encode dhcp option")
+			continue
+		}
+		resp.Options = append(resp.Options, opt)
+	}
+
+	if _, ok := requested[layers.DHCPv6OptBootFileURL]; ok {
+		if _, ok := byOpCode[layers.DHCPv6OptBootFileURL]; !ok {
+			url := "tftp://[" + link.ip.String() + "]/mboot.efi"
+			if httpBoot {
+				url = httpBootURL(link.ip, conf)
+			}
+			resp.Options = append(resp.Options, layers.NewDHCPv6Option(layers.DHCPv6OptBootFileURL, []byte(url)))
+		}
+	}
+
+	// mboot.efi is pointed at the boot.cfg of the host, unless another boot file has been configured
+	if _, ok := requested[layers.DHCPv6OptBootFileParam]; ok {
+		_, url := byOpCode[layers.DHCPv6OptBootFileURL]
+		_, param := byOpCode[layers.DHCPv6OptBootFileParam]
+		if !url && !param {
+			cfg := "boot.cfg"
+			if httpBoot {
+				cfg = strings.TrimSuffix(httpBootURL(link.ip, conf), "mboot.efi") + cfg
+			}
+			v := models.Option{OptionForm: models.OptionForm{OpCode: byte(layers.DHCPv6OptBootFileParam), Data: "-c " + cfg}}
+			opt, _ := v.ToDHCPv6Option()
+			resp.Options = append(resp.Options, opt)
+		}
+	}
+
+	// UEFI HTTP Boot clients ignore advertisements that do not identify the server as HTTPClient
+	if httpBoot {
+		vc := []byte{0, 0, 0x01, 0x37, 0, 10} // enterprise number 311, 10 bytes of data
+		vc = append(vc, "HTTPClient"...)
+		resp.Options = append(resp.Options, layers.NewDHCPv6Option(layers.DHCPv6OptVendorClass, vc))
+	}
+}
+
+func leaseTime6(pool *models.PoolWithAddresses) int {
+	if pool == nil || pool.LeaseTime == 0 {
+		return 3600
+	}
+	return pool.LeaseTime
+}
+
+func findOption6(msg *layers.DHCPv6, code layers.DHCPv6Opt) *layers.DHCPv6Option {
+	for i, v := range msg.Options {
+		if v.Code == code {
+			return &msg.Options[i]
+		}
+	}
+	return nil
+}
+
+// vendorClass6 returns the first vendor class of the message, eg. PXEClient or HTTPClient
+func vendorClass6(msg *layers.DHCPv6) string {
+	// the enterprise number and the length of the first class come first
+	opt := findOption6(msg, layers.DHCPv6OptVendorClass)
+	if opt == nil || len(opt.Data) <= 6 {
+		return ""
+	}
+	n := 6 + int(binary.BigEndian.Uint16(opt.Data[4:]))
+	if n > len(opt.Data) {
+		n = len(opt.Data)
+	}
+	return string(opt.Data[6:n])
+}
+
+func clientID6(msg *layers.DHCPv6) []byte {
+	if opt := findOption6(msg, layers.DHCPv6OptClientID); opt != nil {
+		return opt.Data
+	}
+	return nil
+}
+
+func clientDUID(msg *layers.DHCPv6) *layers.DHCPv6DUID {
+	duid := &layers.DHCPv6DUID{}
+	if id := clientID6(msg); id == nil || duid.DecodeFromBytes(id) != nil {
+		return nil
+	}
+	return duid
+}
+
+// requestedIPv6 returns the addresses in the IA_NA options of the message
+func requestedIPv6(msg *layers.DHCPv6) []net.IP {
+	var ips []net.IP
+	for _, v := range msg.Options {
+		if v.Code != layers.DHCPv6OptIANA || len(v.Data) < 12 {
+			continue
+		}
+		for b := v.Data[12:]; len(b) >= 4; {
+			code, length := layers.DHCPv6Opt(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))
+			if len(b) < 4+length {
+				break
+			}
+			if code == layers.DHCPv6OptIAAddr && length >= 16 {
+				ips = append(ips, net.IP(b[4:20]))
+			}
+			b = b[4+length:]
+		}
+	}
+	return ips
+}
+
+// leasedIPv6 returns the first address that has been handed out in the response, for logging
+func leasedIPv6(resp *layers.DHCPv6) string {
+	if ips := requestedIPv6(resp); len(ips) > 0 {
+		return ips[0].String()
+	}
+	return ""
+}
+
+func statusOption6(code layers.DHCPv6StatusCode, message string) layers.DHCPv6Option {
+	b := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return layers.NewDHCPv6Option(layers.DHCPv6OptStatusCode, append(b, message...))
+}
+
+// encodeOption6 encodes an option that is nested in another option
+func encodeOption6(o layers.DHCPv6Option) []byte {
+	b := make([]byte, 4+len(o.Data))
+	binary.BigEndian.PutUint16(b, uint16(o.Code))
+	binary.BigEndian.PutUint16(b[2:], uint16(len(o.Data)))
+	copy(b[4:], o.Data)
+	return b
+}
+
+// eui64MAC extracts the mac address from a link-local address that has been derived from it
+func eui64MAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	if ip == nil || !ip.IsLinkLocalUnicast() || ip[11] != 0xff || ip[12] != 0xfe {
+		return nil
+	}
+	return net.HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
+}
+
+// decodeDomainName decodes a domain name in DNS wire format
+func decodeDomainName(b []byte) string {
+	var labels []string
+	for len(b) > 0 && b[0] != 0 {
+		n := int(b[0])
+		if len(b) < 1+n {
+			break
+		}
+		labels = append(labels, string(b[1:1+n]))
+		b = b[1+n:]
+	}
+	return strings.Join(labels, ".")
+}
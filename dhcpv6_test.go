@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/models"
+)
+
+func serializeDHCPv6(t *testing.T, msg *layers.DHCPv6) []byte {
+	t.Helper()
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// the ESXi installer solicits with another DUID than the firmware of the host that has been reserved by its DUID
+func TestMatchLease6InstallerDUID(t *testing.T) {
+	mac, _ := net.ParseMAC("00:50:56:00:00:01")
+	firmware := &layers.DHCPv6DUID{Type: layers.DHCPv6DUIDTypeEN, EnterpriseNumber: []byte{0, 0, 0x1a, 0xb6}, Identifier: []byte{1, 2, 3, 4}}
+	installer := &layers.DHCPv6DUID{Type: layers.DHCPv6DUIDTypeLLT, HardwareType: []byte{0, 1}, Time: []byte{0, 0, 0, 1}, LinkLayerAddress: mac}
+
+	reservation := models.Address{}
+	reservation.Mac = mac.String()
+	reservation.DUID = hex.EncodeToString(firmware.Encode())
+	reservation.Reimage = true
+
+	lease := models.Address{}
+	lease.Mac = mac.String()
+	lease.DUID = reservation.DUID
+
+	link := &dhcpv6Link{ip: net.ParseIP("2001:db8::1")}
+	solicit := func(duid *layers.DHCPv6DUID) *layers.DHCPv6 {
+		return &layers.DHCPv6{
+			MsgType:       layers.DHCPv6MsgTypeSolicit,
+			TransactionID: []byte{1, 2, 3},
+			Options:       layers.DHCPv6Options{layers.NewDHCPv6Option(layers.DHCPv6OptClientID, duid.Encode())},
+		}
+	}
+
+	// the relay reports the link-layer address of the client
+	relayed := &layers.DHCPv6{
+		MsgType:  layers.DHCPv6MsgTypeRelayForward,
+		LinkAddr: net.ParseIP("2001:db8:1::1"),
+		PeerAddr: net.ParseIP("fe80::1"),
+		Options: layers.DHCPv6Options{
+			layers.NewDHCPv6Option(layers.DHCPv6OptClientLinkLayerAddress, append([]byte{0, 1}, mac...)),
+			layers.NewDHCPv6Option(layers.DHCPv6OptRelayMessage, serializeDHCPv6(t, solicit(&layers.DHCPv6DUID{Type: layers.DHCPv6DUIDTypeEN, EnterpriseNumber: []byte{0, 0, 0x1a, 0xb6}, Identifier: []byte{5, 6, 7, 8}}))),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		msg      *layers.DHCPv6
+		src      string
+		address  models.Address
+		expected bool
+	}{
+		{"firmware", solicit(firmware), "fe80::250:56ff:fe00:1", reservation, true},
+		{"installer duid-llt", solicit(installer), "fe80::1", reservation, true},
+		{"installer relayed", relayed, "2001:db8:1::1", reservation, true},
+		// the mac of a DUID-EN is guessed from the link-local address, anyone can pick that one
+		{"link-local", solicit(&layers.DHCPv6DUID{Type: layers.DHCPv6DUIDTypeEN, EnterpriseNumber: []byte{0, 0, 0, 1}, Identifier: []byte{1}}), "fe80::250:56ff:fe00:1", reservation, false},
+		// dynamic leases stay bound to the DUID
+		{"dynamic lease", solicit(installer), "fe80::1", lease, false},
+	}
+
+	for _, tt := range tests {
+		req, err := decodeDHCPv6(serializeDHCPv6(t, tt.msg), net.ParseIP(tt.src), link)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if req.mac.String() != mac.String() {
+			t.Errorf("%s: decoded mac %s, expected %s", tt.name, req.mac, mac)
+		}
+		duid := hex.EncodeToString(clientID6(req.msg))
+		if got := matchLease6(tt.address, duid, req.mac.String(), req.linkLayer); got != tt.expected {
+			t.Errorf("%s: matched %t, expected %t", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestBootOptions6(t *testing.T) {
+	link := &dhcpv6Link{ip: net.ParseIP("2001:db8::1")}
+	conf := &config.Config{Port: 8443}
+
+	tests := []struct {
+		vendorClass string
+		url         string
+		cfg         string
+	}{
+		{"PXEClient:Arch:00007", "tftp://[2001:db8::1]/mboot.efi", "boot.cfg"},
+		{"HTTPClient:Arch:00016", "https://[2001:db8::1]:8443/boot/mboot.efi", "https://[2001:db8::1]:8443/boot/boot.cfg"},
+	}
+
+	for _, tt := range tests {
+		vc := append([]byte{0, 0, 0x01, 0x37, 0, byte(len(tt.vendorClass))}, tt.vendorClass...)
+		req := &dhcpv6Request{msg: &layers.DHCPv6{Options: layers.DHCPv6Options{layers.NewDHCPv6Option(layers.DHCPv6OptVendorClass, vc)}}}
+		resp := &layers.DHCPv6{}
+		addOptions6(conf, req, resp, nil, nil, link)
+
+		if opt := findOption6(resp, layers.DHCPv6OptBootFileURL); opt == nil || string(opt.Data) != tt.url {
+			t.Errorf("%s: got boot file url %v, expected %s", tt.vendorClass, opt, tt.url)
+		}
+		// every parameter is prefixed with its length
+		expected := append([]byte{0, 2, '-', 'c', 0, byte(len(tt.cfg))}, tt.cfg...)
+		if opt := findOption6(resp, layers.DHCPv6OptBootFileParam); opt == nil || string(opt.Data) != string(expected) {
+			t.Errorf("%s: got boot file parameters %v, expected -c %s", tt.vendorClass, opt, tt.cfg)
+		}
+	}
+}
+
+func TestTransaction6(t *testing.T) {
+	link := &dhcpv6Link{ifi: &net.Interface{Name: "eth0"}, ip: net.ParseIP("2001:db8::1"), vlan: 10}
+	duid := &layers.DHCPv6DUID{Type: layers.DHCPv6DUIDTypeLL, HardwareType: []byte{0, 1}, LinkLayerAddress: net.HardwareAddr{0, 0x50, 0x56, 0, 0, 1}}
+	vc := append([]byte{0, 0, 0x01, 0x37, 0, 20}, "PXEClient:Arch:00007"...)
+	solicit := &layers.DHCPv6{
+		MsgType:       layers.DHCPv6MsgTypeSolicit,
+		TransactionID: []byte{0x12, 0x34, 0x56},
+		Options: layers.DHCPv6Options{
+			layers.NewDHCPv6Option(layers.DHCPv6OptClientID, duid.Encode()),
+			layers.NewDHCPv6Option(layers.DHCPv6OptOro, []byte{0, 59, 0, 60}),
+			layers.NewDHCPv6Option(layers.DHCPv6OptVendorClass, vc),
+		},
+	}
+	relayed := &layers.DHCPv6{
+		MsgType:  layers.DHCPv6MsgTypeRelayForward,
+		LinkAddr: net.ParseIP("2001:db8:1::1"),
+		PeerAddr: net.ParseIP("fe80::1"),
+		Options: layers.DHCPv6Options{
+			layers.NewDHCPv6Option(layers.DHCPv6OptInterfaceID, []byte("eth1/1/3")),
+			layers.NewDHCPv6Option(layers.DHCPv6OptRelayMessage, serializeDHCPv6(t, solicit)),
+		},
+	}
+
+	req, err := decodeDHCPv6(serializeDHCPv6(t, relayed), net.ParseIP("2001:db8:1::1"), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := newTransaction6(link, req)
+	if tx.Source != "relayed" || tx.Relay != "2001:db8:1::1" || tx.CircuitID != "eth1/1/3" || tx.Vlan != 10 || tx.Interface != "eth0" {
+		t.Errorf("got %+v, expected the relay of the request", tx)
+	}
+	if tx.Mac != "00:50:56:00:00:01" || tx.Xid != 0x123456 || tx.MessageType != "Solicit" || tx.VendorClass != "PXEClient:Arch:00007" {
+		t.Errorf("got %+v, expected the client of the request", tx)
+	}
+	if len(tx.RequestOptions) != 3 || tx.RequestOptions[1].Code != 6 || tx.RequestOptions[1].Value != "59,60" {
+		t.Errorf("got options %+v", tx.RequestOptions)
+	}
+}
+
+func TestAdmit6(t *testing.T) {
+	conf := &config.Config{DisableDhcp: true, RateLimit: config.RateLimit{Mac: 1, MacBurst: 2}}
+	limits := newRateLimits(conf.RateLimit)
+
+	request := func(duid byte, mac net.HardwareAddr) *dhcpv6Request {
+		msg := &layers.DHCPv6{MsgType: layers.DHCPv6MsgTypeSolicit, Options: layers.DHCPv6Options{layers.NewDHCPv6Option(layers.DHCPv6OptClientID, []byte{0, 2, 0, 0, 0, 1, duid})}}
+		return &dhcpv6Request{msg: msg, mac: mac, linkAddr: net.ParseIP("2001:db8::1")}
+	}
+
+	known := request(1, net.HardwareAddr{0, 0x50, 0x56, 0, 0, 1})
+	for i := 0; i < 2; i++ {
+		if err := admit6(conf, limits, known); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	var drop *dropError
+	if err := admit6(conf, limits, known); !errors.As(err, &drop) || drop.reason != "rate_limit_mac" {
+		t.Errorf("got %v, expected the request to be dropped", err)
+	}
+
+	// the clients whose mac address is unknown do not share a bucket
+	for i := 0; i < 2; i++ {
+		if err := admit6(conf, limits, request(2, nil)); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := admit6(conf, limits, request(3, nil)); err != nil {
+		t.Errorf("got %v, expected another client to pass", err)
+	}
+	if err := admit6(conf, limits, request(2, nil)); !errors.As(err, &drop) {
+		t.Errorf("got %v, expected the request to be dropped", err)
+	}
+}
@@ -0,0 +1,329 @@
+package failover
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// Two instances serve the same pools by splitting their dynamic ranges, the primary hands out the first part of every
+// range and the secondary the rest. Both answer every request, a client that already has a lease gets it from either
+// of them because the leases are replicated to the partner as soon as they are written. The instances exchange
+// heartbeats over the https api, once the partner has been silent for the peer timeout the whole range is served,
+// the own part is used up first. When the partner is back the leases are synced before the range is split again.
+// The clocks of both instances have to be in sync, the newer version of a lease wins.
+
+var ErrDisabled = errors.New("failover: no peer configured")
+
+const (
+	RolePrimary   = "primary"
+	RoleSecondary = "secondary"
+
+	// SecretHeader carries the shared secret of the requests between the partners
+	SecretHeader = "X-Failover-Secret"
+
+	// queueSize is the number of written addresses that may wait to be replicated
+	queueSize = 1024
+)
+
+type Node struct {
+	conf config.Failover
+	http *http.Client
+
+	mu          sync.Mutex
+	state       models.FailoverState
+	peerState   models.FailoverState
+	started     time.Time
+	lastContact time.Time
+	// syncing is set while the leases of the partner are fetched
+	syncing bool
+	// pushAll replicates all leases with the next heartbeat, because some have been lost
+	pushAll bool
+
+	queue chan int
+}
+
+// current is the configured instance, it is nil if failover is disabled
+var current *Node
+
+func New(conf config.Failover) (*Node, error) {
+	if conf.Peer == "" {
+		return nil, ErrDisabled
+	}
+	if conf.Role != RolePrimary && conf.Role != RoleSecondary {
+		return nil, fmt.Errorf("failover: invalid role %q, expected %s or %s", conf.Role, RolePrimary, RoleSecondary)
+	}
+	if conf.Secret == "" {
+		return nil, fmt.Errorf("failover: a shared secret is required")
+	}
+	if conf.Split < 0 || conf.Split > 100 {
+		return nil, fmt.Errorf("failover: split must be between 0 and 100")
+	}
+	if conf.Heartbeat <= 0 || conf.PeerTimeout <= conf.Heartbeat {
+		return nil, fmt.Errorf("failover: the peer timeout must be longer than the heartbeat interval")
+	}
+
+	return &Node{
+		conf: conf,
+		http: &http.Client{
+			Timeout:   time.Duration(conf.PeerTimeout) * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}},
+		},
+		state:   models.FailoverStartup,
+		started: time.Now(),
+		queue:   make(chan int, queueSize),
+	}, nil
+}
+
+// Init enables failover and replicates the addresses that are written to tx from now on
+func Init(conf config.Failover, tx *gorm.DB) error {
+	n, err := New(conf)
+	if err != nil {
+		return err
+	}
+
+	if err := n.watch(tx); err != nil {
+		return err
+	}
+
+	current = n
+	return nil
+}
+
+// Run sends the heartbeats and replicates the leases, it returns right away if failover is disabled
+func Run() {
+	n := current
+	if n == nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"role":  n.conf.Role,
+		"peer":  n.conf.Peer,
+		"split": n.conf.Split,
+	}).Info("failover: enabled")
+
+	go n.replicate()
+
+	ticker := time.NewTicker(time.Duration(n.conf.Heartbeat) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		var status models.FailoverStatus
+		if err := n.do(http.MethodPost, "heartbeat", n.Status(), &status); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"peer": n.conf.Peer,
+				"err":  err,
+			}).Debug("failover: heartbeat failed")
+		} else if err := n.contact(status); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"peer": n.conf.Peer,
+				"err":  err,
+			}).Error("failover: heartbeat rejected")
+		}
+
+		n.checkTimeout()
+
+		<-ticker.C
+	}
+}
+
+// Enabled reports if this instance is paired with a partner
+func Enabled() bool {
+	return current != nil
+}
+
+// Authorized reports if the secret is the one shared with the partner
+func Authorized(secret string) bool {
+	n := current
+	return n != nil && subtle.ConstantTimeCompare([]byte(secret), []byte(n.conf.Secret)) == 1
+}
+
+// Status returns the state of this instance, it is disabled if failover is not configured
+func Status() models.FailoverStatus {
+	n := current
+	if n == nil {
+		return models.FailoverStatus{State: models.FailoverDisabled}
+	}
+	return n.Status()
+}
+
+func (n *Node) Status() models.FailoverStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := models.FailoverStatus{
+		Role:      n.conf.Role,
+		State:     n.state,
+		Split:     n.conf.Split,
+		Peer:      n.conf.Peer,
+		PeerState: n.peerState,
+	}
+	if !n.lastContact.IsZero() {
+		lastContact := n.lastContact
+		status.LastContact = &lastContact
+	}
+	return status
+}
+
+// Heartbeat records the heartbeat of the partner and returns the state of this instance
+func Heartbeat(peer models.FailoverStatus) (models.FailoverStatus, error) {
+	n := current
+	if n == nil {
+		return models.FailoverStatus{}, ErrDisabled
+	}
+	if err := n.contact(peer); err != nil {
+		return models.FailoverStatus{}, err
+	}
+	return n.Status(), nil
+}
+
+// contact is called whenever the partner has been heard of, either by its heartbeat or by its answer to ours
+func (n *Node) contact(peer models.FailoverStatus) error {
+	if peer.Role == n.conf.Role {
+		return fmt.Errorf("failover: both instances are configured as %s", n.conf.Role)
+	}
+	if peer.Split != n.conf.Split {
+		return fmt.Errorf("failover: the split of the partner is %d%% but ours is %d%%", peer.Split, n.conf.Split)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.lastContact = time.Now()
+	n.peerState = peer.State
+
+	if n.pushAll {
+		n.pushAll = false
+		go n.pushLeases()
+	}
+
+	// the leases the partner has handed out in the meantime are fetched before the range is split again
+	if n.state != models.FailoverNormal && !n.syncing {
+		n.syncing = true
+		go n.resync()
+	}
+
+	return nil
+}
+
+func (n *Node) checkTimeout() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	last := n.lastContact
+	if last.IsZero() {
+		last = n.started
+	}
+
+	if n.state != models.FailoverPartnerDown && time.Since(last) > time.Duration(n.conf.PeerTimeout)*time.Second {
+		logrus.WithFields(logrus.Fields{
+			"peer":         n.conf.Peer,
+			"last_contact": n.lastContact,
+		}).Warn("failover: lost contact with the partner, serving the whole range")
+		n.state = models.FailoverPartnerDown
+	}
+}
+
+func (n *Node) resync() {
+	var leases []models.FailoverLease
+	err := n.do(http.MethodGet, "leases", nil, &leases)
+
+	var applied int
+	if err == nil {
+		applied, err = Apply(leases)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.syncing = false
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"peer": n.conf.Peer,
+			"err":  err,
+		}).Warn("failover: failed to sync the leases of the partner")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"peer":    n.conf.Peer,
+		"leases":  len(leases),
+		"applied": applied,
+	}).Info("failover: in contact with the partner, splitting the range")
+	n.state = models.FailoverNormal
+}
+
+// Next returns the next free address of the share of this instance. If the partner is down the rest of the range is
+// handed out once the own share has been used up.
+func Next(pool *models.PoolWithAddresses) (net.IP, error) {
+	n := current
+	if n == nil {
+		return pool.Next()
+	}
+
+	n.mu.Lock()
+	state := n.state
+	n.mu.Unlock()
+
+	upper := n.conf.Role == RoleSecondary
+	pool.SetShare(n.conf.Split, upper)
+
+	ip, err := pool.Next()
+	if err == nil || state != models.FailoverPartnerDown {
+		return ip, err
+	}
+
+	pool.SetShare(n.conf.Split, !upper)
+	return pool.Next()
+}
+
+// do sends a request to the api of the partner
+func (n *Node) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/failover/%s", strings.TrimRight(n.conf.Peer, "/"), path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SecretHeader, n.conf.Secret)
+
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
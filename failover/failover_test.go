@@ -0,0 +1,74 @@
+package failover
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/models"
+)
+
+// benchPool is a /22 that is split in half, the first addresses of both shares are taken and every tenth of them is a
+// reservation
+func benchPool(lower int, upper int) *models.PoolWithAddresses {
+	pool := &models.PoolWithAddresses{
+		Pool: models.Pool{
+			NetAddress: "10.0.0.0",
+			PoolForm: models.PoolForm{
+				StartAddress: "10.0.0.10",
+				EndAddress:   "10.0.3.250",
+				Netmask:      22,
+				Gateway:      "10.0.0.1",
+			},
+		},
+	}
+
+	expires := time.Now().Add(time.Hour)
+	reservations := make(map[string][]models.Address)
+	for i := 0; i < lower+upper; i++ {
+		// the upper share starts with the 505th of the 1009 addresses
+		offset := 10 + i
+		if i >= lower {
+			offset = 10 + 504 + i - lower
+		}
+
+		item := models.Address{Expires: expires}
+		item.IP = fmt.Sprintf("10.0.%d.%d", offset/256, offset%256)
+		item.Mac = fmt.Sprintf("02:00:00:00:%02x:%02x", i>>8, i&0xff)
+		if i%10 == 0 {
+			item.Reserved = true
+			reservations[item.IP] = append(reservations[item.IP], item)
+		}
+		pool.Addresses = append(pool.Addresses, item)
+	}
+	pool.SetReservations(reservations)
+	return pool
+}
+
+func benchmarkNext(b *testing.B, state models.FailoverState, lower int, upper int) {
+	current = &Node{
+		conf:  config.Failover{Role: RoleSecondary, Split: 50},
+		state: state,
+	}
+	defer func() {
+		current = nil
+	}()
+	pool := benchPool(lower, upper)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Next(pool); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	benchmarkNext(b, models.FailoverNormal, 400, 400)
+}
+
+// BenchmarkNextPartnerDown hands out the share of the partner because the own one has been used up
+func BenchmarkNextPartnerDown(b *testing.B) {
+	benchmarkNext(b, models.FailoverPartnerDown, 400, 505)
+}
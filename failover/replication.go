@@ -0,0 +1,324 @@
+package failover
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// replicatedKey marks the writes of leases received from the partner, they are not sent back
+type replicatedKey struct{}
+
+// watch queues every address that is created or updated to be replicated. Deletes are not replicated, both instances
+// sweep their expired leases on their own.
+func (n *Node) watch(tx *gorm.DB) error {
+	enqueue := func(tx *gorm.DB) {
+		if tx.Error != nil || tx.Statement.Table != "addresses" {
+			return
+		}
+		if ctx := tx.Statement.Context; ctx != nil && ctx.Value(replicatedKey{}) != nil {
+			return
+		}
+
+		var id int
+		if v, ok := tx.Statement.Model.(*models.Address); ok {
+			id = v.ID
+		}
+		if v, ok := tx.Statement.Dest.(*models.Address); ok && id == 0 {
+			id = v.ID
+		}
+		if id == 0 {
+			return
+		}
+
+		select {
+		case n.queue <- id:
+		default:
+			n.mu.Lock()
+			n.pushAll = true
+			n.mu.Unlock()
+		}
+	}
+
+	cb := tx.Callback()
+	if err := cb.Create().After("gorm:create").Register("failover:replicate", enqueue); err != nil {
+		return err
+	}
+	return cb.Update().After("gorm:update").Register("failover:replicate", enqueue)
+}
+
+// replicate sends the queued addresses to the partner, a burst of writes is sent at once
+func (n *Node) replicate() {
+	for id := range n.queue {
+		ids := []int{id}
+		for more := true; more; {
+			select {
+			case id := <-n.queue:
+				ids = append(ids, id)
+			default:
+				more = false
+			}
+		}
+
+		var items []models.Address
+		if res := db.DB.Preload("Group").Where("id IN ?", ids).Find(&items); res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": res.Error,
+			}).Warn("failover: failed to load the leases to replicate")
+			continue
+		}
+
+		leases := make([]models.FailoverLease, 0, len(items))
+		for _, v := range items {
+			leases = append(leases, toLease(v))
+		}
+
+		if err := n.do(http.MethodPost, "leases", leases, nil); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"peer":   n.conf.Peer,
+				"leases": len(leases),
+				"err":    err,
+			}).Debug("failover: failed to replicate leases, sending all of them once the partner is back")
+
+			n.mu.Lock()
+			n.pushAll = true
+			n.mu.Unlock()
+		}
+	}
+}
+
+// pushLeases sends all active leases to the partner
+func (n *Node) pushLeases() {
+	leases, err := Leases()
+	if err == nil {
+		err = n.do(http.MethodPost, "leases", leases, nil)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"peer": n.conf.Peer,
+			"err":  err,
+		}).Warn("failover: failed to replicate all leases")
+
+		n.mu.Lock()
+		n.pushAll = true
+		n.mu.Unlock()
+	}
+}
+
+// Leases returns the reservations and the addresses that are leased or blocked right now
+func Leases() ([]models.FailoverLease, error) {
+	var items []models.Address
+	if res := db.DB.Preload("Group").Where("expires > ? OR "+models.ReservationCondition, time.Now()).Find(&items); res.Error != nil {
+		return nil, res.Error
+	}
+
+	leases := make([]models.FailoverLease, 0, len(items))
+	for _, v := range items {
+		leases = append(leases, toLease(v))
+	}
+	return leases, nil
+}
+
+// Apply writes the addresses received from the partner unless the local version is newer. An address is matched by
+// its ip and its client, the reimage flag is not part of the key because it changes when the host is installed. Every
+// address is written in a transaction of its own.
+func Apply(leases []models.FailoverLease) (int, error) {
+	tx := db.DB.WithContext(context.WithValue(context.Background(), replicatedKey{}, true))
+
+	var pools []models.Pool
+	if res := tx.Find(&pools); res.Error != nil {
+		return 0, res.Error
+	}
+
+	var groups []models.Group
+	if res := tx.Find(&groups); res.Error != nil {
+		return 0, res.Error
+	}
+	groupIDs := make(map[string]int32, len(groups))
+	for _, v := range groups {
+		groupIDs[v.Name] = int32(v.ID)
+	}
+
+	var applied int
+	for _, l := range leases {
+		var ok bool
+		// a failure must not leave the competing lease of the ip deleted without the replicated one
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			var err error
+			ok, err = applyLease(tx, pools, groupIDs, l)
+			return err
+		})
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied++
+		}
+	}
+
+	return applied, nil
+}
+
+// applyLease writes a single address received from the partner, it returns false if the lease has been skipped
+func applyLease(tx *gorm.DB, pools []models.Pool, groupIDs map[string]int32, l models.FailoverLease) (bool, error) {
+	var items []models.Address
+	if res := tx.Where("ip = ?", l.IP).Find(&items); res.Error != nil {
+		return false, res.Error
+	}
+
+	item := match(items, l)
+	if item != nil && !l.UpdatedAt.After(item.UpdatedAt) {
+		return false, nil
+	}
+
+	// the other address of the ip must not have the same reimage flag, a dynamic lease gives way to the
+	// partner while a local reservation is kept
+	for _, v := range items {
+		if (item != nil && v.ID == item.ID) || v.Reimage != l.Reimage {
+			continue
+		}
+		if v.IsReservation() {
+			logrus.WithFields(logrus.Fields{
+				"ip":  l.IP,
+				"mac": l.Mac,
+			}).Warn("failover: the replicated address conflicts with a local reservation, it has not been applied")
+			return false, nil
+		}
+	}
+	for i, v := range items {
+		if (item != nil && v.ID == item.ID) || v.Reimage != l.Reimage {
+			continue
+		}
+		if res := tx.Delete(&items[i]); res.Error != nil {
+			return false, res.Error
+		}
+	}
+
+	columns := map[string]interface{}{
+		"reimage":              l.Reimage,
+		"reserved":             l.Reserved,
+		"mac":                  l.Mac,
+		"hostname":             l.Hostname,
+		"domain":               l.Domain,
+		"duid":                 l.DUID,
+		"circuit_id":           l.CircuitID,
+		"remote_id":            l.RemoteID,
+		"ks":                   l.Ks,
+		"first_seen":           l.FirstSeen,
+		"last_seen":            l.LastSeen,
+		"last_seen_relay":      l.LastSeenRelay,
+		"last_seen_circuit_id": l.LastSeenCircuitID,
+		"last_seen_remote_id":  l.LastSeenRemoteID,
+		"conflict_mac":         l.ConflictMac,
+		"expires":              l.Expires,
+		"updated_at":           l.UpdatedAt,
+	}
+	// groups that only exist on the partner leave the group of the address as it is
+	if id, ok := groupIDs[l.Group]; ok {
+		columns["group_id"] = models.NullInt32{NullInt32: sql.NullInt32{Int32: id, Valid: true}}
+	} else if l.Group == "" {
+		columns["group_id"] = models.NullInt32{}
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"ip":    l.IP,
+			"group": l.Group,
+		}).Debug("failover: the group of the replicated address does not exist")
+	}
+
+	if item == nil {
+		pool := poolOf(pools, l.IP)
+		if pool == nil {
+			logrus.WithFields(logrus.Fields{
+				"ip": l.IP,
+			}).Debug("failover: no pool found for the replicated lease")
+			return false, nil
+		}
+
+		item = &models.Address{
+			AddressForm: models.AddressForm{
+				IP:      l.IP,
+				Mac:     l.Mac,
+				Reimage: l.Reimage,
+				PoolID:  models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}},
+			},
+		}
+		if res := tx.Create(item); res.Error != nil {
+			return false, res.Error
+		}
+	}
+
+	// the columns are written as they are, the update time is the one of the partner
+	if res := tx.Model(item).UpdateColumns(columns); res.Error != nil {
+		return false, res.Error
+	}
+	return true, nil
+}
+
+// match returns the address of the same client, or else the one that is of the same kind. A dynamic lease may have
+// been taken over by another client, and the mac address of a reservation may have been changed on the partner.
+func match(items []models.Address, l models.FailoverLease) *models.Address {
+	for i, v := range items {
+		if (l.Mac != "" && strings.EqualFold(v.Mac, l.Mac)) || (l.DUID != "" && v.DUID == l.DUID) ||
+			(l.CircuitID != "" && v.CircuitID == l.CircuitID && v.RemoteID == l.RemoteID) {
+			return &items[i]
+		}
+	}
+	for i, v := range items {
+		if v.IsReservation() == l.IsReservation() {
+			return &items[i]
+		}
+	}
+	return nil
+}
+
+func toLease(v models.Address) models.FailoverLease {
+	l := models.FailoverLease{
+		IP:                v.IP,
+		Reimage:           v.Reimage,
+		Reserved:          v.Reserved,
+		Mac:               v.Mac,
+		Hostname:          v.Hostname,
+		Domain:            v.Domain,
+		DUID:              v.DUID,
+		CircuitID:         v.CircuitID,
+		RemoteID:          v.RemoteID,
+		Ks:                v.Ks,
+		FirstSeen:         v.FirstSeen,
+		LastSeen:          v.LastSeen,
+		LastSeenRelay:     v.LastSeenRelay,
+		LastSeenCircuitID: v.LastSeenCircuitID,
+		LastSeenRemoteID:  v.LastSeenRemoteID,
+		ConflictMac:       v.ConflictMac,
+		Expires:           v.Expires,
+		UpdatedAt:         v.UpdatedAt,
+	}
+	if v.GroupID.Valid && v.GroupID.Int32 != 0 {
+		l.Group = v.Group.Name
+	}
+	return l
+}
+
+// poolOf returns the pool the ip belongs to, the pool ids of both instances differ
+func poolOf(pools []models.Pool, ip string) *models.Pool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+
+	for i, v := range pools {
+		_, ipNet, err := net.ParseCIDR(v.NetAddress + "/" + strconv.Itoa(v.Netmask))
+		if err == nil && ipNet.Contains(parsed) {
+			return &pools[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package failover
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// instance is the database of one server of a failover pair, the package works on db.DB so it is swapped in for every
+// step of a test
+type instance struct {
+	t  *testing.T
+	db *gorm.DB
+}
+
+// newInstance sets up a server with the same pool and group as its partner, the ids differ on purpose
+func newInstance(t *testing.T, name string, skip int) *instance {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), name+".db")), &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&models.Pool{}, &models.Group{}, &models.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= skip; i++ {
+		pool := models.Pool{
+			NetAddress: "10.0.0.0",
+			PoolForm: models.PoolForm{
+				Name:         name,
+				StartAddress: "10.0.0.10",
+				EndAddress:   "10.0.0.250",
+				Netmask:      24,
+				Gateway:      "10.0.0.1",
+			},
+		}
+		if i < skip {
+			pool.StartAddress = "192.168.0.10"
+			pool.EndAddress = "192.168.0.250"
+			pool.Gateway = "192.168.0.1"
+		}
+		if res := conn.Create(&pool); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		group := models.Group{GroupForm: models.GroupForm{PoolID: pool.ID, Name: "esxi"}}
+		if i < skip {
+			group.Name = "other"
+		}
+		if res := conn.Create(&group); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+
+	return &instance{t: t, db: conn}
+}
+
+func (in *instance) use() {
+	db.DB = in.db
+}
+
+// save writes an address like the dhcp server or the api of the instance does
+func (in *instance) save(item *models.Address) {
+	in.t.Helper()
+	in.use()
+	if item.PoolID.Int32 == 0 {
+		var pool models.Pool
+		if res := in.db.Where("net_address = ?", "10.0.0.0").First(&pool); res.Error != nil {
+			in.t.Fatal(res.Error)
+		}
+		item.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(pool.ID), Valid: true}}
+	}
+	if res := in.db.Save(item); res.Error != nil {
+		in.t.Fatal(res.Error)
+	}
+}
+
+func (in *instance) group(name string) models.NullInt32 {
+	in.t.Helper()
+	var group models.Group
+	if res := in.db.Where("name = ?", name).First(&group); res.Error != nil {
+		in.t.Fatal(res.Error)
+	}
+	return models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(group.ID), Valid: true}}
+}
+
+func (in *instance) addresses(ip string) []models.Address {
+	in.t.Helper()
+	var items []models.Address
+	if res := in.db.Preload("Group").Where("ip = ?", ip).Find(&items); res.Error != nil {
+		in.t.Fatal(res.Error)
+	}
+	return items
+}
+
+// replicateAll sends all addresses of an instance to its partner, like the push after the partner has come back
+func replicateAll(t *testing.T, from *instance, to *instance) int {
+	t.Helper()
+
+	from.use()
+	leases, err := Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to.use()
+	applied, err := Apply(leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return applied
+}
+
+func newPair(t *testing.T) (*instance, *instance) {
+	return newInstance(t, "primary", 0), newInstance(t, "secondary", 1)
+}
+
+func TestReplicateLease(t *testing.T) {
+	primary, secondary := newPair(t)
+
+	now := time.Now().Truncate(time.Second)
+	item := &models.Address{Expires: now.Add(time.Hour), FirstSeen: now, LastSeen: now}
+	item.IP = "10.0.0.10"
+	item.Mac = "02:00:00:00:00:01"
+	item.Hostname = "client"
+	primary.save(item)
+
+	if applied := replicateAll(t, primary, secondary); applied != 1 {
+		t.Fatalf("applied %d leases, expected 1", applied)
+	}
+
+	items := secondary.addresses("10.0.0.10")
+	if len(items) != 1 {
+		t.Fatalf("found %d addresses, expected 1", len(items))
+	}
+	if items[0].Mac != item.Mac || items[0].Hostname != item.Hostname || !items[0].Expires.Equal(item.Expires) {
+		t.Errorf("replicated %+v, expected %+v", items[0].AddressForm, item.AddressForm)
+	}
+	if items[0].PoolID.Int32 != 2 {
+		t.Errorf("replicated into pool %d, expected the local pool 2", items[0].PoolID.Int32)
+	}
+
+	// nothing changed, the partner has the same version
+	if applied := replicateAll(t, primary, secondary); applied != 0 {
+		t.Errorf("applied %d leases again, expected none", applied)
+	}
+}
+
+func TestReplicateReimage(t *testing.T) {
+	primary, secondary := newPair(t)
+
+	item := &models.Address{}
+	item.IP = "10.0.0.20"
+	item.Mac = "02:00:00:00:00:02"
+	item.Hostname = "esx01"
+	item.Reimage = true
+	item.GroupID = primary.group("esxi")
+	primary.save(item)
+	replicateAll(t, primary, secondary)
+
+	// the host has been installed
+	time.Sleep(10 * time.Millisecond)
+	item.Reimage = false
+	primary.save(item)
+	replicateAll(t, primary, secondary)
+
+	items := secondary.addresses("10.0.0.20")
+	if len(items) != 1 {
+		t.Fatalf("found %d addresses, expected the reimage flag to be updated in place", len(items))
+	}
+	if items[0].Reimage {
+		t.Errorf("the reimage flag has not been replicated")
+	}
+}
+
+func TestReplicateReservation(t *testing.T) {
+	primary, secondary := newPair(t)
+
+	item := &models.Address{}
+	item.IP = "10.0.0.30"
+	item.Mac = "02:00:00:00:00:03"
+	item.Hostname = "esx02"
+	item.Domain = "example.com"
+	item.CircuitID = "eth1/1/3"
+	item.RemoteID = "leaf1"
+	item.Ks = "a3MuY2Zn"
+	item.Reserved = true
+	item.GroupID = primary.group("esxi")
+	primary.save(item)
+	replicateAll(t, primary, secondary)
+
+	items := secondary.addresses("10.0.0.30")
+	if len(items) != 1 {
+		t.Fatalf("found %d addresses, expected 1", len(items))
+	}
+	got := items[0]
+	if !got.Reserved || got.Domain != item.Domain || got.CircuitID != item.CircuitID || got.RemoteID != item.RemoteID || got.Ks != item.Ks {
+		t.Errorf("replicated %+v, expected %+v", got.AddressForm, item.AddressForm)
+	}
+	// the group has another id on the secondary
+	if got.GroupID != secondary.group("esxi") || got.Group.Name != "esxi" {
+		t.Errorf("replicated into group %d %q, expected esxi", got.GroupID.Int32, got.Group.Name)
+	}
+
+	// the host got a new network card
+	time.Sleep(10 * time.Millisecond)
+	item.Mac = "02:00:00:00:00:33"
+	primary.save(item)
+	replicateAll(t, primary, secondary)
+
+	items = secondary.addresses("10.0.0.30")
+	if len(items) != 1 || items[0].Mac != item.Mac {
+		t.Errorf("found %+v, expected the mac address of the reservation to be updated", items)
+	}
+}
+
+func TestReplicateTakenOverLease(t *testing.T) {
+	primary, secondary := newPair(t)
+
+	now := time.Now()
+	item := &models.Address{Expires: now.Add(time.Hour)}
+	item.IP = "10.0.0.40"
+	item.Mac = "02:00:00:00:00:04"
+	secondary.save(item)
+
+	// the lease expired on the secondary and the primary gave the ip to another client in the meantime
+	time.Sleep(10 * time.Millisecond)
+	other := &models.Address{Expires: now.Add(2 * time.Hour)}
+	other.IP = "10.0.0.40"
+	other.Mac = "02:00:00:00:00:44"
+	primary.save(other)
+	replicateAll(t, primary, secondary)
+
+	items := secondary.addresses("10.0.0.40")
+	if len(items) != 1 || items[0].ID != item.ID || items[0].Mac != other.Mac {
+		t.Errorf("found %+v, expected the lease to be taken over by %s", items, other.Mac)
+	}
+}
+
+func TestReplicateOlderVersion(t *testing.T) {
+	primary, secondary := newPair(t)
+
+	item := &models.Address{Expires: time.Now().Add(time.Hour)}
+	item.IP = "10.0.0.50"
+	item.Mac = "02:00:00:00:00:05"
+	item.Hostname = "old"
+	primary.save(item)
+	replicateAll(t, primary, secondary)
+
+	time.Sleep(10 * time.Millisecond)
+	local := secondary.addresses("10.0.0.50")[0]
+	local.Hostname = "new"
+	secondary.save(&local)
+
+	if applied := replicateAll(t, primary, secondary); applied != 0 {
+		t.Errorf("applied %d leases, expected the older version to be ignored", applied)
+	}
+	if items := secondary.addresses("10.0.0.50"); items[0].Hostname != "new" {
+		t.Errorf("found hostname %q, expected the newer local one", items[0].Hostname)
+	}
+}
+
+func TestReplicateConflictingReservation(t *testing.T) {
+	primary, secondary := newPair(t)
+
+	item := &models.Address{Expires: time.Now().Add(time.Hour)}
+	item.IP = "10.0.0.60"
+	item.Mac = "02:00:00:00:00:06"
+	primary.save(item)
+
+	// the ip has been reserved for another host on the secondary only
+	reservation := &models.Address{}
+	reservation.IP = "10.0.0.60"
+	reservation.Mac = "02:00:00:00:00:66"
+	reservation.Reserved = true
+	secondary.save(reservation)
+	replicateAll(t, primary, secondary)
+
+	items := secondary.addresses("10.0.0.60")
+	if len(items) != 1 || items[0].ID != reservation.ID || items[0].Mac != reservation.Mac {
+		t.Errorf("found %+v, expected the local reservation to be kept", items)
+	}
+}
+
+func TestReplicateFailure(t *testing.T) {
+	primary, secondary := newPair(t)
+
+	now := time.Now()
+	item := &models.Address{Expires: now.Add(time.Hour)}
+	item.IP = "10.0.0.70"
+	item.Mac = "02:00:00:00:00:07"
+	secondary.save(item)
+
+	time.Sleep(10 * time.Millisecond)
+	other := &models.Address{Expires: now.Add(2 * time.Hour)}
+	other.IP = "10.0.0.70"
+	other.Mac = "02:00:00:00:00:77"
+	other.Reserved = true
+	primary.save(other)
+
+	// the reservation of the partner replaces the lease, writing it fails after the lease has been deleted
+	failed := errors.New("failed")
+	secondary.db.Callback().Update().Before("gorm:update").Register("test:fail", func(tx *gorm.DB) {
+		tx.AddError(failed)
+	})
+
+	primary.use()
+	leases, err := Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary.use()
+	if _, err := Apply(leases); !errors.Is(err, failed) {
+		t.Fatalf("got %v, expected the replication to fail", err)
+	}
+
+	items := secondary.addresses("10.0.0.70")
+	if len(items) != 1 || items[0].ID != item.ID || items[0].Mac != item.Mac {
+		t.Errorf("found %+v, expected the lease to be kept", items)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+)
+
+// UEFI HTTP Boot clients identify themselves with the HTTPClient vendor class and get the URL of mboot.efi instead of
+// a file name. mboot.efi loads boot.cfg and the modules relative to its own URL, so everything that is served over
+// tftp is also served below /boot. The firmware has to trust the CA of the appliance (cert/ca.crt) to boot over https.
+
+// httpBootURL returns the URL of mboot.efi on the appliance
+func httpBootURL(ip net.IP, conf *config.Config) string {
+	return "https://" + net.JoinHostPort(ip.String(), strconv.Itoa(conf.Port)) + "/boot/mboot.efi"
+}
+
+// httpBoot serves the boot files over https, using the same per host logic as tftp
+func httpBoot(conf *config.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		filename := strings.TrimPrefix(path.Clean("/"+c.Param("filepath")), "/")
+
+		// the address of the appliance that the host has reached, it is used for the kickstart url
+		var laddr net.IP
+		if v, ok := c.Request.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+			laddr = v.IP
+		}
+
+		ip := c.RemoteIP()
+		address, image := bootAddress(ip)
+
+		logrus.WithFields(logrus.Fields{
+			"raddr":     ip,
+			"laddr":     laddr,
+			"filename":  filename,
+			"imageid":   image.ID,
+			"addressid": address.ID,
+		}).Debug("httpboot")
+
+		if filename == "boot.cfg" {
+			bc, err := bootCfg(ip, address, image, laddr, conf)
+			if err != nil {
+				logrus.Warn(err)
+				c.Status(http.StatusNotFound) // 404
+				return
+			}
+			c.Data(http.StatusOK, "text/plain", bc) // 200
+			return
+		}
+
+		filename = bootFile(filename, ip, &address, image)
+		file, err := os.Open(filename)
+		if err != nil {
+			c.Status(http.StatusNotFound) // 404
+			return
+		}
+		defer file.Close()
+
+		fi, err := file.Stat()
+		if err != nil || fi.IsDir() {
+			c.Status(http.StatusNotFound) // 404
+			return
+		}
+
+		// ServeContent handles range requests
+		http.ServeContent(c.Writer, c.Request, fi.Name(), fi.ModTime(), file)
+
+		logrus.WithFields(logrus.Fields{
+			"id":    address.ID,
+			"ip":    address.IP,
+			"host":  address.Hostname,
+			"file":  filename,
+			"bytes": fi.Size(),
+		}).Info("httpboot")
+	}
+}
+
+// imageURL returns the url the image is served at when the modules are downloaded over http
+func imageURL(ip net.IP, image models.Image, conf *config.Config) string {
+	return "http://" + net.JoinHostPort(ip.String(), strconv.Itoa(conf.ImagePort)) + "/images/" + strconv.Itoa(image.ID) + "/"
+}
+
+// serveImages serves the image directories read-only over plain http, mboot.efi is not able to download the modules
+// over https when it has been loaded over tftp
+func serveImages(conf *config.Config) {
+	r := gin.New()
+	if err := r.SetTrustedProxies(nil); err != nil {
+		logrus.Fatal(err)
+	}
+	r.GET("images/:id/*filepath", imageFile)
+	r.HEAD("images/:id/*filepath", imageFile)
+
+	listen := ":" + strconv.Itoa(conf.ImagePort)
+	logrus.WithFields(logrus.Fields{
+		"port": listen,
+	}).Info("Imageserver")
+
+	err := http.ListenAndServe(listen, r)
+
+	logrus.WithFields(logrus.Fields{
+		"error": err,
+	}).Error("Imageserver")
+}
+
+// imageFile serves a file of an image with support for range requests
+func imageFile(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusBadRequest) // 400
+		return
+	}
+
+	var image models.Image
+	if res := db.DB.First(&image, id); res.Error != nil {
+		c.Status(http.StatusNotFound) // 404
+		return
+	}
+
+	// the files on the iso are upper case while boot.cfg refers to them in lower case
+	name := path.Clean("/" + c.Param("filepath"))
+	filename := image.Path + name
+	if _, err := os.Stat(filename); err != nil {
+		dir, file := path.Split(name)
+		filename = image.Path + dir + strings.ToUpper(file)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		c.Status(http.StatusNotFound) // 404
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil || fi.IsDir() {
+		c.Status(http.StatusNotFound) // 404
+		return
+	}
+
+	http.ServeContent(c.Writer, c.Request, fi.Name(), fi.ModTime(), file)
+
+	logrus.WithFields(logrus.Fields{
+		"raddr": c.RemoteIP(),
+		"image": image.ID,
+		"file":  filename,
+		"range": c.GetHeader("Range"),
+	}).Debug("imageserver")
+}
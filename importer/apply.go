@@ -0,0 +1,334 @@
+package importer
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// target is a pool that addresses can be imported into, either one that exists or one of the export
+type target struct {
+	pool     models.Pool
+	net      *net.IPNet
+	imported int // index of the pool in the report, -1 for existing pools
+}
+
+// Run checks the pools and addresses of the report against the database and decides what to do with them, they are
+// created unless it is a dry run. Nothing that exists is overwritten, except for expired leases and for leases of the
+// same client that become a reservation. Conflicts are skipped, the rest is imported in one transaction.
+func Run(report *models.ImportReport, dryRun bool) error {
+	report.DryRun = dryRun
+
+	var existing []models.Pool
+	if res := db.DB.Find(&existing); res.Error != nil {
+		return res.Error
+	}
+
+	var rows []models.Address
+	if res := db.DB.Find(&rows); res.Error != nil {
+		return res.Error
+	}
+
+	var targets []*target
+	for _, v := range existing {
+		_, ipNet, err := net.ParseCIDR(v.NetAddress + "/" + strconv.Itoa(v.Netmask))
+		if err != nil {
+			continue
+		}
+		targets = append(targets, &target{pool: v, net: ipNet, imported: -1})
+	}
+
+	for i := range report.Pools {
+		if t := planPool(&report.Pools[i], targets); t != nil {
+			t.imported = i
+			targets = append(targets, t)
+		}
+	}
+
+	byIP := make(map[string][]models.Address)
+	for _, v := range rows {
+		byIP[v.IP] = append(byIP[v.IP], v)
+	}
+
+	plans := make([]addressPlan, len(report.Addresses))
+	seen := make(map[string]bool)
+	macs := make(map[*target]map[string]string)
+	for _, t := range targets {
+		macs[t] = make(map[string]string)
+	}
+	for _, v := range rows {
+		if !v.IsReservation() || v.Mac == "" {
+			continue
+		}
+		for _, t := range targets {
+			if t.imported < 0 && v.PoolID.Valid && int(v.PoolID.Int32) == t.pool.ID {
+				macs[t][v.Mac] = v.IP
+			}
+		}
+	}
+
+	for i := range report.Addresses {
+		plans[i] = planAddress(&report.Addresses[i], targets, byIP, seen, macs)
+	}
+
+	for _, v := range report.Pools {
+		count(report, v.Action)
+	}
+	for _, v := range report.Addresses {
+		count(report, v.Action)
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		for i := range report.Pools {
+			item := &report.Pools[i]
+			if item.Action != models.ImportCreate {
+				continue
+			}
+
+			pool := newModelPool(item)
+			if res := tx.Create(&pool); res.Error != nil {
+				return fmt.Errorf("pool %s: %w", item.Name, res.Error)
+			}
+			item.PoolID = pool.ID
+			for _, t := range targets {
+				if t.imported == i {
+					t.pool.ID = pool.ID
+				}
+			}
+		}
+
+		for i := range report.Addresses {
+			item := &report.Addresses[i]
+			plan := plans[i]
+			if item.Action != models.ImportCreate && item.Action != models.ImportUpdate {
+				continue
+			}
+
+			item.PoolID = plan.target.pool.ID
+			row := plan.row
+			if row == nil {
+				row = &models.Address{}
+			}
+			applyAddress(row, item)
+
+			if res := tx.Save(row); res.Error != nil {
+				return fmt.Errorf("address %s: %w", item.IP, res.Error)
+			}
+			item.AddressID = row.ID
+		}
+
+		return nil
+	})
+}
+
+func count(report *models.ImportReport, action string) {
+	switch action {
+	case models.ImportCreate:
+		report.Created++
+	case models.ImportUpdate:
+		report.Updated++
+	case models.ImportExists:
+		report.Existing++
+	case models.ImportConflict:
+		report.Conflicts++
+	}
+}
+
+func newModelPool(item *models.ImportPool) models.Pool {
+	return models.Pool{
+		NetAddress: item.NetAddress,
+		PoolForm: models.PoolForm{
+			Name:              item.Name,
+			StartAddress:      item.StartAddress,
+			EndAddress:        item.EndAddress,
+			Netmask:           item.Netmask,
+			LeaseTime:         item.LeaseTime,
+			Gateway:           item.Gateway,
+			Exclusions:        item.Exclusions,
+			OnlyServeReserved: item.OnlyServeReserved,
+		},
+	}
+}
+
+// planPool decides what to do with a pool of the export, it returns the target for its addresses unless the pool
+// exists already or is in conflict
+func planPool(item *models.ImportPool, targets []*target) *target {
+	conflict := func(format string, args ...interface{}) *target {
+		item.Action = models.ImportConflict
+		item.Reason = fmt.Sprintf(format, args...)
+		return nil
+	}
+
+	pool := newModelPool(item)
+	if err := pool.BeforeSave(nil); err != nil {
+		return conflict("%s", err)
+	}
+
+	_, ipNet, err := net.ParseCIDR(pool.NetAddress + "/" + strconv.Itoa(pool.Netmask))
+	if err != nil {
+		return conflict("%s", err)
+	}
+
+	for _, t := range targets {
+		if !t.net.Contains(ipNet.IP) && !ipNet.Contains(t.net.IP) {
+			continue
+		}
+
+		switch {
+		case t.imported >= 0:
+			return conflict("overlaps %s of the export", t.pool.Name)
+		case t.net.String() != ipNet.String():
+			return conflict("overlaps pool %d (%s, %s)", t.pool.ID, t.pool.Name, t.net)
+		}
+
+		item.Action = models.ImportExists
+		item.PoolID = t.pool.ID
+		if t.pool.StartAddress != pool.StartAddress || t.pool.EndAddress != pool.EndAddress {
+			item.Reason = fmt.Sprintf("pool %d (%s) keeps its range %s-%s", t.pool.ID, t.pool.Name, t.pool.StartAddress, t.pool.EndAddress)
+		}
+		return nil
+	}
+
+	item.Action = models.ImportCreate
+	return &target{pool: pool, net: ipNet}
+}
+
+type addressPlan struct {
+	target *target
+	// row is the address that is taken over, a new one is created if it is nil
+	row *models.Address
+}
+
+// planAddress decides what to do with an address of the export
+func planAddress(item *models.ImportAddress, targets []*target, byIP map[string][]models.Address, seen map[string]bool, macs map[*target]map[string]string) addressPlan {
+	var plan addressPlan
+	conflict := func(format string, args ...interface{}) addressPlan {
+		item.Action = models.ImportConflict
+		item.Reason = fmt.Sprintf(format, args...)
+		return plan
+	}
+
+	ip := net.ParseIP(item.IP)
+	if ip == nil {
+		return conflict("%q is not an ip address", item.IP)
+	}
+	item.IP = ip.String()
+
+	switch {
+	case item.Mac == "" && item.DUID == "" && item.CircuitID == "":
+		return conflict("the address has no mac address, duid or circuit id")
+	case item.Mac != "" && len(item.Mac) != 17:
+		return conflict("invalid mac address %q", item.Mac)
+	case item.DUID != "" && !validDUID(item.DUID):
+		return conflict("invalid duid %q", item.DUID)
+	}
+
+	for _, t := range targets {
+		if (ip.To4() == nil) == t.pool.IsIPv6() && t.net.Contains(ip) {
+			plan.target = t
+			break
+		}
+	}
+	if plan.target == nil {
+		return conflict("no pool contains the address")
+	}
+	item.Pool = plan.target.pool.Name
+	item.PoolID = plan.target.pool.ID
+
+	// the exclusions of the export are where its reservations are, the ones that have been set up here belong to
+	// devices that are not managed by us
+	if plan.target.imported < 0 && plan.target.pool.IsExcluded(ip) {
+		return conflict("excluded from pool %d", plan.target.pool.ID)
+	}
+	if item.IP == plan.target.pool.Gateway {
+		return conflict("the address is the gateway of the pool")
+	}
+
+	if seen[item.IP] {
+		return conflict("the address is part of the export more than once")
+	}
+	seen[item.IP] = true
+
+	if !item.Lease && item.Mac != "" {
+		if other, ok := macs[plan.target][item.Mac]; ok && other != item.IP {
+			return conflict("the mac address has a reservation for %s already", other)
+		}
+		macs[plan.target][item.Mac] = item.IP
+	}
+
+	now := time.Now()
+	for _, v := range byIP[item.IP] {
+		v := v
+		same := (item.Mac != "" && v.Mac == item.Mac) || (item.DUID != "" && v.DUID == item.DUID) ||
+			(item.CircuitID != "" && v.CircuitID == item.CircuitID)
+
+		switch {
+		case same && (v.IsReservation() || (item.Lease && !v.Expires.Before(*item.Expires))):
+			item.Action = models.ImportExists
+			item.AddressID = v.ID
+			return plan
+		case same:
+			// the lease becomes a reservation or is extended
+			plan.row = &v
+		case v.IsReservation():
+			return conflict("reserved for %s (address %d)", describeClient(v), v.ID)
+		case v.Expires.After(now):
+			return conflict("leased to %s until %s (address %d)", describeClient(v), v.Expires.Format(time.RFC3339), v.ID)
+		case plan.row == nil && !v.Reimage:
+			// an expired lease of someone else
+			plan.row = &v
+		}
+	}
+
+	if plan.row != nil {
+		item.Action = models.ImportUpdate
+		item.AddressID = plan.row.ID
+	} else {
+		item.Action = models.ImportCreate
+	}
+	return plan
+}
+
+func describeClient(v models.Address) string {
+	switch {
+	case v.Mac != "":
+		return v.Mac
+	case v.DUID != "":
+		return "duid " + v.DUID
+	default:
+		return "circuit id " + v.CircuitID
+	}
+}
+
+// applyAddress writes the imported address into the row
+func applyAddress(row *models.Address, item *models.ImportAddress) {
+	row.IP = item.IP
+	row.Mac = item.Mac
+	row.DUID = item.DUID
+	row.CircuitID = item.CircuitID
+	row.RemoteID = item.RemoteID
+	row.PoolID = models.NullInt32{NullInt32: sql.NullInt32{Int32: int32(item.PoolID), Valid: true}}
+
+	if item.Hostname != "" {
+		row.Hostname = item.Hostname
+	}
+	if item.Domain != "" {
+		row.Domain = item.Domain
+	}
+
+	if item.Lease {
+		row.Expires = *item.Expires
+	} else {
+		row.Reserved = true
+	}
+}
@@ -0,0 +1,250 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tribock/go-via/models"
+)
+
+// The importer takes over the subnets, reservations and active leases of another dhcp server. Every subnet or scope
+// becomes a pool, the dynamic ranges of a subnet are merged into one range and the gaps between them are excluded from
+// the dynamic allocation. Reservations and leases are assigned to the pool whose network contains them.
+
+const (
+	FormatISC       = "isc"
+	FormatISCLeases = "isc-leases"
+	FormatKea       = "kea"
+	FormatWindows   = "windows"
+)
+
+var Formats = []string{FormatISC, FormatISCLeases, FormatKea, FormatWindows}
+
+var leasePattern = regexp.MustCompile(`(?m)^\s*(lease|ia-na|ia-ta|ia-pd)\s+\S+\s*\{`)
+
+// Detect guesses the format of an export from its content
+func Detect(data []byte) string {
+	data = bytes.TrimSpace(utf8Export(data))
+	switch {
+	case bytes.HasPrefix(data, []byte("<")):
+		return FormatWindows
+	case bytes.Contains(data, []byte(`"Dhcp4"`)) || bytes.Contains(data, []byte(`"Dhcp6"`)):
+		return FormatKea
+	case leasePattern.Match(data):
+		return FormatISCLeases
+	default:
+		return FormatISC
+	}
+}
+
+// Parse reads the pools and addresses of an export, the format is detected if it is empty. Nothing has been checked
+// against the database yet, that is done by Run.
+func Parse(format string, data []byte) (*models.ImportReport, error) {
+	if format == "" {
+		format = Detect(data)
+	}
+
+	var pools []models.ImportPool
+	var addresses []models.ImportAddress
+	var err error
+	switch format {
+	case FormatISC:
+		pools, addresses, err = parseDhcpdConf(data)
+	case FormatISCLeases:
+		addresses, err = parseDhcpdLeases(data)
+	case FormatKea:
+		pools, addresses, err = parseKea(data)
+	case FormatWindows:
+		pools, addresses, err = parseWindows(data)
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(Formats, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", format, err)
+	}
+
+	return &models.ImportReport{
+		Format:    format,
+		Pools:     pools,
+		Addresses: addresses,
+	}, nil
+}
+
+// newPool describes the pool of a network with the given dynamic ranges, it only serves reservations if there are none
+func newPool(name string, network *net.IPNet, ranges [][2]net.IP, gateway string, leaseTime int) models.ImportPool {
+	// the routers of an outer scope may be of the other address family
+	if gw := net.ParseIP(gateway); gw == nil || (gw.To4() == nil) != (network.IP.To4() == nil) {
+		gateway = ""
+	}
+
+	ones, _ := network.Mask.Size()
+	pool := models.ImportPool{
+		Name:       name,
+		NetAddress: network.IP.String(),
+		Netmask:    ones,
+		Gateway:    gateway,
+		LeaseTime:  leaseTime,
+	}
+	if pool.Name == "" {
+		pool.Name = network.String()
+	}
+
+	if len(ranges) == 0 {
+		start, end := hostRange(network)
+		pool.StartAddress = start.String()
+		pool.EndAddress = end.String()
+		pool.OnlyServeReserved = true
+		return pool
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i][0].To16(), ranges[j][0].To16()) < 0
+	})
+
+	// the gaps between the ranges are never handed out by the other server either
+	var exclusions []string
+	end := ranges[0][1]
+	for _, v := range ranges[1:] {
+		if gapStart, gapEnd := nextIP(end), prevIP(v[0]); bytes.Compare(gapStart.To16(), gapEnd.To16()) <= 0 {
+			if gapStart.Equal(gapEnd) {
+				exclusions = append(exclusions, gapStart.String())
+			} else {
+				exclusions = append(exclusions, gapStart.String()+"-"+gapEnd.String())
+			}
+		}
+		if bytes.Compare(v[1].To16(), end.To16()) > 0 {
+			end = v[1]
+		}
+	}
+
+	pool.StartAddress = ranges[0][0].String()
+	pool.EndAddress = end.String()
+	pool.Exclusions = strings.Join(exclusions, ", ")
+	return pool
+}
+
+// parseRange parses a range of addresses, either "start end", "start - end" or a prefix
+func parseRange(s string) ([2]net.IP, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return [2]net.IP{}, err
+		}
+		return [2]net.IP{ipNet.IP, lastIP(ipNet)}, nil
+	}
+
+	fields := strings.Fields(strings.Replace(s, "-", " ", 1))
+	if len(fields) == 1 {
+		fields = append(fields, fields[0])
+	}
+	if len(fields) != 2 {
+		return [2]net.IP{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+	if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) || bytes.Compare(start.To16(), end.To16()) > 0 {
+		return [2]net.IP{}, fmt.Errorf("invalid range %q", s)
+	}
+	return [2]net.IP{start, end}, nil
+}
+
+// hostRange returns the first and the last address of a network that can be given to a host
+func hostRange(network *net.IPNet) (net.IP, net.IP) {
+	start := nextIP(network.IP)
+	end := lastIP(network)
+	if network.IP.To4() != nil {
+		end = prevIP(end)
+	}
+	return start, end
+}
+
+func lastIP(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range ip {
+		ip[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip
+}
+
+func nextIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// normalizeMac writes a mac address the way net.HardwareAddr does, the other servers also accept octets without a
+// leading zero like 0:50:56:a:b:c
+func normalizeMac(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ':' || r == '-'
+	})
+	if len(parts) == 6 {
+		for i, v := range parts {
+			if len(v) == 1 {
+				parts[i] = "0" + v
+			}
+		}
+		s = strings.Join(parts, ":")
+	}
+
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		// kept as it is, the address is reported as conflict
+		return s
+	}
+	return mac.String()
+}
+
+// normalizeDUID hex encodes a DUID without separators, the way the DHCPv6 server stores it
+func normalizeDUID(s string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", " ", "").Replace(s))
+}
+
+// splitFQDN splits a host name into the name and the domain, the domain is only used for names that have none
+func splitFQDN(name string, domain string) (string, string) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if i := strings.Index(name, "."); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, domain
+}
+
+// validDUID reports if the DUID has been hex encoded
+func validDUID(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) >= 4
+}
@@ -0,0 +1,437 @@
+package importer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tribock/go-via/models"
+)
+
+// dhcpd.conf and dhcpd.leases share the same syntax, statements end with a semicolon and declarations have a block of
+// statements in braces
+
+// iscDefaultLeaseTime is what dhcpd uses if the configuration has no default-lease-time
+const iscDefaultLeaseTime = 43200
+
+type iscNode struct {
+	args     []string
+	block    bool
+	children []*iscNode
+}
+
+// arg returns the nth argument or an empty string
+func (n *iscNode) arg(i int) string {
+	if i < len(n.args) {
+		return n.args[i]
+	}
+	return ""
+}
+
+// values returns the arguments after the first skip ones, without the commas of lists
+func (n *iscNode) values(skip int) []string {
+	var items []string
+	if skip > len(n.args) {
+		return nil
+	}
+	for _, v := range n.args[skip:] {
+		if v != "," {
+			items = append(items, v)
+		}
+	}
+	return items
+}
+
+// is reports if the node starts with the words
+func (n *iscNode) is(words ...string) bool {
+	if len(n.args) < len(words) {
+		return false
+	}
+	for i, v := range words {
+		if n.args[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenizeISC splits the file into words, quoted strings, commas, semicolons and braces. Comments are dropped and
+// the escapes of quoted strings are resolved, dhcpd.leases writes binary ids with octal escapes.
+func tokenizeISC(data []byte) ([]string, error) {
+	var tokens []string
+	line := 1
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			line++
+		case c == '{' || c == '}' || c == ';' || c == ',':
+			tokens = append(tokens, string(c))
+		case c == '"':
+			var b []byte
+			i++
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] != '\\' || i+1 >= len(data) {
+					b = append(b, data[i])
+					continue
+				}
+				i++
+				switch {
+				case i+2 < len(data) && isOctal(data[i]) && isOctal(data[i+1]) && isOctal(data[i+2]):
+					v, _ := strconv.ParseUint(string(data[i:i+3]), 8, 8)
+					b = append(b, byte(v))
+					i += 2
+				case data[i] == 'n':
+					b = append(b, '\n')
+				case data[i] == 't':
+					b = append(b, '\t')
+				default:
+					b = append(b, data[i])
+				}
+			}
+			if i >= len(data) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			tokens = append(tokens, string(b))
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n{};,#\"", rune(data[i])) {
+				i++
+			}
+			tokens = append(tokens, string(data[start:i]))
+			i--
+		}
+	}
+	return tokens, nil
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// parseISC builds the tree of statements and declarations
+func parseISC(data []byte) ([]*iscNode, error) {
+	tokens, err := tokenizeISC(data)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &iscNode{block: true}
+	stack := []*iscNode{root}
+	current := &iscNode{}
+	for _, t := range tokens {
+		parent := stack[len(stack)-1]
+		switch t {
+		case ";":
+			if len(current.args) > 0 {
+				parent.children = append(parent.children, current)
+			}
+			current = &iscNode{}
+		case "{":
+			current.block = true
+			parent.children = append(parent.children, current)
+			stack = append(stack, current)
+			current = &iscNode{}
+		case "}":
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("unexpected }")
+			}
+			if len(current.args) > 0 {
+				return nil, fmt.Errorf("missing ; after %s", strings.Join(current.args, " "))
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			current.args = append(current.args, t)
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("missing } after %s", strings.Join(stack[len(stack)-1].args, " "))
+	}
+
+	return root.children, nil
+}
+
+// iscScope are the parameters that are inherited by the declarations of a block
+type iscScope struct {
+	shared    string
+	leaseTime int
+	gateway   string
+	domain    string
+}
+
+// inherit applies the parameters of a block, dhcpd does not care where in the block they are
+func (s iscScope) inherit(nodes []*iscNode) iscScope {
+	for _, v := range nodes {
+		switch {
+		case v.block:
+		case v.is("default-lease-time"):
+			if n, err := strconv.Atoi(v.arg(1)); err == nil {
+				s.leaseTime = n
+			}
+		case v.is("option", "routers"):
+			if items := v.values(2); len(items) > 0 {
+				s.gateway = items[0]
+			}
+		case v.is("option", "domain-name"):
+			s.domain = v.arg(2)
+		}
+	}
+	return s
+}
+
+// parseDhcpdConf reads the subnets and the hosts with fixed addresses of a dhcpd.conf
+func parseDhcpdConf(data []byte) ([]models.ImportPool, []models.ImportAddress, error) {
+	nodes, err := parseISC(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pools []models.ImportPool
+	var addresses []models.ImportAddress
+
+	var walk func(nodes []*iscNode, scope iscScope) error
+	walk = func(nodes []*iscNode, scope iscScope) error {
+		scope = scope.inherit(nodes)
+
+		for _, v := range nodes {
+			if !v.block {
+				continue
+			}
+
+			switch {
+			case v.is("shared-network"):
+				shared := scope
+				shared.shared = v.arg(1)
+				if err := walk(v.children, shared); err != nil {
+					return err
+				}
+			case v.is("group"):
+				if err := walk(v.children, scope); err != nil {
+					return err
+				}
+			case v.is("subnet") || v.is("subnet6"):
+				pool, err := iscSubnet(v, scope.inherit(v.children))
+				if err != nil {
+					return err
+				}
+				pools = append(pools, pool)
+				if err := walk(v.children, scope); err != nil {
+					return err
+				}
+			case v.is("host"):
+				addresses = append(addresses, iscHost(v, scope.inherit(v.children))...)
+			}
+		}
+		return nil
+	}
+
+	if err := walk(nodes, iscScope{leaseTime: iscDefaultLeaseTime}); err != nil {
+		return nil, nil, err
+	}
+
+	return pools, addresses, nil
+}
+
+// iscSubnet converts a subnet or subnet6 declaration along with the ranges of its pools
+func iscSubnet(n *iscNode, scope iscScope) (models.ImportPool, error) {
+	var network *net.IPNet
+	var err error
+	if n.is("subnet6") {
+		_, network, err = net.ParseCIDR(n.arg(1))
+	} else {
+		ip, mask := net.ParseIP(n.arg(1)).To4(), net.ParseIP(n.arg(3)).To4()
+		if ip == nil || mask == nil || n.arg(2) != "netmask" {
+			err = fmt.Errorf("invalid subnet")
+		} else {
+			network = &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+		}
+	}
+	if err != nil {
+		return models.ImportPool{}, fmt.Errorf("%s: %w", strings.Join(n.args, " "), err)
+	}
+
+	var ranges [][2]net.IP
+	var collect func(nodes []*iscNode) error
+	collect = func(nodes []*iscNode) error {
+		for _, v := range nodes {
+			switch {
+			case v.block && (v.is("pool") || v.is("pool6")):
+				if err := collect(v.children); err != nil {
+					return err
+				}
+			case v.is("range") || v.is("range6"):
+				// range [dynamic-bootp] start [end], range6 start end, range6 prefix or range6 start temporary
+				var items []string
+				for _, arg := range v.args[1:] {
+					if arg != "dynamic-bootp" && arg != "temporary" {
+						items = append(items, arg)
+					}
+				}
+				r, err := parseRange(strings.Join(items, " "))
+				if err != nil {
+					return fmt.Errorf("%s: %w", strings.Join(v.args, " "), err)
+				}
+				ranges = append(ranges, r)
+			}
+		}
+		return nil
+	}
+	if err := collect(n.children); err != nil {
+		return models.ImportPool{}, err
+	}
+
+	var name string
+	if scope.shared != "" {
+		name = scope.shared + " " + network.String()
+	}
+
+	return newPool(name, network, ranges, scope.gateway, scope.leaseTime), nil
+}
+
+// iscHost converts a host declaration, there is one reservation for every fixed address. Hosts without a fixed
+// address only make the client known to dhcpd, they have no reservation.
+func iscHost(n *iscNode, scope iscScope) []models.ImportAddress {
+	host := models.ImportAddress{Hostname: n.arg(1)}
+	var ips []string
+	for _, v := range n.children {
+		switch {
+		case v.is("hardware", "ethernet"):
+			host.Mac = normalizeMac(v.arg(2))
+		case v.is("fixed-address") || v.is("fixed-address6"):
+			ips = append(ips, v.values(1)...)
+		case v.is("host-identifier", "option", "dhcp6.client-id"):
+			host.DUID = normalizeDUID(v.arg(3))
+		case v.is("option", "host-name"):
+			host.Hostname = v.arg(2)
+		case v.is("ddns-hostname"):
+			host.Hostname = v.arg(1)
+		}
+	}
+	host.Hostname, host.Domain = splitFQDN(host.Hostname, scope.domain)
+
+	var items []models.ImportAddress
+	for _, ip := range ips {
+		item := host
+		item.IP = ip
+		items = append(items, item)
+	}
+	return items
+}
+
+// parseDhcpdLeases reads the active leases and the hosts that have been added through OMAPI of a dhcpd.leases. The
+// file is a journal, the last entry of an address wins.
+func parseDhcpdLeases(data []byte) ([]models.ImportAddress, error) {
+	nodes, err := parseISC(data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var order []string
+	entries := make(map[string][]models.ImportAddress)
+	set := func(key string, items ...models.ImportAddress) {
+		if _, ok := entries[key]; !ok {
+			order = append(order, key)
+		}
+		entries[key] = items
+	}
+
+	for _, v := range nodes {
+		if !v.block {
+			continue
+		}
+
+		switch {
+		case v.is("lease"):
+			set(v.arg(1), iscLease(v, v.arg(1), now)...)
+		case v.is("ia-na") || v.is("ia-ta"):
+			// the id is the IAID followed by the DUID of the client
+			var duid string
+			if id := v.arg(1); len(id) > 4 {
+				duid = hex.EncodeToString([]byte(id[4:]))
+			}
+			for _, addr := range v.children {
+				if addr.block && addr.is("iaaddr") {
+					items := iscLease(addr, addr.arg(1), now)
+					for i := range items {
+						items[i].DUID = duid
+					}
+					set(addr.arg(1), items...)
+				}
+			}
+		case v.is("host"):
+			// hosts are removed by an entry that only says deleted
+			var deleted bool
+			for _, s := range v.children {
+				deleted = deleted || s.is("deleted")
+			}
+			if deleted {
+				set("host " + v.arg(1))
+			} else {
+				set("host "+v.arg(1), iscHost(v, iscScope{})...)
+			}
+		}
+	}
+
+	var items []models.ImportAddress
+	for _, k := range order {
+		items = append(items, entries[k]...)
+	}
+	return items, nil
+}
+
+// iscLease converts a lease or an iaaddr, there is nothing unless the lease is active
+func iscLease(n *iscNode, ip string, now time.Time) []models.ImportAddress {
+	item := models.ImportAddress{IP: ip, Lease: true}
+	var active bool
+	var forever bool
+	for _, v := range n.children {
+		switch {
+		case v.is("binding", "state"):
+			active = v.arg(2) == "active"
+		case v.is("ends"):
+			if v.arg(1) == "never" {
+				forever = true
+			} else if t, ok := iscTime(v.args[1:]); ok {
+				item.Expires = &t
+			}
+		case v.is("hardware", "ethernet"):
+			item.Mac = normalizeMac(v.arg(2))
+		case v.is("client-hostname"):
+			item.Hostname, item.Domain = splitFQDN(v.arg(1), "")
+		}
+	}
+
+	switch {
+	case !active:
+		return nil
+	case forever:
+		// an infinite lease is as good as a reservation
+		item.Lease = false
+	case item.Expires == nil || item.Expires.Before(now):
+		return nil
+	}
+	return []models.ImportAddress{item}
+}
+
+// iscTime parses the times of dhcpd.leases, "4 2024/05/02 10:00:00" in UTC or "epoch 1714644000"
+func iscTime(args []string) (time.Time, bool) {
+	if len(args) >= 2 && args[0] == "epoch" {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		return time.Unix(n, 0), err == nil
+	}
+	if len(args) >= 3 {
+		t, err := time.Parse("2006/01/02 15:04:05", args[1]+" "+args[2])
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
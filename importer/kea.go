@@ -0,0 +1,254 @@
+package importer
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tribock/go-via/models"
+	"github.com/tribock/go-via/option82"
+)
+
+// keaDefaultLeaseTime is what Kea uses if the configuration has no valid-lifetime
+const keaDefaultLeaseTime = 7200
+
+type keaConfig struct {
+	Dhcp4 *keaServer `json:"Dhcp4"`
+	Dhcp6 *keaServer `json:"Dhcp6"`
+}
+
+type keaServer struct {
+	keaScope
+	SharedNetworks []keaSharedNetwork `json:"shared-networks"`
+	Reservations   []keaReservation   `json:"reservations"`
+}
+
+type keaSharedNetwork struct {
+	keaScope
+	Name string `json:"name"`
+}
+
+// keaScope are the parameters that are inherited by the subnets
+type keaScope struct {
+	ValidLifetime int         `json:"valid-lifetime"`
+	OptionData    []keaOption `json:"option-data"`
+	Subnet4       []keaSubnet `json:"subnet4"`
+	Subnet6       []keaSubnet `json:"subnet6"`
+}
+
+type keaSubnet struct {
+	Subnet        string           `json:"subnet"`
+	ValidLifetime int              `json:"valid-lifetime"`
+	OptionData    []keaOption      `json:"option-data"`
+	Reservations  []keaReservation `json:"reservations"`
+	Pools         []struct {
+		Pool string `json:"pool"`
+	} `json:"pools"`
+}
+
+type keaOption struct {
+	Name string `json:"name"`
+	Code int    `json:"code"`
+	Data string `json:"data"`
+}
+
+type keaReservation struct {
+	HWAddress   string      `json:"hw-address"`
+	DUID        string      `json:"duid"`
+	CircuitID   string      `json:"circuit-id"`
+	IPAddress   string      `json:"ip-address"`
+	IPAddresses []string    `json:"ip-addresses"`
+	Hostname    string      `json:"hostname"`
+	OptionData  []keaOption `json:"option-data"`
+}
+
+// parseKea reads the subnets and host reservations of a Kea configuration, the reservations in a hosts database are
+// not part of it
+func parseKea(data []byte) ([]models.ImportPool, []models.ImportAddress, error) {
+	var conf keaConfig
+	if err := json.Unmarshal(stripJSONComments(data), &conf); err != nil {
+		return nil, nil, err
+	}
+	if conf.Dhcp4 == nil && conf.Dhcp6 == nil {
+		return nil, nil, fmt.Errorf("neither Dhcp4 nor Dhcp6 has been configured")
+	}
+
+	var pools []models.ImportPool
+	var addresses []models.ImportAddress
+
+	for _, server := range []*keaServer{conf.Dhcp4, conf.Dhcp6} {
+		if server == nil {
+			continue
+		}
+
+		global := server.keaScope
+		if global.ValidLifetime == 0 {
+			global.ValidLifetime = keaDefaultLeaseTime
+		}
+
+		scopes := []keaSharedNetwork{{keaScope: global}}
+		for _, v := range server.SharedNetworks {
+			v.keaScope = inheritKea(global, v.keaScope)
+			scopes = append(scopes, v)
+		}
+
+		for _, scope := range scopes {
+			for _, subnet := range append(scope.Subnet4, scope.Subnet6...) {
+				pool, err := keaSubnetPool(subnet, scope)
+				if err != nil {
+					return nil, nil, err
+				}
+				pools = append(pools, pool)
+
+				domain := keaOptionValue(subnet.OptionData, "domain-name", 15)
+				if domain == "" {
+					domain = keaOptionValue(scope.OptionData, "domain-name", 15)
+				}
+				for _, v := range subnet.Reservations {
+					addresses = append(addresses, keaHost(v, domain)...)
+				}
+			}
+		}
+
+		for _, v := range server.Reservations {
+			addresses = append(addresses, keaHost(v, keaOptionValue(global.OptionData, "domain-name", 15))...)
+		}
+	}
+
+	return pools, addresses, nil
+}
+
+// inheritKea fills the parameters of a shared network that have not been set from the global ones
+func inheritKea(parent keaScope, scope keaScope) keaScope {
+	if scope.ValidLifetime == 0 {
+		scope.ValidLifetime = parent.ValidLifetime
+	}
+	scope.OptionData = append(append([]keaOption(nil), parent.OptionData...), scope.OptionData...)
+	return scope
+}
+
+func keaSubnetPool(subnet keaSubnet, scope keaSharedNetwork) (models.ImportPool, error) {
+	_, network, err := net.ParseCIDR(subnet.Subnet)
+	if err != nil {
+		return models.ImportPool{}, fmt.Errorf("subnet %q: %w", subnet.Subnet, err)
+	}
+
+	var ranges [][2]net.IP
+	for _, v := range subnet.Pools {
+		r, err := parseRange(v.Pool)
+		if err != nil {
+			return models.ImportPool{}, fmt.Errorf("subnet %s: %w", subnet.Subnet, err)
+		}
+		ranges = append(ranges, r)
+	}
+
+	leaseTime := subnet.ValidLifetime
+	if leaseTime == 0 {
+		leaseTime = scope.ValidLifetime
+	}
+
+	gateway := keaOptionValue(subnet.OptionData, "routers", 3)
+	if gateway == "" {
+		gateway = keaOptionValue(scope.OptionData, "routers", 3)
+	}
+	gateway = strings.TrimSpace(strings.Split(gateway, ",")[0])
+
+	var name string
+	if scope.Name != "" {
+		name = scope.Name + " " + network.String()
+	}
+
+	return newPool(name, network, ranges, gateway, leaseTime), nil
+}
+
+// keaOptionValue returns the data of an option that is given by name or by code, the last one wins
+func keaOptionValue(options []keaOption, name string, code int) string {
+	var value string
+	for _, v := range options {
+		if v.Name == name || (v.Name == "" && v.Code == code) {
+			value = v.Data
+		}
+	}
+	return value
+}
+
+// keaHost converts a reservation, DHCPv6 reservations may have several addresses
+func keaHost(r keaReservation, domain string) []models.ImportAddress {
+	if d := keaOptionValue(r.OptionData, "domain-name", 15); d != "" {
+		domain = d
+	}
+
+	host := models.ImportAddress{
+		Mac:       normalizeMac(r.HWAddress),
+		DUID:      normalizeDUID(r.DUID),
+		CircuitID: keaCircuitID(r.CircuitID),
+	}
+	host.Hostname, host.Domain = splitFQDN(r.Hostname, domain)
+
+	ips := r.IPAddresses
+	if r.IPAddress != "" {
+		ips = append([]string{r.IPAddress}, ips...)
+	}
+
+	var items []models.ImportAddress
+	for _, ip := range ips {
+		item := host
+		item.IP = ip
+		items = append(items, item)
+	}
+	return items
+}
+
+// keaCircuitID converts a circuit id, Kea writes them as hex like 01:0a:ff or as text in single quotes
+func keaCircuitID(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) >= 2 && strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'") {
+		return s[1 : len(s)-1]
+	}
+
+	b, err := hex.DecodeString(normalizeDUID(s))
+	if err != nil {
+		return s
+	}
+	return option82.Format(b)
+}
+
+// stripJSONComments removes the //, # and /* */ comments Kea allows in its configuration
+func stripJSONComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		switch {
+		case data[i] == '"':
+			start := i
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(data) {
+				i = len(data) - 1
+			}
+			out = append(out, data[start:i+1]...)
+		case data[i] == '#' || (data[i] == '/' && i+1 < len(data) && data[i+1] == '/'):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case data[i] == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := strings.Index(string(data[i+2:]), "*/")
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+		default:
+			out = append(out, data[i])
+		}
+	}
+	return out
+}
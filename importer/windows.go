@@ -0,0 +1,223 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/tribock/go-via/models"
+)
+
+// Export-DhcpServer writes the IPv4 scopes along with their exclusions and reservations, the leases are only part of
+// the export if it has been run with -Leases. IPv6 scopes are not imported.
+
+type windowsServer struct {
+	XMLName xml.Name `xml:"DHCPServer"`
+	IPv4    struct {
+		OptionValues []windowsOption `xml:"OptionValues>OptionValue"`
+		Scopes       []windowsScope  `xml:"Scopes>Scope"`
+	} `xml:"IPv4"`
+}
+
+type windowsScope struct {
+	ScopeID         string               `xml:"ScopeId"`
+	Name            string               `xml:"Name"`
+	SubnetMask      string               `xml:"SubnetMask"`
+	StartRange      string               `xml:"StartRange"`
+	EndRange        string               `xml:"EndRange"`
+	LeaseDuration   string               `xml:"LeaseDuration"`
+	OptionValues    []windowsOption      `xml:"OptionValues>OptionValue"`
+	ExclusionRanges []windowsRange       `xml:"ExclusionRanges>IPRange"`
+	Reservations    []windowsReservation `xml:"Reservations>Reservation"`
+	Leases          []windowsLease       `xml:"Leases>Lease"`
+}
+
+type windowsOption struct {
+	OptionID int      `xml:"OptionId"`
+	Value    []string `xml:"Value"`
+}
+
+type windowsRange struct {
+	StartRange string `xml:"StartRange"`
+	EndRange   string `xml:"EndRange"`
+}
+
+type windowsReservation struct {
+	Name      string `xml:"Name"`
+	IPAddress string `xml:"IPAddress"`
+	ClientID  string `xml:"ClientId"`
+}
+
+type windowsLease struct {
+	IPAddress       string `xml:"IPAddress"`
+	ClientID        string `xml:"ClientId"`
+	HostName        string `xml:"HostName"`
+	AddressState    string `xml:"AddressState"`
+	LeaseExpiryTime string `xml:"LeaseExpiryTime"`
+}
+
+// windowsTimeLayouts are the ways the lease expiry has been seen in exports, they are in the local time of the server
+var windowsTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"1/2/2006 3:04:05 PM",
+	"2006-01-02 15:04:05",
+	"02.01.2006 15:04:05",
+}
+
+func parseWindows(data []byte) ([]models.ImportPool, []models.ImportAddress, error) {
+	var server windowsServer
+	decoder := xml.NewDecoder(bytes.NewReader(utf8Export(data)))
+	// the declaration still says utf-16 after the conversion
+	decoder.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+	if err := decoder.Decode(&server); err != nil {
+		return nil, nil, err
+	}
+
+	gateway := windowsOptionValue(server.IPv4.OptionValues, 3)
+	domain := windowsOptionValue(server.IPv4.OptionValues, 15)
+
+	var pools []models.ImportPool
+	var addresses []models.ImportAddress
+	now := time.Now()
+	for _, scope := range server.IPv4.Scopes {
+		ip, mask := net.ParseIP(scope.ScopeID).To4(), net.ParseIP(scope.SubnetMask).To4()
+		if ip == nil || mask == nil {
+			return nil, nil, fmt.Errorf("scope %q: invalid scope id or subnet mask", scope.ScopeID)
+		}
+		network := &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+
+		r, err := parseRange(scope.StartRange + " " + scope.EndRange)
+		if err != nil {
+			return nil, nil, fmt.Errorf("scope %s: %w", scope.ScopeID, err)
+		}
+
+		leaseTime, err := parseWindowsDuration(scope.LeaseDuration)
+		if err != nil {
+			return nil, nil, fmt.Errorf("scope %s: %w", scope.ScopeID, err)
+		}
+
+		scopeGateway := gateway
+		if v := windowsOptionValue(scope.OptionValues, 3); v != "" {
+			scopeGateway = v
+		}
+		scopeDomain := domain
+		if v := windowsOptionValue(scope.OptionValues, 15); v != "" {
+			scopeDomain = v
+		}
+
+		pool := newPool(scope.Name, network, [][2]net.IP{r}, scopeGateway, leaseTime)
+		var exclusions []string
+		for _, v := range scope.ExclusionRanges {
+			if v.StartRange == v.EndRange {
+				exclusions = append(exclusions, v.StartRange)
+			} else {
+				exclusions = append(exclusions, v.StartRange+"-"+v.EndRange)
+			}
+		}
+		pool.Exclusions = strings.Join(exclusions, ", ")
+		pools = append(pools, pool)
+
+		for _, v := range scope.Reservations {
+			item := models.ImportAddress{IP: v.IPAddress, Mac: normalizeMac(v.ClientID)}
+			item.Hostname, item.Domain = splitFQDN(v.Name, scopeDomain)
+			addresses = append(addresses, item)
+		}
+
+		// the reservations are listed as leases as well
+		for _, v := range scope.Leases {
+			if v.AddressState != "Active" {
+				continue
+			}
+			expires, ok := parseWindowsTime(v.LeaseExpiryTime)
+			if !ok || expires.Before(now) {
+				continue
+			}
+
+			item := models.ImportAddress{IP: v.IPAddress, Mac: normalizeMac(v.ClientID), Lease: true, Expires: &expires}
+			item.Hostname, item.Domain = splitFQDN(v.HostName, "")
+			addresses = append(addresses, item)
+		}
+	}
+
+	return pools, addresses, nil
+}
+
+// utf8Export converts an export that PowerShell has written as UTF-16, the byte order is taken from the BOM
+func utf8Export(data []byte) []byte {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		order = binary.BigEndian
+	default:
+		return bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	}
+
+	units := make([]uint16, 0, len(data)/2)
+	for i := 2; i+1 < len(data); i += 2 {
+		units = append(units, order.Uint16(data[i:]))
+	}
+	return []byte(string(utf16.Decode(units)))
+}
+
+// windowsOptionValue returns the first value of an option
+func windowsOptionValue(options []windowsOption, id int) string {
+	for _, v := range options {
+		if v.OptionID == id && len(v.Value) > 0 {
+			return strings.TrimSpace(v.Value[0])
+		}
+	}
+	return ""
+}
+
+// parseWindowsDuration parses the lease duration of a scope in seconds, it is written as d.hh:mm:ss or hh:mm:ss
+func parseWindowsDuration(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 8 * 24 * 3600, nil
+	}
+
+	var days int
+	if i := strings.Index(s, "."); i > 0 && i < strings.Index(s, ":") {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid lease duration %q", s)
+		}
+		days = n
+		s = s[i+1:]
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid lease duration %q", s)
+	}
+	var seconds int
+	for _, v := range parts {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid lease duration %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return days*24*3600 + seconds, nil
+}
+
+func parseWindowsTime(s string) (time.Time, bool) {
+	for _, layout := range windowsTimeLayouts {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(s), time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,246 @@
+package ipam
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+)
+
+// Pools are linked to an ip range or a prefix in NetBox by their managed reference. The start and end address and the
+// netmask of a linked pool are taken from the object, a prefix hands out all of its host addresses. NetBox has no
+// notion of a gateway, it is taken from a "gateway" custom field if the object has one.
+
+var ErrDisabled = errors.New("ipam: no url configured")
+
+// Range is what an IPAM object describes of a pool
+type Range struct {
+	StartAddress string
+	EndAddress   string
+	Netmask      int
+	Gateway      string
+}
+
+type Client struct {
+	conf config.IPAM
+	http *http.Client
+}
+
+// netboxObject contains the fields of ip ranges and prefixes that are of interest
+type netboxObject struct {
+	StartAddress string                 `json:"start_address"`
+	EndAddress   string                 `json:"end_address"`
+	Prefix       string                 `json:"prefix"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+func New(conf config.IPAM) (*Client, error) {
+	if conf.URL == "" {
+		return nil, ErrDisabled
+	}
+
+	return &Client{
+		conf: conf,
+		http: &http.Client{
+			Timeout:   time.Duration(conf.Timeout) * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}},
+		},
+	}, nil
+}
+
+// Lookup fetches the object the managed reference points to
+func (c *Client) Lookup(ref string) (*Range, error) {
+	kind, id, err := models.ParseManagedRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/ipam/%s/%d/", strings.TrimRight(c.conf.URL, "/"), kind, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.conf.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.conf.Token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("ipam: %s returned %s: %s", ref, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var obj netboxObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("ipam: failed to decode %s: %w", ref, err)
+	}
+
+	var r *Range
+	if kind == "prefixes" {
+		r, err = prefixRange(obj.Prefix)
+	} else {
+		r, err = ipRange(obj.StartAddress, obj.EndAddress)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ipam: %s: %w", ref, err)
+	}
+
+	if gw, ok := obj.CustomFields["gateway"].(string); ok && gw != "" {
+		r.Gateway = strings.SplitN(gw, "/", 2)[0]
+	}
+
+	return r, nil
+}
+
+// Sync updates the pool from the object it is linked to, it reports if anything has changed
+func (c *Client) Sync(pool *models.Pool) (bool, error) {
+	if pool.ManagedRef == "" {
+		return false, fmt.Errorf("ipam: pool %d is not linked", pool.ID)
+	}
+
+	r, err := c.Lookup(pool.ManagedRef)
+	if err != nil {
+		return false, err
+	}
+
+	updated := *pool
+	updated.StartAddress = r.StartAddress
+	updated.EndAddress = r.EndAddress
+	updated.Netmask = r.Netmask
+	if r.Gateway != "" {
+		updated.Gateway = r.Gateway
+	}
+
+	if updated.StartAddress == pool.StartAddress && updated.EndAddress == pool.EndAddress && updated.Netmask == pool.Netmask && updated.Gateway == pool.Gateway {
+		return false, nil
+	}
+
+	if res := db.DB.Save(&updated); res.Error != nil {
+		return false, res.Error
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"pool":  pool.ID,
+		"ref":   pool.ManagedRef,
+		"start": updated.StartAddress,
+		"end":   updated.EndAddress,
+		"mask":  updated.Netmask,
+	}).Info("ipam: pool updated")
+
+	*pool = updated
+	return true, nil
+}
+
+// SyncAll updates all linked pools, a pool that fails does not stop the others
+func (c *Client) SyncAll() (int, error) {
+	var items []models.Pool
+	if res := db.DB.Where("managed_ref <> ''").Find(&items); res.Error != nil {
+		return 0, res.Error
+	}
+
+	var n int
+	var errs []error
+	for i := range items {
+		changed, err := c.Sync(&items[i])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if changed {
+			n++
+		}
+	}
+
+	return n, errors.Join(errs...)
+}
+
+// Watch periodically syncs the linked pools
+func Watch(conf config.IPAM) {
+	c, err := New(conf)
+	if err != nil {
+		return
+	}
+	if conf.Interval <= 0 {
+		logrus.Info("ipam: periodic sync is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(conf.Interval) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		n, err := c.SyncAll()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("ipam: sync failed")
+		}
+		if n > 0 {
+			logrus.WithFields(logrus.Fields{
+				"updated": n,
+			}).Info("ipam: synced pools")
+		}
+
+		<-ticker.C
+	}
+}
+
+// ipRange converts the start and end address of an ip range, both carry the prefix length of the network
+func ipRange(start string, end string) (*Range, error) {
+	startIP, startNet, err := net.ParseCIDR(start)
+	if err != nil {
+		return nil, err
+	}
+	endIP, endNet, err := net.ParseCIDR(end)
+	if err != nil {
+		return nil, err
+	}
+	if !startNet.IP.Equal(endNet.IP) {
+		return nil, fmt.Errorf("start and end address do not belong to the same network")
+	}
+
+	ones, _ := startNet.Mask.Size()
+	return &Range{StartAddress: startIP.String(), EndAddress: endIP.String(), Netmask: ones}, nil
+}
+
+// prefixRange returns the host addresses of a prefix, without the network and the broadcast address
+func prefixRange(prefix string) (*Range, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("prefix %s is too small", prefix)
+	}
+
+	start := make(net.IP, len(ipNet.IP))
+	copy(start, ipNet.IP)
+	start[len(start)-1]++
+
+	end := make(net.IP, len(ipNet.IP))
+	for i := range end {
+		end[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+	if bits == 32 {
+		end[len(end)-1]--
+	}
+
+	return &Range{StartAddress: start.String(), EndAddress: end.String(), Netmask: ones}, nil
+}
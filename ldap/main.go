@@ -0,0 +1,136 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/models"
+)
+
+var (
+	ErrUserNotFound       = errors.New("ldap: user not found")
+	ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+	ErrNotAuthorized      = errors.New("ldap: user is not a member of any mapped group")
+)
+
+// Identity is a user that has been authenticated against the directory
+type Identity struct {
+	Username string
+	DN       string
+	Email    string
+	Groups   []string
+	Role     string
+}
+
+// Authenticate looks up the user with the service account, verifies the password by binding as the user
+// and maps the group membership to a role.
+func Authenticate(conf config.LDAP, username string, password string) (*Identity, error) {
+	// an empty password would result in an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	timeout := time.Duration(conf.Timeout) * time.Second
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+
+	c, err := goldap.DialURL(conf.URL, goldap.DialWithDialer(&net.Dialer{Timeout: timeout}), goldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetTimeout(timeout)
+
+	if conf.StartTLS {
+		u, _ := url.Parse(conf.URL)
+		tlsConfig.ServerName = u.Hostname()
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return authenticate(c, conf, username, password)
+}
+
+// authenticate looks up and verifies the user on an established connection
+func authenticate(c *goldap.Conn, conf config.LDAP, username string, password string) (*Identity, error) {
+	// search for the user with the service account
+	if err := c.Bind(conf.BindDN, conf.BindPassword); err != nil {
+		return nil, fmt.Errorf("ldap: service account bind failed: %w", err)
+	}
+
+	filter := strings.ReplaceAll(conf.UserFilter, "{username}", goldap.EscapeFilter(username))
+	res, err := c.Search(goldap.NewSearchRequest(conf.BaseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, conf.Timeout, false,
+		filter, []string{conf.GroupAttribute, conf.EmailAttribute}, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+	if len(res.Entries) > 1 {
+		return nil, fmt.Errorf("ldap: %d entries matched %s, refusing to guess", len(res.Entries), username)
+	}
+	entry := res.Entries[0]
+
+	// verify the password by binding as the user
+	if err := c.Bind(entry.DN, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	identity := &Identity{
+		Username: username,
+		DN:       entry.DN,
+		Groups:   entry.GetEqualFoldAttributeValues(conf.GroupAttribute),
+	}
+	if mail := entry.GetEqualFoldAttributeValues(conf.EmailAttribute); len(mail) > 0 {
+		identity.Email = mail[0]
+	}
+
+	identity.Role = MapRole(conf, identity.Groups)
+	if identity.Role == "" {
+		return nil, ErrNotAuthorized
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"username": username,
+		"dn":       entry.DN,
+		"role":     identity.Role,
+	}).Debug("ldap")
+
+	return identity, nil
+}
+
+// MapRole returns the most privileged role that one of the groups is mapped to, or the default role
+func MapRole(conf config.LDAP, groups []string) string {
+	mappings := []struct {
+		role   string
+		groups []string
+	}{
+		{models.RoleAdmin, conf.AdminGroups},
+		{models.RoleOperator, conf.OperatorGroups},
+		{models.RoleReadOnly, conf.ReadOnlyGroups},
+	}
+
+	for _, m := range mappings {
+		for _, mapped := range m.groups {
+			for _, g := range groups {
+				if strings.EqualFold(strings.TrimSpace(mapped), g) {
+					return m.role
+				}
+			}
+		}
+	}
+
+	return conf.DefaultRole
+}
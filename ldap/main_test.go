@@ -0,0 +1,366 @@
+package ldap
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/models"
+)
+
+const (
+	baseDN       = "dc=example,dc=com"
+	serviceDN    = "cn=via,ou=services,dc=example,dc=com"
+	adminsDN     = "cn=vsphere-admins,ou=groups,dc=example,dc=com"
+	operatorsDN  = "cn=vsphere-operators,ou=groups,dc=example,dc=com"
+	unmappedDN   = "cn=staff,ou=groups,dc=example,dc=com"
+	servicePass  = "service-secret"
+	userPassword = "user-secret"
+)
+
+type fakeEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+// fakeDirectory is an in-process LDAP server that answers binds and searches the way Active Directory does
+type fakeDirectory struct {
+	entries map[string]fakeEntry
+	// filters holds the filters of the received searches, decoded again
+	filters []*ber.Packet
+}
+
+func newDirectory() *fakeDirectory {
+	user := func(name string, groups ...string) fakeEntry {
+		return fakeEntry{
+			password: userPassword,
+			attrs: map[string][]string{
+				"objectClass":    {"top", "person", "user"},
+				"sAMAccountName": {name},
+				"mail":           {name + "@example.com"},
+				"memberOf":       groups,
+			},
+		}
+	}
+
+	return &fakeDirectory{entries: map[string]fakeEntry{
+		serviceDN:                               {password: servicePass, attrs: map[string][]string{"objectClass": {"top", "person", "user"}}},
+		"cn=alice,ou=people,dc=example,dc=com":  user("alice", unmappedDN, adminsDN),
+		"cn=bob,ou=people,dc=example,dc=com":    user("bob", operatorsDN),
+		"cn=carol,ou=people,dc=example,dc=com":  user("carol", unmappedDN),
+		"cn=a*b(c),ou=people,dc=example,dc=com": user(`a*b(c)\d`, operatorsDN),
+		// entries that are no users must never be found
+		"cn=alice,ou=contacts,dc=example,dc=com": {attrs: map[string][]string{
+			"objectClass":    {"top", "contact"},
+			"sAMAccountName": {"alice"},
+		}},
+	}}
+}
+
+// connect returns a client that is connected to the directory through a pipe
+func (d *fakeDirectory) connect(t *testing.T) *goldap.Conn {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.serve(t, server)
+	}()
+
+	c := goldap.NewConn(client, false)
+	c.Start()
+	c.SetTimeout(time.Second)
+	t.Cleanup(func() {
+		c.Close()
+		<-done
+	})
+	return c
+}
+
+func (d *fakeDirectory) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	write := func(id int64, op *ber.Packet) bool {
+		msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+		msg.AppendChild(op)
+		_, err := conn.Write(msg.Bytes())
+		return err == nil
+	}
+
+	for {
+		msg, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(msg.Children) < 2 {
+			t.Errorf("malformed message %+v", msg)
+			return
+		}
+		id, _ := msg.Children[0].Value.(int64)
+		op := msg.Children[1]
+
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			code := goldap.LDAPResultInvalidCredentials
+			dn, password := str(op.Children[1]), str(op.Children[2])
+			if e, ok := d.entries[dn]; ok && e.password != "" && e.password == password {
+				code = goldap.LDAPResultSuccess
+			}
+			if !write(id, result(goldap.ApplicationBindResponse, code)) {
+				return
+			}
+
+		case goldap.ApplicationSearchRequest:
+			base, filter := str(op.Children[0]), op.Children[6]
+			d.filters = append(d.filters, filter)
+
+			var dns []string
+			for dn := range d.entries {
+				dns = append(dns, dn)
+			}
+			sort.Strings(dns)
+
+			for _, dn := range dns {
+				if !strings.HasSuffix(dn, ","+base) || !matches(filter, d.entries[dn]) {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for _, name := range op.Children[7].Children {
+					attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, str(name), ""))
+					vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range d.entries[dn].attrs[str(name)] {
+						vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(vals)
+					attrs.AppendChild(attr)
+				}
+				entry.AppendChild(attrs)
+				if !write(id, entry) {
+					return
+				}
+			}
+			if !write(id, result(goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess)) {
+				return
+			}
+
+		case goldap.ApplicationUnbindRequest:
+			return
+
+		default:
+			t.Errorf("unexpected operation %d", op.Tag)
+			return
+		}
+	}
+}
+
+// str returns the value of a primitive, the context specific ones are not decoded by ber
+func str(p *ber.Packet) string {
+	return p.Data.String()
+}
+
+func result(op ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+// matches evaluates a filter, attribute names and values are compared case insensitive like AD does
+func matches(f *ber.Packet, e fakeEntry) bool {
+	values := func(attr string) []string {
+		for k, v := range e.attrs {
+			if strings.EqualFold(k, attr) {
+				return v
+			}
+		}
+		return nil
+	}
+
+	switch f.Tag {
+	case goldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matches(c, e) {
+				return false
+			}
+		}
+		return true
+	case goldap.FilterOr:
+		for _, c := range f.Children {
+			if matches(c, e) {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterNot:
+		return !matches(f.Children[0], e)
+	case goldap.FilterEqualityMatch:
+		for _, v := range values(str(f.Children[0])) {
+			if strings.EqualFold(v, str(f.Children[1])) {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterPresent:
+		return len(values(str(f))) > 0
+	}
+	return false
+}
+
+func testConfig() config.LDAP {
+	return config.LDAP{
+		BindDN:         serviceDN,
+		BindPassword:   servicePass,
+		BaseDN:         baseDN,
+		UserFilter:     "(&(objectClass=user)(sAMAccountName={username}))",
+		GroupAttribute: "memberOf",
+		EmailAttribute: "mail",
+		AdminGroups:    []string{adminsDN},
+		OperatorGroups: []string{operatorsDN},
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	d := newDirectory()
+
+	identity, err := authenticate(d.connect(t), testConfig(), "alice", userPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.DN != "cn=alice,ou=people,dc=example,dc=com" || identity.Email != "alice@example.com" || identity.Role != models.RoleAdmin {
+		t.Errorf("got %+v, expected alice to be an admin", identity)
+	}
+	if len(identity.Groups) != 2 {
+		t.Errorf("got the groups %v, expected 2", identity.Groups)
+	}
+
+	identity, err = authenticate(d.connect(t), testConfig(), "bob", userPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Role != models.RoleOperator {
+		t.Errorf("got the role %q for bob, expected %q", identity.Role, models.RoleOperator)
+	}
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     func(*config.LDAP)
+		username string
+		password string
+		err      error
+	}{
+		{name: "wrong password", username: "alice", password: "wrong", err: ErrInvalidCredentials},
+		{name: "unknown user", username: "mallory", password: userPassword, err: ErrUserNotFound},
+		{name: "unmapped group", username: "carol", password: userPassword, err: ErrNotAuthorized},
+		{name: "service account", username: "alice", password: userPassword, conf: func(c *config.LDAP) {
+			c.BindPassword = "wrong"
+		}},
+		{name: "base dn", username: "alice", password: userPassword, err: ErrUserNotFound, conf: func(c *config.LDAP) {
+			c.BaseDN = "ou=admins,dc=example,dc=com"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testConfig()
+			if tt.conf != nil {
+				tt.conf(&conf)
+			}
+
+			identity, err := authenticate(newDirectory().connect(t), conf, tt.username, tt.password)
+			if err == nil {
+				t.Fatalf("got %+v, expected the login to fail", identity)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateDefaultRole(t *testing.T) {
+	conf := testConfig()
+	conf.DefaultRole = models.RoleReadOnly
+
+	identity, err := authenticate(newDirectory().connect(t), conf, "carol", userPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Role != models.RoleReadOnly {
+		t.Errorf("got the role %q, expected the default role", identity.Role)
+	}
+}
+
+// an empty password would be an unauthenticated bind, it is refused before the directory is contacted
+func TestAuthenticateEmptyPassword(t *testing.T) {
+	conf := testConfig()
+	conf.URL = "ldap://192.0.2.1"
+
+	if _, err := Authenticate(conf, "alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got %v, expected %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestAuthenticateEscapesUsername(t *testing.T) {
+	d := newDirectory()
+
+	// without escaping the filter would match every user
+	if _, err := authenticate(d.connect(t), testConfig(), "*", userPassword); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v, expected %v", err, ErrUserNotFound)
+	}
+	if _, err := authenticate(d.connect(t), testConfig(), "alice)(sAMAccountName=*", userPassword); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v, expected %v", err, ErrUserNotFound)
+	}
+
+	identity, err := authenticate(d.connect(t), testConfig(), `a*b(c)\d`, userPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.DN != "cn=a*b(c),ou=people,dc=example,dc=com" {
+		t.Errorf("found %s", identity.DN)
+	}
+
+	// the server receives the name as it is
+	last := d.filters[len(d.filters)-1]
+	if got := str(last.Children[1].Children[1]); got != `a*b(c)\d` {
+		t.Errorf("searched for %q", got)
+	}
+}
+
+func TestMapRole(t *testing.T) {
+	conf := config.LDAP{
+		AdminGroups:    []string{" CN=Admins,DC=example,DC=com "},
+		OperatorGroups: []string{"cn=operators,dc=example,dc=com"},
+		ReadOnlyGroups: []string{"cn=auditors,dc=example,dc=com"},
+	}
+
+	tests := []struct {
+		groups      []string
+		defaultRole string
+		role        string
+	}{
+		{groups: []string{"cn=admins,dc=example,dc=com"}, role: models.RoleAdmin},
+		{groups: []string{"cn=auditors,dc=example,dc=com", "cn=operators,dc=example,dc=com"}, role: models.RoleOperator},
+		{groups: []string{"cn=auditors,dc=example,dc=com", "cn=admins,dc=example,dc=com"}, role: models.RoleAdmin},
+		{groups: []string{"cn=auditors,dc=example,dc=com"}, role: models.RoleReadOnly},
+		{groups: []string{"cn=staff,dc=example,dc=com"}, role: ""},
+		{groups: nil, defaultRole: models.RoleReadOnly, role: models.RoleReadOnly},
+	}
+	for _, tt := range tests {
+		conf.DefaultRole = tt.defaultRole
+		if role := MapRole(conf, tt.groups); role != tt.role {
+			t.Errorf("MapRole(%v) = %q, expected %q", tt.groups, role, tt.role)
+		}
+	}
+}
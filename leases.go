@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/api"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
+)
+
+// Dynamic leases are the addresses that have been handed out to unknown devices, they are no reservations (see
+// models.ReservationCondition). Decline blocks are addresses without a mac address that have been blocked because a
+// client reported a conflict. Both are only of historical interest once they have expired.
+
+// sweepLeases periodically removes expired dynamic leases and decline blocks
+func sweepLeases(conf *config.Config) {
+	if conf.LeaseSweepInterval <= 0 {
+		logrus.Info("leases: the sweeper is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(conf.LeaseSweepInterval) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		before := time.Now().Add(-time.Duration(conf.LeaseRetention) * time.Hour)
+		n, err := sweep(db.DB, conf.LeaseArchive, before)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("leases: sweep failed")
+		} else if n > 0 {
+			logrus.WithFields(logrus.Fields{
+				"swept":    n,
+				"archived": conf.LeaseArchive,
+			}).Info("leases: swept expired leases")
+		}
+
+		<-ticker.C
+	}
+}
+
+// sweep removes the dynamic leases and decline blocks that expired before the given time
+func sweep(tx *gorm.DB, archive bool, before time.Time) (int, error) {
+	var items []models.Address
+	if res := tx.Not(models.ReservationCondition).Where("expires < ?", before).Find(&items); res.Error != nil {
+		return 0, res.Error
+	}
+
+	return len(items), removeLeases(tx, archive, items)
+}
+
+// reclaim makes an expired lease of ip available to another client, the address table allows only one dynamic
+// lease per ip
+func reclaim(tx *gorm.DB, archive bool, ip string, except int) error {
+	var items []models.Address
+	if res := tx.Not(models.ReservationCondition).Where("ip = ? AND id <> ? AND expires <= ?", ip, except, time.Now()).Find(&items); res.Error != nil {
+		return res.Error
+	}
+
+	return removeLeases(tx, archive, items)
+}
+
+func removeLeases(tx *gorm.DB, archive bool, items []models.Address) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	// the pool index may have been rebuilt before the commit
+	defer api.InvalidatePools()
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var ids []int
+		for _, v := range items {
+			ids = append(ids, v.ID)
+			if !archive {
+				continue
+			}
+
+			entry := models.LeaseArchive{
+				AddressID:     v.ID,
+				IP:            v.IP,
+				Mac:           v.Mac,
+				Hostname:      v.Hostname,
+				PoolID:        v.PoolID,
+				LastSeenRelay: v.LastSeenRelay,
+				Declined:      v.Mac == "",
+				FirstSeen:     v.FirstSeen,
+				LastSeen:      v.LastSeen,
+				Expires:       v.Expires,
+				ArchivedAt:    now,
+			}
+			if res := tx.Create(&entry); res.Error != nil {
+				return res.Error
+			}
+		}
+
+		// the ks tokens of a lease are useless once it is gone
+		if res := tx.Where("address_id IN ?", ids).Delete(&models.KsToken{}); res.Error != nil {
+			return res.Error
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.Address{}).Error
+	})
+}
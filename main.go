@@ -4,6 +4,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"net"
 	"net/http"
@@ -15,8 +17,11 @@ import (
 	"github.com/tribock/go-via/config"
 	ca "github.com/tribock/go-via/crypto"
 	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/failover"
+	"github.com/tribock/go-via/ipam"
 	"github.com/tribock/go-via/models"
 	"github.com/tribock/go-via/secrets"
+	"github.com/tribock/go-via/trace"
 	"github.com/tribock/go-via/websockets"
 
 	"github.com/gin-contrib/static"
@@ -121,7 +126,7 @@ func main() {
 	}
 
 	// load secrets key
-	key := secrets.Init()
+	keys := secrets.Init(conf)
 
 	//connect to database
 	//db.Connect(true)
@@ -133,12 +138,60 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// the server keeps the secret keys in memory, they must not be rotated by another process while it runs
+	if err := db.Lock(); err != nil {
+		if errors.Is(err, db.ErrLocked) && (conf.RotateSecrets || conf.RotateSecretKey) {
+			logrus.Fatal("the server is running, stop it before rotating the secret keys or use the secrets api")
+		}
+		logrus.Fatal(err)
+	}
+
 	//migrate all models
-	err = db.DB.AutoMigrate(&models.Pool{}, &models.Address{}, &models.Option{}, &models.DeviceClass{}, &models.Group{}, &models.Image{}, &models.User{})
+	err = db.DB.AutoMigrate(&models.Pool{}, &models.Address{}, &models.Option{}, &models.DeviceClass{}, &models.Group{}, &models.Image{}, &models.User{}, &models.Session{}, &models.APIToken{}, &models.AuditLog{}, &models.KsToken{}, &models.SecretKey{}, &models.Certificate{}, &models.CertificateRequest{}, &models.LeaseArchive{})
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
+	if err := api.WatchPools(db.DB); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if err := failover.Init(conf.Failover, db.DB); err != nil && !errors.Is(err, failover.ErrDisabled) {
+		logrus.Fatal(err)
+	}
+
+	if err := ca.Init(conf.CA); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if err := keys.Load(db.DB); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if conf.RotateSecrets {
+		item, err := api.ReencryptSecrets(keys)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"version":     item.Version,
+			"reencrypted": item.Reencrypted,
+		}).Info("secrets rotated")
+		return
+	}
+
+	if conf.RotateSecretKey {
+		item, err := api.RotateSecretKey(keys, conf.NewSecretKey)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"version":     item.Version,
+			"reencrypted": item.Reencrypted,
+		}).Info("secret key rotated")
+		return
+	}
+
 	//create the device classes for x86 and arm
 	//64bit x86 UEFI
 	var x86_64 models.DeviceClass
@@ -152,29 +205,73 @@ func main() {
 		logrus.Warning(res.Error)
 	}
 
+	//64bit x86 UEFI HTTP Boot
+	var http_x86_64 models.DeviceClass
+	if res := db.DB.FirstOrCreate(&http_x86_64, models.DeviceClass{DeviceClassForm: models.DeviceClassForm{Name: "HTTP-UEFI_x64", VendorClass: "HTTPClient:Arch:00016"}}); res.Error != nil {
+		logrus.Warning(res.Error)
+	}
+
 	//create admin user if it doesn't exist
 	var adm models.User
 	hp := api.HashAndSalt([]byte("VMware1!"))
-	if res := db.DB.Where(models.User{UserForm: models.UserForm{Username: "admin"}}).Attrs(models.User{UserForm: models.UserForm{Password: hp}}).FirstOrCreate(&adm); res.Error != nil {
+	if res := db.DB.Where(models.User{UserForm: models.UserForm{Username: "admin"}}).Attrs(models.User{UserForm: models.UserForm{Password: hp, Role: models.RoleAdmin}}).FirstOrCreate(&adm); res.Error != nil {
 		logrus.Warning(res.Error)
 	}
 
+	//users created before roles existed had full access, keep it that way
+	if res := db.DB.Model(&models.User{}).Where("role IS NULL OR role = ''").Update("role", models.RoleAdmin); res.Error != nil {
+		logrus.Warning(res.Error)
+	}
+
+	// keep the last transactions for troubleshooting
+	trace.Init(conf.Trace, conf.TracePcap)
+
 	// DHCPd
 	if !conf.DisableDhcp {
 		for _, v := range conf.Network.Interfaces {
-			go serve(v)
+			go serve(v, conf)
+		}
+		go serve6(conf)
+	} else if conf.ProxyDhcp {
+		for _, v := range conf.Network.Interfaces {
+			go serve(v, conf)
+			go serveProxy(v, conf)
 		}
 	}
 
+	// clean up expired leases
+	go sweepLeases(conf)
+
+	// keep the pools that are linked to the ipam in sync
+	go ipam.Watch(conf.IPAM)
+
+	// heartbeats and lease replication with the failover partner
+	go failover.Run()
+
 	// TFTPd
 	go TFTPd(conf)
 
+	// the modules of the images over http
+	if conf.ImagePort != 0 {
+		go serveImages(conf)
+	}
+
 	//REST API
 	r := gin.New()
+	// hosts are recognized by their address, a forwarded header must not let anyone else pose as them
+	if err := r.SetTrustedProxies(nil); err != nil {
+		logrus.Fatal(err)
+	}
 	r.Use(cors.Default())
 
-	// ks.cfg is served at top to not place it behind BasicAuth
-	r.GET("ks.cfg", api.Ks(key))
+	// ks.cfg is served at top to not place it behind BasicAuth, hosts authenticate with the single use token from boot.cfg
+	r.GET("ks.cfg", api.Ks(keys))
+
+	// boot files for UEFI HTTP Boot, hosts are recognized by their address like with tftp
+	r.GET("boot/*filepath", httpBoot(conf))
+
+	// the CRL has to be reachable by anyone validating a certificate
+	r.GET("ca.crl", api.CRL)
 
 	statikFS, err := fs.New()
 	if err != nil {
@@ -195,113 +292,184 @@ func main() {
 	}
 
 	v1 := r.Group("/v1")
+	{
+		// endpoints that have to stay reachable without a session, either to log in or for hosts that are being installed
+		v1.POST("login", api.Login(conf))
+		v1.GET("postconfig", api.PostConfig(keys))
+		v1.GET("version", api.Version(commit, date))
+	}
+
+	// the failover partner authenticates with the shared secret instead of a session
+	peer := v1.Group("/failover", api.AuthenticatePeer)
+	{
+		peer.POST("heartbeat", api.FailoverHeartbeat)
+		peer.GET("leases", api.ListFailoverLeases)
+		peer.POST("leases", api.ReplicateLeases)
+	}
+
+	// the websockets of the web ui, browsers cant set the authorization header on them
+	ws := v1.Group("", api.AuthenticateWebsocket)
+	{
+		ws.GET("log", api.Require(models.PermissionRead), logServer.Handle)
+		ws.GET("dhcp/trace/live", api.Require(models.PermissionRead), websockets.HandleTrace)
+	}
+
+	// everything else in /v1 requires a valid session token
+	v1 = v1.Group("", api.Authenticate)
 	{
 
 		pools := v1.Group("/pools")
 		{
-			pools.GET("", api.ListPools)
-			pools.GET(":id", api.GetPool)
-			pools.POST("/search", api.SearchPool)
-			pools.POST("", api.CreatePool)
-			pools.PATCH(":id", api.UpdatePool)
-			pools.DELETE(":id", api.DeletePool)
-
-			pools.GET(":id/next", api.GetNextFreeIP)
+			pools.GET("", api.Require(models.PermissionRead), api.ListPools)
+			pools.GET(":id", api.Require(models.PermissionRead), api.GetPool)
+			pools.POST("/search", api.Require(models.PermissionRead), api.SearchPool)
+			pools.POST("/import", api.Require(models.PermissionPools), api.Require(models.PermissionHosts), api.ImportPools)
+			pools.POST("", api.Require(models.PermissionPools), api.CreatePool)
+			pools.PATCH(":id", api.Require(models.PermissionPools), api.UpdatePool)
+			pools.DELETE(":id", api.Require(models.PermissionPools), api.DeletePool)
+
+			pools.GET(":id/next", api.Require(models.PermissionRead), api.GetNextFreeIP)
+			pools.POST(":id/sync", api.Require(models.PermissionPools), api.SyncPool(conf))
 		}
 		relay := v1.Group("/relay")
 		{
-			relay.GET(":relay", api.GetPoolByRelay)
+			relay.GET(":relay", api.Require(models.PermissionRead), api.GetPoolByRelay)
 		}
 
 		addresses := v1.Group("/addresses")
 		{
-			addresses.GET("", api.ListAddresses)
-			addresses.GET(":id", api.GetAddress)
-			addresses.POST("/search", api.SearchAddress)
-			addresses.POST("", api.CreateAddress)
-			addresses.PATCH(":id", api.UpdateAddress)
-			addresses.DELETE(":id", api.DeleteAddress)
+			addresses.GET("", api.Require(models.PermissionRead), api.ListAddresses)
+			addresses.GET(":id", api.Require(models.PermissionRead), api.GetAddress)
+			addresses.POST("/search", api.Require(models.PermissionRead), api.SearchAddress)
+			addresses.POST("", api.Require(models.PermissionHosts), api.CreateAddress)
+			addresses.PATCH(":id", api.Require(models.PermissionDeploy), api.UpdateAddress)
+			addresses.DELETE(":id", api.Require(models.PermissionHosts), api.DeleteAddress)
+
+			addresses.GET(":id/password", api.Require(models.PermissionSecrets), api.RevealPassword(keys))
+			addresses.POST("/passwords/export", api.Require(models.PermissionSecrets), api.ExportPasswords(keys))
 		}
 
+		v1.GET("leases/archive", api.Require(models.PermissionRead), api.ListLeaseArchive)
+		v1.GET("failover", api.Require(models.PermissionRead), api.GetFailover)
+
 		options := v1.Group("/options")
 		{
-			options.GET("", api.ListOptions)
-			options.GET(":id", api.GetOption)
-			options.POST("/search", api.SearchOption)
-			options.POST("", api.CreateOption)
-			options.PATCH(":id", api.UpdateOption)
-			options.DELETE(":id", api.DeleteOption)
+			options.GET("", api.Require(models.PermissionRead), api.ListOptions)
+			options.GET(":id", api.Require(models.PermissionRead), api.GetOption)
+			options.POST("/search", api.Require(models.PermissionRead), api.SearchOption)
+			options.POST("", api.Require(models.PermissionPools), api.CreateOption)
+			options.PATCH(":id", api.Require(models.PermissionPools), api.UpdateOption)
+			options.DELETE(":id", api.Require(models.PermissionPools), api.DeleteOption)
 		}
 
 		deviceClass := v1.Group("/device_classes")
 		{
-			deviceClass.GET("", api.ListDeviceClasses)
-			deviceClass.GET(":id", api.GetDeviceClass)
-			deviceClass.POST("/search", api.SearchDeviceClass)
-			deviceClass.POST("", api.CreateDeviceClass)
-			deviceClass.PATCH(":id", api.UpdateDeviceClass)
-			deviceClass.DELETE(":id", api.DeleteDeviceClass)
+			deviceClass.GET("", api.Require(models.PermissionRead), api.ListDeviceClasses)
+			deviceClass.GET(":id", api.Require(models.PermissionRead), api.GetDeviceClass)
+			deviceClass.POST("/search", api.Require(models.PermissionRead), api.SearchDeviceClass)
+			deviceClass.POST("", api.Require(models.PermissionPools), api.CreateDeviceClass)
+			deviceClass.PATCH(":id", api.Require(models.PermissionPools), api.UpdateDeviceClass)
+			deviceClass.DELETE(":id", api.Require(models.PermissionPools), api.DeleteDeviceClass)
 		}
 
 		groups := v1.Group("/groups")
 		{
-			groups.GET("", api.ListGroups)
-			groups.GET(":id", api.GetGroup)
-			groups.POST("", api.CreateGroup(key))
-			groups.PATCH(":id", api.UpdateGroup(key))
-			groups.DELETE(":id", api.DeleteGroup)
+			groups.GET("", api.Require(models.PermissionRead), api.ListGroups)
+			groups.GET(":id", api.Require(models.PermissionRead), api.GetGroup)
+			groups.POST("", api.Require(models.PermissionGroups), api.CreateGroup(keys))
+			groups.PATCH(":id", api.Require(models.PermissionGroups), api.UpdateGroup(keys))
+			groups.DELETE(":id", api.Require(models.PermissionGroups), api.DeleteGroup)
 		}
 
 		images := v1.Group("/images")
 		{
-			images.GET("", api.ListImages)
-			images.GET(":id", api.GetImage)
-			images.POST("", api.CreateImage(conf))
-			images.PATCH(":id", api.UpdateImage)
-			images.DELETE(":id", api.DeleteImage)
+			images.GET("", api.Require(models.PermissionRead), api.ListImages)
+			images.GET(":id", api.Require(models.PermissionRead), api.GetImage)
+			images.POST("", api.Require(models.PermissionImages), api.CreateImage(conf))
+			images.PATCH(":id", api.Require(models.PermissionImages), api.UpdateImage)
+			images.DELETE(":id", api.Require(models.PermissionImages), api.DeleteImage)
 		}
 
 		users := v1.Group("/users")
 		{
-			users.GET("", api.ListUsers)
-			users.GET(":id", api.GetUser)
-			users.POST("", api.CreateUser)
-			users.PATCH(":id", api.UpdateUser)
-			users.DELETE(":id", api.DeleteUser)
+			users.GET("", api.Require(models.PermissionUsers), api.ListUsers)
+			users.GET(":id", api.Require(models.PermissionUsers), api.GetUser)
+			users.POST("", api.Require(models.PermissionUsers), api.CreateUser)
+			users.PATCH(":id", api.Require(models.PermissionUsers), api.UpdateUser)
+			users.DELETE(":id", api.Require(models.PermissionUsers), api.DeleteUser)
+		}
+
+		tokens := v1.Group("/tokens")
+		{
+			tokens.GET("", api.ListAPITokens)
+			tokens.POST("", api.CreateAPIToken)
+			tokens.DELETE(":id", api.DeleteAPIToken)
 		}
 
 		postconfig := v1.Group("/postconfig")
 		{
-			postconfig.GET("", api.PostConfig(key))
-			postconfig.GET(":id", api.PostConfigID(key))
+			postconfig.GET(":id", api.Require(models.PermissionDeploy), api.PostConfigID(keys))
 		}
 
-		login := v1.Group("/login")
+		v1.GET("audit", api.Require(models.PermissionRead), api.ListAudit)
+
+		v1.POST("secrets/rotate", api.Require(models.PermissionSecrets), api.RotateSecrets(keys))
+
+		certificates := v1.Group("/ca")
 		{
-			login.POST("", api.Login)
+			certificates.GET("ca.crt", api.Require(models.PermissionRead), api.DownloadCA)
+			certificates.GET("crl", api.Require(models.PermissionRead), api.CRL)
+			certificates.GET("certificates", api.Require(models.PermissionRead), api.ListCertificates)
+			certificates.GET("certificates/:id", api.Require(models.PermissionRead), api.GetCertificate)
+			certificates.GET("certificates/:id/download", api.Require(models.PermissionRead), api.DownloadCertificate)
+			certificates.POST("certificates/:id/revoke", api.Require(models.PermissionHosts), api.RevokeCertificate)
+			certificates.POST("certificates/:id/reissue", api.Require(models.PermissionHosts), api.ReissueCertificate)
+
+			certificates.POST("import", api.Require(models.PermissionSecrets), api.ImportCA)
+
+			certificates.GET("requests", api.Require(models.PermissionRead), api.ListCertificateRequests)
+			certificates.GET("requests/:id/download", api.Require(models.PermissionRead), api.DownloadCertificateRequest)
+			certificates.POST("requests", api.Require(models.PermissionHosts), api.CreateCertificateRequest(conf))
+			certificates.POST("requests/:id/certificate", api.Require(models.PermissionHosts), api.UploadCertificate)
+			certificates.DELETE("requests/:id", api.Require(models.PermissionHosts), api.DeleteCertificateRequest)
 		}
 
+		v1.POST("logout", api.Logout)
+
 		hosts := v1.Group("/checkilo")
 		{
-			hosts.POST("", api.CheckIP)
+			hosts.POST("", api.Require(models.PermissionDeploy), api.CheckIP)
 		}
-		v1.GET("log", logServer.Handle)
 
-		v1.GET("version", api.Version(commit, date))
+		dhcp := v1.Group("/dhcp")
+		{
+			dhcp.GET("trace", api.Require(models.PermissionRead), api.ListTrace)
+			dhcp.GET("trace/pcap", api.Require(models.PermissionRead), api.ExportTrace)
+			dhcp.GET("metrics", api.Require(models.PermissionRead), api.Metrics)
+		}
+		v1.GET("me", api.GetCurrentUser)
 	}
 
 	/*	r.GET("postconfig", api.PostConfig) */
 
 	// check if ./cert/server.crt exists, if not we will create the folder, and initiate a new CA and a self-signed certificate
-	crt, err := os.Stat("./cert/server.crt")
+	os.MkdirAll("cert", os.ModePerm)
+	if _, err := os.Stat(ca.CACertFile); os.IsNotExist(err) {
+		logrus.WithFields(logrus.Fields{
+			"certificate": "ca.crt does not exist, initiating new CA",
+		}).Info("cert")
+		if err := ca.CreateCA(); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	crt, err := os.Stat(ca.ServerCertFile)
 	if os.IsNotExist(err) {
-		// create folder for certificates
 		logrus.WithFields(logrus.Fields{
-			"certificate": "server.crt does not exist, initiating new CA and creating self-signed ceritificate server.crt",
+			"certificate": "server.crt does not exist, creating ceritificate server.crt",
 		}).Info("cert")
-		os.MkdirAll("cert", os.ModePerm)
-		ca.CreateCA()
-		ca.CreateCert("./cert", "server", "server")
+		if _, err := ca.CreateCert("./cert", "server", ca.ServerRequest(conf.Network.Interfaces)); err != nil {
+			logrus.Fatal(err)
+		}
 	} else {
 		logrus.WithFields(logrus.Fields{
 			crt.Name(): "server.crt found",
@@ -312,7 +480,17 @@ func main() {
 	logrus.WithFields(logrus.Fields{
 		"port": listen,
 	}).Info("Webserver")
-	err = r.RunTLS(listen, "./cert/server.crt", "./cert/server.key")
+	// the certificate is reloaded when it is replaced, eg. by a certificate signed by an external CA
+	reloader, err := ca.NewReloader(ca.ServerCertFile, ca.ServerKeyFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	srv := &http.Server{
+		Addr:      listen,
+		Handler:   r,
+		TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate},
+	}
+	err = srv.ListenAndServeTLS("", "")
 
 	logrus.WithFields(logrus.Fields{
 		"error": err,
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The counters are exposed in the Prometheus text format
+
+var (
+	DHCPRequests = NewCounterVec("via_dhcp_requests_total", "DHCP requests by message type and decision", "type", "decision")
+	DHCPDropped  = NewCounterVec("via_dhcp_dropped_total", "DHCP requests dropped before they were processed", "reason")
+)
+
+var (
+	registryMu sync.Mutex
+	registry   []*CounterVec
+)
+
+// CounterVec is a counter per combination of label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counter
+}
+
+type counter struct {
+	labels []string
+	value  uint64
+}
+
+// NewCounterVec returns a counter that is exposed by WriteTo
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counter),
+	}
+
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+
+	return c
+}
+
+// Inc increments the counter of the label values, they are given in the order of the label names
+func (c *CounterVec) Inc(values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[key]
+	if !ok {
+		v = &counter{labels: values}
+		c.values[key] = v
+	}
+	v.value++
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := c.values[k]
+
+		var labels []string
+		for i, name := range c.labels {
+			var value string
+			if i < len(v.labels) {
+				value = v.labels[i]
+			}
+			labels = append(labels, fmt.Sprintf("%s=%q", name, value))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, strings.Join(labels, ","), v.value)
+	}
+}
+
+// WriteTo writes all counters
+func WriteTo(w io.Writer) error {
+	registryMu.Lock()
+	counters := append([]*CounterVec(nil), registry...)
+	registryMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range counters {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
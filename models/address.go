@@ -1,11 +1,12 @@
 package models
 
 import (
+	"strings"
 	"time"
 )
 
 type AddressForm struct {
-	IP           string    `json:"ip" gorm:"type:varchar(15);not null;index:uniqIp,unique"`
+	IP           string    `json:"ip" gorm:"type:varchar(45);not null;index:uniqIp,unique"`
 	Mac          string    `json:"mac" gorm:"type:varchar(17);not null"`
 	Hostname     string    `json:"hostname" gorm:"type:varchar(255)"`
 	Domain       string    `json:"domain" gorm:"type:varchar(255)"`
@@ -15,6 +16,20 @@ type AddressForm struct {
 	Progress     int       `json:"progress" gorm:"type:INT"`
 	Progresstext string    `json:"progresstext" gorm:"type:varchar(255)"`
 	Ks           string    `json:"ks" gorm:"type:text"`
+
+	// CircuitID binds a reservation to the switch port it is connected to instead of the mac address, RemoteID
+	// optionally restricts it to one relay. The ids are compared with option 82 of relayed requests, printable
+	// ids as they are and binary ids hex encoded.
+	CircuitID string `json:"circuit_id" gorm:"type:varchar(255);index"`
+	RemoteID  string `json:"remote_id" gorm:"type:varchar(255)"`
+
+	// Reserved keeps the address for the host even if it is neither flagged for re-imaging nor member of a group,
+	// addresses that are created through the api are always reserved
+	Reserved bool `json:"reserved" gorm:"type:bool"`
+
+	// DUID reserves an address of an IPv6 pool for the DHCPv6 client with this hex encoded DUID, the mac address
+	// is used if it is empty
+	DUID string `json:"duid" gorm:"column:duid;type:varchar(260);index"`
 }
 
 type Address struct {
@@ -29,11 +44,61 @@ type Address struct {
 	LastSeen  time.Time `json:"last_seen"`
 
 	// DHCP parameters
-	LastSeenRelay  string    `json:"last_seen_relay" gorm:"type:varchar(15)"`
+	LastSeenRelay  string    `json:"last_seen_relay" gorm:"type:varchar(45)"`
 	MissingOptions string    `json:"missing_options" gorm:"type:varchar(255)"`
 	Expires        time.Time `json:"expires_at"`
 
+	// option 82 of the last relayed request
+	LastSeenCircuitID string `json:"last_seen_circuit_id" gorm:"type:varchar(255)"`
+	LastSeenRemoteID  string `json:"last_seen_remote_id" gorm:"type:varchar(255)"`
+
+	// ConflictMac is the device that answered the probe for the address before it was offered, the address is
+	// blocked like a declined one. It is empty if the device was found by ICMP or the client declined the address.
+	ConflictMac string `json:"conflict_mac" gorm:"type:varchar(17)"`
+
+	// BootIP is the address another dhcp server has given the host while it boots through proxy dhcp
+	BootIP string `json:"boot_ip" gorm:"type:varchar(45);index"`
+
+	// RootPassword is generated at kickstart when the group asks for unique root passwords, it is encrypted with
+	// the secrets keyring and can only be retrieved through the audited reveal and export endpoints
+	RootPassword      string     `json:"-" gorm:"type:varchar(255)"`
+	RootPasswordSetAt *time.Time `json:"root_password_set_at"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
+
+// ReservationCondition selects the addresses that have been set up for a host, all others are dynamic leases and
+// decline blocks
+const ReservationCondition = "reimage OR reserved OR (group_id IS NOT NULL AND group_id <> 0)"
+
+// IsReservation reports if the address has been set up for a host instead of being handed out dynamically
+func (a *Address) IsReservation() bool {
+	return a.Reimage || a.Reserved || (a.GroupID.Valid && a.GroupID.Int32 != 0)
+}
+
+// URLHost returns the ip of the address as it is used in the host part of an url
+func (a *Address) URLHost() string {
+	if strings.Contains(a.IP, ":") {
+		return "[" + a.IP + "]"
+	}
+	return a.IP
+}
+
+type AddressPassword struct {
+	ID       int        `json:"id"`
+	Hostname string     `json:"hostname"`
+	Domain   string     `json:"domain"`
+	IP       string     `json:"ip"`
+	Mac      string     `json:"mac"`
+	Password string     `json:"password"`
+	SetAt    *time.Time `json:"set_at"`
+}
+
+type PasswordExportForm struct {
+	// Passphrase the export is encrypted with, it has to be shared with the receiver separately
+	Passphrase string `json:"passphrase" binding:"required,min=12"`
+	// GroupID limits the export to the hosts of a single group
+	GroupID int `json:"group_id"`
+}
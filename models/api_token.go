@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+)
+
+type APITokenForm struct {
+	Name string `json:"name" gorm:"type:varchar(255);not null" binding:"required"`
+	// Scopes is a comma separated list of permissions, it can not exceed the permissions of the owner
+	Scopes    string     `json:"scopes" gorm:"type:varchar(255);not null" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type APIToken struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	UserID    int    `json:"user_id" gorm:"type:BIGINT;not null;index"`
+	Prefix    string `json:"prefix" gorm:"type:varchar(16)"`
+	TokenHash string `json:"-" gorm:"type:varchar(64);not null;uniqueIndex"`
+
+	APITokenForm
+
+	LastUsed *time.Time `json:"last_used,omitempty"`
+
+	User *User `json:"user,omitempty" gorm:"foreignkey:UserID"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewAPIToken is only returned once, when the token is created, as the plaintext token is not persisted
+type NewAPIToken struct {
+	APIToken
+	Token string `json:"token"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditDelete     = "delete"
+	AuditPostConfig = "postconfig"
+	AuditUpload     = "upload"
+	AuditLogin      = "login"
+	AuditLoginFail  = "login-failed"
+	AuditKickstart  = "kickstart"
+	AuditKsDenied   = "kickstart-denied"
+	AuditRotate     = "rotate"
+	AuditReveal     = "reveal"
+	AuditExport     = "export"
+	AuditRevoke     = "revoke"
+	AuditReissue    = "reissue"
+	AuditImport     = "import"
+)
+
+type AuditLog struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	Actor      string         `json:"actor" gorm:"type:varchar(255);index"`
+	ActorID    int            `json:"actor_id" gorm:"type:BIGINT"`
+	SourceIP   string         `json:"source_ip" gorm:"type:varchar(45)"`
+	Action     string         `json:"action" gorm:"type:varchar(32);index"`
+	TargetType string         `json:"target_type" gorm:"type:varchar(64);index:idx_audit_target"`
+	TargetID   int            `json:"target_id" gorm:"type:BIGINT;index:idx_audit_target"`
+	Message    string         `json:"message" gorm:"type:text"`
+	Diff       datatypes.JSON `json:"diff" swaggertype:"object,string"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+type AuditDiff struct {
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+)
+
+// CRL reason codes, RFC 5280 section 5.3.1
+const (
+	RevocationUnspecified   = 0
+	RevocationKeyCompromise = 1
+	RevocationSuperseded    = 4
+	RevocationCessation     = 5
+)
+
+// Certificate is an entry in the issuance index of the internal CA
+type Certificate struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	// Serial is the hex encoded serial number
+	Serial      string `json:"serial" gorm:"type:varchar(64);not null;uniqueIndex"`
+	CommonName  string `json:"common_name" gorm:"type:varchar(255);index"`
+	DNSNames    string `json:"dns_names" gorm:"type:text"`
+	IPAddresses string `json:"ip_addresses" gorm:"type:text"`
+	AddressID   int    `json:"address_id" gorm:"type:BIGINT;index"`
+	KeyType     string `json:"key_type" gorm:"type:varchar(16)"`
+	Issuer      string `json:"issuer" gorm:"type:varchar(255)"`
+	// External certificates have been signed by another CA from a certificate request, they can't be revoked here
+	External  bool      `json:"external"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// Path of the directory, and Name of the files the certificate and key have been written to
+	Path string `json:"path" gorm:"type:varchar(255)"`
+	Name string `json:"name" gorm:"type:varchar(255)"`
+	PEM  string `json:"-" gorm:"type:text"`
+
+	RevokedAt        *time.Time `json:"revoked_at"`
+	RevocationReason int        `json:"revocation_reason"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type RevokeForm struct {
+	// Reason is a CRL reason code, eg. 1 for key compromise or 4 for superseded
+	Reason int `json:"reason"`
+}
+
+// Status of a certificate request
+const (
+	RequestPending = "pending"
+	RequestSigned  = "signed"
+)
+
+type CertificateRequestForm struct {
+	// AddressID of the host to create the request for, 0 creates a request for the appliance itself
+	AddressID int `json:"address_id"`
+}
+
+// CertificateRequest is a CSR whose key is held by the appliance, the certificate is signed by an external CA
+type CertificateRequest struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	CertificateRequestForm
+
+	CommonName    string `json:"common_name" gorm:"type:varchar(255)"`
+	DNSNames      string `json:"dns_names" gorm:"type:text"`
+	IPAddresses   string `json:"ip_addresses" gorm:"type:text"`
+	KeyType       string `json:"key_type" gorm:"type:varchar(16)"`
+	Path          string `json:"path" gorm:"type:varchar(255)"`
+	Name          string `json:"name" gorm:"type:varchar(255)"`
+	PEM           string `json:"pem" gorm:"type:text"`
+	Status        string `json:"status" gorm:"type:varchar(16)"`
+	CertificateID int    `json:"certificate_id" gorm:"type:BIGINT"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CertificateUploadForm struct {
+	// Certificate in PEM format, optionally followed by the chain of issuing certificates
+	Certificate string `json:"certificate" binding:"required"`
+}
+
+type CAImportForm struct {
+	// Certificate of the intermediate CA in PEM format, optionally followed by the chain up to the root
+	Certificate string `json:"certificate" binding:"required"`
+	// Key of the intermediate CA in PEM format, it must not be encrypted
+	Key string `json:"key" binding:"required"`
+}
@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// FailoverState is the state of an instance of a failover pair
+type FailoverState string
+
+const (
+	// FailoverDisabled instances are not paired
+	FailoverDisabled FailoverState = "disabled"
+	// FailoverStartup instances have not heard of their partner yet, they only serve their share
+	FailoverStartup FailoverState = "startup"
+	// FailoverNormal instances are in contact with their partner and serve their share
+	FailoverNormal FailoverState = "normal"
+	// FailoverPartnerDown instances have lost contact with their partner and serve the whole range
+	FailoverPartnerDown FailoverState = "partner-down"
+)
+
+// FailoverStatus is exchanged with every heartbeat
+type FailoverStatus struct {
+	Role        string        `json:"role"`
+	State       FailoverState `json:"state"`
+	Split       int           `json:"split"`
+	Peer        string        `json:"peer,omitempty"`
+	PeerState   FailoverState `json:"peer_state,omitempty"`
+	LastContact *time.Time    `json:"last_contact,omitempty"`
+}
+
+// FailoverLease is the state of an address that is replicated to the partner. The ids of both instances differ,
+// addresses are matched by ip and client, that is the mac address, the duid or the circuit id. The group is matched by
+// its name. The generated root password is not replicated, it is encrypted with the keys of the instance that
+// installed the host, and only that instance reveals it.
+type FailoverLease struct {
+	IP                string    `json:"ip"`
+	Reimage           bool      `json:"reimage"`
+	Reserved          bool      `json:"reserved"`
+	Group             string    `json:"group,omitempty"`
+	Mac               string    `json:"mac"`
+	Hostname          string    `json:"hostname"`
+	Domain            string    `json:"domain"`
+	DUID              string    `json:"duid"`
+	CircuitID         string    `json:"circuit_id"`
+	RemoteID          string    `json:"remote_id"`
+	Ks                string    `json:"ks,omitempty"`
+	FirstSeen         time.Time `json:"first_seen"`
+	LastSeen          time.Time `json:"last_seen"`
+	LastSeenRelay     string    `json:"last_seen_relay"`
+	LastSeenCircuitID string    `json:"last_seen_circuit_id"`
+	LastSeenRemoteID  string    `json:"last_seen_remote_id"`
+	ConflictMac       string    `json:"conflict_mac"`
+	Expires           time.Time `json:"expires_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// IsReservation reports if the address has been set up for a host on the partner
+func (l *FailoverLease) IsReservation() bool {
+	return l.Reimage || l.Reserved || l.Group != ""
+}
+
+// FailoverResult is the answer to replicated leases
+type FailoverResult struct {
+	Applied int `json:"applied"`
+}
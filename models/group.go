@@ -74,4 +74,5 @@ type GroupOptions struct {
 	AllowLegacyCPU       bool `json:"allowlegacycpu"`
 	Certificate          bool `json:"certificate"`
 	CreateVMFS           bool `json:"createvmfs"`
+	UniqueRootPassword   bool `json:"uniquerootpassword"`
 }
@@ -0,0 +1,66 @@
+package models
+
+import "time"
+
+// Actions the importer takes for the pools and addresses of an export
+const (
+	ImportCreate   = "create"
+	ImportUpdate   = "update"
+	ImportExists   = "exists"
+	ImportConflict = "conflict"
+)
+
+// ImportReport lists what has been found in an export of another dhcp server and what has been done with it, nothing
+// has been written if it is a dry run
+type ImportReport struct {
+	Format    string          `json:"format"`
+	DryRun    bool            `json:"dry_run"`
+	Pools     []ImportPool    `json:"pools"`
+	Addresses []ImportAddress `json:"addresses"`
+
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Existing  int `json:"existing"`
+	Conflicts int `json:"conflicts"`
+}
+
+// ImportPool is a subnet or scope of the export
+type ImportPool struct {
+	Name         string `json:"name"`
+	NetAddress   string `json:"net_address"`
+	Netmask      int    `json:"netmask"`
+	StartAddress string `json:"start_address"`
+	EndAddress   string `json:"end_address"`
+	Gateway      string `json:"gateway"`
+	LeaseTime    int    `json:"lease_time"`
+	Exclusions   string `json:"exclusions,omitempty"`
+	// OnlyServeReserved is set for subnets without a dynamic range, they only serve their hosts
+	OnlyServeReserved bool `json:"only_serve_reserved"`
+
+	// Action is create, exists if a pool with the same network is there already or conflict if it overlaps another
+	// pool, PoolID is the pool that has been created or that has been found
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	PoolID int    `json:"pool_id,omitempty"`
+}
+
+// ImportAddress is a reservation or, if Lease is set, an active lease of the export
+type ImportAddress struct {
+	IP        string     `json:"ip"`
+	Mac       string     `json:"mac,omitempty"`
+	DUID      string     `json:"duid,omitempty"`
+	CircuitID string     `json:"circuit_id,omitempty"`
+	RemoteID  string     `json:"remote_id,omitempty"`
+	Hostname  string     `json:"hostname,omitempty"`
+	Domain    string     `json:"domain,omitempty"`
+	Lease     bool       `json:"lease"`
+	Expires   *time.Time `json:"expires_at,omitempty"`
+
+	// Action is create, update if an address of the same client or an expired lease is taken over, exists or
+	// conflict. Pool is the name of the pool the address belongs to.
+	Action    string `json:"action"`
+	Reason    string `json:"reason,omitempty"`
+	Pool      string `json:"pool,omitempty"`
+	PoolID    int    `json:"pool_id,omitempty"`
+	AddressID int    `json:"address_id,omitempty"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// KsToken is a single use token that is handed to a host in boot.cfg and authorizes exactly one ks.cfg download
+type KsToken struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	AddressID int        `json:"address_id" gorm:"type:BIGINT;not null;index"`
+	TokenHash string     `json:"-" gorm:"type:varchar(64);not null;uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	UsedBy    string     `json:"used_by" gorm:"type:varchar(45)"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
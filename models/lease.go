@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// LeaseArchive keeps the dynamic leases and decline blocks that have been swept from the address table
+type LeaseArchive struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	AddressID     int       `json:"address_id" gorm:"type:BIGINT"`
+	IP            string    `json:"ip" gorm:"type:varchar(45);index"`
+	Mac           string    `json:"mac" gorm:"type:varchar(17);index"`
+	Hostname      string    `json:"hostname" gorm:"type:varchar(255)"`
+	PoolID        NullInt32 `json:"pool_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	LastSeenRelay string    `json:"last_seen_relay" gorm:"type:varchar(45)"`
+	// Declined is set for addresses that have been blocked because a client reported a conflict
+	Declined bool `json:"declined" gorm:"type:bool"`
+
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Expires    time.Time `json:"expires_at"`
+	ArchivedAt time.Time `json:"archived_at" gorm:"index"`
+}
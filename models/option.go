@@ -1,10 +1,14 @@
 package models
 
 import (
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/gopacket/layers"
@@ -56,8 +60,18 @@ func (o Option) Level() int {
 	return 0
 }
 
+// ToDHCPOption encodes the option, merge reports if the values of several options with the same opcode are a list
+// that goes into a single option. Data that starts with hex: or base64: is sent as it is for any opcode.
 func (o Option) ToDHCPOption() (opt layers.DHCPOption, merge bool, err error) {
 	code := layers.DHCPOpt(o.OpCode)
+
+	if b, ok, err := rawOptionData(o.Data); ok {
+		if err != nil {
+			return opt, false, err
+		}
+		return layers.NewDHCPOption(code, b), false, nil
+	}
+
 	switch code {
 	case // string
 		layers.DHCPOptHostname,
@@ -70,7 +84,6 @@ func (o Option) ToDHCPOption() (opt layers.DHCPOption, merge bool, err error) {
 		layers.DHCPOptXFontServer,
 		layers.DHCPOptXDisplayManager,
 		layers.DHCPOptMessage,
-		layers.DHCPOptDomainSearch,
 		layers.DHCPOptSIPServers,
 		66, // TFTP server name
 		67: // TFTP file name
@@ -81,7 +94,12 @@ func (o Option) ToDHCPOption() (opt layers.DHCPOption, merge bool, err error) {
 		layers.DHCPOptBroadcastAddr,
 		layers.DHCPOptSolicitAddr:
 
-		return NewIPOption(code, net.ParseIP(o.Data)), false, nil
+		ip := net.ParseIP(strings.TrimSpace(o.Data)).To4()
+		if ip == nil {
+			return opt, false, fmt.Errorf("invalid IPv4 address %q", o.Data)
+		}
+
+		return NewIPOption(code, ip), false, nil
 	case // n*net.IP
 		layers.DHCPOptRouter,
 		layers.DHCPOptTimeServer,
@@ -98,7 +116,47 @@ func (o Option) ToDHCPOption() (opt layers.DHCPOption, merge bool, err error) {
 		layers.DHCPOptNetBIOSTCPNS,
 		layers.DHCPOptNetBIOSTCPDDS:
 
-		return NewIPOption(code, net.ParseIP(o.Data).To4()), true, nil
+		var b []byte
+		for _, v := range strings.FieldsFunc(o.Data, isListSeparator) {
+			ip := net.ParseIP(v).To4()
+			if ip == nil {
+				return opt, false, fmt.Errorf("invalid IPv4 address %q", v)
+			}
+			b = append(b, ip...)
+		}
+		if len(b) == 0 {
+			return opt, false, fmt.Errorf("no address given")
+		}
+
+		return layers.NewDHCPOption(code, b), true, nil
+	case // bool
+		layers.DHCPOptIPForwarding,
+		layers.DHCPOptSourceRouting,
+		layers.DHCPOptAllSubsLocal,
+		layers.DHCPOptMaskDiscovery,
+		layers.DHCPOptMaskSupplier,
+		layers.DHCPOptRouterDiscovery,
+		layers.DHCPOptARPTrailers,
+		layers.DHCPOptEthernetEncap,
+		layers.DHCPOptTCPKeepAliveGarbage:
+
+		v, err := parseBool(o.Data)
+		if err != nil {
+			return opt, false, err
+		}
+
+		return NewBoolOption(code, v), false, nil
+	case // uint8
+		layers.DHCPOptDefaultTTL,
+		layers.DHCPOptTCPTTL,
+		layers.DHCPOptNETBIOSTCPNodeType:
+
+		i, err := strconv.ParseUint(strings.TrimSpace(o.Data), 10, 8)
+		if err != nil {
+			return opt, false, err
+		}
+
+		return layers.NewDHCPOption(code, []byte{byte(i)}), false, nil
 	case // uint16
 		layers.DHCPOptBootfileSize,
 		layers.DHCPOptDatagramMTU,
@@ -114,12 +172,16 @@ func (o Option) ToDHCPOption() (opt layers.DHCPOption, merge bool, err error) {
 	case // n*uint16
 		layers.DHCPOptPathPlateuTableOption:
 
-		i, err := strconv.Atoi(o.Data)
-		if err != nil {
-			return opt, false, err
+		var b []byte
+		for _, v := range strings.FieldsFunc(o.Data, isListSeparator) {
+			i, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return opt, false, err
+			}
+			b = binary.BigEndian.AppendUint16(b, uint16(i))
 		}
 
-		return NewUint16Option(code, i), true, nil
+		return layers.NewDHCPOption(code, b), true, nil
 	case // int32 (signed seconds from UTC)
 		layers.DHCPOptTimeOffset:
 
@@ -143,9 +205,291 @@ func (o Option) ToDHCPOption() (opt layers.DHCPOption, merge bool, err error) {
 		}
 
 		return NewUint32Option(code, i), false, nil
+	case // n*domain name (RFC 3397)
+		layers.DHCPOptDomainSearch:
+
+		b, err := encodeDomainSearch(strings.FieldsFunc(o.Data, isListSeparator))
+		if err != nil {
+			return opt, false, err
+		}
+
+		return layers.NewDHCPOption(code, b), true, nil
+	case // sub-options
+		layers.DHCPOptVendorOption:
+
+		b, err := encodeSubOptions(o.Data)
+		if err != nil {
+			return opt, false, err
+		}
+
+		return layers.NewDHCPOption(code, b), true, nil
+	}
+
+	return opt, false, fmt.Errorf("unsupported dhcp option type %d, use hex: or base64: to send it as it is", o.OpCode)
+}
+
+// EncodeDHCPOptions encodes the options that have been configured for the same opcode. The values of lists like
+// several dns servers are merged into a single option in the order of their priority, otherwise the option with the
+// lowest priority is used. Raw hex: and base64: values are never merged, the one with the lowest priority replaces
+// all other options.
+func EncodeDHCPOptions(options []Option) (opt layers.DHCPOption, err error) {
+	if len(options) == 0 {
+		return opt, fmt.Errorf("no options given")
+	}
+
+	sorted := append([]Option(nil), options...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	for _, v := range sorted {
+		if _, raw, _ := rawOptionData(v.Data); raw {
+			sorted = []Option{v}
+			break
+		}
+	}
+
+	// The domain names of all options are compressed together, their pointers refer to the whole list
+	if layers.DHCPOpt(sorted[0].OpCode) == layers.DHCPOptDomainSearch && len(sorted) > 1 {
+		merged := sorted[0]
+		var names []string
+		for _, v := range sorted {
+			names = append(names, v.Data)
+		}
+		merged.Data = strings.Join(names, ",")
+		sorted = []Option{merged}
+	}
+
+	for i, v := range sorted {
+		o, merge, err := v.ToDHCPOption()
+		if err != nil {
+			return opt, err
+		}
+		if i == 0 {
+			opt = o
+			if !merge {
+				break
+			}
+			continue
+		}
+		opt.Data = append(opt.Data, o.Data...)
+	}
+
+	opt.Length = uint8(len(opt.Data))
+	return opt, nil
+}
+
+// SplitDHCPOption splits an option that is longer than 255 bytes into several options with the same code, the client
+// concatenates them again (RFC 3396)
+func SplitDHCPOption(opt layers.DHCPOption) []layers.DHCPOption {
+	if len(opt.Data) <= 255 {
+		return []layers.DHCPOption{opt}
 	}
 
-	return opt, false, fmt.Errorf("unsupported dhcp option type %d", o.OpCode)
+	var opts []layers.DHCPOption
+	for b := opt.Data; len(b) > 0; {
+		n := len(b)
+		if n > 255 {
+			n = 255
+		}
+		opts = append(opts, layers.NewDHCPOption(opt.Type, b[:n]))
+		b = b[n:]
+	}
+	return opts
+}
+
+// ToDHCPv6Option encodes options of IPv6 pools, their opcode is a DHCPv6 option code
+func (o Option) ToDHCPv6Option() (opt layers.DHCPv6Option, err error) {
+	code := layers.DHCPv6Opt(o.OpCode)
+
+	if b, ok, err := rawOptionData(o.Data); ok {
+		if err != nil {
+			return opt, err
+		}
+		return layers.NewDHCPv6Option(code, b), nil
+	}
+
+	switch code {
+	case // string
+		layers.DHCPv6OptBootFileURL:
+
+		return layers.NewDHCPv6Option(code, []byte(o.Data)), nil
+	case // n*string, each prefixed with its length (RFC 5970)
+		layers.DHCPv6OptBootFileParam:
+
+		var b []byte
+		for _, v := range strings.Fields(o.Data) {
+			b = append(b, byte(len(v)>>8), byte(len(v)))
+			b = append(b, v...)
+		}
+		return layers.NewDHCPv6Option(code, b), nil
+	case // n*net.IP
+		layers.DHCPv6OptDNSServers,
+		layers.DHCPv6OptSNTPServers,
+		layers.DHCPv6OptSIPServersAddressList:
+
+		var b []byte
+		for _, v := range strings.FieldsFunc(o.Data, isListSeparator) {
+			ip := net.ParseIP(v)
+			if ip == nil || ip.To4() != nil {
+				return opt, fmt.Errorf("invalid IPv6 address %q", v)
+			}
+			b = append(b, ip.To16()...)
+		}
+		return layers.NewDHCPv6Option(code, b), nil
+	case // n*domain name (RFC 1035 wire format)
+		layers.DHCPv6OptDomainList,
+		layers.DHCPv6OptSIPServersDomainList:
+
+		var b []byte
+		for _, v := range strings.FieldsFunc(o.Data, isListSeparator) {
+			for _, label := range strings.Split(strings.TrimSuffix(v, "."), ".") {
+				if len(label) == 0 || len(label) > 63 {
+					return opt, fmt.Errorf("invalid domain name %q", v)
+				}
+				b = append(b, byte(len(label)))
+				b = append(b, label...)
+			}
+			b = append(b, 0)
+		}
+		return layers.NewDHCPv6Option(code, b), nil
+	}
+
+	return opt, fmt.Errorf("unsupported dhcpv6 option type %d", o.OpCode)
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || r == ' '
+}
+
+// rawOptionData decodes hex: and base64: data, ok is false for all other data
+func rawOptionData(data string) (b []byte, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(data, "hex:"):
+		// the bytes may be separated, eg. hex:01:04:c0:a8:00:01
+		s := strings.NewReplacer(":", "", " ", "", "-", "").Replace(strings.TrimPrefix(data, "hex:"))
+		b, err = hex.DecodeString(s)
+		return b, true, err
+	case strings.HasPrefix(data, "base64:"):
+		b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(data, "base64:")))
+		return b, true, err
+	}
+	return nil, false, nil
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
+
+// encodeDomainSearch encodes the domain names in the RFC 1035 wire format, a name that ends like one that has been
+// written before points to it instead of repeating it (RFC 3397)
+func encodeDomainSearch(names []string) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no domain name given")
+	}
+
+	var b []byte
+	offsets := map[string]int{}
+	for _, v := range names {
+		labels := strings.Split(strings.TrimSuffix(strings.ToLower(v), "."), ".")
+		for i, label := range labels {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %q", v)
+			}
+
+			suffix := strings.Join(labels[i:], ".")
+			if offset, ok := offsets[suffix]; ok {
+				b = append(b, 0xc0|byte(offset>>8), byte(offset))
+				break
+			}
+			if len(b) < 0x3fff {
+				offsets[suffix] = len(b)
+			}
+
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+			if i == len(labels)-1 {
+				b = append(b, 0)
+			}
+		}
+	}
+
+	return b, nil
+}
+
+// encodeSubOptions encodes the vendor specific information of option 43, a comma separated list of code=value. The
+// value is a string unless it starts with ip:, u8:, u16:, u32:, hex: or base64:, eg. 1=ip:192.168.0.1, 6=u8:8
+func encodeSubOptions(data string) ([]byte, error) {
+	var b []byte
+	for _, v := range strings.Split(data, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid sub-option %q, expected code=value", v)
+		}
+		code, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 8)
+		if err != nil || code == 0 || code == 255 {
+			return nil, fmt.Errorf("invalid sub-option code %q", parts[0])
+		}
+
+		value, err := encodeSubOptionValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("sub-option %d: %w", code, err)
+		}
+		if len(value) > 255 {
+			return nil, fmt.Errorf("sub-option %d is too long", code)
+		}
+
+		b = append(b, byte(code), byte(len(value)))
+		b = append(b, value...)
+	}
+
+	if len(b) == 0 {
+		return nil, fmt.Errorf("no sub-option given")
+	}
+	return b, nil
+}
+
+func encodeSubOptionValue(s string) ([]byte, error) {
+	if b, ok, err := rawOptionData(s); ok {
+		return b, err
+	}
+
+	typ, value, found := strings.Cut(s, ":")
+	if !found {
+		return []byte(s), nil
+	}
+
+	switch typ {
+	case "ip":
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", value)
+		}
+		return ip, nil
+	case "u8":
+		i, err := strconv.ParseUint(value, 10, 8)
+		return []byte{byte(i)}, err
+	case "u16":
+		i, err := strconv.ParseUint(value, 10, 16)
+		return binary.BigEndian.AppendUint16(nil, uint16(i)), err
+	case "u32":
+		i, err := strconv.ParseUint(value, 10, 32)
+		return binary.BigEndian.AppendUint32(nil, uint32(i)), err
+	}
+
+	// a string that happens to contain a colon
+	return []byte(s), nil
 }
 
 func NewUint16Option(t layers.DHCPOpt, v int) layers.DHCPOption {
@@ -172,6 +516,13 @@ func NewUint32Option(t layers.DHCPOpt, v int) layers.DHCPOption {
 	return layers.NewDHCPOption(t, buf)
 }
 
+func NewBoolOption(t layers.DHCPOpt, v bool) layers.DHCPOption {
+	if v {
+		return layers.NewDHCPOption(t, []byte{1})
+	}
+	return layers.NewDHCPOption(t, []byte{0})
+}
+
 func NewStringOption(t layers.DHCPOpt, v string) layers.DHCPOption {
 	return layers.NewDHCPOption(t, []byte(v))
 }
@@ -1,10 +1,15 @@
 package models
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math/big"
 	"net"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tribock/go-via/db"
@@ -13,21 +18,34 @@ import (
 
 type PoolForm struct {
 	Name             string `json:"name" gorm:"type:varchar(255);not null" binding:"required" `
-	StartAddress     string `json:"start_address" gorm:"type:varchar(15);not null" binding:"required" `
-	EndAddress       string `json:"end_address" gorm:"type:varchar(15);not null" binding:"required" `
+	StartAddress     string `json:"start_address" gorm:"type:varchar(45);not null" binding:"required" `
+	EndAddress       string `json:"end_address" gorm:"type:varchar(45);not null" binding:"required" `
 	Netmask          int    `json:"netmask" gorm:"type:integer;not null" binding:"required" `
 	LeaseTime        int    `json:"lease_time" gorm:"type:bigint" binding:"required" `
-	Gateway          string `json:"gateway" gorm:"type:varchar(15)" binding:"required" `
+	Gateway          string `json:"gateway" gorm:"type:varchar(45)" binding:"required" `
 	OnlyServeReimage bool   `json:"only_serve_reimage" gorm:"type:boolean"`
-
-	AuthorizedVlan int    `json:"authorized_vlan" gorm:"type:bigint"`
-	ManagedRef     string `json:"managed_reference"`
+	// OnlyServeReserved hands out reservations only, including the ones that are not flagged for re-imaging
+	OnlyServeReserved bool `json:"only_serve_reserved" gorm:"type:boolean"`
+	// Exclusions are left out of the dynamic allocation, a comma separated list of addresses and ranges, eg.
+	// 10.0.0.10-10.0.0.19, 10.0.0.50
+	Exclusions string `json:"exclusions" gorm:"type:text"`
+
+	// MacAllow only serves the clients whose mac address matches one of the comma separated addresses or prefixes,
+	// eg. the OUI 94:40:c9 of HPE. MacDeny ignores the matching clients, it wins over MacAllow.
+	MacAllow string `json:"mac_allow" gorm:"type:text"`
+	MacDeny  string `json:"mac_deny" gorm:"type:text"`
+
+	// AuthorizedVlan restricts the pool to the requests that arrive on the vlan, 0 serves all of them
+	AuthorizedVlan int `json:"authorized_vlan" gorm:"type:bigint"`
+	// ManagedRef links the pool to an ip range or prefix in the IPAM, eg. ip-ranges/12 or prefixes/5. The addresses,
+	// the netmask and the gateway of linked pools are synced from there.
+	ManagedRef string `json:"managed_reference"`
 }
 
 type Pool struct {
 	ID int `json:"id" gorm:"primary_key"`
 
-	NetAddress string `json:"net_address" gorm:"type:varchar(15);not null"`
+	NetAddress string `json:"net_address" gorm:"type:varchar(45);not null"`
 	PoolForm
 
 	CreatedAt time.Time  `json:"created_at"`
@@ -38,6 +56,23 @@ type Pool struct {
 type PoolWithAddresses struct {
 	Pool
 	Addresses []Address `json:"address,omitempty" gorm:"foreignkey:PoolID"`
+
+	// reservations of all pools by ip, they are looked up in the database for every check as long as it is nil
+	reservations map[string][]Address
+
+	// share limits the dynamic allocation to a part of the range, it is nil as long as the whole range is served
+	share *poolShare
+}
+
+type poolShare struct {
+	percent int
+	upper   bool
+}
+
+// SetReservations provides the addresses flagged for re-imaging of all pools by ip, so that the availability checks
+// dont have to query them
+func (p *PoolWithAddresses) SetReservations(reservations map[string][]Address) {
+	p.reservations = reservations
 }
 
 func (p *Pool) BeforeCreate(tx *gorm.DB) error {
@@ -45,7 +80,11 @@ func (p *Pool) BeforeCreate(tx *gorm.DB) error {
 }
 
 func (p *Pool) BeforeSave(tx *gorm.DB) error {
-	if p.Netmask < 1 || p.Netmask > 32 {
+	bits := 32
+	if p.IsIPv6() {
+		bits = 128
+	}
+	if p.Netmask < 1 || p.Netmask > bits {
 		return fmt.Errorf("invalid netmask")
 	}
 
@@ -64,11 +103,181 @@ func (p *Pool) BeforeSave(tx *gorm.DB) error {
 		return fmt.Errorf("start and end address do not belong to the same network")
 	}
 
+	if gw := net.ParseIP(p.Gateway); gw != nil && (gw.To4() == nil) != p.IsIPv6() {
+		return fmt.Errorf("the gateway does not belong to the same address family")
+	}
+
+	exclusions, err := p.ExcludedRanges()
+	if err != nil {
+		return err
+	}
+	for _, v := range exclusions {
+		if !startNet.Contains(v[0]) || !startNet.Contains(v[1]) {
+			return fmt.Errorf("the exclusion %s-%s does not belong to the network of the pool", v[0], v[1])
+		}
+	}
+
+	if p.MacAllow, err = normalizeMacList(p.MacAllow); err != nil {
+		return err
+	}
+	if p.MacDeny, err = normalizeMacList(p.MacDeny); err != nil {
+		return err
+	}
+
+	if p.AuthorizedVlan < 0 || p.AuthorizedVlan > 4094 {
+		return fmt.Errorf("invalid vlan")
+	}
+
+	if p.ManagedRef != "" {
+		if _, _, err := ParseManagedRef(p.ManagedRef); err != nil {
+			return err
+		}
+	}
+
 	p.NetAddress = startNet.IP.String()
 
 	return nil
 }
 
+// ExcludedRanges parses the exclusions of the pool into ranges, a single address is a range of its own
+func (p *Pool) ExcludedRanges() ([][2]net.IP, error) {
+	var ranges [][2]net.IP
+	for _, v := range strings.Split(p.Exclusions, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		parts := strings.SplitN(v, "-", 2)
+		start := net.ParseIP(strings.TrimSpace(parts[0]))
+		end := start
+		if len(parts) == 2 {
+			end = net.ParseIP(strings.TrimSpace(parts[1]))
+		}
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("invalid exclusion %q", v)
+		}
+		if (start.To4() == nil) != (end.To4() == nil) || bytes.Compare(start.To16(), end.To16()) > 0 {
+			return nil, fmt.Errorf("invalid exclusion %q, the start address is after the end address", v)
+		}
+
+		ranges = append(ranges, [2]net.IP{start, end})
+	}
+
+	return ranges, nil
+}
+
+// IsExcluded reports if the ip is left out of the dynamic allocation
+func (p *Pool) IsExcluded(ip net.IP) bool {
+	ranges, _ := p.ExcludedRanges()
+	for _, v := range ranges {
+		if bytes.Compare(ip.To16(), v[0].To16()) >= 0 && bytes.Compare(ip.To16(), v[1].To16()) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MacAllowed checks the mac address of a client against the allow and deny list of the pool
+func (p *Pool) MacAllowed(mac string) error {
+	mac = strings.ToLower(mac)
+	if matchMacList(p.MacDeny, mac) {
+		return fmt.Errorf("the mac address is denied by pool %d", p.ID)
+	}
+	if strings.TrimSpace(p.MacAllow) != "" && !matchMacList(p.MacAllow, mac) {
+		return fmt.Errorf("the mac address is not allowed by pool %d", p.ID)
+	}
+	return nil
+}
+
+func matchMacList(list string, mac string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" && strings.HasPrefix(mac, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeMacList validates a comma separated list of mac addresses and prefixes and writes them the way
+// net.HardwareAddr does, eg. 00-50-56 and 0050.56 become 00:50:56
+func normalizeMacList(list string) (string, error) {
+	var items []string
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		digits := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(v))
+		if len(digits) < 2 || len(digits) > 12 || len(digits)%2 != 0 {
+			return "", fmt.Errorf("invalid mac address or prefix %q", v)
+		}
+		if _, err := hex.DecodeString(digits); err != nil {
+			return "", fmt.Errorf("invalid mac address or prefix %q", v)
+		}
+
+		var octets []string
+		for i := 0; i < len(digits); i += 2 {
+			octets = append(octets, digits[i:i+2])
+		}
+		items = append(items, strings.Join(octets, ":"))
+	}
+	return strings.Join(items, ","), nil
+}
+
+var managedRefPattern = regexp.MustCompile(`^(ip-ranges|prefixes)/([0-9]+)$`)
+
+// ParseManagedRef splits a managed reference into the kind of the IPAM object and its id
+func ParseManagedRef(ref string) (kind string, id int, err error) {
+	m := managedRefPattern.FindStringSubmatch(ref)
+	if m == nil {
+		return "", 0, fmt.Errorf("invalid managed reference, expected ip-ranges/<id> or prefixes/<id>")
+	}
+	id, _ = strconv.Atoi(m[2])
+	return m[1], id, nil
+}
+
+// SetShare limits Next to a part of the range when another server hands out the rest, the lower part are the first
+// percent of the addresses between the start and the end address
+func (p *PoolWithAddresses) SetShare(percent int, upper bool) {
+	p.share = &poolShare{percent: percent, upper: upper}
+}
+
+// shareRange returns the first and the last address of the part of the range that is served
+func (p *PoolWithAddresses) shareRange(startIP net.IP, endIP net.IP) (net.IP, net.IP) {
+	if p.share == nil {
+		return startIP, endIP
+	}
+
+	start := new(big.Int).SetBytes(startIP.To16())
+	end := new(big.Int).SetBytes(endIP.To16())
+
+	// the first address of the upper part
+	size := new(big.Int).Sub(end, start)
+	size.Add(size, big.NewInt(1))
+	boundary := size.Mul(size, big.NewInt(int64(p.share.percent)))
+	boundary.Div(boundary, big.NewInt(100))
+	boundary.Add(boundary, start)
+
+	if p.share.upper {
+		return bigToIP(boundary), endIP
+	}
+	return startIP, bigToIP(boundary.Sub(boundary, big.NewInt(1)))
+}
+
+func bigToIP(i *big.Int) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	i.FillBytes(ip)
+	return ip
+}
+
+// IsIPv6 reports if the pool hands out IPv6 addresses through DHCPv6
+func (p *Pool) IsIPv6() bool {
+	ip := net.ParseIP(p.StartAddress)
+	return ip != nil && ip.To4() == nil
+}
+
 // Next returns the next free address in the pool (that is not reserved nor already leased)
 func (p *PoolWithAddresses) Next() (ip net.IP, err error) {
 	cidrMask := "/" + strconv.Itoa(p.Netmask)
@@ -86,12 +295,29 @@ func (p *PoolWithAddresses) Next() (ip net.IP, err error) {
 		return nil, fmt.Errorf("start address is unspecified")
 	}
 
+	startIP, endIP = p.shareRange(startIP, endIP)
+	if bytes.Compare(startIP.To16(), endIP.To16()) > 0 {
+		return nil, fmt.Errorf("could not find a free address, the share of the range is empty")
+	}
+
+	// Collect the taken addresses once instead of checking every candidate against all of them
+	now := time.Now()
+	taken := make(map[string]bool)
+	for _, v := range p.Addresses {
+		if v.Expires.After(now) {
+			taken[v.IP] = true
+		}
+	}
+	for k := range p.reservations {
+		taken[k] = true
+	}
+
 	for ip := startIP; startNet.Contains(ip); next(ip) {
 		if ip.IsMulticast() || ip.IsLoopback() {
 			continue
 		}
 
-		if err := p.IsAvailable(ip); err == nil {
+		if !taken[ip.String()] && p.IsAvailable(ip) == nil {
 			return ip, nil
 		}
 
@@ -103,8 +329,15 @@ func (p *PoolWithAddresses) Next() (ip net.IP, err error) {
 	return nil, fmt.Errorf("could not find a free address")
 }
 
+// IsAvailable checks if the ip can be allocated dynamically, it is neither excluded, leased, declined nor reserved
 func (p *PoolWithAddresses) IsAvailable(ip net.IP) error {
-	return p.IsAvailableExcept(ip, "")
+	if p.IsExcluded(ip) {
+		return fmt.Errorf("excluded from the dynamic allocation")
+	}
+
+	return p.isAvailable(ip, func(v Address) bool {
+		return false
+	})
 }
 
 func (p *PoolWithAddresses) Contains(ip net.IP) (bool, error) {
@@ -118,6 +351,20 @@ func (p *PoolWithAddresses) Contains(ip net.IP) (bool, error) {
 }
 
 func (p *PoolWithAddresses) IsAvailableExcept(ip net.IP, exclude string) error {
+	return p.isAvailable(ip, func(v Address) bool {
+		return v.Mac == exclude
+	})
+}
+
+// IsAvailableFor checks if the ip can be handed out to the client with the given mac address, excluding the lease
+// itself which may be bound to a switch port instead of the mac address
+func (p *PoolWithAddresses) IsAvailableFor(ip net.IP, lease Address, mac string) error {
+	return p.isAvailable(ip, func(v Address) bool {
+		return v.ID == lease.ID || (mac != "" && v.Mac == mac)
+	})
+}
+
+func (p *PoolWithAddresses) isAvailable(ip net.IP, excluded func(v Address) bool) error {
 	ok, err := p.Contains(ip)
 	if err != nil {
 		return err
@@ -133,16 +380,18 @@ func (p *PoolWithAddresses) IsAvailableExcept(ip net.IP, exclude string) error {
 
 	// Check all loaded addresses
 	for _, v := range p.Addresses {
-		if v.IP == s && v.Expires.After(time.Now()) && v.Mac != exclude {
+		if v.IP == s && v.Expires.After(time.Now()) && !excluded(v) {
 			return fmt.Errorf("already leased (%d)", v.ID)
 		}
 	}
 
 	// Check reservations as well
-	var reservations []Address
-	db.DB.Where("ip = ? AND reimage", s).Find(&reservations)
+	reservations := p.reservations[s]
+	if p.reservations == nil {
+		db.DB.Where("ip = ?", s).Where(ReservationCondition).Find(&reservations)
+	}
 	for _, v := range reservations {
-		if v.IP == s && v.Mac != exclude {
+		if v.IP == s && !excluded(v) {
 			return fmt.Errorf("already reserved")
 		}
 	}
@@ -159,7 +408,12 @@ func (p *Pool) LastAddr() (net.IP, error) {
 	}
 
 	if startNet.IP.To4() == nil {
-		return net.IP{}, fmt.Errorf("does not support IPv6 addresses")
+		// IPv6 has no broadcast address, this is the last address of the network
+		ip := make(net.IP, net.IPv6len)
+		for i := range ip {
+			ip[i] = startNet.IP[i] | ^startNet.Mask[i]
+		}
+		return ip, nil
 	}
 	ip := make(net.IP, len(startNet.IP.To4()))
 	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(startNet.IP.To4())|^binary.BigEndian.Uint32(startNet.Mask))
@@ -0,0 +1,100 @@
+package models
+
+// Roles that can be assigned to a user
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleReadOnly = "read-only"
+)
+
+type Permission string
+
+// Permissions that are checked by the API, each role is granted a fixed set of them
+const (
+	// read any object except users
+	PermissionRead Permission = "read"
+	// flag hosts for re-imaging and start postconfig
+	PermissionDeploy Permission = "deploy"
+	// create, update and delete hosts
+	PermissionHosts Permission = "hosts"
+	// manage pools, dhcp options and device classes
+	PermissionPools Permission = "pools"
+	// manage groups
+	PermissionGroups Permission = "groups"
+	// upload, update and delete images
+	PermissionImages Permission = "images"
+	// manage users
+	PermissionUsers Permission = "users"
+	// reveal and export stored secrets, and rotate the keys they are encrypted with
+	PermissionSecrets Permission = "secrets"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		PermissionRead,
+		PermissionDeploy,
+		PermissionHosts,
+		PermissionPools,
+		PermissionGroups,
+		PermissionImages,
+		PermissionUsers,
+		PermissionSecrets,
+	},
+	RoleOperator: {
+		PermissionRead,
+		PermissionDeploy,
+	},
+	RoleReadOnly: {
+		PermissionRead,
+	},
+}
+
+// ValidRole reports if the role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// ValidPermission reports if the permission is one of the known permissions
+func ValidPermission(p Permission) bool {
+	for _, v := range rolePermissions[RoleAdmin] {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns the effective permissions of the user
+func (u User) Permissions() []Permission {
+	if u.Scopes == nil {
+		return rolePermissions[u.Role]
+	}
+
+	var effective []Permission
+	for _, v := range rolePermissions[u.Role] {
+		for _, s := range u.Scopes {
+			if v == s {
+				effective = append(effective, v)
+			}
+		}
+	}
+	return effective
+}
+
+// Can reports if the user has been granted the permission
+func (u User) Can(p Permission) bool {
+	for _, v := range u.Permissions() {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+type UserPermissions struct {
+	ID          int          `json:"id"`
+	Username    string       `json:"username"`
+	Role        string       `json:"role"`
+	Permissions []Permission `json:"permissions"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// SecretKey is a version of the data key that secrets are encrypted with, the key itself is wrapped with the master key
+type SecretKey struct {
+	ID int `json:"version" gorm:"primary_key"`
+
+	Key string `json:"-" gorm:"type:varchar(255);not null"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SecretRotation struct {
+	Version     int `json:"version"`
+	Reencrypted int `json:"reencrypted"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+type Session struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	UserID    int       `json:"user_id" gorm:"type:BIGINT;not null;index"`
+	TokenHash string    `json:"-" gorm:"type:varchar(64);not null;uniqueIndex"`
+	SourceIP  string    `json:"source_ip" gorm:"type:varchar(45)"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	User *User `json:"user,omitempty" gorm:"foreignkey:UserID"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type LoginResponse struct {
+	Message   string    `json:"message"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
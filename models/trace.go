@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// DHCPTransaction is a request the dhcp server has received along with the decision that was made about it
+type DHCPTransaction struct {
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface"`
+	Vlan      int       `json:"vlan"`
+	// Source is how the request arrived, broadcast, unicast, tagged or relayed, or multicast for DHCPv6
+	Source      string `json:"source"`
+	Xid         uint32 `json:"xid"`
+	Mac         string `json:"mac"`
+	MessageType string `json:"message_type"`
+	VendorClass string `json:"vendor_class,omitempty"`
+	Relay       string `json:"relay,omitempty"`
+	CircuitID   string `json:"circuit_id,omitempty"`
+	RemoteID    string `json:"remote_id,omitempty"`
+	RequestedIP string `json:"requested_ip,omitempty"`
+
+	RequestOptions []DHCPTraceOption `json:"request_options"`
+
+	PoolID   int    `json:"pool_id,omitempty"`
+	PoolName string `json:"pool_name,omitempty"`
+	Lease    string `json:"lease,omitempty"`
+
+	// Decision is offer, ack, nak, or advertise and reply for DHCPv6, ignored, dropped by the rate limits or mac
+	// address lists, or processed for requests that are not answered
+	Decision     string            `json:"decision"`
+	Reason       string            `json:"reason,omitempty"`
+	ReplyOptions []DHCPTraceOption `json:"reply_options,omitempty"`
+
+	// Duration of the processing in milliseconds
+	Duration float64 `json:"duration_ms"`
+}
+
+// DHCPTraceOption is a decoded dhcp option, the codes of DHCPv6 options have 16 bits
+type DHCPTraceOption struct {
+	Code  uint16 `json:"code"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
@@ -9,6 +9,7 @@ type UserForm struct {
 	Password string `json:"password" gorm:"type:varchar(255)"`
 	Email    string `json:"email" gorm:"type:varchar(255)"`
 	Comment  string `json:"comment" gorm:"type:varchar(255)"`
+	Role     string `json:"role" gorm:"type:varchar(32)"`
 }
 
 type User struct {
@@ -16,6 +17,12 @@ type User struct {
 
 	UserForm
 
+	// Source is the authentication backend that manages the user
+	Source string `json:"source" gorm:"type:varchar(32)"`
+
+	// Scopes limits the permissions of the role when authenticated with an api token
+	Scopes []Permission `json:"-" gorm:"-"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
@@ -0,0 +1,83 @@
+// Package option82 decodes the relay agent information option (RFC 3046) that relays add to forwarded requests
+package option82
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Code of the relay agent information option
+const Code layers.DHCPOpt = 82
+
+// Sub-options of the relay agent information option
+const (
+	SubOptCircuitID = 1
+	SubOptRemoteID  = 2
+)
+
+// Info holds the sub-options of option 82. The circuit id identifies the port the request has been received on and
+// the remote id the relay itself, usually the switch. Both are formatted with Format.
+type Info struct {
+	CircuitID string
+	RemoteID  string
+
+	// SubOptions contains all sub-options by code, including the ones that have not been decoded
+	SubOptions map[byte][]byte
+}
+
+// Decode parses option 82 of the request, ok is false if the request has not been relayed with agent information
+func Decode(req *layers.DHCPv4) (info *Info, ok bool) {
+	for _, v := range req.Options {
+		if v.Type != Code {
+			continue
+		}
+
+		info, err := Parse(v.Data)
+		if err != nil {
+			return nil, false
+		}
+		return info, true
+	}
+
+	return nil, false
+}
+
+// Parse decodes the data of option 82
+func Parse(data []byte) (*Info, error) {
+	info := &Info{SubOptions: map[byte][]byte{}}
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("option82: truncated sub-option")
+		}
+
+		code, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			return nil, fmt.Errorf("option82: sub-option %d is truncated", code)
+		}
+
+		value := data[2 : 2+length]
+		info.SubOptions[code] = value
+		switch code {
+		case SubOptCircuitID:
+			info.CircuitID = Format(value)
+		case SubOptRemoteID:
+			info.RemoteID = Format(value)
+		}
+
+		data = data[2+length:]
+	}
+
+	return info, nil
+}
+
+// Format returns printable ids as they are, like the "Gi1/0/12" many switches use, and binary ids hex encoded
+func Format(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return hex.EncodeToString(b)
+		}
+	}
+	return string(b)
+}
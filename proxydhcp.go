@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/db"
+	"github.com/tribock/go-via/models"
+)
+
+// ProxyDHCP (PXE specification 2.1) lets us PXE boot hosts on networks where another server hands out the addresses.
+// We answer the DHCPDISCOVER of PXE clients that are flagged for re-imaging with an offer that only identifies us as
+// the boot server. The client then takes its address from the other server and asks us for the boot file on port 4011.
+
+const proxyDhcpPort = 4011
+
+// pxeDiscoveryControl is option 43 with PXE_DISCOVERY_CONTROL (sub-option 6) telling the client to skip boot server
+// discovery and to use the boot file name it is given
+var pxeDiscoveryControl = []byte{6, 1, 0x08, 255}
+
+// serveProxy answers the boot file requests of PXE clients on port 4011
+func serveProxy(intf string, conf *config.Config) {
+	ifi, err := net.InterfaceByName(intf)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"if":  intf,
+			"err": err,
+		}).Fatalf("proxydhcp: failed to open interface")
+	}
+
+	ip, _, err := findIPv4Addr(ifi)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"if":  intf,
+			"err": err,
+		}).Fatalf("proxydhcp: failed to get interface IPv4 address")
+	}
+
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: proxyDhcpPort})
+	if err != nil {
+		logrus.Fatalf("proxydhcp: failed to listen: %v", err)
+	}
+	defer c.Close()
+
+	logrus.WithFields(logrus.Fields{
+		"ip":   ip,
+		"port": proxyDhcpPort,
+		"int":  intf,
+	}).Infof("Starting proxy dhcp server")
+
+	b := make([]byte, ifi.MTU)
+	for {
+		n, src, err := c.ReadFromUDP(b)
+		if err != nil {
+			logrus.Fatalf("proxydhcp: failed to receive message: %v", err)
+		}
+
+		packet := gopacket.NewPacket(b[:n], layers.LayerTypeDHCPv4, gopacket.Default)
+		dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4)
+		if dhcpLayer == nil {
+			continue
+		}
+		req, _ := dhcpLayer.(*layers.DHCPv4)
+
+		t := findMsgType(req)
+		if t != layers.DHCPMsgTypeRequest && t != layers.DHCPMsgTypeInform {
+			continue
+		}
+
+		resp, address := proxyResponse(req, layers.DHCPMsgTypeAck, ip)
+		if resp == nil {
+			logrus.WithFields(logrus.Fields{
+				"client-mac": req.ClientHWAddr.String(),
+				"source":     src.IP.String(),
+			}).Debug("proxydhcp: ignored request of unknown client")
+			continue
+		}
+
+		// Remember the address the other server has given the host, tftp recognizes the host by it
+		bootIP := req.ClientIP
+		if bootIP == nil || bootIP.IsUnspecified() {
+			bootIP = src.IP
+		}
+		if res := db.DB.Model(address).Updates(map[string]interface{}{"boot_ip": bootIP.String(), "last_seen": time.Now()}); res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"client-mac": req.ClientHWAddr.String(),
+				"err":        res.Error,
+			}).Warn("proxydhcp: failed to store the boot address")
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		if err := resp.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"client-mac": req.ClientHWAddr.String(),
+				"err":        err,
+			}).Warn("proxydhcp: failed to serialise response")
+			continue
+		}
+
+		c.WriteToUDP(buf.Bytes(), src)
+
+		logrus.WithFields(logrus.Fields{
+			"client-mac": req.ClientHWAddr.String(),
+			"ip":         bootIP.String(),
+			"host":       address.Hostname,
+		}).Infof("proxydhcp: answered %s with boot file", t)
+	}
+}
+
+// processProxy answers the discover of PXE clients that are flagged for re-imaging, everything else on the network
+// is left to the other dhcp server
+func processProxy(t layers.DHCPMsgType, req *layers.DHCPv4, ip net.IP) (*layers.DHCPv4, error) {
+	if t != layers.DHCPMsgTypeDiscover {
+		return nil, nil
+	}
+
+	resp, _ := proxyResponse(req, layers.DHCPMsgTypeOffer, ip)
+	return resp, nil
+}
+
+// proxyResponse builds a response that does not contain an address. Only offers leave out the boot file name, so
+// that the client requests it on port 4011 once it has its address.
+func proxyResponse(req *layers.DHCPv4, t layers.DHCPMsgType, ip net.IP) (*layers.DHCPv4, *models.Address) {
+	var vendorClass string
+	var clientUUID *layers.DHCPOption
+	for i, v := range req.Options {
+		switch v.Type {
+		case layers.DHCPOptClassID:
+			vendorClass = string(v.Data)
+		case 97: // Client machine identifier
+			clientUUID = &req.Options[i]
+		}
+	}
+
+	if !strings.HasPrefix(vendorClass, "PXEClient") {
+		return nil, nil
+	}
+
+	var address models.Address
+	if res := db.DB.Where("mac = ? AND reimage", req.ClientHWAddr.String()).First(&address); res.Error != nil {
+		return nil, nil
+	}
+
+	resp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		Xid:          req.Xid,
+		Flags:        req.Flags,
+		RelayAgentIP: req.RelayAgentIP,
+		ClientHWAddr: req.ClientHWAddr,
+		NextServerIP: ip.To4(),
+	}
+
+	resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(t)}))
+	resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptServerID, ip.To4()))
+	resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptClassID, []byte("PXEClient")))
+	if clientUUID != nil {
+		resp.Options = append(resp.Options, *clientUUID)
+	}
+	resp.Options = append(resp.Options, layers.NewDHCPOption(layers.DHCPOptVendorOption, pxeDiscoveryControl))
+
+	if t == layers.DHCPMsgTypeAck {
+		resp.File = []byte("mboot.efi")
+		resp.Options = append(resp.Options, layers.NewDHCPOption(67, []byte("mboot.efi")))
+	}
+
+	return resp, &address
+}
@@ -0,0 +1,92 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// ExportIterations is the PBKDF2 iteration count used for exports, it has to be passed to openssl when decrypting
+const ExportIterations = 600000
+
+// passwordAlphabet leaves out characters that are easily confused when read out loud, and characters that need
+// quoting in a kickstart file
+const (
+	passwordLower   = "abcdefghijkmnopqrstuvwxyz"
+	passwordUpper   = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	passwordDigits  = "23456789"
+	passwordSpecial = "!%*+-.:=@^_"
+)
+
+// GeneratePassword returns a random password that contains all character classes, and thus passes the ESXi
+// password complexity requirements
+func GeneratePassword(length int) (string, error) {
+	classes := []string{passwordLower, passwordUpper, passwordDigits, passwordSpecial}
+	if length < len(classes) {
+		return "", fmt.Errorf("secrets: a password needs at least %d characters", len(classes))
+	}
+
+	all := passwordLower + passwordUpper + passwordDigits + passwordSpecial
+	b := make([]byte, length)
+	for i := range b {
+		set := all
+		if i < len(classes) {
+			set = classes[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = set[n.Int64()]
+	}
+
+	// shuffle, so that the guaranteed characters are not always at the start
+	for i := len(b) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return string(b), nil
+}
+
+// EncryptExport encrypts data with a passphrase in the format of openssl enc, so that the receiver does not need
+// any tooling besides openssl:
+//
+//	openssl enc -d -aes-256-cbc -pbkdf2 -iter 600000 -md sha256 -in export.enc
+func EncryptExport(data []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// openssl derives key and iv in one go
+	dk, err := pbkdf2.Key(sha256.New, passphrase, salt, ExportIterations, 32+aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	key, iv := dk[:32], dk[32:]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	plaintext := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	out := append([]byte("Salted__"), salt...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	return append(out, ciphertext...), nil
+}
@@ -0,0 +1,59 @@
+package secrets
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+// the export has to be readable with the command that is given to the receiver
+func TestEncryptExportOpenSSL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("openssl takes a few seconds for the key derivation")
+	}
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl is not installed")
+	}
+
+	const passphrase = "correct horse battery staple"
+	// the padding differs for data that is shorter, as long or longer than a block
+	for _, data := range [][]byte{
+		nil,
+		[]byte("esx01,10.0.0.11"),
+		[]byte("esx01,10.0.0.11\n"),
+		[]byte("hostname,ip,mac,password\nesx01,10.0.0.11,00:50:56:00:00:01,Xy3!kP9@qR2%\n"),
+	} {
+		enc, err := EncryptExport(data, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(enc, []byte("Salted__")) || len(enc)%16 != 0 {
+			t.Fatalf("got %d bytes starting with %q, expected the openssl format", len(enc), enc[:8])
+		}
+
+		cmd := exec.Command(openssl, "enc", "-d", "-aes-256-cbc", "-pbkdf2", "-iter", strconv.Itoa(ExportIterations), "-md", "sha256", "-pass", "env:VIA_PASSPHRASE")
+		cmd.Env = append(cmd.Environ(), "VIA_PASSPHRASE="+passphrase)
+		cmd.Stdin = bytes.NewReader(enc)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("openssl failed: %v %s", err, stderr.String())
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("openssl decrypted %q, expected %q", out, data)
+		}
+	}
+
+	enc, err := EncryptExport([]byte("secret"), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(openssl, "enc", "-d", "-aes-256-cbc", "-pbkdf2", "-iter", strconv.Itoa(ExportIterations), "-md", "sha256", "-pass", "pass:wrong passphrase")
+	cmd.Stdin = bytes.NewReader(enc)
+	if out, err := cmd.Output(); err == nil && bytes.Equal(out, []byte("secret")) {
+		t.Errorf("openssl decrypted the export with the wrong passphrase")
+	}
+}
@@ -9,36 +9,93 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/models"
+	"gorm.io/gorm"
 )
 
 // Credits to this person for excellent code: https://www.melvinvivas.com/how-to-encrypt-and-decrypt-data-using-aes/
 
-func Init() string {
+// Secrets are encrypted with a versioned data key and stored as "v<version>:<hex nonce+ciphertext>". The data keys
+// are stored in the database, wrapped with the master key. Secrets without a version prefix have been written before
+// key versioning existed and are encrypted with the master key itself.
+
+const defaultKeyFile = "secret/secret.key"
+
+// Keyring holds the master key and all data key versions that are in use
+type Keyring struct {
+	mu      sync.RWMutex
+	master  string
+	keys    map[int]string
+	current int
+	// file the master key has been read from, empty if it is part of the configuration
+	file string
+}
+
+// Init loads the master key, in order of precedence from the configuration (CONFIG_SECRETKEY), a key file (eg. a
+// mounted secret) or secret/secret.key in the working directory, which is created if it doesn't exist.
+func Init(conf *config.Config) *Keyring {
+	var key, file string
+	switch {
+	case conf.SecretKey != "":
+		logrus.WithFields(logrus.Fields{
+			"key": "using the secret key from the configuration",
+		}).Info("secrets")
+		key = conf.SecretKey
+	case conf.SecretKeyFile != "":
+		b, err := ioutil.ReadFile(conf.SecretKeyFile)
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
+		logrus.WithFields(logrus.Fields{
+			"key": "using the secret key from " + conf.SecretKeyFile,
+		}).Info("secrets")
+		key = string(b)
+		file = conf.SecretKeyFile
+	default:
+		key = initKeyFile()
+		file = defaultKeyFile
+	}
+
+	key = strings.TrimSpace(key)
+	if !validKey(key) {
+		logrus.Fatal("secrets: the secret key has to be a hex encoded 32 byte AES-256 key")
+	}
+
+	return &Keyring{master: key, keys: map[int]string{}, file: file}
+}
+
+func validKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == 32
+}
+
+func initKeyFile() string {
 	var key []byte
-	if _, err := os.Stat("secret/secret.key"); os.IsNotExist(err) {
+	if _, err := os.Stat(defaultKeyFile); os.IsNotExist(err) {
 		//secrets file does not exist, create folder and file
 		os.MkdirAll("secret", os.ModePerm)
 		logrus.WithFields(logrus.Fields{
 			"key": "no secrets file has been detected, attempting to create a new one and generate secret key",
 		}).Info("secrets")
-		file, err := os.Create("secret/secret.key")
+		file, err := os.OpenFile(defaultKeyFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			logrus.Fatal(err.Error())
 		}
 		logrus.WithFields(logrus.Fields{
-			"key": "secret/secret.key created",
+			"key": defaultKeyFile + " created",
 		}).Info("secrets")
 
-		//generate a random 32 byte AES-256 key
-		bytes := make([]byte, 32)
-		if _, err := rand.Read(bytes); err != nil {
-			panic(err.Error())
-		}
-
 		//convert key to string and write to file
-		hexkey := hex.EncodeToString(bytes)
+		hexkey, err := NewKey()
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
 		wr, err := file.WriteString(hexkey)
 		if err != nil {
 			logrus.Fatal(err.Error())
@@ -48,67 +105,340 @@ func Init() string {
 			"bytes": wr,
 		}).Info("secrets")
 		file.Close()
-		key, _ = ioutil.ReadFile("secret/secret.key")
+		key, _ = ioutil.ReadFile(defaultKeyFile)
 	} else {
 		//Database exists, moving on.
 		logrus.WithFields(logrus.Fields{
 			"key": "found existing secret key!",
 		}).Info("secrets")
-		key, _ = ioutil.ReadFile("secret/secret.key")
+		key, _ = ioutil.ReadFile(defaultKeyFile)
 	}
 	return string(key)
 }
 
-func Encrypt(stringToEncrypt string, keyString string) (encryptedString string) {
+// NewKey generates a random 32 byte AES-256 key
+func NewKey() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Load reads the data keys from the database, the first data key is generated if none exist yet
+func (k *Keyring) Load(tx *gorm.DB) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var items []models.SecretKey
+	if res := tx.Order("id").Find(&items); res.Error != nil {
+		return res.Error
+	}
+
+	if len(items) == 0 {
+		item, key, err := k.newDataKey(tx)
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"version": item.ID,
+		}).Info("secrets: generated the first data key")
+		k.keys = map[int]string{item.ID: key}
+		k.current = item.ID
+		return nil
+	}
+
+	keys := map[int]string{}
+	for _, v := range items {
+		key, err := Decrypt(v.Key, k.master)
+		if err != nil {
+			return fmt.Errorf("secrets: could not unwrap data key version %d, is this the right secret key? %w", v.ID, err)
+		}
+		keys[v.ID] = key
+	}
+
+	k.keys = keys
+	k.current = items[len(items)-1].ID
+	return nil
+}
+
+// newDataKey generates a data key and persists it wrapped with the master key
+func (k *Keyring) newDataKey(tx *gorm.DB) (models.SecretKey, string, error) {
+	key, err := NewKey()
+	if err != nil {
+		return models.SecretKey{}, "", err
+	}
+
+	wrapped, err := Encrypt(key, k.master)
+	if err != nil {
+		return models.SecretKey{}, "", err
+	}
+
+	item := models.SecretKey{Key: wrapped}
+	if res := tx.Create(&item); res.Error != nil {
+		return models.SecretKey{}, "", res.Error
+	}
+	return item, key, nil
+}
+
+// Version returns the data key version that new secrets are encrypted with
+func (k *Keyring) Version() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Encrypt encrypts the secret with the current data key
+func (k *Keyring) Encrypt(s string) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.encrypt(s, k.current, k.keys)
+}
+
+// Decrypt decrypts a secret written with any of the known key versions
+func (k *Keyring) Decrypt(s string) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.decrypt(s, k.keys)
+}
+
+func (k *Keyring) encrypt(s string, version int, keys map[int]string) (string, error) {
+	key, ok := keys[version]
+	if !ok {
+		return "", fmt.Errorf("secrets: no data key has been loaded")
+	}
+
+	enc, err := Encrypt(s, key)
+	if err != nil {
+		return "", err
+	}
+	return "v" + strconv.Itoa(version) + ":" + enc, nil
+}
+
+func (k *Keyring) decrypt(s string, keys map[int]string) (string, error) {
+	if !strings.HasPrefix(s, "v") {
+		return Decrypt(s, k.master)
+	}
+
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", fmt.Errorf("secrets: malformed secret")
+	}
+	version, err := strconv.Atoi(s[1:i])
+	if err != nil {
+		return "", fmt.Errorf("secrets: malformed secret version")
+	}
+
+	key, ok := keys[version]
+	if !ok {
+		return "", fmt.Errorf("secrets: unknown key version %d", version)
+	}
+	return Decrypt(s[i+1:], key)
+}
+
+// Rotate generates a new data key version. reencrypt is called within a single transaction and has to pass every
+// stored secret through rewrap, which returns it encrypted with the new version. When it succeeds all older data
+// keys are removed, if it fails nothing is changed.
+func (k *Keyring) Rotate(tx *gorm.DB, reencrypt func(tx *gorm.DB, rewrap func(string) (string, error)) error) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var version int
+	var keys map[int]string
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		item, key, err := k.newDataKey(tx)
+		if err != nil {
+			return err
+		}
+
+		keys = map[int]string{item.ID: key}
+		for v, key := range k.keys {
+			keys[v] = key
+		}
+
+		rewrap := func(s string) (string, error) {
+			if s == "" {
+				return "", nil
+			}
+			dec, err := k.decrypt(s, keys)
+			if err != nil {
+				return "", err
+			}
+			return k.encrypt(dec, item.ID, keys)
+		}
+		if err := reencrypt(tx, rewrap); err != nil {
+			return err
+		}
+
+		if res := tx.Where("id <> ?", item.ID).Delete(&models.SecretKey{}); res.Error != nil {
+			return res.Error
+		}
+
+		version = item.ID
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	k.keys = map[int]string{version: keys[version]}
+	k.current = version
+
+	logrus.WithFields(logrus.Fields{
+		"version": version,
+	}).Info("secrets: rotated data key")
+
+	return version, nil
+}
+
+// RotateMaster rewraps every data key with a new master key in a single transaction. Secrets that are still encrypted
+// with the old master key itself are passed to rewrap by reencrypt, which moves them to the current data key. A master
+// key that is supplied has to be put in place by the operator. An empty master generates a new key instead, which
+// replaces the key file. It is written next to the file first and moved into place once the transaction has been
+// committed.
+func (k *Keyring) RotateMaster(tx *gorm.DB, master string, reencrypt func(tx *gorm.DB, rewrap func(string) (string, error)) error) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	master = strings.TrimSpace(master)
+
+	var next string
+	if master == "" {
+		if k.file == "" {
+			return fmt.Errorf("secrets: the master key is part of the configuration, the new one has to be supplied")
+		}
+		var err error
+		if master, err = NewKey(); err != nil {
+			return err
+		}
+
+		next = k.file + ".new"
+		if err := ioutil.WriteFile(next, []byte(master), 0600); err != nil {
+			return err
+		}
+	}
+	if !validKey(master) {
+		return fmt.Errorf("secrets: the new master key has to be a hex encoded 32 byte AES-256 key")
+	}
+
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		var items []models.SecretKey
+		if res := tx.Find(&items); res.Error != nil {
+			return res.Error
+		}
+
+		for _, v := range items {
+			key, err := Decrypt(v.Key, k.master)
+			if err != nil {
+				return fmt.Errorf("secrets: could not unwrap data key version %d: %w", v.ID, err)
+			}
+			wrapped, err := Encrypt(key, master)
+			if err != nil {
+				return err
+			}
+			if res := tx.Model(&v).UpdateColumn("key", wrapped); res.Error != nil {
+				return res.Error
+			}
+		}
+
+		rewrap := func(s string) (string, error) {
+			if s == "" || strings.HasPrefix(s, "v") {
+				return s, nil
+			}
+			dec, err := Decrypt(s, k.master)
+			if err != nil {
+				return "", err
+			}
+			return k.encrypt(dec, k.current, k.keys)
+		}
+		return reencrypt(tx, rewrap)
+	})
+	if err != nil {
+		if next != "" {
+			os.Remove(next)
+		}
+		return err
+	}
+
+	k.master = master
+
+	if next != "" {
+		if err := os.Rename(next, k.file); err != nil {
+			return fmt.Errorf("secrets: the data keys have been rewrapped, but the new master key could not be moved from %s to %s: %w", next, k.file, err)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"written": next != "",
+	}).Info("secrets: rotated master key")
+
+	return nil
+}
+
+// Encrypt encrypts the string with a hex encoded AES-256 key, the nonce is prepended to the hex encoded ciphertext
+func Encrypt(stringToEncrypt string, keyString string) (string, error) {
 
 	//Since the key is in string, we need to convert decode it to bytes
-	key, _ := hex.DecodeString(keyString)
+	key, err := hex.DecodeString(keyString)
+	if err != nil {
+		return "", fmt.Errorf("secrets: invalid key: %w", err)
+	}
 	plaintext := []byte(stringToEncrypt)
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Create a new GCM - https://en.wikipedia.org/wiki/Galois/Counter_Mode
 	//https://golang.org/pkg/crypto/cipher/#NewGCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Create a nonce. Nonce should be from GCM
 	nonce := make([]byte, aesGCM.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Encrypt the data using aesGCM.Seal
 	//Since we don't want to save the nonce somewhere else in this case, we add it as a prefix to the encrypted data. The first nonce argument in Seal is the prefix.
 	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
-	return fmt.Sprintf("%x", ciphertext)
+	return fmt.Sprintf("%x", ciphertext), nil
 }
 
-func Decrypt(encryptedString string, keyString string) (decryptedString string) {
+// Decrypt reverses Encrypt, it fails if the key is wrong or the ciphertext has been tampered with
+func Decrypt(encryptedString string, keyString string) (string, error) {
 
-	key, _ := hex.DecodeString(keyString)
-	enc, _ := hex.DecodeString(encryptedString)
+	key, err := hex.DecodeString(keyString)
+	if err != nil {
+		return "", fmt.Errorf("secrets: invalid key: %w", err)
+	}
+	enc, err := hex.DecodeString(encryptedString)
+	if err != nil {
+		return "", fmt.Errorf("secrets: malformed ciphertext: %w", err)
+	}
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Create a new GCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return "", fmt.Errorf("secrets: ciphertext is too short")
+	}
 
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
@@ -116,8 +446,8 @@ func Decrypt(encryptedString string, keyString string) (decryptedString string)
 	//Decrypt the data
 	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		panic(err.Error())
+		return "", fmt.Errorf("secrets: decryption failed, wrong key or corrupted data: %w", err)
 	}
 
-	return fmt.Sprintf("%s", plaintext)
+	return string(plaintext), nil
 }
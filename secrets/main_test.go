@@ -0,0 +1,336 @@
+package secrets
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// secret is a stored secret, it stands in for the group and root passwords
+type secret struct {
+	ID    int
+	Value string
+}
+
+func openDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	tx, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "via.db")), &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.AutoMigrate(&models.SecretKey{}, &secret{}); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// newKeyring reads the master key from a key file like a mounted secret, the data keys are loaded from tx
+func newKeyring(t *testing.T, tx *gorm.DB, file string, master string) *Keyring {
+	t.Helper()
+
+	if err := ioutil.WriteFile(file, []byte(master+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k := Init(&config.Config{SecretKeyFile: file})
+	if err := k.Load(tx); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func newMaster(t *testing.T) string {
+	t.Helper()
+
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// store writes secrets encrypted with the keyring, and one that has been written before the data keys existed
+func store(t *testing.T, tx *gorm.DB, k *Keyring, values ...string) {
+	t.Helper()
+
+	for i, v := range values {
+		enc, err := k.Encrypt(v)
+		if i == 0 {
+			enc, err = Encrypt(v, k.master)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := tx.Create(&secret{Value: enc}); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+}
+
+// reencrypt passes every stored secret through rewrap
+func reencrypt(tx *gorm.DB, rewrap func(string) (string, error)) error {
+	var items []secret
+	if res := tx.Order("id").Find(&items); res.Error != nil {
+		return res.Error
+	}
+	for _, v := range items {
+		enc, err := rewrap(v.Value)
+		if err != nil {
+			return err
+		}
+		if res := tx.Model(&v).UpdateColumn("value", enc); res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
+
+// check decrypts all stored secrets with the keyring
+func check(t *testing.T, tx *gorm.DB, k *Keyring, expected ...string) []string {
+	t.Helper()
+
+	var items []secret
+	if res := tx.Order("id").Find(&items); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if len(items) != len(expected) {
+		t.Fatalf("found %d secrets, expected %d", len(items), len(expected))
+	}
+
+	var stored []string
+	for i, v := range items {
+		dec, err := k.Decrypt(v.Value)
+		if err != nil {
+			t.Fatalf("secret %d: %v", v.ID, err)
+		}
+		if dec != expected[i] {
+			t.Errorf("secret %d is %q, expected %q", v.ID, dec, expected[i])
+		}
+		stored = append(stored, v.Value)
+	}
+	return stored
+}
+
+func TestKeyringFormat(t *testing.T) {
+	tx := openDB(t)
+	k := newKeyring(t, tx, filepath.Join(t.TempDir(), "secret.key"), newMaster(t))
+
+	enc, err := k.Encrypt("VMware1!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^v1:[0-9a-f]+$`).MatchString(enc) {
+		t.Errorf("got %q, expected v1:<hex>", enc)
+	}
+	if dec, err := k.Decrypt(enc); err != nil || dec != "VMware1!" {
+		t.Errorf("decrypted %q, %v", dec, err)
+	}
+
+	// the nonce is random, the same secret is never encrypted the same way twice
+	if again, _ := k.Encrypt("VMware1!"); again == enc {
+		t.Errorf("encrypted the secret the same way twice")
+	}
+
+	legacy, err := Encrypt("VMware1!", k.master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := k.Decrypt(legacy); err != nil || dec != "VMware1!" {
+		t.Errorf("decrypted the secret without a version to %q, %v", dec, err)
+	}
+
+	tampered := enc[:len(enc)-2] + "00"
+	if strings.HasSuffix(enc, "00") {
+		tampered = enc[:len(enc)-2] + "ff"
+	}
+	for _, s := range []string{"v1", "vx:00", "v2:" + enc[3:], "v1:zz", "v1:00", tampered} {
+		if dec, err := k.Decrypt(s); err == nil {
+			t.Errorf("decrypted %q to %q, expected an error", s, dec)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	enc, err := Encrypt("VMware1!", newMaster(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(enc, newMaster(t)); err == nil {
+		t.Errorf("decrypted with the wrong key")
+	}
+	if _, err := Decrypt(enc, "no key"); err == nil {
+		t.Errorf("decrypted with an invalid key")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tx := openDB(t)
+	file := filepath.Join(t.TempDir(), "secret.key")
+	master := newMaster(t)
+	k := newKeyring(t, tx, file, master)
+	store(t, tx, k, "legacy", "first", "second")
+	before := check(t, tx, k, "legacy", "first", "second")
+
+	version, err := k.Rotate(tx, reencrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || k.Version() != 2 {
+		t.Errorf("rotated to version %d, expected 2", version)
+	}
+
+	after := check(t, tx, k, "legacy", "first", "second")
+	for i, v := range after {
+		if v == before[i] || !strings.HasPrefix(v, "v2:") {
+			t.Errorf("secret %d is %q, expected it to be encrypted with version 2", i, v)
+		}
+	}
+
+	// the old data key is gone, a restart finds the new one only
+	var count int64
+	tx.Model(&models.SecretKey{}).Count(&count)
+	if count != 1 {
+		t.Errorf("found %d data keys, expected 1", count)
+	}
+	check(t, tx, newKeyring(t, tx, file, master), "legacy", "first", "second")
+}
+
+func TestRotateFailure(t *testing.T) {
+	tx := openDB(t)
+	k := newKeyring(t, tx, filepath.Join(t.TempDir(), "secret.key"), newMaster(t))
+	store(t, tx, k, "legacy", "first")
+	before := check(t, tx, k, "legacy", "first")
+
+	failed := errors.New("failed")
+	_, err := k.Rotate(tx, func(tx *gorm.DB, rewrap func(string) (string, error)) error {
+		if err := reencrypt(tx, rewrap); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, expected the rotation to fail", err)
+	}
+
+	if k.Version() != 1 {
+		t.Errorf("the keyring uses version %d, expected 1", k.Version())
+	}
+	after := check(t, tx, k, "legacy", "first")
+	for i := range after {
+		if after[i] != before[i] {
+			t.Errorf("secret %d has been changed", i)
+		}
+	}
+}
+
+func TestRotateMaster(t *testing.T) {
+	tx := openDB(t)
+	file := filepath.Join(t.TempDir(), "secret.key")
+	master := newMaster(t)
+	k := newKeyring(t, tx, file, master)
+	store(t, tx, k, "legacy", "first")
+	// every data key version has to be rewrapped
+	item, key, err := k.newDataKey(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.keys[item.ID] = key
+	k.current = item.ID
+	store(t, tx, k, "legacy again", "second")
+
+	if err := k.RotateMaster(tx, "", reencrypt); err != nil {
+		t.Fatal(err)
+	}
+	check(t, tx, k, "legacy", "first", "legacy again", "second")
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := strings.TrimSpace(string(b))
+	if next == master || !validKey(next) {
+		t.Fatalf("the key file holds %q, expected a new key", next)
+	}
+	if _, err := ioutil.ReadFile(file + ".new"); err == nil {
+		t.Errorf("the new key has been left next to the key file")
+	}
+
+	// the data keys are only known to the new master key
+	stored := check(t, tx, newKeyring(t, tx, file, next), "legacy", "first", "legacy again", "second")
+	for i, v := range stored {
+		if !strings.HasPrefix(v, "v") {
+			t.Errorf("secret %d is still encrypted with the master key", i)
+		}
+	}
+	old := &Keyring{master: master, keys: map[int]string{}}
+	if err := old.Load(tx); err == nil {
+		t.Errorf("loaded the data keys with the old master key")
+	}
+}
+
+func TestRotateMasterSupplied(t *testing.T) {
+	tx := openDB(t)
+	file := filepath.Join(t.TempDir(), "secret.key")
+	master := newMaster(t)
+	k := newKeyring(t, tx, file, master)
+	store(t, tx, k, "legacy", "first")
+
+	next := newMaster(t)
+	if err := k.RotateMaster(tx, " "+next+"\n", reencrypt); err != nil {
+		t.Fatal(err)
+	}
+
+	// the operator puts the supplied key in place
+	if b, _ := ioutil.ReadFile(file); strings.TrimSpace(string(b)) != master {
+		t.Errorf("the key file has been changed")
+	}
+	check(t, tx, newKeyring(t, tx, file, next), "legacy", "first")
+
+	if err := k.RotateMaster(tx, "no key", reencrypt); err == nil {
+		t.Errorf("rotated to an invalid master key")
+	}
+	configured := &Keyring{master: next, keys: map[int]string{}}
+	if err := configured.RotateMaster(tx, "", reencrypt); err == nil {
+		t.Errorf("generated a master key that is part of the configuration")
+	}
+}
+
+func TestRotateMasterFailure(t *testing.T) {
+	tx := openDB(t)
+	file := filepath.Join(t.TempDir(), "secret.key")
+	master := newMaster(t)
+	k := newKeyring(t, tx, file, master)
+	store(t, tx, k, "legacy", "first")
+
+	failed := errors.New("failed")
+	err := k.RotateMaster(tx, "", func(tx *gorm.DB, rewrap func(string) (string, error)) error {
+		if err := reencrypt(tx, rewrap); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, expected the rotation to fail", err)
+	}
+
+	if b, _ := ioutil.ReadFile(file); strings.TrimSpace(string(b)) != master {
+		t.Errorf("the key file has been changed")
+	}
+	if _, err := ioutil.ReadFile(file + ".new"); err == nil {
+		t.Errorf("the new key has been left next to the key file")
+	}
+	check(t, tx, k, "legacy", "first")
+	check(t, tx, newKeyring(t, tx, file, master), "legacy", "first")
+}
@@ -7,11 +7,12 @@ import (
 	//"github.com/davecgh/go-spew/spew"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/mdlayher/raw"
 	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/config"
+	"github.com/tribock/go-via/option82"
 )
 
-func serve(intf string) {
+func serve(intf string, conf *config.Config) {
 	// Select interface to used
 	ifi, err := net.InterfaceByName(intf)
 	if err != nil {
@@ -31,22 +32,36 @@ func serve(intf string) {
 	}
 
 	mac := ifi.HardwareAddr
+	limits := newRateLimits(conf.RateLimit)
+	vlan := interfaceVlan(ifi)
 
-	// Open a raw socket using ethertype 0x0800 (IPv4)
-	c, err := raw.ListenPacket(ifi, 0x0800, &raw.Config{})
+	// Open a raw socket for the dhcp requests, tagged frames keep their 802.1Q tag
+	c, err := listenVlan(ifi)
 	if err != nil {
 		logrus.Fatalf("dhcp: failed to listen: %v", err)
 	}
 	defer c.Close()
 
+	// The conflict probes are sent and answered on the same socket
+	probe := newConflictProber(conf, ifi, ip, ipNet, c)
+
 	logrus.WithFields(logrus.Fields{
-		"mac": mac,
-		"ip":  ip,
-		"int": intf,
+		"mac":   mac,
+		"ip":    ip,
+		"int":   intf,
+		"vlan":  vlan,
+		"trunk": conf.Network.Trunk,
 	}).Infof("Starting dhcp server")
 
+	serveConn(c, ifi, ip, ipNet, vlan, probe, limits, conf)
+}
+
+// serveConn answers the requests received on the raw socket, vlan is the one of untagged frames
+func serveConn(c net.PacketConn, ifi *net.Interface, ip net.IP, ipNet *net.IPNet, vlan int, probe *conflictProber, limits *rateLimits, conf *config.Config) {
+	mac := ifi.HardwareAddr
+
 	// Accept frames up to interface's MTU in size
-	b := make([]byte, ifi.MTU)
+	b := make([]byte, ifi.MTU+18)
 
 	// Keep reading frames
 	for {
@@ -57,7 +72,13 @@ func serve(intf string) {
 
 		packet := gopacket.NewPacket(b[:n], layers.LayerTypeEthernet, gopacket.Default)
 
+		if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+			probe.handleARP(arpLayer.(*layers.ARP))
+			continue
+		}
+
 		ethLayer := packet.Layer(layers.LayerTypeEthernet)
+		dot1qLayer := packet.Layer(layers.LayerTypeDot1Q)
 		ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
 		udpLayer := packet.Layer(layers.LayerTypeUDP)
 		dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4)
@@ -68,6 +89,18 @@ func serve(intf string) {
 			udp, _ := udpLayer.(*layers.UDP)
 			req, _ := dhcpLayer.(*layers.DHCPv4)
 
+			// The answer is tagged like the request. Without a trunk the tagged frames belong to other vlans, they are
+			// served by the vlan sub-interfaces if any.
+			var tag *layers.Dot1Q
+			reqVlan := vlan
+			if dot1qLayer != nil {
+				if !conf.Network.Trunk {
+					continue
+				}
+				tag, _ = dot1qLayer.(*layers.Dot1Q)
+				reqVlan = int(tag.VLANIdentifier)
+			}
+
 			//spew.Dump(req)
 
 			t := findMsgType(req)
@@ -78,14 +111,42 @@ func serve(intf string) {
 				source = "unicast"
 			}
 
+			// Tagged broadcasts are not on the network of the interface, the pool is selected by the vlan
+			if tag != nil && source == "broadcast" {
+				sourceNet = nil
+				source = "tagged"
+			}
+
 			if (req.RelayAgentIP != nil && !req.RelayAgentIP.Equal(net.IP{0, 0, 0, 0})) {
 				sourceNet = req.RelayAgentIP
 				source = "relayed"
 			}
 
-			resp, err := processPacket(t, req, sourceNet, ip)
+			tx := newTransaction(ifi, t, req, source, reqVlan)
+
+			// Relayed and routed requests have not been sent on the vlan of the client
+			poolVlan := reqVlan
+			if source == "relayed" || source == "unicast" {
+				poolVlan = anyVlan
+			}
+
+			// Floods and clients that are not allowed are dropped quietly, logging them would flood the log as well
+			if err := admit(conf, limits, req, sourceNet, poolVlan); err != nil {
+				recordTransaction(tx, sourceNet, nil, err, b[:n])
+				logrus.WithFields(logrus.Fields{
+					"type":       t.String(),
+					"client-mac": req.ClientHWAddr.String(),
+					"source":     sourceNet.String(),
+					"relay":      req.RelayAgentIP,
+					"error":      err,
+				}).Debugf("dhcp: dropped %s %s", source, t)
+				continue
+			}
+
+			resp, err := processPacket(conf, t, req, sourceNet, ip, poolVlan, probe)
 
 			if err != nil {
+				recordTransaction(tx, sourceNet, nil, err, b[:n])
 				logrus.WithFields(logrus.Fields{
 					"type":       t.String(),
 					"client-mac": req.ClientHWAddr.String(),
@@ -96,6 +157,17 @@ func serve(intf string) {
 				continue
 			}
 
+			// Releases and declines are not answered
+			if resp == nil {
+				recordTransaction(tx, sourceNet, nil, nil, b[:n])
+				logrus.WithFields(logrus.Fields{
+					"client-mac": req.ClientHWAddr.String(),
+					"source":     sourceNet.String(),
+					"relay":      req.RelayAgentIP,
+				}).Debugf("dhcp: processed %s %s", source, t)
+				continue
+			}
+
 			// Copy some information from the request like option 82 (agent info) to the response
 			resp.Flags = req.Flags
 			for _, v := range req.Options {
@@ -105,12 +177,12 @@ func serve(intf string) {
 				if v.Type == layers.DHCPOptHostname {
 					resp.Options = append(resp.Options, v)
 				}
-				if v.Type == 82 {
+				if v.Type == option82.Code {
 					resp.Options = append(resp.Options, v)
 				}
 			}
 
-			layers := buildHeaders(mac, ip, eth, ipv4, udp)
+			layers := buildHeaders(mac, ip, eth, tag, ipv4, udp)
 			layers = append(layers, resp)
 
 			buf := gopacket.NewSerializeBuffer()
@@ -120,6 +192,7 @@ func serve(intf string) {
 			}
 			err = gopacket.SerializeLayers(buf, opts, layers...)
 			if err != nil {
+				recordTransaction(tx, sourceNet, nil, fmt.Errorf("failed to serialise the response: %w", err), b[:n])
 				logrus.WithFields(logrus.Fields{
 					"response":   findMsgType(resp).String(),
 					"client-mac": req.ClientHWAddr.String(),
@@ -130,6 +203,7 @@ func serve(intf string) {
 			}
 
 			c.WriteTo(buf.Bytes(), src)
+			recordTransaction(tx, sourceNet, resp, nil, b[:n], buf.Bytes())
 
 			//spew.Dump(resp)
 			logrus.WithFields(logrus.Fields{
@@ -156,7 +230,7 @@ func findMsgType(p *layers.DHCPv4) layers.DHCPMsgType {
 	return msgType
 }
 
-func buildHeaders(mac net.HardwareAddr, ip net.IP, srcEth *layers.Ethernet, srcIP4 *layers.IPv4, srcUDP *layers.UDP) []gopacket.SerializableLayer {
+func buildHeaders(mac net.HardwareAddr, ip net.IP, srcEth *layers.Ethernet, srcTag *layers.Dot1Q, srcIP4 *layers.IPv4, srcUDP *layers.UDP) []gopacket.SerializableLayer {
 	eth := &layers.Ethernet{
 		SrcMAC:       mac,
 		DstMAC:       srcEth.SrcMAC,
@@ -185,6 +259,16 @@ func buildHeaders(mac net.HardwareAddr, ip net.IP, srcEth *layers.Ethernet, srcI
 
 	udp.SetNetworkLayerForChecksum(ip4)
 
+	if srcTag != nil {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		tag := &layers.Dot1Q{
+			Priority:       srcTag.Priority,
+			VLANIdentifier: srcTag.VLANIdentifier,
+			Type:           layers.EthernetTypeIPv4,
+		}
+		return []gopacket.SerializableLayer{eth, tag, ip4, udp}
+	}
+
 	return []gopacket.SerializableLayer{eth, ip4, udp}
 }
 
@@ -208,3 +292,18 @@ func findIPv4Addr(ifi *net.Interface) (net.IP, *net.IPNet, error) {
 
 	return nil, nil, fmt.Errorf("could not find IPv4 address")
 }
+
+// findIPv6Addr returns the first global unicast IPv6 address of the interface
+func findIPv6Addr(ifi *net.Interface) (net.IP, *net.IPNet, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range addrs {
+		if v, ok := addr.(*net.IPNet); ok && v.IP.To4() == nil && v.IP.IsGlobalUnicast() {
+			return v.IP, v, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("could not find IPv6 address")
+}
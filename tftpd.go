@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/api"
 	"github.com/tribock/go-via/config"
 	"github.com/tribock/go-via/db"
 	"github.com/tribock/go-via/models"
@@ -46,13 +47,7 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 		//strip the port
 		ip, _, _ := net.SplitHostPort(raddr.String())
 
-		//get the object that correlates with the ip
-		var address models.Address
-		db.DB.Preload(clause.Associations).First(&address, "ip = ?", ip)
-
-		//get the image info that correlates with the pool the ip is in
-		var image models.Image
-		db.DB.First(&image, "id = ?", address.Group.ImageID)
+		address, image := bootAddress(ip)
 
 		logrus.WithFields(logrus.Fields{
 			"raddr":     raddr,
@@ -62,53 +57,10 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 			"addressid": address.ID,
 		}).Debug("tftpd")
 
-		//if the filename is mboot.efi, we hijack it and serve the mboot.efi file that is part of that specific image, this guarantees that you always get an mboot file that works for the build
-		switch filename {
-		case "mboot.efi":
-			logrus.WithFields(logrus.Fields{
-				ip: "requesting mboot.efi",
-			}).Info("tftpd")
-			logrus.WithFields(logrus.Fields{
-				"id":           address.ID,
-				"percentage":   10,
-				"progresstext": "mboot.efi",
-			}).Info("progress")
-			filename, _ = mbootPath(image.Path)
-			address.Progress = 10
-			address.Progresstext = "mboot.efi"
-			db.DB.Save(&address)
-		case "crypto64.efi":
-			logrus.WithFields(logrus.Fields{
-				ip: "requesting crypto64.efi",
-			}).Info("tftpd")
-			logrus.WithFields(logrus.Fields{
-				"id":           address.ID,
-				"percentage":   12,
-				"progresstext": "crypto64.efi",
-			}).Info("progress")
-			filename, _ = crypto64Path(image.Path)
-			address.Progress = 12
-			address.Progresstext = "crypto64.efi"
-			db.DB.Save(&address)
-		case "boot.cfg":
+		if filename == "boot.cfg" || filename == "/boot.cfg" {
 			serveBootCfg(filename, address, image, rf, conf)
-		case "/boot.cfg":
-			serveBootCfg(filename, address, image, rf, conf)
-		default:
-			//if no case matches, chroot to /tftp
-			if _, err := os.Stat("tftp/" + filename); err == nil {
-				filename = "tftp/" + filename
-				logrus.WithFields(logrus.Fields{
-					"lowercase file": filename,
-				}).Debug("tftpd")
-			} else {
-				dir, file := path.Split(filename)
-				upperfile := strings.ToUpper(string(file))
-				filename = "tftp/" + dir + upperfile
-				logrus.WithFields(logrus.Fields{
-					"uppercase file": filename,
-				}).Debug("tftpd")
-			}
+		} else {
+			filename = bootFile(filename, ip, &address, image)
 		}
 
 		// get the filesize to send filelength
@@ -146,9 +98,10 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 }
 
 func TFTPd(conf *config.Config) {
+	addr := ":" + strconv.Itoa(conf.TFTPPort)
 	s := tftp.NewServer(readHandler(conf), nil)
-	s.SetTimeout(5 * time.Second)  // optional
-	err := s.ListenAndServe(":69") // blocks until s.Shutdown() is called
+	s.SetTimeout(5 * time.Second) // optional
+	err := s.ListenAndServe(addr) // blocks until s.Shutdown() is called
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"could not start tftp server:": err,
@@ -157,6 +110,72 @@ func TFTPd(conf *config.Config) {
 	}
 }
 
+// bootAddress returns the host that boots from ip and the image it is installed with, hosts that boot through proxy
+// dhcp have been given their address by another server. The host found by its ip may not be marked for reimage, it
+// still gets the boot files but bootCfg refuses to issue a kickstart token for it.
+func bootAddress(ip string) (models.Address, models.Image) {
+	var address models.Address
+	if res := db.DB.Preload(clause.Associations).First(&address, "boot_ip = ? AND reimage", ip); res.Error != nil {
+		db.DB.Preload(clause.Associations).First(&address, "ip = ?", ip)
+	}
+
+	//get the image info that correlates with the pool the ip is in
+	var image models.Image
+	db.DB.First(&image, "id = ?", address.Group.ImageID)
+
+	return address, image
+}
+
+// bootFile returns the path of the requested file on disk
+func bootFile(filename string, ip string, address *models.Address, image models.Image) string {
+	//if the filename is mboot.efi, we hijack it and serve the mboot.efi file that is part of that specific image, this guarantees that you always get an mboot file that works for the build
+	switch filename {
+	case "mboot.efi":
+		logrus.WithFields(logrus.Fields{
+			ip: "requesting mboot.efi",
+		}).Info("tftpd")
+		logrus.WithFields(logrus.Fields{
+			"id":           address.ID,
+			"percentage":   10,
+			"progresstext": "mboot.efi",
+		}).Info("progress")
+		filename, _ = mbootPath(image.Path)
+		address.Progress = 10
+		address.Progresstext = "mboot.efi"
+		db.DB.Save(address)
+	case "crypto64.efi":
+		logrus.WithFields(logrus.Fields{
+			ip: "requesting crypto64.efi",
+		}).Info("tftpd")
+		logrus.WithFields(logrus.Fields{
+			"id":           address.ID,
+			"percentage":   12,
+			"progresstext": "crypto64.efi",
+		}).Info("progress")
+		filename, _ = crypto64Path(image.Path)
+		address.Progress = 12
+		address.Progresstext = "crypto64.efi"
+		db.DB.Save(address)
+	default:
+		//if no case matches, chroot to /tftp
+		if _, err := os.Stat("tftp/" + filename); err == nil {
+			filename = "tftp/" + filename
+			logrus.WithFields(logrus.Fields{
+				"lowercase file": filename,
+			}).Debug("tftpd")
+		} else {
+			dir, file := path.Split(filename)
+			upperfile := strings.ToUpper(string(file))
+			filename = "tftp/" + dir + upperfile
+			logrus.WithFields(logrus.Fields{
+				"uppercase file": filename,
+			}).Debug("tftpd")
+		}
+	}
+
+	return filename
+}
+
 func mbootPath(imagePath string) (string, error) {
 	//check these paths if the file exists.
 	paths := []string{"/EFI/BOOT/BOOTX64.EFI", "/EFI/BOOT/BOOTAA64.EFI", "/MBOOT.EFI", "/mboot.efi", "/efi/boot/bootx64.efi", "/efi/boot/bootaa64.efi"}
@@ -186,8 +205,6 @@ func crypto64Path(imagePath string) (string, error) {
 }
 
 func serveBootCfg(filename string, address models.Address, image models.Image, rf io.ReaderFrom, conf *config.Config) {
-	//if the filename is boot.cfg, or /boot.cfg, we serve the boot cfg that belongs to that build. unfortunately, it seems boot.cfg or /boot.cfg varies in builds.
-
 	// get the requesting ip-address and our source address
 	raddr := rf.(tftp.OutgoingTransfer).RemoteAddr()
 	laddr := rf.(tftp.RequestPacketInfo).LocalIP()
@@ -195,6 +212,42 @@ func serveBootCfg(filename string, address models.Address, image models.Image, r
 	//strip the port
 	ip, _, _ := net.SplitHostPort(raddr.String())
 
+	bc, err := bootCfg(ip, address, image, laddr, conf)
+	if err != nil {
+		logrus.Warn(err)
+		return
+	}
+
+	// Make a buffer to read from
+	buff := bytes.NewBuffer(bc)
+
+	// Send the data from the buffer to the client
+	rf.(tftp.OutgoingTransfer).SetSize(int64(buff.Len()))
+	n, err := rf.ReadFrom(buff)
+	if err != nil {
+		//fmt.Fprintf(os.Stderr, "%v\n", err)
+		logrus.WithFields(logrus.Fields{
+			"os.Stderr": err,
+		}).Debug("tftpd")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"file":  filename,
+		"bytes": n,
+	}).Info("tftpd")
+	//return nil
+}
+
+// bootCfg returns the boot.cfg of the image with the kernel options for the host, laddr is the address of the
+// appliance that the host has reached
+func bootCfg(ip string, address models.Address, image models.Image, laddr net.IP, conf *config.Config) ([]byte, error) {
+	// a device that has taken over the ip of a known host must not get a kickstart token for it
+	if address.ID == 0 || !address.Reimage {
+		return nil, fmt.Errorf("tftpd: %s requested boot.cfg, but no host that boots from it is marked for reimage", ip)
+	}
+
+	//if the filename is boot.cfg, or /boot.cfg, we serve the boot cfg that belongs to that build. unfortunately, it seems boot.cfg or /boot.cfg varies in builds.
 	logrus.WithFields(logrus.Fields{
 		ip: "requesting boot.cfg",
 	}).Info("tftpd")
@@ -209,26 +262,36 @@ func serveBootCfg(filename string, address models.Address, image models.Image, r
 
 	bc, err := ioutil.ReadFile(image.Path + "/BOOT.CFG")
 	if err != nil {
-		logrus.Warn(err)
-		return
+		return nil, err
 	}
 
 	// strip slashes from paths in file
 	re := regexp.MustCompile("/")
 	bc = re.ReplaceAllLiteral(bc, []byte(""))
 
+	// every boot.cfg gets a new single use token, only the holder of the token is able to download the ks.cfg
+	token, err := api.IssueKsToken(address.ID, time.Duration(conf.KsTokenTimeout)*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("tftpd: could not issue kickstart token for %d: %w", address.ID, err)
+	}
+
 	// add kickstart path to kernelopt
 	re = regexp.MustCompile("kernelopt=.*")
 	o := re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" ks=https://"+laddr.String()+":"+strconv.Itoa(conf.Port)+"/ks.cfg")...))
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" ks=https://"+net.JoinHostPort(laddr.String(), strconv.Itoa(conf.Port))+"/ks.cfg?token="+token)...))
 
 	// append the mac address of the hardware interface to ensure ks.cfg request comes from the right interface, along with ip, netmask and gateway.
-	nm := net.CIDRMask(address.Pool.Netmask, 32)
-	netmask := ipv4MaskString(nm)
+	// the installer only takes static IPv4 settings, with IPv6 it configures itself through DHCPv6 and the static address is set by ks.cfg
+	netopts := " netdevice=" + address.Mac
+	if !address.Pool.IsIPv6() {
+		nm := net.CIDRMask(address.Pool.Netmask, 32)
+		netmask := ipv4MaskString(nm)
+		netopts += " ip=" + address.IP + " netmask=" + netmask + " gateway=" + address.Pool.Gateway
+	}
 
 	re = regexp.MustCompile("kernelopt=.*")
 	o = re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" netdevice="+address.Mac+" ip="+address.IP+" netmask="+netmask+" gateway="+address.Pool.Gateway)...))
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(netopts)...))
 
 	// if vlan is configured for the group, append the vlan to kernelopts
 	if address.Group.Vlan != "" {
@@ -256,31 +319,17 @@ func serveBootCfg(filename string, address models.Address, image models.Image, r
 		bc = re.ReplaceAllLiteral(bc, append(o, []byte(" allowLegacyCPU=true")...))
 	}
 
-	// replace prefix with prefix=foldername
+	// replace prefix with prefix=foldername, or the url of the image when the modules are downloaded over http
 	split := strings.Split(image.Path, "/")
+	prefix := split[1]
+	if conf.ImagePort != 0 {
+		prefix = imageURL(laddr, image, conf)
+	}
 	re = regexp.MustCompile("prefix=")
 	o = re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(split[1])...))
-
-	// Make a buffer to read from
-	buff := bytes.NewBuffer(bc)
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(prefix)...))
 
-	// Send the data from the buffer to the client
-	rf.(tftp.OutgoingTransfer).SetSize(int64(buff.Len()))
-	n, err := rf.ReadFrom(buff)
-	if err != nil {
-		//fmt.Fprintf(os.Stderr, "%v\n", err)
-		logrus.WithFields(logrus.Fields{
-			"os.Stderr": err,
-		}).Debug("tftpd")
-		return
-	}
-
-	logrus.WithFields(logrus.Fields{
-		"file":  filename,
-		"bytes": n,
-	}).Info("tftpd")
-	//return nil
+	return bc, nil
 }
 
 func ipv4MaskString(m []byte) string {
@@ -0,0 +1,369 @@
+package trace
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/gopacket/layers"
+	"github.com/tribock/go-via/models"
+)
+
+// The dhcp server records every transaction in a ring buffer, so that it can be looked up why a host did not get an
+// answer without raising the log level. The raw frames of the request and the reply are only kept if the pcap
+// export is enabled. The DHCPv6 server only receives the udp payload, its transactions have no frames.
+
+var ErrDisabled = errors.New("trace: disabled")
+
+// subscriberBuffer is the number of transactions that may be queued for a live tail before they are dropped
+const subscriberBuffer = 64
+
+type frame struct {
+	time time.Time
+	data []byte
+}
+
+type entry struct {
+	tx     models.DHCPTransaction
+	frames []frame
+}
+
+type Buffer struct {
+	mu      sync.Mutex
+	entries []entry
+	// next is the position the next entry is written to, the buffer is full once seq has reached its size
+	next int
+	seq  uint64
+	pcap bool
+
+	subscribers map[*Subscriber]struct{}
+}
+
+// Subscriber receives the transactions of a mac address prefix as they are recorded
+type Subscriber struct {
+	C   <-chan models.DHCPTransaction
+	c   chan models.DHCPTransaction
+	mac string
+	b   *Buffer
+}
+
+// buffer is the configured trace, it is nil if tracing is disabled
+var buffer *Buffer
+
+// Init enables the trace of the last size transactions, pcap also keeps their raw frames
+func Init(size int, pcap bool) {
+	if size <= 0 {
+		buffer = nil
+		return
+	}
+
+	buffer = &Buffer{
+		entries:     make([]entry, size),
+		pcap:        pcap,
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+// Enabled reports if transactions are recorded
+func Enabled() bool {
+	return buffer != nil
+}
+
+// PcapEnabled reports if the raw frames are recorded
+func PcapEnabled() bool {
+	return buffer != nil && buffer.pcap
+}
+
+// Record adds the transaction to the trace, frames are the raw frames of the request and the reply
+func Record(tx models.DHCPTransaction, frames ...[]byte) {
+	b := buffer
+	if b == nil {
+		return
+	}
+
+	e := entry{tx: tx}
+	if b.pcap {
+		for _, v := range frames {
+			if len(v) > 0 {
+				e.frames = append(e.frames, frame{time: tx.Time, data: append([]byte(nil), v...)})
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.tx.ID = b.seq
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+
+	for s := range b.subscribers {
+		if !matchMac(e.tx.Mac, s.mac) {
+			continue
+		}
+		// a live tail that does not keep up misses transactions, they are still in the buffer
+		select {
+		case s.c <- e.tx:
+		default:
+		}
+	}
+}
+
+// List returns the last limit transactions of the mac address prefix, the oldest first. A limit of 0 returns all of
+// them.
+func List(mac string, limit int) ([]models.DHCPTransaction, error) {
+	b := buffer
+	if b == nil {
+		return nil, ErrDisabled
+	}
+
+	items := []models.DHCPTransaction{}
+	for _, v := range b.list(mac) {
+		items = append(items, v.tx)
+	}
+	if limit > 0 && len(items) > limit {
+		items = items[len(items)-limit:]
+	}
+	return items, nil
+}
+
+func (b *Buffer) list(mac string) []entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var items []entry
+	for i := range b.entries {
+		e := b.entries[(b.next+i)%len(b.entries)]
+		if e.tx.ID != 0 && matchMac(e.tx.Mac, mac) {
+			items = append(items, e)
+		}
+	}
+	return items
+}
+
+// Subscribe returns a subscriber for the transactions of the mac address prefix, it has to be closed
+func Subscribe(mac string) (*Subscriber, error) {
+	b := buffer
+	if b == nil {
+		return nil, ErrDisabled
+	}
+
+	c := make(chan models.DHCPTransaction, subscriberBuffer)
+	s := &Subscriber{C: c, c: c, mac: mac, b: b}
+
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+
+	return s, nil
+}
+
+func (s *Subscriber) Close() {
+	s.b.mu.Lock()
+	delete(s.b.subscribers, s)
+	s.b.mu.Unlock()
+}
+
+// WritePcap writes the raw frames of the transactions of the mac address prefix in the pcap format
+func WritePcap(w io.Writer, mac string) error {
+	b := buffer
+	if b == nil || !b.pcap {
+		return ErrDisabled
+	}
+
+	// pcap header, version 2.4 with a snap length of 65535 bytes and ethernet frames
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], uint32(layers.LinkTypeEthernet))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, e := range b.list(mac) {
+		for _, f := range e.frames {
+			record := make([]byte, 16)
+			binary.LittleEndian.PutUint32(record[0:], uint32(f.time.Unix()))
+			binary.LittleEndian.PutUint32(record[4:], uint32(f.time.Nanosecond()/1000))
+			binary.LittleEndian.PutUint32(record[8:], uint32(len(f.data)))
+			binary.LittleEndian.PutUint32(record[12:], uint32(len(f.data)))
+			if _, err := w.Write(record); err != nil {
+				return err
+			}
+			if _, err := w.Write(f.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchMac reports if the mac address starts with the prefix, eg. a full address or an OUI like 00:50:56
+func matchMac(mac string, prefix string) bool {
+	return strings.HasPrefix(mac, strings.ToLower(prefix))
+}
+
+// DecodeOptions converts the options to a readable form
+func DecodeOptions(options layers.DHCPOptions) []models.DHCPTraceOption {
+	items := []models.DHCPTraceOption{}
+	for _, v := range options {
+		if v.Type == layers.DHCPOptPad || v.Type == layers.DHCPOptEnd {
+			continue
+		}
+		items = append(items, models.DHCPTraceOption{
+			Code:  uint16(v.Type),
+			Name:  v.Type.String(),
+			Value: decodeValue(v),
+		})
+	}
+	return items
+}
+
+// DecodeOptions6 converts the DHCPv6 options to a readable form
+func DecodeOptions6(options layers.DHCPv6Options) []models.DHCPTraceOption {
+	items := []models.DHCPTraceOption{}
+	for _, v := range options {
+		items = append(items, models.DHCPTraceOption{
+			Code:  uint16(v.Code),
+			Name:  v.Code.String(),
+			Value: decodeValue6(v),
+		})
+	}
+	return items
+}
+
+func decodeValue6(o layers.DHCPv6Option) string {
+	switch o.Code {
+	case layers.DHCPv6OptClientID, layers.DHCPv6OptServerID:
+		duid := &layers.DHCPv6DUID{}
+		if err := duid.DecodeFromBytes(o.Data); err == nil {
+			return duid.String()
+		}
+	case layers.DHCPv6OptOro:
+		var codes []string
+		for i := 0; i+1 < len(o.Data); i += 2 {
+			codes = append(codes, strconv.Itoa(int(binary.BigEndian.Uint16(o.Data[i:]))))
+		}
+		return strings.Join(codes, ",")
+	case layers.DHCPv6OptElapsedTime:
+		if len(o.Data) == 2 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(o.Data)))
+		}
+	case layers.DHCPv6OptStatusCode:
+		if len(o.Data) >= 2 {
+			return layers.DHCPv6StatusCode(binary.BigEndian.Uint16(o.Data)).String() + " " + string(o.Data[2:])
+		}
+	case layers.DHCPv6OptIANA:
+		// the iaid, t1 and t2 are followed by the addresses
+		if len(o.Data) >= 12 {
+			var ips []string
+			for b := o.Data[12:]; len(b) >= 4; {
+				code := layers.DHCPv6Opt(binary.BigEndian.Uint16(b))
+				n := int(binary.BigEndian.Uint16(b[2:]))
+				if len(b) < 4+n {
+					break
+				}
+				if code == layers.DHCPv6OptIAAddr && n >= 16 {
+					ips = append(ips, net.IP(b[4:20]).String())
+				}
+				b = b[4+n:]
+			}
+			return strings.TrimSpace("iaid=" + hex.EncodeToString(o.Data[:4]) + " " + strings.Join(ips, ","))
+		}
+	case layers.DHCPv6OptVendorClass, layers.DHCPv6OptUserClass, layers.DHCPv6OptBootFileParam:
+		// the vendor class starts with the enterprise number, every class or parameter is prefixed with its length
+		b := o.Data
+		if o.Code == layers.DHCPv6OptVendorClass && len(b) >= 4 {
+			b = b[4:]
+		}
+		var classes []string
+		for len(b) >= 2 {
+			n := int(binary.BigEndian.Uint16(b))
+			if len(b) < 2+n {
+				break
+			}
+			classes = append(classes, string(b[2:2+n]))
+			b = b[2+n:]
+		}
+		if len(classes) > 0 && len(b) == 0 && o.Code == layers.DHCPv6OptBootFileParam {
+			return strings.Join(classes, " ")
+		}
+		if len(classes) > 0 && len(b) == 0 {
+			return strings.Join(classes, ",")
+		}
+	case layers.DHCPv6OptDNSServers, layers.DHCPv6OptSNTPServers, layers.DHCPv6OptSIPServersAddressList:
+		if len(o.Data) > 0 && len(o.Data)%16 == 0 {
+			var ips []string
+			for i := 0; i < len(o.Data); i += 16 {
+				ips = append(ips, net.IP(o.Data[i:i+16]).String())
+			}
+			return strings.Join(ips, ",")
+		}
+	}
+
+	if isPrintable(o.Data) {
+		return string(o.Data)
+	}
+	return hex.EncodeToString(o.Data)
+}
+
+func decodeValue(o layers.DHCPOption) string {
+	switch o.Type {
+	case layers.DHCPOptMessageType:
+		if len(o.Data) == 1 {
+			return layers.DHCPMsgType(o.Data[0]).String()
+		}
+	case layers.DHCPOptParamsRequest:
+		var codes []string
+		for _, v := range o.Data {
+			codes = append(codes, strconv.Itoa(int(v)))
+		}
+		return strings.Join(codes, ",")
+	case layers.DHCPOptSubnetMask,
+		layers.DHCPOptRouter,
+		layers.DHCPOptDNS,
+		layers.DHCPOptNTPServers,
+		layers.DHCPOptBroadcastAddr,
+		layers.DHCPOptRequestIP,
+		layers.DHCPOptServerID:
+		if len(o.Data) > 0 && len(o.Data)%4 == 0 {
+			var ips []string
+			for i := 0; i < len(o.Data); i += 4 {
+				ips = append(ips, net.IP(o.Data[i:i+4]).String())
+			}
+			return strings.Join(ips, ",")
+		}
+	case layers.DHCPOptT1, layers.DHCPOptT2, layers.DHCPOptLeaseTime:
+		if len(o.Data) == 4 {
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint32(o.Data)), 10)
+		}
+	}
+
+	if isPrintable(o.Data) {
+		return string(o.Data)
+	}
+	return hex.EncodeToString(o.Data)
+}
+
+func isPrintable(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, v := range string(b) {
+		if v > unicode.MaxASCII || !unicode.IsPrint(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tribock/go-via/api"
+	"github.com/tribock/go-via/models"
+)
+
+// Pools with an authorized vlan only serve the requests that arrived on that vlan, either on a vlan sub-interface
+// (eg. eth0.100) or 802.1Q tagged on a trunk interface. Requests on the native vlan of an interface are on vlan 0.
+// Relayed requests and the unicast renewals that have been routed to the server are served whatever vlan they arrived
+// on, their pool is selected by the relay or the address of the client.
+
+// anyVlan is the vlan of the requests that have not been received on the network of the client
+const anyVlan = -1
+
+// findPool returns the pool of the request if it may be served on the vlan the request arrived on. Tagged broadcasts
+// have no sourceNet, their pool is the one authorized for the vlan.
+func findPool(sourceNet net.IP, vlan int) (*models.PoolWithAddresses, error) {
+	if sourceNet == nil {
+		return api.FindPoolByVlan(vlan)
+	}
+
+	pool, err := api.FindPool(sourceNet.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if vlan != anyVlan && pool.AuthorizedVlan != 0 && pool.AuthorizedVlan != vlan {
+		return nil, fmt.Errorf("ignored, pool %d only serves vlan %d but the request arrived on vlan %d", pool.ID, pool.AuthorizedVlan, vlan)
+	}
+
+	return pool, nil
+}
+
+// interfaceVlan returns the vlan id of a vlan sub-interface and 0 for all other interfaces
+func interfaceVlan(ifi *net.Interface) int {
+	f, err := os.Open("/proc/net/vlan/config")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	// eth0.100       | 100  | eth0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) != 3 || strings.TrimSpace(fields[0]) != ifi.Name {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			return id
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,205 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// vlanConn is a raw socket for the dhcp requests that keeps their 802.1Q tag. Linux removes the tag from received
+// frames, or the network card already did with rx-vlan offload. Only sockets for all protocols get the tag as
+// auxiliary data, and even those of the frames that are not part of a vlan sub-interface. The tag is put back into the
+// frame, so that it is decoded like it has been on the wire.
+type vlanConn struct {
+	ifi *net.Interface
+	f   *os.File
+	rc  syscall.RawConn
+}
+
+var sizeofTpacketAuxdata = int(unsafe.Sizeof(unix.TpacketAuxdata{}))
+
+// dhcpFilter passes the received IPv4 UDP datagrams to port 67 and the ARP frames for the conflict probes, the socket
+// receives all protocols. The tag has been removed from the frames when the filter runs.
+var dhcpFilter = []bpf.Instruction{
+	bpf.LoadExtension{Num: bpf.ExtType},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.PACKET_OUTGOING, SkipTrue: 9},
+	bpf.LoadAbsolute{Off: 12, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(layers.EthernetTypeARP), SkipTrue: 6},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(layers.EthernetTypeIPv4), SkipTrue: 6},
+	bpf.LoadAbsolute{Off: 23, Size: 1},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(layers.IPProtocolUDP), SkipTrue: 4},
+	// the offset of the udp header depends on the length of the ip header
+	bpf.LoadMemShift{Off: 14},
+	bpf.LoadIndirect{Off: 16, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 67, SkipTrue: 1},
+	bpf.RetConstant{Val: 0xffff},
+	bpf.RetConstant{Val: 0},
+}
+
+func listenVlan(ifi *net.Interface) (net.PacketConn, error) {
+	// no protocol until the filter is in place, the socket would receive the frames of all interfaces
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	filter, err := bpf.Assemble(dhcpFilter)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	prog := &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&filter[0])),
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "vlan-packet-socket")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &vlanConn{ifi: ifi, f: f, rc: rc}, nil
+}
+
+// ReadFrom receives a frame, b has to have room for the tag
+func (c *vlanConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	oob := make([]byte, unix.CmsgSpace(sizeofTpacketAuxdata))
+
+	var n, oobn int
+	var from unix.Sockaddr
+	var err error
+	cerr := c.rc.Read(func(fd uintptr) bool {
+		n, oobn, _, from, err = unix.Recvmsg(int(fd), b, oob, 0)
+		return err != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if cerr != nil {
+		return 0, nil, cerr
+	}
+
+	sa, ok := from.(*unix.SockaddrLinklayer)
+	if !ok {
+		return 0, nil, unix.EINVAL
+	}
+	addr := &raw.Addr{HardwareAddr: append(net.HardwareAddr(nil), sa.Addr[:sa.Halen]...)}
+
+	tpid, tci, ok := vlanTag(oob[:oobn])
+	// the frames with vlan 0 only carry a priority, they are on the native vlan
+	if !ok || tci&0x0fff == 0 || n < 12 || n+4 > len(b) {
+		return n, addr, nil
+	}
+
+	copy(b[16:n+4], b[12:n])
+	binary.BigEndian.PutUint16(b[12:], tpid)
+	binary.BigEndian.PutUint16(b[14:], tci)
+	return n + 4, addr, nil
+}
+
+// vlanTag returns the tag protocol identifier and the tag control information of the auxiliary data of a frame
+func vlanTag(oob []byte) (uint16, uint16, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_PACKET || m.Header.Type != unix.PACKET_AUXDATA || len(m.Data) < sizeofTpacketAuxdata {
+			continue
+		}
+
+		// struct tpacket_auxdata, in the byte order of the host
+		status := binary.NativeEndian.Uint32(m.Data[0:])
+		tci := binary.NativeEndian.Uint16(m.Data[16:])
+		tpid := binary.NativeEndian.Uint16(m.Data[18:])
+		if status&unix.TP_STATUS_VLAN_VALID == 0 {
+			return 0, 0, false
+		}
+		if status&unix.TP_STATUS_VLAN_TPID_VALID == 0 {
+			tpid = uint16(layers.EthernetTypeDot1Q)
+		}
+		return tpid, tci, true
+	}
+
+	return 0, 0, false
+}
+
+// WriteTo sends a frame as it is, tagged frames keep their tag
+func (c *vlanConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*raw.Addr)
+	if !ok || a.HardwareAddr == nil || len(b) < 14 {
+		return 0, unix.EINVAL
+	}
+
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(binary.BigEndian.Uint16(b[12:])),
+		Ifindex:  c.ifi.Index,
+		Halen:    uint8(len(a.HardwareAddr)),
+	}
+	copy(sa.Addr[:], a.HardwareAddr)
+
+	var err error
+	cerr := c.rc.Write(func(fd uintptr) bool {
+		err = unix.Sendto(int(fd), b, 0, sa)
+		return err != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if cerr != nil {
+		return 0, cerr
+	}
+	return len(b), nil
+}
+
+func (c *vlanConn) Close() error {
+	return c.f.Close()
+}
+
+func (c *vlanConn) LocalAddr() net.Addr {
+	return &raw.Addr{HardwareAddr: c.ifi.HardwareAddr}
+}
+
+func (c *vlanConn) SetDeadline(t time.Time) error {
+	return c.f.SetDeadline(t)
+}
+
+func (c *vlanConn) SetReadDeadline(t time.Time) error {
+	return c.f.SetReadDeadline(t)
+}
+
+func (c *vlanConn) SetWriteDeadline(t time.Time) error {
+	return c.f.SetWriteDeadline(t)
+}
+
+// htons converts a short from the byte order of the host to the one of the network
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
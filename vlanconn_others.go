@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+)
+
+// listenVlan opens a raw socket for IPv4 frames, the 802.1Q tags of the received frames are only known on linux. The
+// answers to ARP conflict probes are not received either, the probes time out and the addresses are offered.
+func listenVlan(ifi *net.Interface) (net.PacketConn, error) {
+	return raw.ListenPacket(ifi, uint16(layers.EthernetTypeIPv4), &raw.Config{})
+}
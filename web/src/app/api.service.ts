@@ -166,6 +166,12 @@ export class ApiService {
     );
   }
 
+  public getCurrentUser() {
+    return this.httpClient.get(
+      'https://' + window.location.host + '/v1/me'
+    );
+  }
+
   public getVersion() {
     return this.httpClient.get(
       'https://' + window.location.host + '/v1/version'
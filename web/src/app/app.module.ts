@@ -8,7 +8,7 @@ import { CdsModule } from '@cds/angular';
 import { BrowserAnimationsModule } from '@angular/platform-browser/animations';
 import { ReactiveFormsModule } from '@angular/forms';
 import { FormsModule } from '@angular/forms';
-import { HttpClientModule } from '@angular/common/http';
+import { HttpClientModule, HTTP_INTERCEPTORS } from '@angular/common/http';
 import { HelpComponent } from './help/help.component';
 import { ManageDhcpPoolsComponent } from './manage-dhcp-pools/manage-dhcp-pools.component';
 import { ManageGroupsComponent } from './manage-groups/manage-groups.component';
@@ -21,6 +21,7 @@ import { LoginComponent } from './login/login.component';
 import { DeploymentsComponent } from './deployments/deployments.component';
 import { HealthChecksComponent } from './health-checks/health-checks.component';
 import { SettingsComponent } from './settings/settings.component';
+import { AuthInterceptor } from './auth.interceptor';
 
 
 
@@ -50,7 +51,9 @@ import { SettingsComponent } from './settings/settings.component';
     FormsModule,
     FlexLayoutModule,
   ],
-  providers: [],
+  providers: [
+    { provide: HTTP_INTERCEPTORS, useClass: AuthInterceptor, multi: true },
+  ],
   bootstrap: [AppComponent]
 })
 export class AppModule { }
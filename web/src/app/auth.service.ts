@@ -24,28 +24,36 @@ export class AuthService {
     var resp = this.httpClient.post(
       'https://' + window.location.host + '/v1/login',
       body
+    ).pipe(
+      map((data: any) => {
+        localStorage.setItem('token', data.token);
+        this.usernameSubject.next(username);
+        localStorage.setItem('username', username);
+        this.isAuthenticated = true;
+        return data;
+      })
     );
 
-    this.usernameSubject.next(username);
-    localStorage.setItem('username', username);
-    this.isAuthenticated = true;
-    console.log(this.isAuthenticated);
-
-
-
     return resp
   }
 
   logout(): void {
+    if (this.getToken()) {
+      this.httpClient.post('https://' + window.location.host + '/v1/logout', {}).subscribe();
+    }
     this.isAuthenticated = false;
     this.usernameSubject.next('');
     localStorage.removeItem('username');
+    localStorage.removeItem('token');
     this.router.navigate(['/login']);
   }
 
+  getToken(): string {
+    return localStorage.getItem('token') || '';
+  }
+
   isLoggedIn(): boolean {
-    console.log(this.isAuthenticated);
     // return true; // use this for local dev
-    return this.isAuthenticated;
+    return this.isAuthenticated || this.getToken() !== '';
   }
 }
\ No newline at end of file
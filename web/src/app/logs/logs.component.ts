@@ -13,7 +13,7 @@ export class LogsComponent implements OnInit {
   
 
   constructor() {
-    const ws = new WebSocket('wss://' +  window.location.host + '/v1/log')
+    const ws = new WebSocket('wss://' +  window.location.host + '/v1/log?token=' + localStorage.getItem('token'))
     ws.addEventListener('message', event => {
       const { time, level, msg, ...payload } = JSON.parse(event.data);
       const data = {
@@ -75,10 +75,11 @@ export class ManageGroupsComponent implements OnInit {
       ssh: [''],
       certificate: [''],
       createvmfs: [''],
+      uniquerootpassword: [''],
       callbackurl: [''],
       ks: [''],
     });
-    const ws = new WebSocket('wss://' + window.location.host + '/v1/log')
+    const ws = new WebSocket('wss://' + window.location.host + '/v1/log?token=' + localStorage.getItem('token'))
     ws.addEventListener('message', event => {
       const data = JSON.parse(event.data)
       if (data.msg === "progress") {
@@ -159,6 +160,9 @@ export class ManageGroupsComponent implements OnInit {
     if (data.createvmfs) {
       json_pc.createvmfs = data.createvmfs;
     }
+    if (data.uniquerootpassword) {
+      json_pc.uniquerootpassword = data.uniquerootpassword;
+    }
     if (data.ks) {
       data.ks = btoa(data.ks)
     }
@@ -169,6 +173,7 @@ export class ManageGroupsComponent implements OnInit {
     delete data.allowlegacycpu;
     delete data.certificate;
     delete data.createvmfs;
+    delete data.uniquerootpassword;
 
     this.apiService.addGroup(data).subscribe((data: any) => {
       if (data.id) {
@@ -203,7 +208,7 @@ export class ManageGroupsComponent implements OnInit {
     this.showGroupModalMode = mode;
     if (mode === "edit") {
       this.group = this.groups.find(group => group.id === id);
-      const { ssh, erasedisks, allowlegacycpu, certificate, createvmfs } = (this.group.options || {});
+      const { ssh, erasedisks, allowlegacycpu, certificate, createvmfs, uniquerootpassword } = (this.group.options || {});
       this.Groupform.patchValue({
         ...this.group,
         ssh,
@@ -211,6 +216,7 @@ export class ManageGroupsComponent implements OnInit {
         allowlegacycpu,
         certificate,
         createvmfs,
+        uniquerootpassword,
 
       });
     }
@@ -258,6 +264,9 @@ export class ManageGroupsComponent implements OnInit {
     if (data.createvmfs) {
       json_pc.createvmfs = data.createvmfs;
     }
+    if (data.uniquerootpassword) {
+      json_pc.uniquerootpassword = data.uniquerootpassword;
+    }
 
     if (data.ks) {
       data.ks = btoa(data.ks)
@@ -274,6 +283,7 @@ export class ManageGroupsComponent implements OnInit {
     delete data.allowlegacycpu;
     delete data.certificate;
     delete data.createvmfs;
+    delete data.uniquerootpassword;
 
     this.apiService.updateGroup(this.group.id, data).subscribe((resp: any) => {
       delete resp.password;
@@ -29,6 +29,7 @@ export class ManageUsersComponent implements OnInit {
       password: ['', [Validators.required]],
       email: ['', [Validators.required]],
       comment: ['', [Validators.required]],
+      role: ['read-only', [Validators.required]],
     });
    }
 
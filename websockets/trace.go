@@ -0,0 +1,71 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tribock/go-via/api"
+	"github.com/tribock/go-via/trace"
+	"nhooyr.io/websocket"
+)
+
+// HandleTrace streams the dhcp transactions as they are recorded, the mac query parameter limits them to a mac
+// address or a prefix of it
+func HandleTrace(c *gin.Context) {
+	s, err := trace.Subscribe(c.Query("mac"))
+	if err != nil {
+		api.Error(c, http.StatusNotFound, err) // 404
+		return
+	}
+	defer s.Close()
+
+	conn, err := websocket.Accept(c.Writer, c.Request, &websocket.AcceptOptions{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("could not accept websocket")
+		return
+	}
+	defer conn.Close(websocket.StatusInternalError, "")
+
+	err = tail(c.Request.Context(), conn, s)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
+		websocket.CloseStatus(err) == websocket.StatusGoingAway {
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("websocket was closed unexpected")
+		return
+	}
+}
+
+func tail(ctx context.Context, c *websocket.Conn, s *trace.Subscriber) error {
+	ctx = c.CloseRead(ctx)
+
+	for {
+		select {
+		case tx := <-s.C:
+			msg, err := json.Marshal(tx)
+			if err != nil {
+				return err
+			}
+			if err := writeTimeout(ctx, time.Second*5, c, msg); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}